@@ -5,6 +5,7 @@ import (
 	"go-gin-payment/conn"
 	"go-gin-payment/ext"
 	"go-gin-payment/ext/logger"
+	"go-gin-payment/models"
 )
 
 func SetupLog(e string) func() {
@@ -22,6 +23,19 @@ func SetupLog(e string) func() {
 func Prepare() func() {
 	// mysql
 	conn.NewConn()
+	if err := models.AutoMigrate(); err != nil {
+		logger.L.Panicln("db migrate error:", err)
+	}
+	if n, err := models.EncryptPlaintextPaymentAccounts(); err != nil {
+		logger.L.Panicln("encrypt payment accounts error:", err)
+	} else if n > 0 {
+		logger.L.Infof("encrypted %d plaintext payment accounts", n)
+	}
+	if n, err := models.EncryptPlaintextWebhookTargets(); err != nil {
+		logger.L.Panicln("encrypt webhook targets error:", err)
+	} else if n > 0 {
+		logger.L.Infof("encrypted %d plaintext webhook targets", n)
+	}
 
 	// connect redis, the connection is in async mode, need to wait to continue after connected
 	if err := conn.RedisConnect(); err != nil {
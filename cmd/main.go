@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"os/exec"
 	"runtime/debug"
@@ -11,6 +12,7 @@ import (
 	"go-gin-payment/config"
 	"go-gin-payment/ext/logger"
 	"go-gin-payment/jobs/api"
+	"go-gin-payment/jobs/webhook"
 
 	_ "go-gin-payment/docs"
 )
@@ -48,12 +50,37 @@ func createProcess() {
 		closer := cmd_lib.Prepare()
 		defer closer()
 
-		r := api.RunAPI()
-		err := r.Run(config.APIPort)
+		// 发送通知，会继续发送重启前没有完成的
+		stopWebhook := webhook.Start(4)
+		defer stopWebhook()
+
+		// 支付状态推送，转发其他实例发布的事件
+		stopEventHub := api.StartPaymentEventHub()
+		defer stopEventHub()
+
+		// 定时更新微信平台证书
+		stopCertRefresher := api.StartWechatCertRefresher()
+		defer stopCertRefresher()
+
+		// 自动关闭过期未支付的订单
+		stopSweeper := api.StartPaymentSweeper()
+		defer stopSweeper()
+
+		// 每天下载微信账单对账
+		stopReconciler := api.StartReconciler()
+		defer stopReconciler()
+
+		srv := &http.Server{
+			Addr:              config.APIPort,
+			Handler:           api.RunAPI(),
+			ReadHeaderTimeout: config.Current.Server.ReadHeaderTimeout.Duration,
+			IdleTimeout:       config.Current.Server.IdleTimeout.Duration,
+		}
+		logger.L.Println("start Web API at:", config.APIPort)
+		err := srv.ListenAndServe()
 		if err != nil {
 			panic(err)
 		}
-		logger.L.Println("start Web API at:", config.APIPort)
 	}
 }
 
@@ -0,0 +1,72 @@
+// 微信账单对账命令行，默认对前一天所有的微信支付账号重新对账
+//
+//	go run cmd/reconcile/main.go -e production -date 2021-06-01 -account 2
+//	go run cmd/reconcile/main.go -e production -date 2021-06-01 -show  只查看已经保存的结果
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go-gin-payment/cmd/cmd_lib"
+	"go-gin-payment/jobs/api"
+	"go-gin-payment/models"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run 返回退出码，0为对账一致，1为执行出错，2为有差异或者对账失败
+func run() int {
+	e := flag.String("e", "development", "production | development")
+	date := flag.String("date", "", "bill date, 2006-01-02, default is yesterday")
+	account := flag.Int64("account", 0, "payment account id, default is all wechat payment accounts")
+	show := flag.Bool("show", false, "only show saved reconciliation results")
+	flag.Parse()
+
+	cleaner := cmd_lib.Setup(*e)
+	defer cleaner()
+
+	if len(*date) == 0 {
+		*date = time.Now().In(models.ChinaTz).AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	var rs []*models.Reconciliation
+	if *show {
+		for _, r := range models.FindReconciliations(*date, *account, 1000) {
+			r := r
+			rs = append(rs, &r)
+		}
+	} else {
+		var err error
+		rs, err = api.ReconcileWechatBills(*date, *account)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reconcile error:", err)
+			return 1
+		}
+	}
+
+	failed := false
+	for _, r := range rs {
+		fmt.Printf("payment account: %d, bill_date: %s, status: %s, trades: %d/%d (wechat/ours), refunds: %d, mismatches: %d\n",
+			r.PaymentAccountID, r.BillDate, r.Status, r.TradeCount, r.OurTradeCount, r.RefundCount, r.MismatchCount)
+		if len(r.Error) > 0 {
+			fmt.Println("  error:", r.Error)
+		}
+		for _, item := range models.FindReconciliationItems(r.ID) {
+			d, _ := json.Marshal(item)
+			fmt.Println(" ", string(d))
+		}
+		if r.Status != models.RECONCILIATION_STATUS_DONE || r.MismatchCount > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+// 本地微信支付模拟器，开发时不需要真实的商户号
+//
+//	go run cmd/wechatsim/main.go -addr 127.0.0.1:5012 -mchid 1900000100 -key <APIv3密钥>
+//	WECHAT_PAY_BASE_URL=http://127.0.0.1:5012 go run cmd/main.go
+//
+// 支付账号的mer_id和api_v3_secret需要和这里的一致；下单后调用
+// curl -X POST http://127.0.0.1:5012/sim/pay/<trans_no> 模拟用户支付，通知会发送到SelfAPIURL
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"go-gin-payment/ext/wechatsim"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5012", "listen address")
+	mchIDs := flag.String("mchid", "", "merchant ids, separated by comma")
+	key := flag.String("key", "", "api v3 key of the merchants, 32 bytes")
+	flag.Parse()
+
+	var merchants []wechatsim.Merchant
+	for _, id := range strings.Split(*mchIDs, ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 {
+			merchants = append(merchants, wechatsim.Merchant{MchID: id, APIV3Key: *key})
+		}
+	}
+	if len(merchants) == 0 {
+		fmt.Fprintln(os.Stderr, "-mchid is required")
+		os.Exit(1)
+	}
+	s, err := wechatsim.New(*addr, merchants...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "start simulator error:", err)
+		os.Exit(1)
+	}
+	defer s.Close()
+	fmt.Println("wechat pay simulator is running, platform cert serial:", s.Serial)
+	fmt.Println("WECHAT_PAY_BASE_URL=" + s.URL)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+}
@@ -1,27 +1,92 @@
 package config
 
-const (
-	APIPort = ":5011"
+import (
+	"fmt"
+	"os"
+	"time"
 )
 
+//
+// 配置按 环境默认值 -> 配置文件 -> 环境变量 的顺序覆盖，启动时校验，见load.go
+//
+// 下面的变量由Parse从Current复制，其他代码直接使用
+//
+
+// Current 当前生效的配置
+var Current *Config
+
 var Env string
+
+// APIPort 监听的地址，比如":5011"
+var APIPort string
+
+// MaxBodyBytes 签名校验、限流和微信通知验签时读取请求body的上限，超过时拒绝请求
+var MaxBodyBytes int64
 var WebURL string
 var SelfAPIURL string
 
-const WebAPISecret = "xxx"
+// WebAPISecret 调用web端接口时带的X_API_SECRET
+var WebAPISecret string
+
+// APISecret 共享的X_GGP_KEY，为空时只能使用调用方各自的key(见jobs/api/api_client.go)
+var APISecret string
+
+// WebWebhookSecret 发送给web端的通知的签名secret，没有设置时使用WebAPISecret
+var WebWebhookSecret string
+
+// WechatPayBaseURL 微信支付API的地址，开发和测试时可以用环境变量WECHAT_PAY_BASE_URL指向模拟器(cmd/wechatsim)
+var WechatPayBaseURL string
+
+// WechatPayTimeout 调用微信支付API的超时时间
+var WechatPayTimeout time.Duration
+
+// WebTimeout 发送通知和调用web端接口的超时时间
+var WebTimeout time.Duration
 
+// PaymentEventSecret 浏览器订阅支付状态的token的签名secret，没有设置时使用WebAPISecret
+var PaymentEventSecret string
+
+// AdminAPISecret 管理接口(/admin)的secret，没有设置时只有admin权限的调用方可以使用管理接口
+var AdminAPISecret string
+
+// MetricsSecret 抓取/metrics时的Bearer token，为空时不验证，这时需要在nginx等处限制访问
+var MetricsSecret string
+
+// PaymentMasterKey 加密支付账号私钥等信息的主密钥，环境变量PAYMENT_MASTER_KEY为base64格式的32字节
+// 没有设置时不能通过接口创建和修改支付账号
+var PaymentMasterKey []byte
+
+func init() {
+	// 测试中没有调用Parse时使用开发环境的默认值
+	apply(Default("development"))
+}
+
+// Parse 加载e环境的配置，配置有错误时panic，错误信息包含所有不合法的字段
 func Parse(e string) {
-	Env = e
-
-	if IsPrd() {
-		WebURL = "https://eggman.tv"
-		SelfAPIURL = "https://xx.eggman.com"
-	} else {
-		WebURL = "http://localhost:5010"
-		// 这个地址服务器端配置了转发到ssh tunnel，再转发到本地，用于开发测试
-		// nginx -> ssh tunnel -> local dev
-		SelfAPIURL = "https://xx.eggman.com"
+	c, err := Load(e, configFile(e), os.Getenv)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config for env %s: %s", e, err))
 	}
+	apply(c)
+}
+
+func apply(c *Config) {
+	Current = c
+	Env = c.Env
+	APIPort = c.Server.Port
+	MaxBodyBytes = int64(c.Server.MaxBodyBytes)
+	WebURL = c.URL.Web
+	SelfAPIURL = c.URL.SelfAPI
+	WechatPayBaseURL = c.URL.WechatPay
+	WechatPayTimeout = c.HTTP.WechatPayTimeout.Duration
+	WebTimeout = c.HTTP.WebTimeout.Duration
+	APISecret = c.Secret.API
+	WebAPISecret = c.Secret.WebAPI
+	WebWebhookSecret = c.Secret.WebWebhook
+	PaymentEventSecret = c.Secret.PaymentEvent
+	AdminAPISecret = c.Secret.Admin
+	MetricsSecret = c.Secret.Metrics
+	PaymentMasterKey = c.Secret.masterKey
 }
 
 func IsPrd() bool {
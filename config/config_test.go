@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envOf(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestLoadDefault(t *testing.T) {
+	c, err := Load("development", "", envOf(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, ":5011", c.Server.Port)
+	assert.Equal(t, "http://localhost:5010", c.URL.Web)
+	assert.Equal(t, "xxx", c.Secret.WebWebhook)
+	assert.Equal(t, 10*time.Second, c.HTTP.WebTimeout.Duration)
+	assert.Equal(t, 1<<20, c.Server.MaxBodyBytes)
+
+	// 生产环境没有数据库和secret的默认值
+	_, err = Load("production", "", envOf(nil))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "db.dsn")
+	assert.Contains(t, err.Error(), "secret.web_api")
+	assert.Contains(t, err.Error(), "secret.metrics")
+	assert.NotContains(t, err.Error(), "secret.api")
+	assert.Contains(t, err.Error(), "redis.uri")
+
+	_, err = Load("prod", "", envOf(nil))
+	assert.Contains(t, err.Error(), "env")
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "production.yml")
+	assert.Nil(t, os.WriteFile(yml, []byte(`
+server:
+  port: ":6011"
+db:
+  dsn: "ggp:pwd@tcp(mysql:3306)/ggp_production?parseTime=True"
+  max_open_conns: 100
+redis:
+  uri: redis://redis:6379/2
+http:
+  wechat_pay_timeout: 5s
+secret:
+  api: file_api
+  web_api: file_web
+  metrics: file_metrics
+`), 0644))
+
+	c, err := Load("production", yml, envOf(map[string]string{"API_SECRET": "env_api", "DB_MAX_IDLE_CONNS": "7"}))
+	assert.Nil(t, err)
+	assert.Equal(t, ":6011", c.Server.Port)
+	assert.Equal(t, 100, c.DB.MaxOpenConns)
+	assert.Equal(t, 7, c.DB.MaxIdleConns)
+	assert.Equal(t, 5*time.Second, c.HTTP.WechatPayTimeout.Duration)
+	assert.Equal(t, "env_api", c.Secret.API)
+	assert.Equal(t, "file_web", c.Secret.PaymentEvent)
+	assert.Equal(t, "https://eggman.tv", c.URL.Web)
+	opt, err := c.Redis.Options()
+	assert.Nil(t, err)
+	assert.Equal(t, "redis:6379", opt.Addr)
+	assert.Equal(t, 2, opt.DB)
+
+	tml := filepath.Join(dir, "staging.toml")
+	assert.Nil(t, os.WriteFile(tml, []byte(`
+[db]
+dsn = "ggp:pwd@tcp(mysql:3306)/ggp_staging"
+[redis]
+uri = "redis://redis:6379/3"
+[url]
+web = "https://staging.eggman.tv/"
+self_api = "https://staging-api.eggman.tv"
+[secret]
+api = "a"
+web_api = "b"
+metrics = "c"
+`), 0644))
+	c, err = Load("staging", tml, envOf(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "https://staging.eggman.tv", c.URL.Web)
+
+	// 字段写错
+	assert.Nil(t, os.WriteFile(yml, []byte("db:\n  dns: x\n"), 0644))
+	_, err = Load("development", yml, envOf(nil))
+	assert.NotNil(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	env := map[string]string{
+		"DB_DSN":         "ggp:pwd@tcp(mysql:3306)/ggp_production",
+		"REDIS_URI":      "redis://redis:6379/1",
+		"API_SECRET":     "xxx",
+		"WEB_API_SECRET": "web",
+		"METRICS_SECRET": "metrics",
+	}
+	_, err := Load("production", "", envOf(env))
+	assert.Contains(t, err.Error(), "secret.api: can not use the development secret")
+
+	env["API_SECRET"] = "api"
+	delete(env, "METRICS_SECRET")
+	_, err = Load("production", "", envOf(env))
+	assert.Contains(t, err.Error(), "secret.metrics: is required in production")
+
+	env["METRICS_SECRET"] = "metrics"
+	env["WEB_TIMEOUT"] = "10"
+	_, err = Load("production", "", envOf(env))
+	assert.Contains(t, err.Error(), "WEB_TIMEOUT")
+
+	delete(env, "WEB_TIMEOUT")
+	env["PAYMENT_MASTER_KEY"] = "abc"
+	env["REDIS_URI"] = "localhost:6379"
+	_, err = Load("production", "", envOf(env))
+	assert.Contains(t, err.Error(), "secret.payment_master_key")
+	assert.Contains(t, err.Error(), "redis.uri")
+
+	env["PAYMENT_MASTER_KEY"] = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	env["REDIS_URI"] = "redis://redis:6379/1"
+	c, err := Load("production", "", envOf(env))
+	assert.Nil(t, err)
+	assert.Len(t, c.Secret.masterKey, 32)
+}
+
+func TestRedisOptions(t *testing.T) {
+	r := RedisConfig{URI: "rediss://:p%40ss@redis:6380/4", PoolSize: 20, MaxRetries: 3}
+	opt, err := r.Options()
+	assert.Nil(t, err)
+	assert.Equal(t, "redis:6380", opt.Addr)
+	assert.Equal(t, "p@ss", opt.Password)
+	assert.Equal(t, 4, opt.DB)
+	assert.NotNil(t, opt.TLSConfig)
+	assert.Equal(t, 20, opt.PoolSize)
+	assert.Equal(t, 3, opt.MaxRetries)
+	assert.NotContains(t, r.RedactedURI(), "p%40ss")
+}
+
+func TestRateLimit(t *testing.T) {
+	c, err := Load("development", "", envOf(nil))
+	assert.Nil(t, err)
+	rl := c.RateLimit
+	assert.True(t, rl.Enabled)
+	name, rule := rl.Match("POST", "/wechat/payment_check")
+	assert.Equal(t, "payment_check", name)
+	assert.Equal(t, 10, rule.Burst)
+	name, _ = rl.Match("POST", "/alipay/page_pay")
+	assert.Equal(t, "payment_create", name)
+	name, _ = rl.Match("DELETE", "/admin/api_clients/:id/keys/:keyID")
+	assert.Equal(t, "admin", name)
+	name, rule = rl.Match("POST", "/payments/:transNo/close")
+	assert.Equal(t, "default", name)
+	assert.Equal(t, rl.Default, rule)
+
+	yml := filepath.Join(t.TempDir(), "development.yml")
+	assert.Nil(t, os.WriteFile(yml, []byte(`
+rate_limit:
+  groups:
+    - name: check
+      routes: ["/wechat/payment_check"]
+      limit: {requests: 10, per: 1s, burst: 5}
+`), 0644))
+	c, err = Load("development", yml, envOf(map[string]string{"RATE_LIMIT_ENABLED": "false"}))
+	assert.Nil(t, err)
+	assert.False(t, c.RateLimit.Enabled)
+	assert.Len(t, c.RateLimit.Groups, 1)
+	name, rule = c.RateLimit.Match("GET", "/wechat/payment_check")
+	assert.Equal(t, "check", name)
+	assert.Equal(t, 10.0, rule.PerSecond())
+
+	assert.Nil(t, os.WriteFile(yml, []byte(`
+rate_limit:
+  groups:
+    - name: default
+      routes: ["/ping"]
+      limit: {requests: 10, burst: 5}
+`), 0644))
+	_, err = Load("development", yml, envOf(nil))
+	assert.Contains(t, err.Error(), "rate_limit.groups[0].name")
+	assert.Contains(t, err.Error(), "rate_limit.groups[0].limit")
+}
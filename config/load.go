@@ -0,0 +1,415 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-gin-payment/ext/envelope"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+//
+// 配置文件为yaml或者toml(按扩展名)，路径为环境变量CONFIG_FILE，没有设置时依次查找
+// config/<env>.yml、config/<env>.yaml、config/<env>.toml，都不存在时只使用默认值和环境变量
+//
+// 文件中的字段见config/example.yml，环境变量见envFields，未知的字段会报错
+//
+
+// envDevelopmentSecret 开发环境默认的secret，生产环境不能使用
+const envDevelopmentSecret = "xxx"
+
+var envs = []string{"development", "test", "staging", "production"}
+
+type Config struct {
+	Env    string       `yaml:"-" toml:"-"`
+	Server ServerConfig `yaml:"server" toml:"server"`
+	DB     DBConfig     `yaml:"db" toml:"db"`
+	Redis  RedisConfig  `yaml:"redis" toml:"redis"`
+	URL    URLConfig    `yaml:"url" toml:"url"`
+	HTTP   HTTPConfig   `yaml:"http" toml:"http"`
+	Secret SecretConfig `yaml:"secret" toml:"secret"`
+	// RateLimit 见rate_limit.go
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+type ServerConfig struct {
+	Port              string   `yaml:"port" toml:"port"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	// IdleTimeout keep-alive连接的空闲时间，没有WriteTimeout是因为支付状态推送是长连接
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// MaxBodyBytes 签名校验、限流和微信通知验签时读取请求body的上限
+	MaxBodyBytes int `yaml:"max_body_bytes" toml:"max_body_bytes"`
+}
+
+type DBConfig struct {
+	DSN          string `yaml:"dsn" toml:"dsn"`
+	MaxIdleConns int    `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	MaxOpenConns int    `yaml:"max_open_conns" toml:"max_open_conns"`
+	// ConnMaxLifetime 为0时不限制
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	// ConnectRetries 启动时连接失败的重试次数，每次间隔2秒
+	ConnectRetries int `yaml:"connect_retries" toml:"connect_retries"`
+}
+
+type RedisConfig struct {
+	// URI 格式为redis://[:password@]host:port/db，rediss://为TLS连接，见Options
+	URI          string `yaml:"uri" toml:"uri"`
+	PoolSize     int    `yaml:"pool_size" toml:"pool_size"`
+	MinIdleConns int    `yaml:"min_idle_conns" toml:"min_idle_conns"`
+	MaxRetries   int    `yaml:"max_retries" toml:"max_retries"`
+}
+
+type URLConfig struct {
+	Web       string `yaml:"web" toml:"web"`
+	SelfAPI   string `yaml:"self_api" toml:"self_api"`
+	WechatPay string `yaml:"wechat_pay" toml:"wechat_pay"`
+}
+
+type HTTPConfig struct {
+	WechatPayTimeout Duration `yaml:"wechat_pay_timeout" toml:"wechat_pay_timeout"`
+	WebTimeout       Duration `yaml:"web_timeout" toml:"web_timeout"`
+}
+
+type SecretConfig struct {
+	// API 共享的X_GGP_KEY，兼容还没有换成调用方key(见jobs/api/api_client.go)的调用方
+	API          string `yaml:"api" toml:"api"`
+	WebAPI       string `yaml:"web_api" toml:"web_api"`
+	WebWebhook   string `yaml:"web_webhook" toml:"web_webhook"`
+	PaymentEvent string `yaml:"payment_event" toml:"payment_event"`
+	Admin        string `yaml:"admin" toml:"admin"`
+	// PaymentMasterKey base64格式的32字节
+	PaymentMasterKey string `yaml:"payment_master_key" toml:"payment_master_key"`
+	// Metrics 抓取/metrics时的Bearer token，development和test以外的环境必须设置，为空时不验证
+	Metrics string `yaml:"metrics" toml:"metrics"`
+
+	masterKey []byte
+}
+
+// Duration 配置文件和环境变量中为"10s"、"2m"这样的格式
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default 各个环境的默认值，生产环境的数据库和secret没有默认值
+func Default(e string) *Config {
+	c := &Config{
+		Env: e,
+		Server: ServerConfig{
+			Port:              ":5011",
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			MaxBodyBytes:      1 << 20,
+		},
+		DB: DBConfig{
+			MaxIdleConns:   5,
+			MaxOpenConns:   500,
+			ConnectRetries: 20,
+		},
+		Redis: RedisConfig{
+			PoolSize:     20,
+			MinIdleConns: 2,
+			MaxRetries:   10,
+		},
+		URL: URLConfig{
+			WechatPay: "https://api.mch.weixin.qq.com",
+		},
+		HTTP: HTTPConfig{
+			WechatPayTimeout: Duration{30 * time.Second},
+			WebTimeout:       Duration{10 * time.Second},
+		},
+		RateLimit: defaultRateLimit(),
+	}
+	switch e {
+	case "development", "test":
+		c.DB.DSN = "root:@tcp(localhost:3306)/ggp_development?charset=utf8mb4&parseTime=True&loc=UTC"
+		c.Redis.URI = "redis://localhost:6379/1"
+		c.URL.Web = "http://localhost:5010"
+		// 这个地址服务器端配置了转发到ssh tunnel，再转发到本地，用于开发测试
+		// nginx -> ssh tunnel -> local dev
+		c.URL.SelfAPI = "https://xx.eggman.com"
+		c.Secret.API = envDevelopmentSecret
+		c.Secret.WebAPI = envDevelopmentSecret
+	case "production":
+		c.URL.Web = "https://eggman.tv"
+		c.URL.SelfAPI = "https://xx.eggman.com"
+	}
+	return c
+}
+
+// envFields 环境变量覆盖的字段，值为空时不覆盖
+var envFields = []struct {
+	name  string
+	field func(c *Config) interface{}
+}{
+	{"API_PORT", func(c *Config) interface{} { return &c.Server.Port }},
+	{"SERVER_READ_HEADER_TIMEOUT", func(c *Config) interface{} { return &c.Server.ReadHeaderTimeout }},
+	{"SERVER_IDLE_TIMEOUT", func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"SERVER_MAX_BODY_BYTES", func(c *Config) interface{} { return &c.Server.MaxBodyBytes }},
+	{"DB_DSN", func(c *Config) interface{} { return &c.DB.DSN }},
+	{"DB_MAX_IDLE_CONNS", func(c *Config) interface{} { return &c.DB.MaxIdleConns }},
+	{"DB_MAX_OPEN_CONNS", func(c *Config) interface{} { return &c.DB.MaxOpenConns }},
+	{"DB_CONN_MAX_LIFETIME", func(c *Config) interface{} { return &c.DB.ConnMaxLifetime }},
+	{"DB_CONNECT_RETRIES", func(c *Config) interface{} { return &c.DB.ConnectRetries }},
+	{"REDIS_URI", func(c *Config) interface{} { return &c.Redis.URI }},
+	{"REDIS_POOL_SIZE", func(c *Config) interface{} { return &c.Redis.PoolSize }},
+	{"REDIS_MIN_IDLE_CONNS", func(c *Config) interface{} { return &c.Redis.MinIdleConns }},
+	{"REDIS_MAX_RETRIES", func(c *Config) interface{} { return &c.Redis.MaxRetries }},
+	{"WEB_URL", func(c *Config) interface{} { return &c.URL.Web }},
+	{"SELF_API_URL", func(c *Config) interface{} { return &c.URL.SelfAPI }},
+	{"WECHAT_PAY_BASE_URL", func(c *Config) interface{} { return &c.URL.WechatPay }},
+	{"WECHAT_PAY_TIMEOUT", func(c *Config) interface{} { return &c.HTTP.WechatPayTimeout }},
+	{"WEB_TIMEOUT", func(c *Config) interface{} { return &c.HTTP.WebTimeout }},
+	{"API_SECRET", func(c *Config) interface{} { return &c.Secret.API }},
+	{"WEB_API_SECRET", func(c *Config) interface{} { return &c.Secret.WebAPI }},
+	{"WEB_WEBHOOK_SECRET", func(c *Config) interface{} { return &c.Secret.WebWebhook }},
+	{"PAYMENT_EVENT_SECRET", func(c *Config) interface{} { return &c.Secret.PaymentEvent }},
+	{"ADMIN_API_SECRET", func(c *Config) interface{} { return &c.Secret.Admin }},
+	{"PAYMENT_MASTER_KEY", func(c *Config) interface{} { return &c.Secret.PaymentMasterKey }},
+	{"METRICS_SECRET", func(c *Config) interface{} { return &c.Secret.Metrics }},
+	{"RATE_LIMIT_ENABLED", func(c *Config) interface{} { return &c.RateLimit.Enabled }},
+}
+
+// Load path为空时不读取配置文件，getenv用于测试
+func Load(e, path string, getenv func(string) string) (*Config, error) {
+	c := Default(e)
+	if len(path) > 0 {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	c.normalize()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file error: %s", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yml", ".yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(d))
+		dec.KnownFields(true)
+		// 空文件返回io.EOF
+		if err := dec.Decode(c); err != nil && len(bytes.TrimSpace(d)) > 0 {
+			return fmt.Errorf("parse config file %s error: %s", path, err)
+		}
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(d))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("parse config file %s error: %s", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file type: %s, must be .yml, .yaml or .toml", ext)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(getenv func(string) string) error {
+	var errs []string
+	for _, f := range envFields {
+		v := strings.TrimSpace(getenv(f.name))
+		if len(v) == 0 {
+			continue
+		}
+		switch p := f.field(c).(type) {
+		case *string:
+			*p = v
+		case *int:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not an integer", f.name, v))
+				continue
+			}
+			*p = n
+		case *bool:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a bool", f.name, v))
+				continue
+			}
+			*p = b
+		case *Duration:
+			if err := p.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a duration like 10s", f.name, v))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// normalize 没有设置的secret使用WebAPISecret，和之前的行为一致
+func (c *Config) normalize() {
+	c.URL.Web = strings.TrimRight(c.URL.Web, "/")
+	c.URL.SelfAPI = strings.TrimRight(c.URL.SelfAPI, "/")
+	c.URL.WechatPay = strings.TrimRight(c.URL.WechatPay, "/")
+	if len(c.Secret.WebWebhook) == 0 {
+		c.Secret.WebWebhook = c.Secret.WebAPI
+	}
+	if len(c.Secret.PaymentEvent) == 0 {
+		c.Secret.PaymentEvent = c.Secret.WebAPI
+	}
+}
+
+// Validate 返回所有不合法的字段
+func (c *Config) Validate() error {
+	var errs []string
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	known := false
+	for _, e := range envs {
+		known = known || c.Env == e
+	}
+	if !known {
+		add("env: %q must be one of %s", c.Env, strings.Join(envs, ", "))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Server.Port); err != nil {
+		add("server.port: %q must be like :5011", c.Server.Port)
+	} else if _, err := strconv.Atoi(port); err != nil {
+		add("server.port: %q must be like :5011", c.Server.Port)
+	}
+	if c.Server.ReadHeaderTimeout.Duration < 0 || c.Server.IdleTimeout.Duration < 0 {
+		add("server: timeouts can not be negative")
+	}
+	if c.Server.MaxBodyBytes <= 0 {
+		add("server.max_body_bytes: must be greater than 0")
+	}
+
+	if len(c.DB.DSN) == 0 {
+		add("db.dsn: is required (env DB_DSN)")
+	} else if _, err := mysql.ParseDSN(c.DB.DSN); err != nil {
+		add("db.dsn: %s", err)
+	}
+	if c.DB.MaxOpenConns <= 0 {
+		add("db.max_open_conns: must be greater than 0")
+	}
+	if c.DB.MaxIdleConns < 0 || c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		add("db.max_idle_conns: must be between 0 and db.max_open_conns")
+	}
+	if c.DB.ConnMaxLifetime.Duration < 0 {
+		add("db.conn_max_lifetime: can not be negative")
+	}
+	if c.DB.ConnectRetries <= 0 {
+		add("db.connect_retries: must be greater than 0")
+	}
+
+	if _, err := c.Redis.Options(); err != nil {
+		add("redis.uri: %s (env REDIS_URI)", err)
+	}
+	if c.Redis.PoolSize <= 0 || c.Redis.MinIdleConns < 0 || c.Redis.MaxRetries < 0 {
+		add("redis: pool_size must be greater than 0, min_idle_conns and max_retries can not be negative")
+	}
+
+	for name, u := range map[string]string{"url.web": c.URL.Web, "url.self_api": c.URL.SelfAPI, "url.wechat_pay": c.URL.WechatPay} {
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || len(p.Host) == 0 {
+			add("%s: %q must be an absolute http(s) url", name, u)
+		}
+	}
+
+	if c.HTTP.WechatPayTimeout.Duration <= 0 || c.HTTP.WebTimeout.Duration <= 0 {
+		add("http: timeouts must be greater than 0")
+	}
+
+	if len(c.Secret.WebAPI) == 0 {
+		add("secret.web_api: is required")
+	}
+	if len(c.Secret.Metrics) == 0 && c.Env != "development" && c.Env != "test" {
+		add("secret.metrics: is required in %s (env METRICS_SECRET)", c.Env)
+	}
+	// secret.api可以不设置，这时只能使用数据库中调用方的key
+	for name, s := range map[string]string{"secret.api": c.Secret.API, "secret.web_api": c.Secret.WebAPI, "secret.metrics": c.Secret.Metrics} {
+		if s == envDevelopmentSecret && c.Env != "development" && c.Env != "test" {
+			add("%s: can not use the development secret in %s", name, c.Env)
+		}
+	}
+	c.RateLimit.validate(add)
+
+	c.Secret.masterKey = nil
+	if len(c.Secret.PaymentMasterKey) > 0 {
+		key, err := envelope.ParseKey(c.Secret.PaymentMasterKey)
+		if err != nil {
+			add("secret.payment_master_key: must be base64 of 32 bytes, %s", err)
+		}
+		c.Secret.masterKey = key
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Options 用redis.ParseURL解析redis://[:password@]host:port/db，rediss://为TLS连接，并设置连接池的参数
+func (r RedisConfig) Options() (*redis.Options, error) {
+	opt, err := redis.ParseURL(r.URI)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be like redis://[:password@]host:port/db or rediss://..., %s", r.RedactedURI(), err)
+	}
+	opt.PoolSize = r.PoolSize
+	opt.MinIdleConns = r.MinIdleConns
+	opt.MaxRetries = r.MaxRetries
+	return opt, nil
+}
+
+// RedactedURI 隐藏密码，用于日志和错误信息
+func (r RedisConfig) RedactedURI() string {
+	u, err := url.Parse(r.URI)
+	if err != nil {
+		return "<invalid uri>"
+	}
+	return u.Redacted()
+}
+
+// configFile 见文件开头的说明
+func configFile(e string) string {
+	if p := os.Getenv("CONFIG_FILE"); len(p) > 0 {
+		return p
+	}
+	for _, ext := range []string{".yml", ".yaml", ".toml"} {
+		p := filepath.Join("config", e+ext)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
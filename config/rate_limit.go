@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RateLimitConfig 按调用方、店铺和路由的令牌桶限流，多个实例通过redis共享
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Default 没有匹配到分组的路由使用的限制
+	Default RateLimitRule `yaml:"default" toml:"default"`
+	// Client 每个调用方所有店铺和路由共用的限制，避免换store_id绕过限流
+	Client RateLimitRule `yaml:"client" toml:"client"`
+	// Groups 按顺序匹配，第一个匹配的分组生效
+	Groups []RateLimitGroup `yaml:"groups" toml:"groups"`
+}
+
+// RateLimitRule 平均每Per可以请求Requests次，Burst为桶的容量，即允许的突发请求数
+type RateLimitRule struct {
+	Requests int      `yaml:"requests" toml:"requests"`
+	Per      Duration `yaml:"per" toml:"per"`
+	Burst    int      `yaml:"burst" toml:"burst"`
+}
+
+// RateLimitGroup Routes为"POST /wechat/payment_check"、"/payments/:transNo"(所有method)
+// 或者"/admin/*"(前缀)，路由使用gin的路由定义
+type RateLimitGroup struct {
+	Name   string        `yaml:"name" toml:"name"`
+	Routes []string      `yaml:"routes" toml:"routes"`
+	Limit  RateLimitRule `yaml:"limit" toml:"limit"`
+}
+
+// PerSecond 每秒补充的令牌数
+func (r RateLimitRule) PerSecond() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+func defaultRateLimit() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled: true,
+		Default: RateLimitRule{Requests: 1200, Per: Duration{time.Minute}, Burst: 200},
+		Client:  RateLimitRule{Requests: 3000, Per: Duration{time.Minute}, Burst: 500},
+		Groups: []RateLimitGroup{
+			{
+				// 每次查询都会调用第三方的接口
+				Name: "payment_check",
+				Routes: []string{
+					"POST /wechat/payment_check",
+					"POST /wechat/combine_payment_check",
+					"POST /alipay/payment_check",
+					"GET /payments/:transNo",
+				},
+				Limit: RateLimitRule{Requests: 60, Per: Duration{time.Minute}, Burst: 10},
+			},
+			{
+				Name: "payment_create",
+				Routes: []string{
+					"POST /payments",
+					"POST /wechat/gen_mp_prepay",
+					"POST /wechat/h5_pay",
+					"POST /wechat/native_pay",
+					"POST /wechat/combine_pay",
+					"POST /alipay/*",
+				},
+				Limit: RateLimitRule{Requests: 300, Per: Duration{time.Minute}, Burst: 50},
+			},
+			{
+				Name:   "admin",
+				Routes: []string{"/admin/*"},
+				Limit:  RateLimitRule{Requests: 120, Per: Duration{time.Minute}, Burst: 30},
+			},
+		},
+	}
+}
+
+// Match 返回路由所属的分组，没有匹配时为default
+func (c *RateLimitConfig) Match(method, route string) (string, RateLimitRule) {
+	for _, g := range c.Groups {
+		for _, r := range g.Routes {
+			if matchRoute(r, method, route) {
+				return g.Name, g.Limit
+			}
+		}
+	}
+	return "default", c.Default
+}
+
+func matchRoute(pattern, method, route string) bool {
+	if i := strings.IndexByte(pattern, ' '); i > 0 {
+		if !strings.EqualFold(pattern[:i], method) {
+			return false
+		}
+		pattern = strings.TrimSpace(pattern[i+1:])
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(route, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == route
+}
+
+func (c *RateLimitConfig) validate(add func(format string, args ...interface{})) {
+	if !c.Enabled {
+		return
+	}
+	validRule := func(name string, r RateLimitRule) {
+		if r.Requests <= 0 || r.Per.Duration <= 0 || r.Burst <= 0 {
+			add("%s: requests, per and burst must be greater than 0", name)
+		}
+	}
+	validRule("rate_limit.default", c.Default)
+	validRule("rate_limit.client", c.Client)
+	names := map[string]bool{"default": true, "client": true}
+	for i, g := range c.Groups {
+		name := fmt.Sprintf("rate_limit.groups[%d]", i)
+		if len(g.Name) == 0 || names[g.Name] || strings.Contains(g.Name, ":") {
+			add("%s.name: %q must be unique, not default or client and without ':'", name, g.Name)
+		}
+		names[g.Name] = true
+		if len(g.Routes) == 0 {
+			add("%s.routes: is required", name)
+		}
+		validRule(name+".limit", g.Limit)
+	}
+}
@@ -0,0 +1,76 @@
+package conn
+
+import (
+	"database/sql"
+
+	"go-gin-payment/ext/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 连接池的统计，抓取时读取，没有连接时不输出，不会因为抓取去连接数据库
+
+// Connected 是否已经连接了数据库，不会尝试连接
+func Connected() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return connection != nil
+}
+
+func dbStats() (sql.DBStats, bool) {
+	mutex.Lock()
+	c := connection
+	mutex.Unlock()
+	if c == nil {
+		return sql.DBStats{}, false
+	}
+	d, err := c.DB()
+	if err != nil {
+		return sql.DBStats{}, false
+	}
+	return d.Stats(), true
+}
+
+func dbGauge(name, help string, counter bool, f func(s sql.DBStats) float64) {
+	fn := func() (float64, bool) {
+		s, ok := dbStats()
+		return f(s), ok
+	}
+	if counter {
+		metrics.NewCounterFunc(name, help, fn)
+	} else {
+		metrics.NewGaugeFunc(name, help, fn)
+	}
+}
+
+func redisGauge(name, help string, counter bool, f func(s *redis.PoolStats) float64) {
+	fn := func() (float64, bool) {
+		if Redis == nil {
+			return 0, false
+		}
+		return f(Redis.PoolStats()), true
+	}
+	if counter {
+		metrics.NewCounterFunc(name, help, fn)
+	} else {
+		metrics.NewGaugeFunc(name, help, fn)
+	}
+}
+
+func init() {
+	dbGauge("ggp_db_max_open_connections", "Maximum number of open connections to mysql.", false, func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	dbGauge("ggp_db_open_connections", "Established connections to mysql, in use and idle.", false, func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	dbGauge("ggp_db_in_use_connections", "Mysql connections currently in use.", false, func(s sql.DBStats) float64 { return float64(s.InUse) })
+	dbGauge("ggp_db_idle_connections", "Idle mysql connections.", false, func(s sql.DBStats) float64 { return float64(s.Idle) })
+	dbGauge("ggp_db_wait_count_total", "Total number of connections waited for.", true, func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	dbGauge("ggp_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", true, func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	dbGauge("ggp_db_max_idle_closed_total", "Connections closed due to max_idle_conns.", true, func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	dbGauge("ggp_db_max_lifetime_closed_total", "Connections closed due to conn_max_lifetime.", true, func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+
+	redisGauge("ggp_redis_pool_hits_total", "Times a free connection was found in the redis pool.", true, func(s *redis.PoolStats) float64 { return float64(s.Hits) })
+	redisGauge("ggp_redis_pool_misses_total", "Times a free connection was not found in the redis pool.", true, func(s *redis.PoolStats) float64 { return float64(s.Misses) })
+	redisGauge("ggp_redis_pool_timeouts_total", "Times a wait timeout occurred in the redis pool.", true, func(s *redis.PoolStats) float64 { return float64(s.Timeouts) })
+	redisGauge("ggp_redis_pool_total_connections", "Connections in the redis pool.", false, func(s *redis.PoolStats) float64 { return float64(s.TotalConns) })
+	redisGauge("ggp_redis_pool_idle_connections", "Idle connections in the redis pool.", false, func(s *redis.PoolStats) float64 { return float64(s.IdleConns) })
+	redisGauge("ggp_redis_pool_stale_connections_total", "Stale connections removed from the redis pool.", true, func(s *redis.PoolStats) float64 { return float64(s.StaleConns) })
+}
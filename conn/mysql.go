@@ -3,12 +3,14 @@ package conn
 import (
 	"fmt"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"go-gin-payment/config"
 	"go-gin-payment/ext/logger"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
@@ -18,10 +20,6 @@ var mutex sync.Mutex
 // DB mysql connection
 var connection *gorm.DB
 
-const (
-	connectRetryMaxTimes = 20
-)
-
 var connectRetryTimes int
 
 // for test env
@@ -42,7 +40,7 @@ func DB() *gorm.DB {
 // NewConn create a connection if there's none
 func NewConn() {
 	if connection == nil {
-		if connectRetryTimes < connectRetryMaxTimes {
+		if connectRetryTimes < config.Current.DB.ConnectRetries {
 			connection = dbConnect()
 			if connection == nil {
 				logger.L.Infof("connect db failed for the %d times, retry next time", (connectRetryTimes + 1))
@@ -55,7 +53,7 @@ func NewConn() {
 		} else {
 			// reset retry times
 			connectRetryTimes = 0
-			logger.L.Errorf("connect db failed, reach max retry times: %d", connectRetryMaxTimes)
+			logger.L.Errorf("connect db failed, reach max retry times: %d", config.Current.DB.ConnectRetries)
 		}
 	}
 }
@@ -73,22 +71,18 @@ func dbConnect() *gorm.DB {
 		return connection
 	}
 
-	var dbURI string
-	if config.Env == "development" || config.Env == "test" {
-		dbURI = "root:@tcp(localhost:3306)/ggp_development?charset=utf8mb4&parseTime=True&loc=UTC"
-		if config.Env == "test" {
-			// 修改测试环境下事务等级，未提交也可读
-			dbURI = fmt.Sprintf("%s&tx_isolation=%s", dbURI, url.QueryEscape("'READ-UNCOMMITTED'"))
+	cfg := config.Current.DB
+	dbURI := cfg.DSN
+	if config.Env == "test" {
+		// 修改测试环境下事务等级，未提交也可读
+		sep := "?"
+		if strings.Contains(dbURI, "?") {
+			sep = "&"
 		}
-	} else {
-		// 注意这里是连接的host中的mysql，需要用户不是来自localhost
-		// hostIP := os.Getenv("HOST_IP")
-		hostIP := "mysql" // docker host name
-		logger.L.Println("host ip:", hostIP)
-		dbURI = "ggp:t2Q1021285@tcp(" + hostIP + ":3306)/ggp_production?charset=utf8mb4&parseTime=True&loc=UTC"
+		dbURI = fmt.Sprintf("%s%stx_isolation=%s", dbURI, sep, url.QueryEscape("'READ-UNCOMMITTED'"))
 	}
 
-	logger.L.Println("connecting to mysql:", dbURI)
+	logger.L.Println("connecting to mysql:", maskDSN(dbURI))
 	db, err := gorm.Open(mysql.Open(dbURI), &gorm.Config{})
 	if err != nil {
 		// CAUTION: need to close db even not connected, otherwise memory will leak
@@ -112,13 +106,26 @@ func dbConnect() *gorm.DB {
 		return nil
 	}
 
-	logger.L.Println("connected to db:", dbURI)
-	d.SetMaxIdleConns(5)
-	d.SetMaxOpenConns(500)
+	logger.L.Println("connected to db:", maskDSN(dbURI))
+	d.SetMaxIdleConns(cfg.MaxIdleConns)
+	d.SetMaxOpenConns(cfg.MaxOpenConns)
+	d.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
 
 	return db
 }
 
+// maskDSN 日志中不打印密码
+func maskDSN(dsn string) string {
+	c, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return "invalid dsn"
+	}
+	if len(c.Passwd) > 0 {
+		c.Passwd = "***"
+	}
+	return c.FormatDSN()
+}
+
 // SetTestDBAsTx 重置测试环境下数据库连接为事务的方式
 func SetTestDBAsTx() {
 	if connection == nil {
@@ -44,10 +44,9 @@ const docTemplate = `{
                     },
                     {
                         "type": "string",
-                        "description": "支付账号ID，我们内部的模型ID，用于标识支付账号。",
+                        "description": "支付账号ID，我们内部的模型ID，用于标识支付账号。不传时使用店铺默认的微信支付账号",
                         "name": "payment_account_id",
-                        "in": "formData",
-                        "required": true
+                        "in": "formData"
                     },
                     {
                         "type": "string",
@@ -76,6 +75,18 @@ const docTemplate = `{
                         "name": "total_price",
                         "in": "formData",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "订单失效时间，rfc3339格式，比如2018-06-08T10:34:56+08:00",
+                        "name": "time_expire",
+                        "in": "formData"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "服务商账号分账，支付成功后资金冻结，需要分账或者解冻",
+                        "name": "profit_sharing",
+                        "in": "formData"
                     }
                 ],
                 "responses": {
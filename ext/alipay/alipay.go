@@ -0,0 +1,343 @@
+// Package alipay 支付宝开放平台的最小客户端，只支持公钥证书模式和RSA2签名
+//
+// 文档: https://opendocs.alipay.com/common/02kf5q
+// 公钥证书模式: https://opendocs.alipay.com/common/02kdnc
+package alipay
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	GatewayURL = "https://openapi.alipay.com/gateway.do"
+
+	timeFormat = "2006-01-02 15:04:05"
+)
+
+var chinaTz = time.FixedZone("CST", 8*3600)
+
+// Client 使用应用私钥签名，使用支付宝公钥证书验签
+type Client struct {
+	AppID      string
+	Gateway    string
+	HTTPClient *http.Client
+
+	privateKey       *rsa.PrivateKey
+	alipayPublicKey  *rsa.PublicKey
+	appCertSN        string
+	alipayRootCertSN string
+	alipayCertSN     string
+}
+
+// NewClient privateKey为应用私钥，支持PEM或者不带头尾的base64格式
+// appCert为应用公钥证书，rootCert为支付宝根证书，alipayCert为支付宝公钥证书，均为证书文件的内容
+func NewClient(appID, privateKey, appCert, rootCert, alipayCert string) (*Client, error) {
+	c := &Client{
+		AppID:      appID,
+		Gateway:    GatewayURL,
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+	}
+
+	var err error
+	if c.privateKey, err = parsePrivateKey(privateKey); err != nil {
+		return nil, fmt.Errorf("load app private key error: %w", err)
+	}
+
+	cert, err := parseCert(appCert)
+	if err != nil {
+		return nil, fmt.Errorf("load app cert error: %w", err)
+	}
+	c.appCertSN = certSN(cert)
+
+	if c.alipayRootCertSN, err = rootCertSN(rootCert); err != nil {
+		return nil, fmt.Errorf("load alipay root cert error: %w", err)
+	}
+
+	cert, err = parseCert(alipayCert)
+	if err != nil {
+		return nil, fmt.Errorf("load alipay cert error: %w", err)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("alipay cert public key is not rsa")
+	}
+	c.alipayPublicKey = pub
+	c.alipayCertSN = certSN(cert)
+	return c, nil
+}
+
+// CheckCerts 保存账号前检查证书，应用公钥证书要和应用私钥匹配，证书都不能过期
+func CheckCerts(privateKey, appCert, rootCert, alipayCert string, now time.Time) error {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("load app private key error: %w", err)
+	}
+	app, err := parseCert(appCert)
+	if err != nil {
+		return fmt.Errorf("load app cert error: %w", err)
+	}
+	if pub, ok := app.PublicKey.(*rsa.PublicKey); !ok || !key.PublicKey.Equal(pub) {
+		return errors.New("app cert does not match app private key")
+	}
+	if _, err := rootCertSN(rootCert); err != nil {
+		return fmt.Errorf("load alipay root cert error: %w", err)
+	}
+	alipay, err := parseCert(alipayCert)
+	if err != nil {
+		return fmt.Errorf("load alipay cert error: %w", err)
+	}
+	if _, ok := alipay.PublicKey.(*rsa.PublicKey); !ok {
+		return errors.New("alipay cert public key is not rsa")
+	}
+	for name, c := range map[string]*x509.Certificate{"app cert": app, "alipay cert": alipay} {
+		if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+			return fmt.Errorf("%s is not valid at %s, valid from %s to %s", name,
+				now.Format(time.RFC3339), c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// BuildParams 生成带签名的公共请求参数
+func (c *Client) BuildParams(method string, biz map[string]interface{}, extra map[string]string) (url.Values, error) {
+	b, err := json.Marshal(biz)
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("app_id", c.AppID)
+	v.Set("method", method)
+	v.Set("format", "JSON")
+	v.Set("charset", "utf-8")
+	v.Set("sign_type", "RSA2")
+	v.Set("timestamp", time.Now().In(chinaTz).Format(timeFormat))
+	v.Set("version", "1.0")
+	v.Set("app_cert_sn", c.appCertSN)
+	v.Set("alipay_root_cert_sn", c.alipayRootCertSN)
+	v.Set("biz_content", string(b))
+	for k, val := range extra {
+		if len(val) > 0 {
+			v.Set(k, val)
+		}
+	}
+
+	sign, err := c.sign(signContent(v))
+	if err != nil {
+		return nil, err
+	}
+	v.Set("sign", sign)
+	return v, nil
+}
+
+// PageURL 电脑网站支付和手机网站支付需要跳转到支付宝的页面，返回跳转地址
+func (c *Client) PageURL(method string, biz map[string]interface{}, extra map[string]string) (string, error) {
+	v, err := c.BuildParams(method, biz, extra)
+	if err != nil {
+		return "", err
+	}
+	return c.Gateway + "?" + v.Encode(), nil
+}
+
+// OrderString APP支付返回给客户端SDK的订单字符串
+func (c *Client) OrderString(method string, biz map[string]interface{}, extra map[string]string) (string, error) {
+	v, err := c.BuildParams(method, biz, extra)
+	if err != nil {
+		return "", err
+	}
+	return v.Encode(), nil
+}
+
+// Do 调用服务端接口，返回验签后的xxx_response节点
+// 业务失败时返回*Error和验签后的节点，没有验签通过(包括error_response)时返回空的节点，调用方不能使用其中的内容
+func (c *Client) Do(method string, biz map[string]interface{}, extra map[string]string) (gjson.Result, error) {
+	v, err := c.BuildParams(method, biz, extra)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	rsp, err := c.HTTPClient.PostForm(c.Gateway, v)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	doc := gjson.ParseBytes(body)
+	node := doc.Get(strings.ReplaceAll(method, ".", "_") + "_response")
+	if !node.Exists() {
+		return gjson.Result{}, fmt.Errorf("alipay %s error: %s", method, body)
+	}
+	// 业务失败时支付宝也会签名，先验签再判断code
+	if err := c.verify(node.Raw, doc.Get("sign").String()); err != nil {
+		return gjson.Result{}, fmt.Errorf("alipay %s verify rsp sign error: %w", method, err)
+	}
+	if node.Get("code").String() != "10000" {
+		return node, &Error{
+			Method:  method,
+			Code:    node.Get("code").String(),
+			Msg:     node.Get("msg").String(),
+			SubCode: node.Get("sub_code").String(),
+			SubMsg:  node.Get("sub_msg").String(),
+		}
+	}
+	return node, nil
+}
+
+// Error 验签通过但code不是10000的业务失败，20000为服务不可用，4xxxx为请求被拒绝
+// https://opendocs.alipay.com/common/02km9f
+type Error struct {
+	Method  string
+	Code    string
+	Msg     string
+	SubCode string
+	SubMsg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("alipay %s failed, code: %s, msg: %s, sub_code: %s, sub_msg: %s", e.Method, e.Code, e.Msg, e.SubCode, e.SubMsg)
+}
+
+// Rejected 支付宝明确拒绝了请求，同样的参数重试也不会成功，xxx.SYSTEM_ERROR需要重试
+func (e *Error) Rejected() bool {
+	return strings.HasPrefix(e.Code, "4") && !strings.HasSuffix(e.SubCode, "SYSTEM_ERROR")
+}
+
+// VerifyNotify 校验异步通知的签名，sign和sign_type不参与签名
+// https://opendocs.alipay.com/common/02mse7
+func (c *Client) VerifyNotify(v url.Values) error {
+	sign := v.Get("sign")
+	if len(sign) == 0 {
+		return errors.New("alipay notify sign is empty")
+	}
+	if t := v.Get("sign_type"); t != "" && t != "RSA2" {
+		return fmt.Errorf("alipay notify sign_type not supported: %s", t)
+	}
+	p := url.Values{}
+	for k := range v {
+		if k == "sign" || k == "sign_type" {
+			continue
+		}
+		p.Set(k, v.Get(k))
+	}
+	return c.verify(signContent(p), sign)
+}
+
+func (c *Client) sign(content string) (string, error) {
+	h := sha256.Sum256([]byte(content))
+	s, err := rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(s), nil
+}
+
+func (c *Client) verify(content, sign string) error {
+	s, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(content))
+	return rsa.VerifyPKCS1v15(c.alipayPublicKey, crypto.SHA256, h[:], s)
+}
+
+// signContent 参数按key排序后用&拼接，空值不参与签名
+func signContent(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		if len(v.Get(k)) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+v.Get(k))
+	}
+	return strings.Join(parts, "&")
+}
+
+// certSN 证书序列号为 md5(issuer + 十进制serial number)
+func certSN(cert *x509.Certificate) string {
+	v := md5.Sum([]byte(cert.Issuer.String() + cert.SerialNumber.String()))
+	return hex.EncodeToString(v[:])
+}
+
+// rootCertSN 根证书文件中包含多个证书，只取RSA签名的证书用_拼接
+func rootCertSN(s string) (string, error) {
+	var sns []string
+	rest := []byte(s)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if cert.SignatureAlgorithm == x509.SHA256WithRSA || cert.SignatureAlgorithm == x509.SHA1WithRSA {
+			sns = append(sns, certSN(cert))
+		}
+	}
+	if len(sns) == 0 {
+		return "", errors.New("no rsa cert found in root cert")
+	}
+	return strings.Join(sns, "_"), nil
+}
+
+func parseCert(s string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid cert pem")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	var der []byte
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		der = block.Bytes
+	} else {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("invalid private key")
+		}
+		der = b
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not rsa")
+	}
+	return key, nil
+}
@@ -0,0 +1,142 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genTestCert(t *testing.T, cn string) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(time.Now().UnixNano()),
+		Subject:            pkix.Name{CommonName: cn, Organization: []string{"Ant Financial"}, Country: []string{"CN"}},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testSign(t *testing.T, key *rsa.PrivateKey, content string) string {
+	h := sha256.Sum256([]byte(content))
+	s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(s)
+}
+
+func newTestClient(t *testing.T) (*Client, *rsa.PrivateKey) {
+	appKey, appCert := genTestCert(t, "app")
+	_, rootCert := genTestCert(t, "root")
+	alipayKey, alipayCert := genTestCert(t, "alipay")
+
+	// 应用私钥使用不带头尾的base64格式，和支付宝工具生成的一致
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(appKey)
+	assert.Nil(t, err)
+	c, err := NewClient("2021000000000000", base64.StdEncoding.EncodeToString(pkcs8), appCert, rootCert, alipayCert)
+	assert.Nil(t, err)
+	return c, alipayKey
+}
+
+func TestVerifyNotify(t *testing.T) {
+	c, alipayKey := newTestClient(t)
+
+	v := url.Values{}
+	v.Set("app_id", "2021000000000000")
+	v.Set("out_trade_no", "abcssscascscds")
+	v.Set("total_amount", "0.10")
+	v.Set("trade_status", "TRADE_SUCCESS")
+	v.Set("sign", testSign(t, alipayKey, signContent(v)))
+	v.Set("sign_type", "RSA2")
+	assert.Nil(t, c.VerifyNotify(v))
+
+	v.Set("total_amount", "100.00")
+	assert.NotNil(t, c.VerifyNotify(v))
+}
+
+func TestCheckCerts(t *testing.T) {
+	appKey, appCert := genTestCert(t, "app")
+	otherKey, _ := genTestCert(t, "other")
+	_, rootCert := genTestCert(t, "root")
+	_, alipayCert := genTestCert(t, "alipay")
+	keyPEM := func(k *rsa.PrivateKey) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}))
+	}
+
+	assert.Nil(t, CheckCerts(keyPEM(appKey), appCert, rootCert, alipayCert, time.Now()))
+	assert.NotNil(t, CheckCerts(keyPEM(otherKey), appCert, rootCert, alipayCert, time.Now()))
+	assert.NotNil(t, CheckCerts(keyPEM(appKey), appCert, rootCert, alipayCert, time.Now().Add(2*time.Hour)))
+	assert.NotNil(t, CheckCerts(keyPEM(appKey), appCert, "", alipayCert, time.Now()))
+}
+
+func TestDo(t *testing.T) {
+	c, alipayKey := newTestClient(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "alipay.trade.query", r.PostForm.Get("method"))
+		assert.NotEmpty(t, r.PostForm.Get("sign"))
+
+		node := `{"code":"10000","msg":"Success","out_trade_no":"abcssscascscds","trade_no":"2013112011001004330000121536","trade_status":"TRADE_SUCCESS"}`
+		fmt.Fprintf(w, `{"alipay_trade_query_response":%s,"sign":"%s"}`, node, testSign(t, alipayKey, node))
+	}))
+	defer ts.Close()
+	c.Gateway = ts.URL
+
+	node, err := c.Do("alipay.trade.query", map[string]interface{}{"out_trade_no": "abcssscascscds"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "TRADE_SUCCESS", node.Get("trade_status").String())
+}
+
+func TestDoError(t *testing.T) {
+	c, alipayKey := newTestClient(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := `{"code":"40004","msg":"Business Failed","sub_code":"ACQ.TRADE_HAS_CLOSE","sub_msg":"交易已经关闭"}`
+		fmt.Fprintf(w, `{"alipay_trade_refund_response":%s,"sign":"%s"}`, node, testSign(t, alipayKey, node))
+	}))
+	defer ts.Close()
+	c.Gateway = ts.URL
+
+	_, err := c.Do("alipay.trade.refund", map[string]interface{}{"out_trade_no": "abcssscascscds"}, nil)
+	var aerr *Error
+	assert.True(t, errors.As(err, &aerr))
+	assert.Equal(t, "ACQ.TRADE_HAS_CLOSE", aerr.SubCode)
+	assert.True(t, aerr.Rejected())
+	assert.False(t, (&Error{Code: "20000"}).Rejected())
+
+	// 签名不对和error_response不返回节点
+	for _, body := range []string{
+		`{"alipay_trade_close_response":{"code":"40004","sub_code":"ACQ.TRADE_NOT_EXIST"},"sign":"` + testSign(t, alipayKey, "{}") + `"}`,
+		`{"error_response":{"code":"40004","sub_code":"ACQ.TRADE_NOT_EXIST"}}`,
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		c.Gateway = ts.URL
+		node, err := c.Do("alipay.trade.close", map[string]interface{}{"out_trade_no": "abcssscascscds"}, nil)
+		ts.Close()
+		assert.NotNil(t, err)
+		assert.False(t, errors.As(err, &aerr))
+		assert.False(t, node.Exists())
+	}
+	assert.False(t, (&Error{Code: "40004", SubCode: "ACQ.SYSTEM_ERROR"}).Rejected())
+}
@@ -0,0 +1,107 @@
+// Package envelope 信封加密，每条数据使用自己的数据密钥(DEK)加密，DEK再用主密钥加密后和数据一起保存
+//
+// 加密后的内容格式为: enc:v1:base64(nonce + ciphertext)，算法为AES-256-GCM
+// 没有这个前缀的内容视为明文，用于兼容加密之前的数据
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	prefix  = "enc:v1:"
+	KeySize = 32
+)
+
+var ErrInvalidKey = errors.New("envelope: key must be 32 bytes")
+
+// ParseKey 解析base64格式的主密钥
+func ParseKey(s string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// GenerateDataKey 生成新的数据密钥
+func GenerateDataKey() ([]byte, error) {
+	k := make([]byte, KeySize)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// WrapKey 用主密钥加密数据密钥
+func WrapKey(master, dek []byte) (string, error) {
+	return Encrypt(master, string(dek), "dek")
+}
+
+func UnwrapKey(master []byte, wrapped string) ([]byte, error) {
+	s, err := Decrypt(master, wrapped, "dek")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// Encrypt aad为附加数据(比如字段名)，解密时必须一致，防止不同字段的密文被互换
+func Encrypt(key []byte, plaintext, aad string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(aad))
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt 不是加密格式的内容原样返回
+func Decrypt(key []byte, s, aad string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	d, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return "", err
+	}
+	if len(d) < gcm.NonceSize() {
+		return "", errors.New("envelope: ciphertext too short")
+	}
+	p, err := gcm.Open(nil, d[:gcm.NonceSize()], d[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
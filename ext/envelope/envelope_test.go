@@ -0,0 +1,45 @@
+package envelope
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+	master, err := GenerateDataKey()
+	assert.Nil(t, err)
+	parsed, err := ParseKey(base64.StdEncoding.EncodeToString(master))
+	assert.Nil(t, err)
+	assert.Equal(t, master, parsed)
+
+	dek, err := GenerateDataKey()
+	assert.Nil(t, err)
+	wrapped, err := WrapKey(master, dek)
+	assert.Nil(t, err)
+	unwrapped, err := UnwrapKey(master, wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, dek, unwrapped)
+
+	s, err := Encrypt(dek, "api v3 secret", "api_v3_secret")
+	assert.Nil(t, err)
+	assert.True(t, IsEncrypted(s))
+	p, err := Decrypt(dek, s, "api_v3_secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "api v3 secret", p)
+
+	// 字段不一致或密钥错误都不能解密
+	_, err = Decrypt(dek, s, "cert_private")
+	assert.NotNil(t, err)
+	_, err = Decrypt(master, s, "api_v3_secret")
+	assert.NotNil(t, err)
+
+	// 明文原样返回
+	p, err = Decrypt(dek, "plain", "api_v3_secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", p)
+
+	_, err = ParseKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.Equal(t, ErrInvalidKey, err)
+}
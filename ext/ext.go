@@ -2,8 +2,6 @@ package ext
 
 import (
 	"fmt"
-	"strings"
-	"time"
 
 	"go-gin-payment/config"
 	"go-gin-payment/ext/logger"
@@ -16,23 +14,30 @@ type M map[string]interface{}
 func LoggerHookFunc(name string, payload map[string]interface{}) {
 }
 
+// SendToWeb 调用web端的接口，uri为相对路径，带上X_API_SECRET
 func SendToWeb(uri string, b []byte) ([]byte, error) {
-	if !strings.HasPrefix(uri, "http") {
-		uri = config.WebURL + uri
-	}
-
-	rsp, err := resty.SetTimeout(10*time.Second).R().
-		SetHeader("X_API_SECRET", config.WebAPISecret).
-		SetBody(b).
-		Post(uri)
+	code, body, err := PostToWeb(config.WebURL+uri, b, map[string]string{"X_API_SECRET": config.WebAPISecret})
 	if err != nil {
 		logger.L.Warn("send to web err:", err)
 		return nil, err
 	}
-	if !rsp.IsSuccess() {
-		msgErr := fmt.Errorf("send to web err: %s, code: %d", string(rsp.Body()), rsp.StatusCode())
+	if code < 200 || code > 299 {
+		msgErr := fmt.Errorf("send to web err: %s, code: %d", string(body), code)
 		logger.L.Warnf(msgErr.Error())
 		return nil, msgErr
 	}
-	return rsp.Body(), nil
+	return body, nil
+}
+
+// PostToWeb 返回状态码和响应内容，err只表示请求没有完成(比如超时)
+// url为完整的地址，只带上headers，X_API_SECRET只能由SendToWeb发送给web端
+func PostToWeb(url string, b []byte, headers map[string]string) (int, []byte, error) {
+	rsp, err := resty.SetTimeout(config.WebTimeout).R().
+		SetHeaders(headers).
+		SetBody(b).
+		Post(url)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rsp.StatusCode(), rsp.Body(), nil
 }
@@ -0,0 +1,143 @@
+// Package metrics 封装prometheus/client_golang，所有指标注册到同一个registry，由Handler输出
+//
+// 指标在包初始化时用NewCounterVec等创建并注册:
+//
+//	var requests = metrics.NewCounterVec("ggp_http_requests_total", "HTTP requests", "method", "route", "status")
+//	requests.Inc("GET", "/payments/:transNo", "200")
+//
+// label的值要控制数量，不能使用trans_no这样的值
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefBuckets 默认的histogram分桶，单位为秒
+var DefBuckets = prometheus.DefBuckets
+
+var registry = prometheus.NewRegistry()
+
+// Handler 输出所有注册的指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// CounterVec 只能增加的计数
+type CounterVec struct {
+	v *prometheus.CounterVec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	registry.MustRegister(v)
+	return &CounterVec{v}
+}
+
+func (c *CounterVec) Inc(lvs ...string) {
+	c.v.WithLabelValues(lvs...).Inc()
+}
+
+// Add v不能为负数
+func (c *CounterVec) Add(v float64, lvs ...string) {
+	c.v.WithLabelValues(lvs...).Add(v)
+}
+
+func (c *CounterVec) Value(lvs ...string) float64 {
+	return read(c.v.WithLabelValues(lvs...)).GetCounter().GetValue()
+}
+
+// GaugeVec 可以增减的值
+type GaugeVec struct {
+	v *prometheus.GaugeVec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	registry.MustRegister(v)
+	return &GaugeVec{v}
+}
+
+func (g *GaugeVec) Set(v float64, lvs ...string) {
+	g.v.WithLabelValues(lvs...).Set(v)
+}
+
+func (g *GaugeVec) Add(v float64, lvs ...string) {
+	g.v.WithLabelValues(lvs...).Add(v)
+}
+
+func (g *GaugeVec) Value(lvs ...string) float64 {
+	return read(g.v.WithLabelValues(lvs...)).GetGauge().GetValue()
+}
+
+// funcCollector 输出时调用f取值，用于连接池等已经有统计的值，f返回false时不输出
+type funcCollector struct {
+	desc *prometheus.Desc
+	typ  prometheus.ValueType
+	f    func() (float64, bool)
+}
+
+func (c *funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *funcCollector) Collect(ch chan<- prometheus.Metric) {
+	if v, ok := c.f(); ok {
+		ch <- prometheus.MustNewConstMetric(c.desc, c.typ, v)
+	}
+}
+
+func newFunc(name, help string, typ prometheus.ValueType, f func() (float64, bool)) {
+	registry.MustRegister(&funcCollector{desc: prometheus.NewDesc(name, help, nil, nil), typ: typ, f: f})
+}
+
+// NewGaugeFunc 见funcCollector
+func NewGaugeFunc(name, help string, f func() (float64, bool)) {
+	newFunc(name, help, prometheus.GaugeValue, f)
+}
+
+// NewCounterFunc 同NewGaugeFunc，用于只会增加的统计，比如连接池的等待次数
+func NewCounterFunc(name, help string, f func() (float64, bool)) {
+	newFunc(name, help, prometheus.CounterValue, f)
+}
+
+// HistogramVec 分桶统计，比如请求的耗时
+type HistogramVec struct {
+	v *prometheus.HistogramVec
+}
+
+// NewHistogramVec buckets为空时使用DefBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	v := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	registry.MustRegister(v)
+	return &HistogramVec{v}
+}
+
+func (h *HistogramVec) Observe(v float64, lvs ...string) {
+	h.v.WithLabelValues(lvs...).Observe(v)
+}
+
+// ObserveSince 记录从start到现在的秒数
+func (h *HistogramVec) ObserveSince(start time.Time, lvs ...string) {
+	h.Observe(time.Since(start).Seconds(), lvs...)
+}
+
+// Count 用于测试
+func (h *HistogramVec) Count(lvs ...string) uint64 {
+	return read(h.v.WithLabelValues(lvs...).(prometheus.Metric)).GetHistogram().GetSampleCount()
+}
+
+func read(m prometheus.Metric) *dto.Metric {
+	var d dto.Metric
+	if err := m.Write(&d); err != nil {
+		panic("metrics: " + err.Error())
+	}
+	return &d
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Test requests.", "route", "status")
+	c.Inc("/a", "200")
+	c.Add(2, "/a", "200")
+	c.Inc("/b\"\n", "500")
+	assert.Equal(t, 3.0, c.Value("/a", "200"))
+	assert.Panics(t, func() { c.Inc("/a") })
+	assert.Panics(t, func() { c.Add(-1, "/a", "200") })
+
+	g := NewGaugeVec("test_queue", "Test queue.")
+	g.Set(5)
+	g.Add(-2)
+	assert.Equal(t, 3.0, g.Value())
+
+	h := NewHistogramVec("test_duration_seconds", "Test duration.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(3, "/a")
+	assert.Equal(t, uint64(3), h.Count("/a"))
+
+	NewGaugeFunc("test_hidden", "Not connected.", func() (float64, bool) { return 1, false })
+	NewCounterFunc("test_waits_total", "Connected.", func() (float64, bool) { return 7, true })
+	assert.Panics(t, func() { NewGaugeVec("test_queue", "Duplicate.") })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	out := rec.Body.String()
+
+	assert.Contains(t, out, "# TYPE test_requests_total counter\n")
+	assert.Contains(t, out, `test_requests_total{route="/a",status="200"} 3`+"\n")
+	assert.Contains(t, out, `test_requests_total{route="/b\"\n",status="500"} 1`+"\n")
+	assert.Contains(t, out, "# TYPE test_queue gauge\ntest_queue 3\n")
+	assert.Contains(t, out, `test_duration_seconds_bucket{route="/a",le="0.1"} 1`+"\n"+
+		`test_duration_seconds_bucket{route="/a",le="1"} 2`+"\n"+
+		`test_duration_seconds_bucket{route="/a",le="+Inf"} 3`+"\n"+
+		`test_duration_seconds_sum{route="/a"} 3.55`+"\n"+
+		`test_duration_seconds_count{route="/a"} 3`+"\n")
+	assert.Contains(t, out, "# TYPE test_waits_total counter\ntest_waits_total 7\n")
+	assert.NotContains(t, out, "test_hidden")
+}
@@ -0,0 +1,195 @@
+// Package reqsig 调用方请求的签名和校验，代替直接在X_GGP_KEY中发送key，签名泄露后不能被重放
+//
+// 每个请求都带有以下header:
+//
+//	X-GGP-Key-Id: 0123456789abcdef    key的id
+//	X-GGP-Timestamp: 1700000000         unix时间戳(秒)
+//	X-GGP-Nonce: 6b1d4c...              每个请求不同的随机串，8到64个字符
+//	X-GGP-Request-Signature: 5257a8...
+//
+// 签名为HMAC-SHA256(secret, method + "\n" + path?query + "\n" + timestamp + "\n" + nonce + "\n" + hex(sha256(body)))的hex
+//
+// 调用方使用我们的key(ggpk_<key_id>_xxx)时，secret为hex(HMAC-SHA256(key, "ggp-request-signature"))，见FromAPIKey，
+// 和数据库中保存的key的哈希不同，可以直接使用NewClient或者Transport给请求签名
+package reqsig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderKeyID     = "X-GGP-Key-Id"
+	HeaderTimestamp = "X-GGP-Timestamp"
+	HeaderNonce     = "X-GGP-Nonce"
+	HeaderSignature = "X-GGP-Request-Signature"
+
+	// DefaultTolerance 允许的时间误差，超过的请求视为重放，nonce至少需要保存两倍的时间
+	DefaultTolerance = 5 * time.Minute
+
+	// DefaultMaxBodyBytes ParseRequest读取body的默认上限
+	DefaultMaxBodyBytes = 1 << 20
+
+	// apiKeySigningLabel 从key派生签名secret时的HMAC消息
+	apiKeySigningLabel = "ggp-request-signature"
+
+	apiKeyPrefix = "ggpk_"
+	apiKeyIDLen  = 16
+	nonceMinLen  = 8
+	nonceMaxLen  = 64
+)
+
+var (
+	ErrInvalidHeader     = errors.New("reqsig: missing or invalid signature headers")
+	ErrInvalidAPIKey     = errors.New("reqsig: invalid api key")
+	ErrSignatureMismatch = errors.New("reqsig: signature mismatch")
+	ErrTimestampExpired  = errors.New("reqsig: timestamp out of tolerance")
+	ErrBodyTooLarge      = errors.New("reqsig: request body too large")
+)
+
+// Signed 从请求中解析出的签名参数
+type Signed struct {
+	KeyID     string
+	Timestamp string
+	Nonce     string
+	Signature string
+
+	method string
+	uri    string
+	body   []byte
+}
+
+// FromAPIKey 从key中解析key_id和签名使用的secret
+func FromAPIKey(key string) (keyID, secret string, err error) {
+	rest := strings.TrimPrefix(key, apiKeyPrefix)
+	if len(rest) == len(key) || len(rest) <= apiKeyIDLen+1 || rest[apiKeyIDLen] != '_' {
+		return "", "", ErrInvalidAPIKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(apiKeySigningLabel))
+	return rest[:apiKeyIDLen], hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Sign 计算签名，uri为path和query，比如/payments/abc?x=1
+func Sign(secret, method, uri, ts, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToUpper(method) + "\n" + uri + "\n" + ts + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 给请求加上签名的header，r.Body会被读取后重置
+func SignRequest(r *http.Request, keyID, secret string, now time.Time) error {
+	var body []byte
+	if r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		body = b
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	r.Header.Set(HeaderKeyID, keyID)
+	r.Header.Set(HeaderTimestamp, ts)
+	r.Header.Set(HeaderNonce, n)
+	r.Header.Set(HeaderSignature, Sign(secret, r.Method, r.URL.RequestURI(), ts, n, body))
+	return nil
+}
+
+// IsSigned 请求是否使用签名验证
+func IsSigned(r *http.Request) bool {
+	return len(r.Header.Get(HeaderSignature)) > 0
+}
+
+// ParseRequest 读取签名的header和body并检查时间，r.Body会被重置以便后续继续读取
+// 签名需要在查到key_id对应的secret后用Verify校验，nonce由调用方去重
+// body超过maxBodyBytes时返回ErrBodyTooLarge，maxBodyBytes<=0时使用DefaultMaxBodyBytes
+func ParseRequest(r *http.Request, now time.Time, tolerance time.Duration, maxBodyBytes int64) (*Signed, error) {
+	s := &Signed{
+		KeyID:     r.Header.Get(HeaderKeyID),
+		Timestamp: r.Header.Get(HeaderTimestamp),
+		Nonce:     r.Header.Get(HeaderNonce),
+		Signature: r.Header.Get(HeaderSignature),
+		method:    r.Method,
+		uri:       r.URL.RequestURI(),
+	}
+	if len(s.KeyID) == 0 || len(s.Signature) == 0 || len(s.Nonce) < nonceMinLen || len(s.Nonce) > nonceMaxLen {
+		return nil, ErrInvalidHeader
+	}
+	t, err := strconv.ParseInt(s.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > tolerance || d < -tolerance {
+		return nil, ErrTimestampExpired
+	}
+	if r.Body != nil {
+		if maxBodyBytes <= 0 {
+			maxBodyBytes = DefaultMaxBodyBytes
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, ErrBodyTooLarge
+			}
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.body = body
+	}
+	return s, nil
+}
+
+func (s *Signed) Verify(secret string) error {
+	expected := Sign(secret, s.method, s.uri, s.Timestamp, s.Nonce, s.body)
+	if !hmac.Equal([]byte(expected), []byte(s.Signature)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// Transport 给每个请求签名，Base为空时使用http.DefaultTransport
+type Transport struct {
+	KeyID  string
+	Secret string
+	Base   http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrip不能修改原请求
+	r = r.Clone(r.Context())
+	if err := SignRequest(r, t.KeyID, t.Secret, time.Now()); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
+
+// NewClient 使用我们的key签名请求的http.Client
+func NewClient(apiKey string, timeout time.Duration) (*http.Client, error) {
+	keyID, secret, err := FromAPIKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: &Transport{KeyID: keyID, Secret: secret}}, nil
+}
@@ -0,0 +1,100 @@
+package reqsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIKey = "ggpk_0123456789abcdef_secretsecretsecret"
+
+func TestFromAPIKey(t *testing.T) {
+	keyID, secret, err := FromAPIKey(testAPIKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", keyID)
+	assert.Len(t, secret, 64)
+	// 不能用数据库中保存的key的哈希签名
+	sum := sha256.Sum256([]byte(testAPIKey))
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), secret)
+
+	for _, k := range []string{"", "xxx", "ggpk_0123456789abcdef", "ggpk_0123456789abcdefxsecret"} {
+		_, _, err := FromAPIKey(k)
+		assert.Equal(t, ErrInvalidAPIKey, err, k)
+	}
+}
+
+func TestSignAndParseRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"trans_no":"abcssscascscds"}`)
+	r := httptest.NewRequest("POST", "/payments/abc/refunds?x=1", bytes.NewReader(body))
+	assert.Nil(t, SignRequest(r, "kid", "secret", now))
+	assert.True(t, IsSigned(r))
+
+	s, err := ParseRequest(r, now.Add(time.Minute), DefaultTolerance, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "kid", s.KeyID)
+	assert.Nil(t, s.Verify("secret"))
+	assert.Equal(t, ErrSignatureMismatch, s.Verify("other"))
+	// body可以继续读取
+	got, _ := io.ReadAll(r.Body)
+	assert.Equal(t, body, got)
+
+	_, err = ParseRequest(r, now.Add(10*time.Minute), DefaultTolerance, 0)
+	assert.Equal(t, ErrTimestampExpired, err)
+
+	// 修改了body或者query
+	r.Body = io.NopCloser(bytes.NewReader([]byte(`{}`)))
+	s, _ = ParseRequest(r, now, DefaultTolerance, 0)
+	assert.Equal(t, ErrSignatureMismatch, s.Verify("secret"))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.URL.RawQuery = "x=2"
+	s, _ = ParseRequest(r, now, DefaultTolerance, 0)
+	assert.Equal(t, ErrSignatureMismatch, s.Verify("secret"))
+
+	r.Header.Del(HeaderNonce)
+	_, err = ParseRequest(r, now, DefaultTolerance, 0)
+	assert.Equal(t, ErrInvalidHeader, err)
+
+	r = httptest.NewRequest("POST", "/payments", bytes.NewReader(body))
+	assert.Nil(t, SignRequest(r, "kid", "secret", now))
+	_, err = ParseRequest(r, now, DefaultTolerance, int64(len(body)-1))
+	assert.Equal(t, ErrBodyTooLarge, err)
+}
+
+func TestClient(t *testing.T) {
+	keyID, secret, _ := FromAPIKey(testAPIKey)
+	nonces := make(map[string]bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := ParseRequest(r, time.Now(), DefaultTolerance, 0)
+		if err != nil || s.KeyID != keyID || s.Verify(secret) != nil || nonces[s.Nonce] {
+			w.WriteHeader(401)
+			return
+		}
+		nonces[s.Nonce] = true
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(testAPIKey, 5*time.Second)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		res, err := c.Post(ts.URL+"/payments?a=b", "application/json", bytes.NewReader([]byte(`{"a":1}`)))
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, `{"a":1}`, string(b))
+	}
+	res, err := c.Get(ts.URL + "/payments/abc")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+}
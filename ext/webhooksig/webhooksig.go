@@ -0,0 +1,107 @@
+// Package webhooksig 通知签名的生成和校验，接收通知的一方可以直接使用Verify/VerifyRequest
+//
+// 每个通知请求都带有以下header:
+//
+//	X-GGP-Event-Id: evt_xxx       同一个通知重试时不变，用于去重
+//	X-GGP-Event: payment.state    通知类型
+//	X-GGP-Signature: t=1700000000,v1=5257a869e7...
+//
+// v1为HMAC-SHA256(secret, t + "." + body)的hex，t为unix时间戳(秒)
+// 更换secret期间可能有多个v1，只要有一个匹配即可
+package webhooksig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-GGP-Signature"
+	HeaderEventID   = "X-GGP-Event-Id"
+	HeaderEvent     = "X-GGP-Event"
+
+	// DefaultTolerance 允许的时间误差，超过的请求视为重放
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidHeader     = errors.New("webhooksig: invalid signature header")
+	ErrSignatureMismatch = errors.New("webhooksig: signature mismatch")
+	ErrTimestampExpired  = errors.New("webhooksig: timestamp out of tolerance")
+)
+
+// Sign 生成X-GGP-Signature的值，更换secret期间previous中的secret也会各生成一个v1
+func Sign(secret string, t time.Time, body []byte, previous ...string) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	h := fmt.Sprintf("t=%s,v1=%s", ts, compute(secret, ts, body))
+	for _, p := range previous {
+		h += ",v1=" + compute(p, ts, body)
+	}
+	return h
+}
+
+// Verify 校验X-GGP-Signature，tolerance为0时不校验时间
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return ErrInvalidHeader
+	}
+	if tolerance > 0 {
+		d := now.Sub(time.Unix(t, 0))
+		if d > tolerance || d < -tolerance {
+			return ErrTimestampExpired
+		}
+	}
+
+	expected := []byte(compute(secret, ts, body))
+	for _, s := range sigs {
+		if hmac.Equal(expected, []byte(s)) {
+			return nil
+		}
+	}
+	return ErrSignatureMismatch
+}
+
+// VerifyRequest 读取并校验请求，返回body，r.Body会被重置以便后续继续读取
+func VerifyRequest(r *http.Request, secret string) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := Verify(secret, r.Header.Get(HeaderSignature), body, time.Now(), DefaultTolerance); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func compute(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package webhooksig
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"trans_no":"abcssscascscds","is_success":true}`)
+	h := Sign("whsec_test", now, body)
+
+	assert.Nil(t, Verify("whsec_test", h, body, now, DefaultTolerance))
+	assert.Nil(t, Verify("whsec_test", h, body, now.Add(time.Hour), 0))
+	assert.Equal(t, ErrSignatureMismatch, Verify("whsec_other", h, body, now, DefaultTolerance))
+	assert.Equal(t, ErrSignatureMismatch, Verify("whsec_test", h, []byte(`{}`), now, DefaultTolerance))
+	assert.Equal(t, ErrTimestampExpired, Verify("whsec_test", h, body, now.Add(10*time.Minute), DefaultTolerance))
+	assert.Equal(t, ErrInvalidHeader, Verify("whsec_test", "v1=abc", body, now, DefaultTolerance))
+
+	// 更换secret期间有多个签名
+	rotated := h + ",v1=" + compute("whsec_new", "1700000000", body)
+	assert.Nil(t, Verify("whsec_new", rotated, body, now, DefaultTolerance))
+	assert.Equal(t, rotated, Sign("whsec_test", now, body, "whsec_new"))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"trans_no":"abcssscascscds"}`)
+	r := httptest.NewRequest("POST", "/notify", bytes.NewReader(body))
+	r.Header.Set(HeaderSignature, Sign("whsec_test", time.Now(), body))
+
+	got, err := VerifyRequest(r, "whsec_test")
+	assert.Nil(t, err)
+	assert.Equal(t, body, got)
+
+	again, _ := io.ReadAll(r.Body)
+	assert.Equal(t, body, again)
+}
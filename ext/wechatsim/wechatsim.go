@@ -0,0 +1,825 @@
+// Package wechatsim 进程内的微信支付v3模拟器，用于开发和测试，不需要网络和真实的商户号
+//
+// 支持的接口:
+//
+//	GET  /v3/certificates                                       下载平台证书(用商户的APIv3密钥加密)
+//	POST /v3/pay/transactions/{jsapi|app|native|h5}             下单，服务商为/v3/pay/partner/transactions/...
+//	GET  /v3/pay/transactions/out-trade-no/{out_trade_no}       查询订单
+//	POST /v3/pay/transactions/out-trade-no/{out_trade_no}/close 关闭订单
+//	POST /v3/refund/domestic/refunds                            申请退款
+//	GET  /v3/refund/domestic/refunds/{out_refund_no}            查询退款
+//
+// 所有应答都用生成的平台证书签名，wechatpay-go的validator可以正常验签；
+// Pay/CompleteRefund模拟用户支付和退款到账，并把加密、签名后的通知发送到下单时的notify_url，
+// 开发时也可以调用POST /sim/pay/{out_trade_no}和POST /sim/refunds/{out_refund_no}/complete
+package wechatsim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TradeStateNotPay  = "NOTPAY"
+	TradeStateSuccess = "SUCCESS"
+	TradeStateClosed  = "CLOSED"
+	TradeStateRefund  = "REFUND"
+
+	RefundStatusProcessing = "PROCESSING"
+	RefundStatusSuccess    = "SUCCESS"
+
+	authorizationPrefix = "WECHATPAY2-SHA256-RSA2048 "
+)
+
+var chinaTz = time.FixedZone("CST", 8*3600)
+
+// Merchant 模拟器中的商户，服务商模式下为服务商商户号
+type Merchant struct {
+	MchID string
+	// APIV3Key 用于加密平台证书和通知，32字节
+	APIV3Key string
+	// PublicKey 商户API证书的公钥，不为空时校验请求的签名
+	PublicKey *rsa.PublicKey
+}
+
+// Order 模拟器保存的订单
+type Order struct {
+	MchID         string // 服务商模式下为sp_mchid
+	AppID         string // 服务商模式下为sp_appid
+	SubMchID      string
+	SubAppID      string
+	OutTradeNo    string
+	TransactionID string
+	TradeType     string // JSAPI/APP/NATIVE/MWEB
+	TradeState    string
+	Description   string
+	Total         int64
+	Refunded      int64
+	OpenID        string
+	NotifyURL     string
+	PrepayID      string
+	CodeURL       string
+	H5URL         string
+	SuccessTime   time.Time
+}
+
+// Refund 模拟器保存的退款
+type Refund struct {
+	MchID       string
+	SubMchID    string
+	OutTradeNo  string
+	OutRefundNo string
+	RefundID    string
+	Status      string
+	Refund      int64
+	Total       int64
+	NotifyURL   string
+	CreateTime  time.Time
+	SuccessTime time.Time
+}
+
+// Server 调用Close停止
+type Server struct {
+	// URL 设置为config.WechatPayBaseURL
+	URL string
+	// PlatformKey和PlatformCert 用于应答和通知签名
+	PlatformKey  *rsa.PrivateKey
+	PlatformCert *x509.Certificate
+	Serial       string
+	// NotifyClient 发送通知使用的client
+	NotifyClient *http.Client
+
+	srv       *httptest.Server
+	mu        sync.Mutex
+	merchants map[string]*Merchant
+	orders    map[string]*Order
+	refunds   map[string]*Refund
+	seq       int64
+}
+
+// New addr为空时监听127.0.0.1的随机端口
+func New(addr string, merchants ...Merchant) (*Server, error) {
+	key, cert, err := genPlatformCert()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		PlatformKey:  key,
+		PlatformCert: cert,
+		Serial:       fmt.Sprintf("%X", cert.SerialNumber),
+		NotifyClient: &http.Client{Timeout: 10 * time.Second},
+		merchants:    make(map[string]*Merchant),
+		orders:       make(map[string]*Order),
+		refunds:      make(map[string]*Refund),
+	}
+	for _, m := range merchants {
+		if err := s.AddMerchant(m); err != nil {
+			return nil, err
+		}
+	}
+	s.srv = httptest.NewUnstartedServer(s)
+	if len(addr) > 0 {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s.srv.Listener.Close()
+		s.srv.Listener = l
+	}
+	s.srv.Start()
+	s.URL = s.srv.URL
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddMerchant 同一个商户号重复添加时覆盖
+func (s *Server) AddMerchant(m Merchant) error {
+	if len(m.MchID) == 0 || len(m.APIV3Key) != 32 {
+		return errors.New("wechatsim: mch_id is required and api v3 key must be 32 bytes")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merchants[m.MchID] = &m
+	return nil
+}
+
+// Order 按商户订单号查找，返回副本
+func (s *Server) Order(outTradeNo string) (Order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(outTradeNo)
+	if o == nil {
+		return Order{}, false
+	}
+	return *o, true
+}
+
+// Refund 按商户退款号查找，返回副本
+func (s *Server) Refund(outRefundNo string) (Refund, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.refunds {
+		if r.OutRefundNo == outRefundNo {
+			return *r, true
+		}
+	}
+	return Refund{}, false
+}
+
+// Pay 模拟用户支付成功，并发送TRANSACTION.SUCCESS通知
+func (s *Server) Pay(outTradeNo, openID string) error {
+	s.mu.Lock()
+	o := s.findOrder(outTradeNo)
+	if o == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("wechatsim: order not found: %s", outTradeNo)
+	}
+	if o.TradeState != TradeStateNotPay {
+		s.mu.Unlock()
+		return fmt.Errorf("wechatsim: order %s is %s", outTradeNo, o.TradeState)
+	}
+	o.TradeState = TradeStateSuccess
+	o.TransactionID = s.nextID("4200001100")
+	o.SuccessTime = time.Now()
+	if len(openID) > 0 {
+		o.OpenID = openID
+	}
+	resource := orderJSON(o)
+	mchID, notifyURL := o.MchID, o.NotifyURL
+	s.mu.Unlock()
+	return s.Notify(notifyURL, mchID, "TRANSACTION.SUCCESS", "transaction", "支付成功", resource)
+}
+
+// CompleteRefund 模拟退款到账，并发送REFUND.SUCCESS通知
+func (s *Server) CompleteRefund(outRefundNo string) error {
+	s.mu.Lock()
+	var r *Refund
+	for _, v := range s.refunds {
+		if v.OutRefundNo == outRefundNo {
+			r = v
+		}
+	}
+	if r == nil || r.Status != RefundStatusProcessing {
+		s.mu.Unlock()
+		return fmt.Errorf("wechatsim: refund not found or not processing: %s", outRefundNo)
+	}
+	r.Status = RefundStatusSuccess
+	r.SuccessTime = time.Now()
+	resource := refundNotifyJSON(r, s.orders[orderKey(r.MchID, r.SubMchID, r.OutTradeNo)])
+	mchID, notifyURL := r.MchID, r.NotifyURL
+	s.mu.Unlock()
+	return s.Notify(notifyURL, mchID, "REFUND.SUCCESS", "refund", "退款成功", resource)
+}
+
+// Notify 用商户的APIv3密钥加密resource，用平台证书签名后POST到notifyURL，非2xx时返回错误
+func (s *Server) Notify(notifyURL, mchID, eventType, originalType, summary string, resource interface{}) error {
+	s.mu.Lock()
+	m := s.merchants[mchID]
+	s.mu.Unlock()
+	if m == nil {
+		return fmt.Errorf("wechatsim: merchant not found: %s", mchID)
+	}
+	plain, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	nonce := randomString(12)
+	ciphertext, err := encryptAESGCM(m.APIV3Key, nonce, originalType, plain)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	id := s.nextID("EV-")
+	s.mu.Unlock()
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":            id,
+		"create_time":   time.Now().In(chinaTz).Format(time.RFC3339),
+		"resource_type": "encrypt-resource",
+		"event_type":    eventType,
+		"summary":       summary,
+		"resource": map[string]interface{}{
+			"original_type":   originalType,
+			"algorithm":       "AEAD_AES_256_GCM",
+			"ciphertext":      ciphertext,
+			"associated_data": originalType,
+			"nonce":           nonce,
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.signHeader(req.Header, body); err != nil {
+		return err
+	}
+	rsp, err := s.NotifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		d, _ := io.ReadAll(rsp.Body)
+		return fmt.Errorf("wechatsim: notify %s response %d: %s", notifyURL, rsp.StatusCode, d)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/sim/") {
+		s.handleControl(w, r)
+		return
+	}
+	m, err := s.authenticate(r, body)
+	if err != nil {
+		s.writeError(w, http.StatusUnauthorized, "SIGN_ERROR", err.Error())
+		return
+	}
+
+	path := r.URL.Path
+	partner := strings.HasPrefix(path, "/v3/pay/partner/transactions/")
+	switch {
+	case r.Method == http.MethodGet && path == "/v3/certificates":
+		s.handleCertificates(w, m)
+	case r.Method == http.MethodPost && path == "/v3/refund/domestic/refunds":
+		s.handleRefund(w, m, body)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v3/refund/domestic/refunds/"):
+		s.handleQueryRefund(w, m, strings.TrimPrefix(path, "/v3/refund/domestic/refunds/"), r.URL.Query().Get("sub_mchid"))
+	case strings.HasPrefix(path, "/v3/pay/transactions/") || partner:
+		rest := strings.TrimPrefix(strings.TrimPrefix(path, "/v3/pay/partner/transactions/"), "/v3/pay/transactions/")
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(rest, "out-trade-no/") && strings.HasSuffix(rest, "/close"):
+			s.handleClose(w, m, partner, strings.TrimSuffix(strings.TrimPrefix(rest, "out-trade-no/"), "/close"), body)
+		case r.Method == http.MethodGet && strings.HasPrefix(rest, "out-trade-no/"):
+			s.handleQuery(w, m, partner, strings.TrimPrefix(rest, "out-trade-no/"), r)
+		case r.Method == http.MethodPost && tradeTypes[rest] != "":
+			s.handleCreate(w, m, partner, rest, body)
+		default:
+			s.writeError(w, http.StatusNotFound, "NOT_FOUND", "unsupported api: "+path)
+		}
+	default:
+		s.writeError(w, http.StatusNotFound, "NOT_FOUND", "unsupported api: "+path)
+	}
+}
+
+// handleControl 开发时手动模拟用户操作，不需要签名
+//
+//	POST /sim/pay/{out_trade_no}?openid=xxx
+//	POST /sim/refunds/{out_refund_no}/complete
+func (s *Server) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/sim/pay/"):
+		err = s.Pay(strings.TrimPrefix(path, "/sim/pay/"), r.URL.Query().Get("openid"))
+	case strings.HasPrefix(path, "/sim/refunds/") && strings.HasSuffix(path, "/complete"):
+		err = s.CompleteRefund(strings.TrimSuffix(strings.TrimPrefix(path, "/sim/refunds/"), "/complete"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+var tradeTypes = map[string]string{"jsapi": "JSAPI", "app": "APP", "native": "NATIVE", "h5": "MWEB"}
+
+// authenticate 解析Authorization中的商户号，商户设置了PublicKey时校验签名
+func (s *Server) authenticate(r *http.Request, body []byte) (*Merchant, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, authorizationPrefix) {
+		return nil, errors.New("invalid authorization")
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(h, authorizationPrefix), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	s.mu.Lock()
+	m := s.merchants[params["mchid"]]
+	s.mu.Unlock()
+	if m == nil {
+		return nil, fmt.Errorf("merchant not found: %s", params["mchid"])
+	}
+	if m.PublicKey == nil {
+		return m, nil
+	}
+	sign, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, err
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), params["timestamp"], params["nonce_str"], body)
+	sum := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(m.PublicKey, crypto.SHA256, sum[:], sign); err != nil {
+		return nil, errors.New("signature mismatch")
+	}
+	return m, nil
+}
+
+func (s *Server) handleCertificates(w http.ResponseWriter, m *Merchant) {
+	nonce := randomString(12)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.PlatformCert.Raw})
+	ciphertext, err := encryptAESGCM(m.APIV3Key, nonce, "certificate", certPem)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "SYSTEM_ERROR", err.Error())
+		return
+	}
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": []interface{}{map[string]interface{}{
+			"serial_no":      s.Serial,
+			"effective_time": s.PlatformCert.NotBefore.In(chinaTz).Format(time.RFC3339),
+			"expire_time":    s.PlatformCert.NotAfter.In(chinaTz).Format(time.RFC3339),
+			"encrypt_certificate": map[string]interface{}{
+				"algorithm":       "AEAD_AES_256_GCM",
+				"nonce":           nonce,
+				"associated_data": "certificate",
+				"ciphertext":      ciphertext,
+			},
+		}},
+	})
+}
+
+type createRequest struct {
+	AppID       string `json:"appid"`
+	MchID       string `json:"mchid"`
+	SpAppID     string `json:"sp_appid"`
+	SpMchID     string `json:"sp_mchid"`
+	SubAppID    string `json:"sub_appid"`
+	SubMchID    string `json:"sub_mchid"`
+	OutTradeNo  string `json:"out_trade_no"`
+	Description string `json:"description"`
+	NotifyURL   string `json:"notify_url"`
+	Amount      struct {
+		Total int64 `json:"total"`
+	} `json:"amount"`
+	Payer struct {
+		OpenID    string `json:"openid"`
+		SubOpenID string `json:"sub_openid"`
+	} `json:"payer"`
+	SceneInfo *struct {
+		PayerClientIP string `json:"payer_client_ip"`
+	} `json:"scene_info"`
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, m *Merchant, partner bool, kind string, body []byte) {
+	var req createRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+		return
+	}
+	o := &Order{
+		OutTradeNo:  req.OutTradeNo,
+		TradeType:   tradeTypes[kind],
+		TradeState:  TradeStateNotPay,
+		Description: req.Description,
+		Total:       req.Amount.Total,
+		NotifyURL:   req.NotifyURL,
+		OpenID:      req.Payer.OpenID,
+	}
+	if partner {
+		o.MchID, o.AppID, o.SubMchID, o.SubAppID = req.SpMchID, req.SpAppID, req.SubMchID, req.SubAppID
+		o.OpenID = req.Payer.SubOpenID
+	} else {
+		o.MchID, o.AppID = req.MchID, req.AppID
+	}
+
+	var missing []string
+	for _, f := range [][2]string{{"out_trade_no", o.OutTradeNo}, {"description", o.Description}, {"notify_url", o.NotifyURL}, {"appid", o.AppID}} {
+		if len(f[1]) == 0 {
+			missing = append(missing, f[0])
+		}
+	}
+	if o.Total <= 0 {
+		missing = append(missing, "amount.total")
+	}
+	if partner && len(o.SubMchID) == 0 {
+		missing = append(missing, "sub_mchid")
+	}
+	if o.TradeType == "JSAPI" && len(o.OpenID) == 0 {
+		missing = append(missing, "payer")
+	}
+	if o.TradeType == "MWEB" && (req.SceneInfo == nil || len(req.SceneInfo.PayerClientIP) == 0) {
+		missing = append(missing, "scene_info.payer_client_ip")
+	}
+	if len(missing) > 0 {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "invalid params: "+strings.Join(missing, ","))
+		return
+	}
+	if o.MchID != m.MchID {
+		s.writeError(w, http.StatusBadRequest, "MCH_NOT_EXISTS", "mchid does not match authorization")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := orderKey(o.MchID, o.SubMchID, o.OutTradeNo)
+	if old, ok := s.orders[key]; ok {
+		switch {
+		case old.TradeState != TradeStateNotPay:
+			s.writeError(w, http.StatusBadRequest, "ORDERPAID", "订单已支付或已关闭")
+		case old.Total != o.Total || old.Description != o.Description || old.TradeType != o.TradeType:
+			s.writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "201 商户订单号重复")
+		default:
+			s.writeJSON(w, http.StatusOK, createResponse(old))
+		}
+		return
+	}
+	o.PrepayID = s.nextID("wx")
+	switch o.TradeType {
+	case "NATIVE":
+		o.CodeURL = "weixin://wxpay/bizpayurl?pr=" + randomString(9)
+	case "MWEB":
+		o.H5URL = "https://wx.tenpay.com/cgi-bin/mmpayweb-bin/checkmweb?prepay_id=" + o.PrepayID + "&package=" + randomString(10)
+	}
+	s.orders[key] = o
+	s.writeJSON(w, http.StatusOK, createResponse(o))
+}
+
+func createResponse(o *Order) map[string]interface{} {
+	switch o.TradeType {
+	case "NATIVE":
+		return map[string]interface{}{"code_url": o.CodeURL}
+	case "MWEB":
+		return map[string]interface{}{"h5_url": o.H5URL}
+	default:
+		return map[string]interface{}{"prepay_id": o.PrepayID}
+	}
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, m *Merchant, partner bool, outTradeNo string, r *http.Request) {
+	q := r.URL.Query()
+	mchID := q.Get("mchid")
+	if partner {
+		mchID = q.Get("sp_mchid")
+	}
+	if mchID != m.MchID {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "mchid does not match authorization")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderKey(mchID, q.Get("sub_mchid"), outTradeNo)]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "ORDER_NOT_EXIST", "订单不存在")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, orderJSON(o))
+}
+
+func (s *Server) handleClose(w http.ResponseWriter, m *Merchant, partner bool, outTradeNo string, body []byte) {
+	var req createRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+		return
+	}
+	mchID := req.MchID
+	if partner {
+		mchID = req.SpMchID
+	}
+	if mchID != m.MchID {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "mchid does not match authorization")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderKey(mchID, req.SubMchID, outTradeNo)]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "ORDER_NOT_EXIST", "订单不存在")
+		return
+	}
+	if o.TradeState != TradeStateNotPay && o.TradeState != TradeStateClosed {
+		s.writeError(w, http.StatusBadRequest, "ORDERPAID", "订单已支付")
+		return
+	}
+	o.TradeState = TradeStateClosed
+	s.writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, m *Merchant, body []byte) {
+	var req struct {
+		SubMchID    string `json:"sub_mchid"`
+		OutTradeNo  string `json:"out_trade_no"`
+		OutRefundNo string `json:"out_refund_no"`
+		NotifyURL   string `json:"notify_url"`
+		Amount      struct {
+			Refund int64 `json:"refund"`
+			Total  int64 `json:"total"`
+		} `json:"amount"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+		return
+	}
+	if len(req.OutRefundNo) == 0 || req.Amount.Refund <= 0 {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "out_refund_no and amount.refund are required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderKey(m.MchID, req.SubMchID, req.OutTradeNo)]
+	if !ok || (o.TradeState != TradeStateSuccess && o.TradeState != TradeStateRefund) {
+		s.writeError(w, http.StatusBadRequest, "RESOURCE_NOT_EXISTS", "订单不存在或者未支付")
+		return
+	}
+	refundKey := orderKey(m.MchID, req.SubMchID, req.OutRefundNo)
+	if r, ok := s.refunds[refundKey]; ok {
+		s.writeJSON(w, http.StatusOK, refundJSON(r, o))
+		return
+	}
+	if req.Amount.Total != o.Total {
+		s.writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "订单金额不一致")
+		return
+	}
+	if o.Refunded+req.Amount.Refund > o.Total {
+		s.writeError(w, http.StatusBadRequest, "NOT_ENOUGH", "退款金额超过订单可退金额")
+		return
+	}
+	o.Refunded += req.Amount.Refund
+	o.TradeState = TradeStateRefund
+	r := &Refund{
+		MchID:       m.MchID,
+		SubMchID:    req.SubMchID,
+		OutTradeNo:  req.OutTradeNo,
+		OutRefundNo: req.OutRefundNo,
+		RefundID:    s.nextID("50300000"),
+		Status:      RefundStatusProcessing,
+		Refund:      req.Amount.Refund,
+		Total:       o.Total,
+		NotifyURL:   req.NotifyURL,
+		CreateTime:  time.Now(),
+	}
+	s.refunds[refundKey] = r
+	s.writeJSON(w, http.StatusOK, refundJSON(r, o))
+}
+
+func (s *Server) handleQueryRefund(w http.ResponseWriter, m *Merchant, outRefundNo, subMchID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.refunds[orderKey(m.MchID, subMchID, outRefundNo)]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "RESOURCE_NOT_EXISTS", "退款单不存在")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, refundJSON(r, s.orders[orderKey(r.MchID, r.SubMchID, r.OutTradeNo)]))
+}
+
+func (s *Server) findOrder(outTradeNo string) *Order {
+	for _, o := range s.orders {
+		if o.OutTradeNo == outTradeNo {
+			return o
+		}
+	}
+	return nil
+}
+
+// nextID 调用时需要已经持有锁或者不会并发
+func (s *Server) nextID(prefix string) string {
+	s.seq++
+	return prefix + time.Now().In(chinaTz).Format("20060102150405") + strconv.FormatInt(s.seq, 10)
+}
+
+func orderKey(mchID, subMchID, no string) string {
+	return mchID + "|" + subMchID + "|" + no
+}
+
+func orderJSON(o *Order) map[string]interface{} {
+	res := map[string]interface{}{
+		"out_trade_no":     o.OutTradeNo,
+		"trade_type":       o.TradeType,
+		"trade_state":      o.TradeState,
+		"trade_state_desc": tradeStateDesc[o.TradeState],
+		"amount": map[string]interface{}{
+			"total":    o.Total,
+			"currency": "CNY",
+		},
+	}
+	if len(o.SubMchID) > 0 {
+		res["sp_mchid"], res["sp_appid"], res["sub_mchid"], res["sub_appid"] = o.MchID, o.AppID, o.SubMchID, o.SubAppID
+	} else {
+		res["mchid"], res["appid"] = o.MchID, o.AppID
+	}
+	if o.TradeState == TradeStateSuccess || o.TradeState == TradeStateRefund {
+		res["transaction_id"] = o.TransactionID
+		res["bank_type"] = "OTHERS"
+		res["success_time"] = o.SuccessTime.In(chinaTz).Format(time.RFC3339)
+		res["amount"] = map[string]interface{}{
+			"total":          o.Total,
+			"payer_total":    o.Total,
+			"currency":       "CNY",
+			"payer_currency": "CNY",
+		}
+		if len(o.SubMchID) > 0 {
+			res["payer"] = map[string]interface{}{"sub_openid": o.OpenID}
+		} else {
+			res["payer"] = map[string]interface{}{"openid": o.OpenID}
+		}
+	}
+	return res
+}
+
+var tradeStateDesc = map[string]string{
+	TradeStateNotPay:  "未支付",
+	TradeStateSuccess: "支付成功",
+	TradeStateClosed:  "已关闭",
+	TradeStateRefund:  "转入退款",
+}
+
+func refundJSON(r *Refund, o *Order) map[string]interface{} {
+	res := map[string]interface{}{
+		"refund_id":     r.RefundID,
+		"out_refund_no": r.OutRefundNo,
+		"out_trade_no":  r.OutTradeNo,
+		"channel":       "ORIGINAL",
+		"status":        r.Status,
+		"create_time":   r.CreateTime.In(chinaTz).Format(time.RFC3339),
+		"amount": map[string]interface{}{
+			"refund":       r.Refund,
+			"total":        r.Total,
+			"payer_total":  r.Total,
+			"payer_refund": r.Refund,
+			"currency":     "CNY",
+		},
+	}
+	if o != nil {
+		res["transaction_id"] = o.TransactionID
+	}
+	if r.Status == RefundStatusSuccess {
+		res["success_time"] = r.SuccessTime.In(chinaTz).Format(time.RFC3339)
+	}
+	return res
+}
+
+// refundNotifyJSON 退款通知和查询的字段不同，状态字段为refund_status
+func refundNotifyJSON(r *Refund, o *Order) map[string]interface{} {
+	res := refundJSON(r, o)
+	delete(res, "status")
+	delete(res, "create_time")
+	delete(res, "channel")
+	res["refund_status"] = r.Status
+	res["user_received_account"] = "支付用户零钱"
+	if len(r.SubMchID) > 0 {
+		res["sp_mchid"], res["sub_mchid"] = r.MchID, r.SubMchID
+	} else {
+		res["mchid"] = r.MchID
+	}
+	return res
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var body []byte
+	if v != nil {
+		body, _ = json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := s.signHeader(w.Header(), body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Request-Id", randomString(16))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, code, message string) {
+	s.writeJSON(w, status, map[string]interface{}{"code": code, "message": message})
+}
+
+// signHeader 应答和通知的签名串为: 时间戳\n随机串\n报文主体\n
+func (s *Server) signHeader(h http.Header, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randomString(16)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, body)))
+	sign, err := rsa.SignPKCS1v15(rand.Reader, s.PlatformKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	h.Set("Wechatpay-Serial", s.Serial)
+	h.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sign))
+	h.Set("Wechatpay-Timestamp", timestamp)
+	h.Set("Wechatpay-Nonce", nonce)
+	return nil
+}
+
+// encryptAESGCM 和utils.DecryptAES256GCM对应，返回base64(密文+tag)
+func encryptAESGCM(key, nonce, associatedData string, plaintext []byte) (string, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plaintext, []byte(associatedData))), nil
+}
+
+func genPlatformCert() (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(5, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, (n+1)/2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}
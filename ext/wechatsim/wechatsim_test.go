@@ -0,0 +1,182 @@
+package wechatsim
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+const (
+	testMchID    = "1900000100"
+	testAPIV3Key = "0123456789abcdef0123456789abcdef"
+)
+
+func newTestClient(t *testing.T, s *Server, key *rsa.PrivateKey) *core.Client {
+	client, err := core.NewClient(context.TODO(),
+		option.WithMerchant(testMchID, "3775B6A45ACD588826D15E583A95F5DD", key),
+		option.WithWechatPay([]*x509.Certificate{s.PlatformCert}),
+	)
+	assert.Nil(t, err)
+	return client
+}
+
+func readBody(t *testing.T, rsp *http.Response) gjson.Result {
+	d, err := io.ReadAll(rsp.Body)
+	assert.Nil(t, err)
+	return gjson.ParseBytes(d)
+}
+
+func TestSimulator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	s, err := New("", Merchant{MchID: testMchID, APIV3Key: testAPIV3Key, PublicKey: &key.PublicKey})
+	assert.Nil(t, err)
+	defer s.Close()
+	client := newTestClient(t, s, key)
+	ctx := context.TODO()
+
+	// 平台证书用APIv3密钥加密
+	rsp, err := client.Get(ctx, s.URL+"/v3/certificates")
+	assert.Nil(t, err)
+	c := readBody(t, rsp).Get("data.0")
+	assert.Equal(t, s.Serial, c.Get("serial_no").String())
+	certPem, err := utils.DecryptToString(testAPIV3Key, c.Get("encrypt_certificate.associated_data").String(),
+		c.Get("encrypt_certificate.nonce").String(), c.Get("encrypt_certificate.ciphertext").String())
+	assert.Nil(t, err)
+	cert, err := utils.LoadCertificate(certPem)
+	assert.Nil(t, err)
+	assert.Equal(t, s.PlatformCert.SerialNumber, cert.SerialNumber)
+
+	// 签名错误的请求
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	_, err = newTestClient(t, s, other).Get(ctx, s.URL+"/v3/certificates")
+	assert.NotNil(t, err)
+
+	// 收到的通知
+	notified := make(chan gjson.Result, 1)
+	notifySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified <- readBody(t, &http.Response{Body: r.Body})
+	}))
+	defer notifySrv.Close()
+
+	body := map[string]interface{}{
+		"mchid":        testMchID,
+		"appid":        "wxd678efh567hg6787",
+		"out_trade_no": "t1",
+		"description":  "test",
+		"notify_url":   notifySrv.URL,
+		"amount":       map[string]interface{}{"total": 100},
+	}
+	rsp, err = client.Post(ctx, s.URL+"/v3/pay/transactions/native", body)
+	assert.Nil(t, err)
+	assert.Contains(t, readBody(t, rsp).Get("code_url").String(), "weixin://wxpay/bizpayurl")
+
+	// 参数不同时订单号重复
+	body["amount"] = map[string]interface{}{"total": 200}
+	_, err = client.Post(ctx, s.URL+"/v3/pay/transactions/native", body)
+	assert.NotNil(t, err)
+
+	rsp, err = client.Get(ctx, s.URL+"/v3/pay/transactions/out-trade-no/t1?mchid="+testMchID)
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateNotPay, readBody(t, rsp).Get("trade_state").String())
+
+	// 支付后发送加密的通知
+	assert.Nil(t, s.Pay("t1", "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"))
+	n := <-notified
+	assert.Equal(t, "TRANSACTION.SUCCESS", n.Get("event_type").String())
+	plain, err := utils.DecryptToString(testAPIV3Key, n.Get("resource.associated_data").String(),
+		n.Get("resource.nonce").String(), n.Get("resource.ciphertext").String())
+	assert.Nil(t, err)
+	doc := gjson.Parse(plain)
+	assert.Equal(t, "t1", doc.Get("out_trade_no").String())
+	assert.Equal(t, TradeStateSuccess, doc.Get("trade_state").String())
+	assert.Equal(t, int64(100), doc.Get("amount.total").Int())
+
+	// 已支付的订单不能关闭
+	_, err = client.Post(ctx, s.URL+"/v3/pay/transactions/out-trade-no/t1/close", map[string]interface{}{"mchid": testMchID})
+	assert.NotNil(t, err)
+
+	// 退款
+	refund := map[string]interface{}{
+		"out_trade_no":  "t1",
+		"out_refund_no": "r1",
+		"notify_url":    notifySrv.URL,
+		"amount":        map[string]interface{}{"refund": 60, "total": 100, "currency": "CNY"},
+	}
+	rsp, err = client.Post(ctx, s.URL+"/v3/refund/domestic/refunds", refund)
+	assert.Nil(t, err)
+	assert.Equal(t, RefundStatusProcessing, readBody(t, rsp).Get("status").String())
+	refund["out_refund_no"] = "r2"
+	_, err = client.Post(ctx, s.URL+"/v3/refund/domestic/refunds", refund)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, s.CompleteRefund("r1"))
+	n = <-notified
+	assert.Equal(t, "REFUND.SUCCESS", n.Get("event_type").String())
+	r, ok := s.Refund("r1")
+	assert.True(t, ok)
+	assert.Equal(t, RefundStatusSuccess, r.Status)
+}
+
+func TestSimulatorClose(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	s, err := New("", Merchant{MchID: testMchID, APIV3Key: testAPIV3Key})
+	assert.Nil(t, err)
+	defer s.Close()
+	client := newTestClient(t, s, key)
+	ctx := context.TODO()
+
+	// 服务商下单
+	_, err = client.Post(ctx, s.URL+"/v3/pay/partner/transactions/jsapi", map[string]interface{}{
+		"sp_mchid":     testMchID,
+		"sp_appid":     "wx8888888888888888",
+		"sub_mchid":    "1900000109",
+		"out_trade_no": "t2",
+		"description":  "test",
+		"notify_url":   "https://xx.com/notify",
+		"amount":       map[string]interface{}{"total": 100},
+	})
+	// 缺少payer
+	assert.NotNil(t, err)
+
+	rsp, err := client.Post(ctx, s.URL+"/v3/pay/partner/transactions/jsapi", map[string]interface{}{
+		"sp_mchid":     testMchID,
+		"sp_appid":     "wx8888888888888888",
+		"sub_mchid":    "1900000109",
+		"out_trade_no": "t2",
+		"description":  "test",
+		"notify_url":   "https://xx.com/notify",
+		"amount":       map[string]interface{}{"total": 100},
+		"payer":        map[string]interface{}{"sub_openid": "o1"},
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, readBody(t, rsp).Get("prepay_id").String())
+
+	rsp, err = client.Post(ctx, s.URL+"/v3/pay/partner/transactions/out-trade-no/t2/close", map[string]interface{}{
+		"sp_mchid":  testMchID,
+		"sub_mchid": "1900000109",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+
+	rsp, err = client.Get(ctx, s.URL+"/v3/pay/partner/transactions/out-trade-no/t2?sp_mchid="+testMchID+"&sub_mchid=1900000109")
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateClosed, readBody(t, rsp).Get("trade_state").String())
+
+	_, err = client.Get(ctx, s.URL+"/v3/pay/transactions/out-trade-no/t3?mchid="+testMchID)
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.Pay("t2", ""))
+}
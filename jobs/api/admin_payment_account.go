@@ -0,0 +1,297 @@
+package api
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/alipay"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+// operatorHeaderKey 调用方自己填写的操作人，只作为审计日志的备注
+const operatorHeaderKey = "X_GGP_OPERATOR"
+
+// fetchWechatPlatformCert 保存微信账号前用来确认商户号、证书和APIv3密钥可用，测试时替换
+var fetchWechatPlatformCert = getWechatPlatformCert
+
+// paymentAccountView 返回给管理接口的内容，私钥和APIv3密钥只返回是否设置
+type paymentAccountView struct {
+	ID                     int64     `json:"id"`
+	CreatedAt              time.Time `json:"created_at"`
+	UpdatedAt              time.Time `json:"updated_at"`
+	AccountType            string    `json:"account_type"`
+	Name                   string    `json:"name"`
+	MerID                  string    `json:"mer_id"`
+	AppID                  string    `json:"app_id"`
+	CertSerialNumber       string    `json:"cert_serial_number"`
+	CertPublic             string    `json:"cert_public"`
+	AlipayCertPublicKey    string    `json:"alipay_cert_public_key"`
+	AlipayRootCert         string    `json:"alipay_root_cert"`
+	AlipayAppCertPublicKey string    `json:"alipay_app_cert_public_key"`
+	HasCertPrivate         bool      `json:"has_cert_private"`
+	HasAPIV3Secret         bool      `json:"has_api_v3_secret"`
+	Encrypted              bool      `json:"encrypted"`
+}
+
+func newPaymentAccountView(pa *models.PaymentAccount) paymentAccountView {
+	return paymentAccountView{
+		ID:                     pa.ID,
+		CreatedAt:              pa.CreatedAt,
+		UpdatedAt:              pa.UpdatedAt,
+		AccountType:            pa.AccountType,
+		Name:                   pa.Name,
+		MerID:                  pa.MerID,
+		AppID:                  pa.AppID,
+		CertSerialNumber:       pa.CertSerialNumber,
+		CertPublic:             pa.CertPublic,
+		AlipayCertPublicKey:    pa.AlipayCertPublicKey,
+		AlipayRootCert:         pa.AlipayRootCert,
+		AlipayAppCertPublicKey: pa.AlipayAppCertPublicKey,
+		HasCertPrivate:         len(pa.CertPrivate) > 0,
+		HasAPIV3Secret:         len(pa.APIV3Secret) > 0,
+		Encrypted:              len(pa.EncryptedDataKey) > 0,
+	}
+}
+
+// paymentAccountInput 创建和修改的参数，修改时没有传的字段不变
+type paymentAccountInput struct {
+	AccountType            *string `json:"account_type"`
+	Name                   *string `json:"name"`
+	MerID                  *string `json:"mer_id"`
+	AppID                  *string `json:"app_id"`
+	APIV3Secret            *string `json:"api_v3_secret"`
+	CertSerialNumber       *string `json:"cert_serial_number"`
+	CertPublic             *string `json:"cert_public"`
+	CertPrivate            *string `json:"cert_private"`
+	AlipayCertPublicKey    *string `json:"alipay_cert_public_key"`
+	AlipayRootCert         *string `json:"alipay_root_cert"`
+	AlipayAppCertPublicKey *string `json:"alipay_app_cert_public_key"`
+}
+
+func (in *paymentAccountInput) apply(pa *models.PaymentAccount) {
+	for _, f := range []struct {
+		from *string
+		to   *string
+	}{
+		{in.AccountType, &pa.AccountType},
+		{in.Name, &pa.Name},
+		{in.MerID, &pa.MerID},
+		{in.AppID, &pa.AppID},
+		{in.APIV3Secret, &pa.APIV3Secret},
+		{in.CertSerialNumber, &pa.CertSerialNumber},
+		{in.CertPublic, &pa.CertPublic},
+		{in.CertPrivate, &pa.CertPrivate},
+		{in.AlipayCertPublicKey, &pa.AlipayCertPublicKey},
+		{in.AlipayRootCert, &pa.AlipayRootCert},
+		{in.AlipayAppCertPublicKey, &pa.AlipayAppCertPublicKey},
+	} {
+		if f.from != nil {
+			*f.to = strings.TrimSpace(*f.from)
+		}
+	}
+	pa.LoadedCertPrivate = nil
+}
+
+// apiAdminPaymentAccounts 管理支付账号，需要X_GGP_ADMIN_KEY
+//
+// 保存前会检查证书和密钥，微信账号还会用账号下载一次平台证书确认可用。
+// 私钥和APIv3密钥加密保存(需要配置PAYMENT_MASTER_KEY)，接口不会返回，修改记录见/audits
+func apiAdminPaymentAccounts(g *gin.RouterGroup) {
+	g.GET("/payment_accounts", func(ctx *gin.Context) {
+		pas, err := models.FindPaymentAccounts()
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		res := make([]paymentAccountView, 0, len(pas))
+		for i := range pas {
+			res = append(res, newPaymentAccountView(&pas[i]))
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": res})
+	})
+
+	g.GET("/payment_accounts/:id", func(ctx *gin.Context) {
+		pa, err := models.FindPaLoadPrivateCert(cast.ToInt64(ctx.Param("id")), false)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": newPaymentAccountView(pa)})
+	})
+
+	g.GET("/payment_accounts/:id/audits", func(ctx *gin.Context) {
+		as := models.FindPaymentAccountAudits(cast.ToInt64(ctx.Param("id")))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": as})
+	})
+
+	// 创建支付账号
+	//
+	// body:
+	// {
+	// 	"account_type": "wechat"|"alipay",
+	// 	"name": "xx",
+	// 	"mer_id": "1609845740",
+	// 	"app_id": "", 微信服务商账号的AppID
+	// 	"api_v3_secret": "", 微信
+	// 	"cert_serial_number": "", 微信
+	// 	"cert_public": "", 微信商户证书
+	// 	"cert_private": "", 微信商户私钥或支付宝应用私钥
+	// 	"alipay_cert_public_key": "", "alipay_root_cert": "", "alipay_app_cert_public_key": "" 支付宝
+	// }
+	g.POST("/payment_accounts", func(ctx *gin.Context) {
+		var in paymentAccountInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		var pa models.PaymentAccount
+		in.apply(&pa)
+		if err := checkPaymentAccount(&pa); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := models.CreatePaymentAccount(&pa, adminActor(ctx)); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin created payment account, id: %d, type: %s, mer_id: %s, operator: %s", pa.ID, pa.AccountType, pa.MerID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": newPaymentAccountView(&pa)})
+	})
+
+	// 修改支付账号，参数同创建，没有传的字段不变，不能修改account_type
+	g.PUT("/payment_accounts/:id", func(ctx *gin.Context) {
+		var in paymentAccountInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		old, err := models.FindPaLoadPrivateCert(cast.ToInt64(ctx.Param("id")), false)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if in.AccountType != nil && *in.AccountType != old.AccountType {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "account_type can not be changed"})
+			return
+		}
+		pa := *old
+		in.apply(&pa)
+		if err := checkPaymentAccount(&pa); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := models.UpdatePaymentAccount(old, &pa, adminActor(ctx)); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		wechatCerts.Invalidate(pa.ID)
+		models.InvalidatePaymentAccount(pa.ID)
+		l().Infof("admin updated payment account, id: %d, operator: %s", pa.ID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": newPaymentAccountView(&pa)})
+	})
+
+	g.DELETE("/payment_accounts/:id", func(ctx *gin.Context) {
+		pa, err := models.FindPaLoadPrivateCert(cast.ToInt64(ctx.Param("id")), false)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := models.DeletePaymentAccount(pa, adminActor(ctx)); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		wechatCerts.Invalidate(pa.ID)
+		models.InvalidatePaymentAccount(pa.ID)
+		l().Infof("admin deleted payment account, id: %d, operator: %s", pa.ID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+}
+
+// adminActor 操作人为验证过的调用方，通过X_GGP_ADMIN_KEY获得管理权限时也会记录
+// X_GGP_OPERATOR是调用方自己填写的，任何人都可以伪造，只作为备注
+func adminActor(ctx *gin.Context) models.AuditActor {
+	a := models.AuditActor{
+		Note: ctx.GetHeader(operatorHeaderKey),
+		IP:   ctx.ClientIP(),
+	}
+	c := currentAPIClient(ctx)
+	if c == nil {
+		a.Name = "unknown"
+		return a
+	}
+	a.APIClientID = c.ID
+	a.Name = fmt.Sprintf("api_client:%d(%s)", c.ID, c.Name)
+	if !c.HasScope(models.API_SCOPE_ADMIN) {
+		a.Name += " with admin key"
+	}
+	return a
+}
+
+// adminOperator 管理接口日志中的操作人，见adminActor
+func adminOperator(ctx *gin.Context) string {
+	return adminActor(ctx).String()
+}
+
+// checkPaymentAccount 没有主密钥时不允许保存，防止私钥明文入库
+func checkPaymentAccount(pa *models.PaymentAccount) error {
+	if len(config.PaymentMasterKey) == 0 {
+		return models.ErrNoMasterKey
+	}
+	if len(pa.Name) == 0 || len(pa.MerID) == 0 {
+		return errors.New("name and mer_id are required")
+	}
+	switch pa.AccountType {
+	case models.ACCOUNT_TYPE_WECHAT:
+		if err := checkWechatPaymentAccount(pa, time.Now()); err != nil {
+			return err
+		}
+		cs, err := fetchWechatPlatformCert(pa)
+		if err != nil {
+			return fmt.Errorf("download wechat platform cert error: %w", err)
+		}
+		if len(cs) == 0 {
+			// 证书都解密失败，一般是APIv3密钥不对
+			return errors.New("download wechat platform cert error: no cert decrypted, check api_v3_secret")
+		}
+		return nil
+	case models.ACCOUNT_TYPE_ALIPAY:
+		return alipay.CheckCerts(pa.CertPrivate, pa.AlipayAppCertPublicKey, pa.AlipayRootCert, pa.AlipayCertPublicKey, time.Now())
+	default:
+		return fmt.Errorf("invalid account_type: %s", pa.AccountType)
+	}
+}
+
+// checkWechatPaymentAccount 商户证书要和私钥、序列号匹配并且没有过期，APIv3密钥为32位
+func checkWechatPaymentAccount(pa *models.PaymentAccount, now time.Time) error {
+	if len(pa.APIV3Secret) != 32 {
+		return errors.New("api_v3_secret must be 32 bytes")
+	}
+	if err := pa.LoadPrivCert(); err != nil {
+		return err
+	}
+	cert, err := utils.LoadCertificate(pa.CertPublic)
+	if err != nil {
+		return fmt.Errorf("load cert_public error: %w", err)
+	}
+	if serial := fmt.Sprintf("%X", cert.SerialNumber); !strings.EqualFold(serial, pa.CertSerialNumber) {
+		return fmt.Errorf("cert_serial_number does not match cert_public, serial of cert is %s", serial)
+	}
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || !pa.LoadedCertPrivate.PublicKey.Equal(pub) {
+		return errors.New("cert_public does not match cert_private")
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("cert_public is not valid at %s, valid from %s to %s",
+			now.Format(time.RFC3339), cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestWechatMerchantAccount 带有和私钥匹配的商户证书
+func newTestWechatMerchantAccount(t *testing.T) *models.PaymentAccount {
+	pa := newTestWechatAccount(t)
+	assert.Nil(t, pa.LoadPrivCert())
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x3775B6A45ACD5888),
+		Subject:      pkix.Name{CommonName: pa.MerID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &pa.LoadedCertPrivate.PublicKey, pa.LoadedCertPrivate)
+	assert.Nil(t, err)
+	pa.ID = 0
+	pa.Name = "test"
+	pa.CertPublic = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	pa.CertSerialNumber = fmt.Sprintf("%X", tpl.SerialNumber)
+	pa.APIV3Secret = "0123456789abcdef0123456789abcdef"
+	return pa
+}
+
+func TestCheckWechatPaymentAccount(t *testing.T) {
+	pa := newTestWechatMerchantAccount(t)
+	assert.Nil(t, checkWechatPaymentAccount(pa, time.Now()))
+	assert.NotNil(t, checkWechatPaymentAccount(pa, time.Now().Add(2*time.Hour)))
+
+	c := *pa
+	c.CertSerialNumber = "3775B6A45ACD5889"
+	assert.NotNil(t, checkWechatPaymentAccount(&c, time.Now()))
+
+	c = *pa
+	c.APIV3Secret = "short"
+	assert.NotNil(t, checkWechatPaymentAccount(&c, time.Now()))
+
+	c = *pa
+	c.CertPrivate = newTestWechatAccount(t).CertPrivate
+	assert.NotNil(t, checkWechatPaymentAccount(&c, time.Now()))
+}
+
+func TestCheckPaymentAccount(t *testing.T) {
+	defer func(k []byte, f func(*models.PaymentAccount) ([]*x509.Certificate, error)) {
+		config.PaymentMasterKey = k
+		fetchWechatPlatformCert = f
+	}(config.PaymentMasterKey, fetchWechatPlatformCert)
+
+	pa := newTestWechatMerchantAccount(t)
+	config.PaymentMasterKey = nil
+	assert.Equal(t, models.ErrNoMasterKey, checkPaymentAccount(pa))
+
+	config.PaymentMasterKey = make([]byte, 32)
+	_, cert := genTestPlatformCert(t)
+	fetchWechatPlatformCert = func(*models.PaymentAccount) ([]*x509.Certificate, error) {
+		return []*x509.Certificate{cert}, nil
+	}
+	assert.Nil(t, checkPaymentAccount(pa))
+
+	// APIv3密钥不对时平台证书解密失败
+	fetchWechatPlatformCert = func(*models.PaymentAccount) ([]*x509.Certificate, error) {
+		return nil, nil
+	}
+	assert.NotNil(t, checkPaymentAccount(pa))
+
+	pa.AccountType = "other"
+	assert.NotNil(t, checkPaymentAccount(pa))
+}
+
+// 审计日志的操作人来自验证过的调用方，X_GGP_OPERATOR只作为备注
+func TestAdminActor(t *testing.T) {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("POST", "/admin/payment_accounts", nil)
+	ctx.Request.Header.Set(operatorHeaderKey, "admin")
+
+	c := &models.APIClient{Name: "ops", Scopes: models.API_SCOPE_ADMIN}
+	c.ID = 3
+	ctx.Set(apiClientCtxKey, c)
+	a := adminActor(ctx)
+	assert.Equal(t, int64(3), a.APIClientID)
+	assert.Equal(t, "api_client:3(ops)", a.Name)
+	assert.Equal(t, "admin", a.Note)
+	assert.Equal(t, `api_client:3(ops) (note: "admin")`, adminOperator(ctx))
+
+	// 通过X_GGP_ADMIN_KEY获得管理权限
+	ctx.Set(apiClientCtxKey, legacyAPIClient)
+	a = adminActor(ctx)
+	assert.Equal(t, int64(0), a.APIClientID)
+	assert.Equal(t, "api_client:0(legacy) with admin key", a.Name)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+)
+
+// reconciliationListLimit 列表最多返回的数量
+const reconciliationListLimit = 200
+
+type reconciliationDetail struct {
+	models.Reconciliation
+	Summary map[string]int              `json:"summary"`
+	Items   []models.ReconciliationItem `json:"items"`
+}
+
+func newReconciliationDetail(r *models.Reconciliation) reconciliationDetail {
+	items := models.FindReconciliationItems(r.ID)
+	return reconciliationDetail{*r, reconciliationSummary(items), items}
+}
+
+// apiAdminReconciliations 查看和重新执行微信账单对账，需要X_GGP_ADMIN_KEY
+func apiAdminReconciliations(g *gin.RouterGroup) {
+	// GET /admin/reconciliations?bill_date=2021-06-01&payment_account_id=2 参数都是可选的
+	g.GET("/reconciliations", func(ctx *gin.Context) {
+		rs := models.FindReconciliations(ctx.Query("bill_date"), cast.ToInt64(ctx.Query("payment_account_id")), reconciliationListLimit)
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": rs})
+	})
+
+	// 对账结果和所有的差异
+	g.GET("/reconciliations/:id", func(ctx *gin.Context) {
+		r, err := models.FindReconciliation(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": newReconciliationDetail(r)})
+	})
+
+	// 重新对账，会重新下载账单并覆盖之前的结果，对账失败的错误保存在结果的error中
+	//
+	// body:
+	// {
+	// 	"bill_date": "2021-06-01",
+	// 	"payment_account_id": 2 可选，不传时对所有的微信支付账号
+	// }
+	g.POST("/reconciliations", func(ctx *gin.Context) {
+		o := struct {
+			BillDate         string `json:"bill_date"`
+			PaymentAccountID int64  `json:"payment_account_id"`
+		}{}
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		rs, err := ReconcileWechatBills(o.BillDate, o.PaymentAccountID)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin reconciled bill_date: %s, payment account: %d, operator: %s", o.BillDate, o.PaymentAccountID, adminOperator(ctx))
+		res := make([]reconciliationDetail, 0, len(rs))
+		for _, r := range rs {
+			res = append(res, newReconciliationDetail(r))
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": res})
+	})
+}
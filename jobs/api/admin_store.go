@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+)
+
+type storeDetail struct {
+	models.Store
+	PaymentAccounts []models.StorePaymentAccount `json:"payment_accounts"`
+}
+
+// storeInput 创建和修改店铺的参数，修改时没有传的字段不变
+type storeInput struct {
+	Name               *string `json:"name"`
+	UUID               *string `json:"uuid"`
+	WechatPaymentMerID *string `json:"wechat_payment_mer_id"`
+}
+
+func (in *storeInput) apply(s *models.Store) {
+	if in.Name != nil {
+		s.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.UUID != nil && s.ID == 0 {
+		s.UUID = strings.TrimSpace(*in.UUID)
+	}
+	if in.WechatPaymentMerID != nil {
+		s.WechatPaymentMerID = strings.TrimSpace(*in.WechatPaymentMerID)
+	}
+}
+
+// apiAdminStores 管理店铺和店铺可以使用的支付账号，需要X_GGP_ADMIN_KEY
+//
+// 每个渠道(wechat/alipay)可以绑定多个支付账号，其中一个为默认账号，下单时不传payment_account_id则使用默认账号
+func apiAdminStores(g *gin.RouterGroup) {
+	g.GET("/stores", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": models.FindStores()})
+	})
+
+	g.GET("/stores/:id", func(ctx *gin.Context) {
+		s, err := models.FindStore(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": storeDetail{*s, models.FindStorePaymentAccounts(s.ID)}})
+	})
+
+	// 创建店铺
+	//
+	// body:
+	// {
+	// 	"name": "xx",
+	// 	"uuid": "", 可选，不传时自动生成
+	// 	"wechat_payment_mer_id": "1900000109" 可选，使用微信服务商账号时必须，为子商户号
+	// }
+	g.POST("/stores", func(ctx *gin.Context) {
+		var in storeInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		var s models.Store
+		in.apply(&s)
+		if err := models.CreateStore(&s); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin created store, id: %d, name: %s, operator: %s", s.ID, s.Name, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": s})
+	})
+
+	// 修改店铺，参数同创建，不能修改uuid
+	g.PUT("/stores/:id", func(ctx *gin.Context) {
+		var in storeInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		s, err := models.FindStore(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		in.apply(s)
+		if err := s.Update(); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin updated store, id: %d, operator: %s", s.ID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": s})
+	})
+
+	g.DELETE("/stores/:id", func(ctx *gin.Context) {
+		s, err := models.FindStore(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := models.DeleteStore(s); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin deleted store, id: %d, operator: %s", s.ID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+
+	// 绑定支付账号，已经绑定时修改是否为默认账号，渠道的第一个账号自动成为默认
+	//
+	// body:
+	// {
+	// 	"payment_account_id": 2,
+	// 	"is_default": true
+	// }
+	g.POST("/stores/:id/payment_accounts", func(ctx *gin.Context) {
+		o := struct {
+			PaymentAccountID int64 `json:"payment_account_id"`
+			IsDefault        bool  `json:"is_default"`
+		}{}
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		s, err := models.FindStore(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		pa, err := models.FindPaLoadPrivateCert(o.PaymentAccountID, false)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		spa, err := models.BindStorePaymentAccount(s, pa, o.IsDefault)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin bound payment account %d to store %d, default: %v, operator: %s", pa.ID, s.ID, spa.IsDefault, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": storeDetail{*s, models.FindStorePaymentAccounts(s.ID)}})
+	})
+
+	g.DELETE("/stores/:id/payment_accounts/:paymentAccountID", func(ctx *gin.Context) {
+		storeID := cast.ToInt64(ctx.Param("id"))
+		paID := cast.ToInt64(ctx.Param("paymentAccountID"))
+		if err := models.UnbindStorePaymentAccount(storeID, paID); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin unbound payment account %d from store %d, operator: %s", paID, storeID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"testing"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreInputApply(t *testing.T) {
+	name, uuid, merID := " shop ", "abc", ""
+	s := models.Store{Name: "old", UUID: "old-uuid", WechatPaymentMerID: "1900000109"}
+	s.ID = 1
+	(&storeInput{Name: &name, UUID: &uuid}).apply(&s)
+	assert.Equal(t, "shop", s.Name)
+	// 已有店铺不能修改uuid
+	assert.Equal(t, "old-uuid", s.UUID)
+	assert.Equal(t, "1900000109", s.WechatPaymentMerID)
+
+	(&storeInput{WechatPaymentMerID: &merID}).apply(&s)
+	assert.Empty(t, s.WechatPaymentMerID)
+
+	var n models.Store
+	(&storeInput{Name: &name, UUID: &uuid}).apply(&n)
+	assert.Equal(t, "abc", n.UUID)
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-gin-payment/jobs/webhook"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+)
+
+const (
+	// redeliverFailedLimit 批量重新发送时一次最多处理的数量
+	redeliverFailedLimit = 1000
+	// defaultWebhookSecretRotateOverlap 轮换secret时旧secret默认继续签名的时间
+	defaultWebhookSecretRotateOverlap = 24 * time.Hour
+)
+
+// webhookTargetInput 创建和修改通知地址的参数，修改时没有传的字段不变，secret只能通过轮换修改
+type webhookTargetInput struct {
+	Name      *string `json:"name"`
+	URLPrefix *string `json:"url_prefix"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+func (in *webhookTargetInput) apply(t *models.WebhookTarget) {
+	if in.Name != nil {
+		t.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.URLPrefix != nil {
+		t.URLPrefix = strings.TrimSpace(*in.URLPrefix)
+	}
+	if in.Enabled != nil {
+		t.Enabled = *in.Enabled
+	}
+}
+
+type webhookDeliveryDetail struct {
+	models.WebhookDelivery
+	AttemptLogs []models.WebhookAttempt `json:"attempt_logs"`
+}
+
+// apiAdminWebhooks 查看和重新发送通知，管理addi_notify_url的签名secret，需要X_GGP_ADMIN_KEY
+//
+// 重新发送会创建新的通知(redelivery_of为原通知的ID)，event_id不变，接收方可以用来去重
+func apiAdminWebhooks(g *gin.RouterGroup) {
+	// 查看trans_no所有的通知和每次发送的结果
+	// GET /admin/webhooks/deliveries?trans_no=abcssscascscds
+	g.GET("/webhooks/deliveries", func(ctx *gin.Context) {
+		transNo := ctx.Query("trans_no")
+		if len(transNo) == 0 {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "trans_no is required"})
+			return
+		}
+		ds := models.FindWebhookDeliveriesByTransNo(transNo)
+		res := make([]webhookDeliveryDetail, 0, len(ds))
+		for _, d := range ds {
+			res = append(res, webhookDeliveryDetail{d, models.FindWebhookAttempts(d.ID)})
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": res})
+	})
+
+	g.GET("/webhooks/deliveries/:id", func(ctx *gin.Context) {
+		d, err := models.FindWebhookDelivery(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": webhookDeliveryDetail{*d, models.FindWebhookAttempts(d.ID)}})
+	})
+
+	// 重新发送一个通知
+	//
+	// body:
+	// {
+	// 	"target": "web"|"addi"|"url",
+	// 	"url": "https://xx.com/notify" target为url时必须
+	// }
+	g.POST("/webhooks/deliveries/:id/redeliver", func(ctx *gin.Context) {
+		o := struct {
+			Target string `json:"target"`
+			URL    string `json:"url"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		d, err := models.FindWebhookDelivery(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if len(o.Target) == 0 {
+			o.Target = d.Target
+		}
+		nd, err := webhook.Redeliver(d, o.Target, o.URL)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin redeliver webhook, id: %d, new id: %d, target: %s, url: %s", d.ID, nd.ID, nd.Target, nd.URL)
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": nd})
+	})
+
+	// 重新发送时间段内所有放弃重试(dead)的通知，发送到原来的地址
+	// 重新发送后原通知改为redelivered，不会被再次选中；has_more为true时用返回的next_cursor继续
+	//
+	// body:
+	// {
+	// 	"from": "2024-06-08T00:00:00+08:00",
+	// 	"to": "2024-06-09T00:00:00+08:00",
+	// 	"cursor": 0 可选，上次返回的next_cursor
+	// }
+	g.POST("/webhooks/redeliver_failed", func(ctx *gin.Context) {
+		o := struct {
+			From   time.Time `json:"from"`
+			To     time.Time `json:"to"`
+			Cursor int64     `json:"cursor"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if o.From.IsZero() || !o.To.After(o.From) {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "invalid time window"})
+			return
+		}
+
+		ds := models.FindDeadWebhookDeliveries(o.From, o.To, o.Cursor, redeliverFailedLimit)
+		ids := make([]int64, 0, len(ds))
+		var errs []string
+		for i := range ds {
+			nd, err := webhook.Redeliver(&ds[i], ds[i].Target, ds[i].URL)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%d: %s", ds[i].ID, err))
+				continue
+			}
+			ids = append(ids, nd.ID)
+		}
+		// 重新发送失败的仍然是dead，用id分页避免下一批又选中
+		var next int64
+		if len(ds) > 0 {
+			next = ds[len(ds)-1].ID
+		}
+		l().Infof("admin redeliver failed webhooks, from: %s, to: %s, cursor: %d, count: %d, errors: %d", o.From, o.To, o.Cursor, len(ids), len(errs))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{
+			"redelivered": ids,
+			"errors":      errs,
+			"has_more":    len(ds) == redeliverFailedLimit,
+			"next_cursor": next,
+		}})
+	})
+
+	g.GET("/webhooks/targets", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": models.FindWebhookTargets()})
+	})
+
+	// 创建addi_notify_url的签名配置，返回的secret只出现这一次，加密保存(需要配置PAYMENT_MASTER_KEY)
+	//
+	// body:
+	// {
+	// 	"name": "xx",
+	// 	"url_prefix": "https://xx.com/notify/",
+	// 	"enabled": true
+	// }
+	g.POST("/webhooks/targets", func(ctx *gin.Context) {
+		var in webhookTargetInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		var t models.WebhookTarget
+		in.apply(&t)
+		secret, err := models.CreateWebhookTarget(&t)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin created webhook target, id: %d, url_prefix: %s, operator: %s", t.ID, t.URLPrefix, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"webhook_target": t, "secret": secret}})
+	})
+
+	// 修改通知地址，参数同创建
+	g.PUT("/webhooks/targets/:id", func(ctx *gin.Context) {
+		var in webhookTargetInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		t, err := models.FindWebhookTarget(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		in.apply(t)
+		if err := t.Update(); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin updated webhook target, id: %d, url_prefix: %s, enabled: %v, operator: %s", t.ID, t.URLPrefix, t.Enabled, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": t})
+	})
+
+	g.DELETE("/webhooks/targets/:id", func(ctx *gin.Context) {
+		id := cast.ToInt64(ctx.Param("id"))
+		if err := models.DeleteWebhookTarget(id); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin deleted webhook target, id: %d, operator: %s", id, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+
+	// 轮换secret，返回新secret，旧secret在overlap内继续签名(请求中有两个v1)
+	//
+	// body:
+	// {
+	// 	"overlap": "24h" 可选，默认24h，"0s"表示旧secret立即失效
+	// }
+	g.POST("/webhooks/targets/:id/rotate_secret", func(ctx *gin.Context) {
+		in := struct {
+			Overlap string `json:"overlap"`
+		}{}
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		overlap := defaultWebhookSecretRotateOverlap
+		if len(in.Overlap) > 0 {
+			d, err := time.ParseDuration(in.Overlap)
+			if err != nil || d < 0 {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "invalid overlap: " + in.Overlap})
+				return
+			}
+			overlap = d
+		}
+		t, err := models.FindWebhookTarget(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		secret, err := models.RotateWebhookTargetSecret(t, overlap, time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin rotated webhook target secret, id: %d, overlap: %s, operator: %s", t.ID, overlap, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"webhook_target": t, "secret": secret}})
+	})
+}
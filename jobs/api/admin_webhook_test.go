@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-gin-payment/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestAdminAuth(t *testing.T) {
+	config.AdminAPISecret = "admin_secret"
+	defer func() { config.AdminAPISecret = "" }()
+	router := RunAPI()
+
+	req, _ := http.NewRequest("GET", "/admin/webhooks/deliveries", nil)
+	req.Header.Set(authHeaderKey, config.APISecret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	req.Header.Set(adminAuthHeaderKey, "admin_secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "trans_no is required", gjson.Get(w.Body.String(), "error").String())
+}
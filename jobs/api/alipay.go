@@ -0,0 +1,308 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/alipay"
+	"go-gin-payment/ext/logger"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func alilg() *logrus.Entry {
+	return logger.LF("alipay")
+}
+
+//
+// 支付宝文档: https://opendocs.alipay.com/open/270/105898
+//
+// 只支持公钥证书模式，payment_account中:
+// mer_id: 支付宝应用的AppID
+// cert_private: 应用私钥
+// alipay_app_cert_public_key: 应用公钥证书
+// alipay_root_cert: 支付宝根证书
+// alipay_cert_public_key: 支付宝公钥证书
+//
+// 金额在接口中都是以分为单位传入，调用支付宝时转换为元
+//
+
+// alipayPayMethods 不同的支付方式对应的支付宝接口和产品码
+var alipayPayMethods = map[string]struct {
+	method      string
+	productCode string
+}{
+	"page_pay":  {"alipay.trade.page.pay", "FAST_INSTANT_TRADE_PAY"},
+	"wap_pay":   {"alipay.trade.wap.pay", "QUICK_WAP_WAY"},
+	"app_pay":   {"alipay.trade.app.pay", "QUICK_MSECURITY_PAY"},
+	"precreate": {"alipay.trade.precreate", "FACE_TO_FACE_PAYMENT"},
+}
+
+func apiAlipay(r *gin.Engine) {
+	// 下单，page_pay和wap_pay返回跳转地址url，app_pay返回给APP SDK的order_string，precreate返回二维码qr_code
+	//
+	// body:
+	// {
+	//  "store_id": "1",
+	// 	"payment_account_id": "5", 可选，不传时使用店铺默认的支付宝账号
+	// 	"trans_no": "abcssscascscds",
+	// 	"desp": "hello",
+	// 	"total_price": 10,
+	// 	"return_url": "https://eggman.tv/paid", 可选
+	// 	"quit_url": "https://eggman.tv/cart", 可选
+	// 	"addi_notify_url": "https://xx.com/notify" 可选
+	// 	"time_expire": "2018-06-08T10:34:56+08:00" 可选，订单失效时间
+	// }
+	for name := range alipayPayMethods {
+		name := name
+		r.POST("/alipay/"+name, requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+			var o paymentOps
+			err := ctx.ShouldBindJSON(&o)
+			if err != nil {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+				return
+			}
+			o.From = name
+			o.Provider = models.ACCOUNT_TYPE_ALIPAY
+
+			data, err := createClientPayment(ctx, &o)
+			if err != nil {
+				ctx.JSON(http.StatusOK, paymentErrorResponse(err))
+				return
+			}
+			ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
+		})
+	}
+
+	// 支付结果异步通知，必须返回纯文本success，否则支付宝会重复通知
+	// https://opendocs.alipay.com/open/270/105902
+	r.POST("/alipay/payment_notify/:transNo", notifyMetrics(models.ACCOUNT_TYPE_ALIPAY, "payment"), paymentNotifyHandler(&alipayProvider{}))
+
+	// 查询订单状态
+	// https://opendocs.alipay.com/open/02e7gm
+	r.POST("/alipay/payment_check", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		o := struct {
+			PaymentAccountID string `json:"payment_account_id"`
+			TransNo          string `json:"trans_no"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		o.PaymentAccountID, _, err = clientPaymentCheckAccount(ctx, o.TransNo, o.PaymentAccountID, "")
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+
+		pa, err := findAlipayAccount(o.PaymentAccountID)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		res := getAlipayPaymentStateByTransNo(pa, o.TransNo)
+		if res.Err != "" {
+			ctx.JSON(http.StatusOK, common.M{
+				"status": "error",
+				"error": fmt.Sprintf("check trans_no state error, payment account id: %s, trans_no: %s, err: %s",
+					o.PaymentAccountID, o.TransNo, res.Err),
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"payment_state": res}})
+	})
+
+	// 关闭未支付的订单
+	// https://opendocs.alipay.com/open/02o6e7
+	r.POST("/alipay/payment_close", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		o := struct {
+			PaymentAccountID string `json:"payment_account_id"`
+			TransNo          string `json:"trans_no"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+
+		rec, err := findClientPaymentRecord(ctx, o.TransNo)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := closePayment(rec); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+}
+
+func findAlipayAccount(id string) (*models.PaymentAccount, error) {
+	pa, err := models.FindPaLoadPrivateCert(id, false)
+	if err != nil {
+		return nil, fmt.Errorf("err to find payment account with id: %s, err: %s", id, err)
+	}
+	if !pa.IsAlipayAccount() {
+		return nil, fmt.Errorf("payment account is not alipay, id: %s", id)
+	}
+	return pa, nil
+}
+
+func setUpAlipayClient(pa *models.PaymentAccount) (*alipay.Client, error) {
+	return alipay.NewClient(pa.MerID, pa.CertPrivate, pa.AlipayAppCertPublicKey, pa.AlipayRootCert, pa.AlipayCertPublicKey)
+}
+
+func createAlipayPaymentOrder(o *paymentOps, name string) (common.M, error) {
+	client, err := setUpAlipayClient(o.paymentAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	m := alipayPayMethods[name]
+	biz := map[string]interface{}{
+		"out_trade_no": o.TransNo,
+		"total_amount": fenToYuanStr(o.TotalPrice),
+		"subject":      o.Desp,
+		"product_code": m.productCode,
+	}
+	if len(o.TimeExpire) > 0 {
+		biz["time_expire"] = o.expireAt.In(models.ChinaTz).Format("2006-01-02 15:04:05")
+	}
+	if name == "wap_pay" && len(o.QuitURL) > 0 {
+		biz["quit_url"] = o.QuitURL
+	}
+	extra := map[string]string{
+		"notify_url": config.SelfAPIURL + "/alipay/payment_notify/" + o.TransNo,
+		"return_url": o.ReturnURL,
+	}
+
+	switch name {
+	case "page_pay", "wap_pay":
+		u, err := client.PageURL(m.method, biz, extra)
+		if err != nil {
+			return nil, err
+		}
+		return common.M{"url": u}, nil
+	case "app_pay":
+		s, err := client.OrderString(m.method, biz, extra)
+		if err != nil {
+			return nil, err
+		}
+		return common.M{"order_string": s}, nil
+	default:
+		node, err := client.Do(m.method, biz, extra)
+		if err != nil {
+			alilg().Warnf("precreate err: %s", err)
+			return nil, err
+		}
+		return common.M{"qr_code": node.Get("qr_code").String()}, nil
+	}
+}
+
+func getAlipayPaymentStateByTransNo(pa *models.PaymentAccount, transNo string) *paymentState {
+	res := paymentState{
+		TransNo:       transNo,
+		PaymentMethod: "alipay",
+	}
+	client, err := setUpAlipayClient(pa)
+	if err != nil {
+		res.Err = "setup alipay client error:" + err.Error()
+		return &res
+	}
+	node, err := client.Do("alipay.trade.query", map[string]interface{}{"out_trade_no": transNo}, nil)
+	if node.Exists() {
+		res.Raw = node.Value()
+	}
+	if err != nil {
+		res.Err = err.Error()
+		// 用户没有扫码时支付宝还没有创建交易
+		res.notExist = isAlipayTradeNotExist(err)
+		return &res
+	}
+	alilg().Printf("alipay, trans_no state check rsp: %s", node.Raw)
+
+	res.State = node.Get("trade_status").String()
+	res.PayNo = node.Get("trade_no").String()
+	res.IsSuccess = isAlipayTradeSuccess(res.State)
+	res.status, _ = models.AlipayTradeStatusToStatus(res.State)
+	res.rawRsp = node.Raw
+	return &res
+}
+
+// isAlipayTradeNotExist 验签通过的返回中sub_code为ACQ.TRADE_NOT_EXIST，支付宝没有这个交易
+func isAlipayTradeNotExist(err error) bool {
+	var aerr *alipay.Error
+	return errors.As(err, &aerr) && aerr.SubCode == "ACQ.TRADE_NOT_EXIST"
+}
+
+// alipayRejectedReason 支付宝明确拒绝的请求(4xxxx)，同样的参数重试也不会成功，返回支付宝的错误码和描述
+func alipayRejectedReason(err error) (string, bool) {
+	var aerr *alipay.Error
+	if !errors.As(err, &aerr) || !aerr.Rejected() {
+		return "", false
+	}
+	return aerr.SubCode + ": " + aerr.SubMsg, true
+}
+
+// closeAlipayPayment 关闭订单，用户未扫码时支付宝还没有创建交易，会返回ACQ.TRADE_NOT_EXIST，也视为关闭成功
+func closeAlipayPayment(pa *models.PaymentAccount, transNo string) error {
+	client, err := setUpAlipayClient(pa)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do("alipay.trade.close", map[string]interface{}{"out_trade_no": transNo}, nil)
+	if err != nil && !isAlipayTradeNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkAlipayPaymentNotify 校验通知和我们保存的订单是否一致
+func checkAlipayPaymentNotify(rec *models.PaymentRecord, pa *models.PaymentAccount, form url.Values) error {
+	var errs []string
+	check := func(field, got, expected string) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("%s: got %q, expected %q", field, got, expected))
+		}
+	}
+	check("out_trade_no", form.Get("out_trade_no"), rec.TransNo)
+	check("total_amount", form.Get("total_amount"), fenToYuanStr(rec.TotalFen()))
+	check("app_id", form.Get("app_id"), pa.MerID)
+
+	if len(errs) > 0 {
+		return errors.New("alipay payment notify mismatch, " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func alipayNotifyFail(ctx *gin.Context, code int, msg string) {
+	alilg().Warnf("alipay notify rejected, path: %s, code: %d, msg: %s", ctx.Request.URL.Path, code, msg)
+	ctx.String(code, "fail")
+	ctx.Abort()
+}
+
+func isAlipayTradeSuccess(state string) bool {
+	return state == "TRADE_SUCCESS" || state == "TRADE_FINISHED"
+}
+
+func fenToYuanStr(v int64) string {
+	return fmt.Sprintf("%.2f", models.FenToYuan(v))
+}
+
+func flattenForm(v url.Values) map[string]string {
+	m := make(map[string]string, len(v))
+	for k := range v {
+		m[k] = v.Get(k)
+	}
+	return m
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	registerPaymentProvider(models.ACCOUNT_TYPE_ALIPAY, &alipayProvider{})
+}
+
+type alipayProvider struct{}
+
+func (p *alipayProvider) Routes(r *gin.Engine) {
+	apiAlipay(r)
+}
+
+func (p *alipayProvider) PublicPaths() []string {
+	return []string{"/alipay/payment_notify"}
+}
+
+func (p *alipayProvider) CreatePayment(o *paymentOps) (common.M, error) {
+	if _, ok := alipayPayMethods[o.From]; !ok {
+		return nil, fmt.Errorf("unsupported alipay from: %s", o.From)
+	}
+	return createAlipayPaymentOrder(o, o.From)
+}
+
+func (p *alipayProvider) QueryPayment(rec *models.PaymentRecord, pa *models.PaymentAccount) *paymentState {
+	return getAlipayPaymentStateByTransNo(pa, rec.TransNo)
+}
+
+func (p *alipayProvider) ClosePayment(rec *models.PaymentRecord, pa *models.PaymentAccount) error {
+	return closeAlipayPayment(pa, rec.TransNo)
+}
+
+// Refund 支付宝退款是同步返回结果的，fund_change为Y表示退款成功
+// 为N时(比如重复请求)用退款查询确认，查询不到成功时为processing，由退款查询(QueryRefund)继续确认
+// https://opendocs.alipay.com/open/02e7go
+func (p *alipayProvider) Refund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error) {
+	client, err := setUpAlipayClient(pa)
+	if err != nil {
+		return nil, err
+	}
+	node, err := client.Do("alipay.trade.refund", map[string]interface{}{
+		"out_trade_no":   rec.TransNo,
+		"refund_amount":  fenToYuanStr(models.YuanToFen(rr.RefundMoney)),
+		"out_request_no": rr.RefundNo,
+		"refund_reason":  rr.Reason,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if node.Get("fund_change").String() == "Y" {
+		return &refundResult{
+			RefundPayNo: node.Get("trade_no").String(),
+			Status:      models.REFUND_STATUS_SUCCESS,
+			Raw:         node.Raw,
+		}, nil
+	}
+	res, err := p.QueryRefund(rec, rr, pa)
+	if err != nil {
+		alilg().Warnf("query alipay refund error, refund_no: %s, err: %s", rr.RefundNo, err)
+		return &refundResult{
+			RefundPayNo: node.Get("trade_no").String(),
+			Status:      models.REFUND_STATUS_PROCESSING,
+			Raw:         node.Raw,
+		}, nil
+	}
+	return res, nil
+}
+
+// QueryRefund refund_status为REFUND_SUCCESS表示退款成功，其他都视为还在处理
+// https://opendocs.alipay.com/open/02e7gm
+func (p *alipayProvider) QueryRefund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error) {
+	client, err := setUpAlipayClient(pa)
+	if err != nil {
+		return nil, err
+	}
+	node, err := client.Do("alipay.trade.fastpay.refund.query", map[string]interface{}{
+		"out_trade_no":   rec.TransNo,
+		"out_request_no": rr.RefundNo,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &refundResult{
+		RefundPayNo: node.Get("trade_no").String(),
+		Status:      alipayRefundStatus(node.Get("refund_status").String()),
+		Raw:         node.Raw,
+	}, nil
+}
+
+func alipayRefundStatus(refundStatus string) string {
+	if refundStatus == "REFUND_SUCCESS" {
+		return models.REFUND_STATUS_SUCCESS
+	}
+	return models.REFUND_STATUS_PROCESSING
+}
+
+func (p *alipayProvider) ParseNotify(ctx *gin.Context, rec *models.PaymentRecord, pa *models.PaymentAccount) (*paymentState, error) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		return nil, newNotifyError(http.StatusBadRequest, err)
+	}
+	form := ctx.Request.PostForm
+
+	client, err := setUpAlipayClient(pa)
+	if err != nil {
+		return nil, fmt.Errorf("setup alipay client error: %w", err)
+	}
+	if err := client.VerifyNotify(form); err != nil {
+		return nil, newNotifyError(http.StatusUnauthorized, fmt.Errorf("alipay notify signature invalid: %w", err))
+	}
+	if err := checkAlipayPaymentNotify(rec, pa, form); err != nil {
+		alilg().WithField("alert", true).Errorf("trans_no: %s, %s, data: %s", rec.TransNo, err, form.Encode())
+		return nil, newNotifyError(http.StatusBadRequest, err)
+	}
+
+	state := form.Get("trade_status")
+	status, ok := models.AlipayTradeStatusToStatus(state)
+	if !ok {
+		return nil, fmt.Errorf("unsupported alipay trade_status: %s", state)
+	}
+	return &paymentState{
+		State:         state,
+		IsSuccess:     isAlipayTradeSuccess(state),
+		TransNo:       rec.TransNo,
+		PaymentMethod: "alipay",
+		PayNo:         form.Get("trade_no"),
+		Raw:           flattenForm(form),
+		status:        status,
+		rawRsp:        form.Encode(),
+	}, nil
+}
+
+// NotifyResponse 必须返回纯文本success，否则支付宝会重复通知
+func (p *alipayProvider) NotifyResponse(ctx *gin.Context, err error) {
+	if err != nil {
+		alipayNotifyFail(ctx, notifyErrorCode(err), err.Error())
+		return
+	}
+	ctx.String(http.StatusOK, "success")
+}
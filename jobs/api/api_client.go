@@ -0,0 +1,283 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+)
+
+//
+// 调用方和key，每个调用方有自己的key、权限(scope)和可以操作的店铺
+//
+// 1. 管理接口创建调用方，返回的key只出现一次，调用方放在X_GGP_KEY中
+// 2. 轮换时生成新key，旧key在overlap时间内仍然可以使用，调用方在这段时间内换成新key
+// 3. 绑定了店铺的调用方只能下单和操作这些店铺的支付记录，handler中用findClientPaymentRecord等方法检查
+//
+
+// defaultAPIKeyRotateOverlap 轮换key时旧key默认的有效时间
+const defaultAPIKeyRotateOverlap = 24 * time.Hour
+
+type apiClientDetail struct {
+	models.APIClient
+	Keys []models.APIKey `json:"keys"`
+}
+
+// apiClientInput 创建和修改调用方的参数，修改时没有传的字段不变
+// store_ids不能为空，不限制店铺时需要明确传all_stores: true
+type apiClientInput struct {
+	Name      *string   `json:"name"`
+	Scopes    *[]string `json:"scopes"`
+	StoreIDs  *[]int64  `json:"store_ids"`
+	AllStores *bool     `json:"all_stores"`
+	Disabled  *bool     `json:"disabled"`
+}
+
+func (in *apiClientInput) apply(c *models.APIClient) error {
+	if in.StoreIDs != nil && len(*in.StoreIDs) == 0 {
+		return fmt.Errorf("store_ids can not be empty, use all_stores: true to allow all stores")
+	}
+	if in.AllStores != nil {
+		if *in.AllStores && in.StoreIDs != nil {
+			return fmt.Errorf("can not set both store_ids and all_stores")
+		}
+		if !*in.AllStores && in.StoreIDs == nil {
+			return fmt.Errorf("store_ids is required when all_stores is false")
+		}
+	}
+	if in.Name != nil {
+		c.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Scopes != nil {
+		c.Scopes = strings.Join(*in.Scopes, ",")
+	}
+	if in.StoreIDs != nil {
+		c.StoreIDs = *in.StoreIDs
+		c.AllStores = false
+	}
+	if in.AllStores != nil && *in.AllStores {
+		c.StoreIDs = []int64{}
+		c.AllStores = true
+	}
+	if in.Disabled != nil {
+		c.Disabled = *in.Disabled
+	}
+	return nil
+}
+
+// currentAPIClient 验证通过的调用方，不需要验证的路由返回nil
+func currentAPIClient(ctx *gin.Context) *models.APIClient {
+	if v, ok := ctx.Get(apiClientCtxKey); ok {
+		if c, ok := v.(*models.APIClient); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// checkClientStore 调用方是否可以操作店铺
+func checkClientStore(ctx *gin.Context, storeID int64) error {
+	c := currentAPIClient(ctx)
+	if c == nil || c.CanAccessStore(storeID) {
+		return nil
+	}
+	return fmt.Errorf("api client %d can not access store %d", c.ID, storeID)
+}
+
+func isClientStoreRestricted(ctx *gin.Context) bool {
+	c := currentAPIClient(ctx)
+	return c != nil && c.IsStoreRestricted()
+}
+
+// findClientPaymentRecord 查找支付记录，并检查调用方是否可以操作记录的店铺
+func findClientPaymentRecord(ctx *gin.Context, transNo string) (*models.PaymentRecord, error) {
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClientStore(ctx, rec.StoreID); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// checkClientTransNo 用于直接使用trans_no查询第三方的接口，没有限制店铺的调用方不要求有支付记录
+func checkClientTransNo(ctx *gin.Context, transNo string) error {
+	if !isClientStoreRestricted(ctx) {
+		return nil
+	}
+	_, err := findClientPaymentRecord(ctx, transNo)
+	return err
+}
+
+// clientPaymentCheckAccount 查询第三方订单时使用的支付账号和店铺，有支付记录时使用记录中的，
+// 请求中的payment_account_id、store_id和记录不一致时拒绝，避免用别的商户号查询；
+// 没有支付记录时只有不限制店铺的调用方可以使用请求中的值
+func clientPaymentCheckAccount(ctx *gin.Context, transNo, paymentAccountID, storeID string) (string, string, error) {
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		if isClientStoreRestricted(ctx) {
+			return "", "", err
+		}
+		return paymentAccountID, storeID, nil
+	}
+	if err := checkClientStore(ctx, rec.StoreID); err != nil {
+		return "", "", err
+	}
+	paID, sID := strconv.FormatInt(rec.PaymentAccountID, 10), strconv.FormatInt(rec.StoreID, 10)
+	if (len(paymentAccountID) > 0 && paymentAccountID != paID) || (len(storeID) > 0 && storeID != sID) {
+		return "", "", fmt.Errorf("payment_account_id or store_id does not match the payment record, trans_no: %s", transNo)
+	}
+	return paID, sID, nil
+}
+
+func checkClientPaymentRecordID(ctx *gin.Context, id int64) error {
+	if !isClientStoreRestricted(ctx) {
+		return nil
+	}
+	rec, err := models.FindPaymentRecordByID(id)
+	if err != nil {
+		return err
+	}
+	return checkClientStore(ctx, rec.StoreID)
+}
+
+// createClientPayment 检查调用方可以在店铺下单
+func createClientPayment(ctx *gin.Context, o *paymentOps) (common.M, error) {
+	if err := checkClientStore(ctx, cast.ToInt64(o.StoreID)); err != nil {
+		return nil, err
+	}
+	return createPayment(o)
+}
+
+// createClientRefund 检查调用方可以操作支付记录的店铺
+func createClientRefund(ctx *gin.Context, o *refundOps) (common.M, error) {
+	if err := checkClientTransNo(ctx, o.TransNo); err != nil {
+		return nil, err
+	}
+	return createRefund(o)
+}
+
+// apiAdminAPIClients 管理调用方和key，需要admin权限或者X_GGP_ADMIN_KEY
+func apiAdminAPIClients(g *gin.RouterGroup) {
+	g.GET("/api_clients", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": models.FindAPIClients()})
+	})
+
+	g.GET("/api_clients/:id", func(ctx *gin.Context) {
+		c, err := models.FindAPIClient(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": apiClientDetail{*c, models.FindAPIKeys(c.ID)}})
+	})
+
+	// 创建调用方，返回的key只出现这一次
+	//
+	// body:
+	// {
+	// 	"name": "web",
+	// 	"scopes": ["payment", "refund", "read"], 可选值payment|refund|read|admin
+	// 	"store_ids": [1, 2], 可以操作的店铺，不能为空
+	// 	"all_stores": true 不限制店铺时传这个，和store_ids必须传一个
+	// }
+	g.POST("/api_clients", func(ctx *gin.Context) {
+		var in apiClientInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		var c models.APIClient
+		if err := in.apply(&c); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		key, err := models.CreateAPIClient(&c)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin created api client, id: %d, name: %s, scopes: %s, operator: %s", c.ID, c.Name, c.Scopes, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"api_client": c, "key": key}})
+	})
+
+	// 修改调用方，参数同创建，另外可以传"disabled": true停用
+	g.PUT("/api_clients/:id", func(ctx *gin.Context) {
+		var in apiClientInput
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		c, err := models.FindAPIClient(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := in.apply(c); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := c.Update(); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin updated api client, id: %d, scopes: %s, store_ids: %v, all_stores: %v, disabled: %v, operator: %s", c.ID, c.Scopes, c.StoreIDs, c.AllStores, c.Disabled, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": c})
+	})
+
+	// 轮换key，返回新key，现有的key在overlap后失效
+	//
+	// body:
+	// {
+	// 	"overlap": "24h" 可选，默认24h，"0s"表示旧key立即失效
+	// }
+	g.POST("/api_clients/:id/keys", func(ctx *gin.Context) {
+		in := struct {
+			Overlap string `json:"overlap"`
+		}{}
+		if err := ctx.ShouldBindJSON(&in); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		overlap := defaultAPIKeyRotateOverlap
+		if len(in.Overlap) > 0 {
+			d, err := time.ParseDuration(in.Overlap)
+			if err != nil || d < 0 {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "invalid overlap: " + in.Overlap})
+				return
+			}
+			overlap = d
+		}
+		c, err := models.FindAPIClient(cast.ToInt64(ctx.Param("id")))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		key, k, err := models.RotateAPIKey(c, overlap, time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin rotated api key, api client: %d, key_id: %s, overlap: %s, operator: %s", c.ID, k.KeyID, overlap, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"api_key": k, "key": key}})
+	})
+
+	// 立即停用一个key
+	g.DELETE("/api_clients/:id/keys/:keyID", func(ctx *gin.Context) {
+		id, keyID := cast.ToInt64(ctx.Param("id")), cast.ToInt64(ctx.Param("keyID"))
+		if err := models.RevokeAPIKey(id, keyID, time.Now()); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		l().Infof("admin revoked api key, api client: %d, key: %d, operator: %s", id, keyID, adminOperator(ctx))
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+}
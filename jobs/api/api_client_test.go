@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestRequireScope(t *testing.T) {
+	router := RunAPI()
+
+	// 共享的API_SECRET没有admin权限
+	req, _ := http.NewRequest("POST", "/wechat/profit_sharing/receivers", strings.NewReader("{}"))
+	req.Header.Set(authHeaderKey, config.APISecret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "api client has no scope: admin", gjson.Get(w.Body.String(), "error").String())
+
+	_, err := authenticateAPIClient("bad")
+	assert.EqualError(t, err, "api secret is invalid")
+}
+
+func TestCheckClientStore(t *testing.T) {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	// 不需要验证的路由没有调用方
+	assert.Nil(t, checkClientStore(ctx, 1))
+	assert.Nil(t, checkClientTransNo(ctx, "abc"))
+
+	ctx.Set(apiClientCtxKey, legacyAPIClient)
+	assert.Nil(t, checkClientStore(ctx, 1))
+	assert.False(t, isClientStoreRestricted(ctx))
+
+	c := &models.APIClient{Scopes: models.API_SCOPE_PAYMENT, StoreIDs: []int64{2}}
+	c.ID = 5
+	ctx.Set(apiClientCtxKey, c)
+	assert.Nil(t, checkClientStore(ctx, 2))
+	assert.EqualError(t, checkClientStore(ctx, 1), "api client 5 can not access store 1")
+
+	_, err := createClientPayment(ctx, &paymentOps{StoreID: "1"})
+	assert.EqualError(t, err, "api client 5 can not access store 1")
+}
+
+func TestAPIClientInputApply(t *testing.T) {
+	apply := func(c *models.APIClient, body string) error {
+		var in apiClientInput
+		assert.Nil(t, json.Unmarshal([]byte(body), &in))
+		return in.apply(c)
+	}
+
+	c := &models.APIClient{StoreIDs: []int64{1, 2}}
+	assert.EqualError(t, apply(c, `{"store_ids": []}`), "store_ids can not be empty, use all_stores: true to allow all stores")
+	assert.Equal(t, []int64{1, 2}, c.StoreIDs)
+	assert.NotNil(t, apply(c, `{"store_ids": [3], "all_stores": true}`))
+	assert.NotNil(t, apply(c, `{"all_stores": false}`))
+
+	assert.Nil(t, apply(c, `{"name": "web"}`))
+	assert.Equal(t, []int64{1, 2}, c.StoreIDs)
+	assert.True(t, c.IsStoreRestricted())
+
+	assert.Nil(t, apply(c, `{"all_stores": true}`))
+	assert.True(t, c.AllStores)
+	assert.False(t, c.IsStoreRestricted())
+
+	assert.Nil(t, apply(c, `{"store_ids": [3]}`))
+	assert.False(t, c.AllStores)
+	assert.Equal(t, []int64{3}, c.StoreIDs)
+}
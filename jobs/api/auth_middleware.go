@@ -1,23 +1,45 @@
 package api
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/reqsig"
+	"go-gin-payment/models"
 
 	"bitbucket.org/343_3rd/gmodels/common"
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	authHeaderKey    = "X_GGP_KEY"
-	authHeaderSecret = "xxx"
+	authHeaderKey = "X_GGP_KEY"
+
+	adminAuthHeaderKey = "X_GGP_ADMIN_KEY"
+
+	// apiClientCtxKey 验证通过的调用方(*models.APIClient)在gin.Context中的key
+	apiClientCtxKey = "api_client"
 )
 
+// legacyAPIClient 使用共享的API_SECRET的调用方，可以操作所有店铺，没有admin权限
+// 所有调用方都换成各自的key后去掉API_SECRET即可停用
+var legacyAPIClient = &models.APIClient{
+	Name:      "legacy",
+	Scopes:    strings.Join([]string{models.API_SCOPE_PAYMENT, models.API_SCOPE_READ, models.API_SCOPE_REFUND}, ","),
+	AllStores: true,
+}
+
 // authHeaderMiddlewareWithoutPaths 可以传递哪些路由不需要验证，默认都需要
+//
+// X_GGP_KEY为调用方的key(见api_client.go)，或者共享的API_SECRET；
+// 也可以不发送key，改为用key签名请求，见request_signature.go
 func authHeaderMiddlewareWithoutPaths(withoutPaths ...string) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		pa := ctx.FullPath()
-		fmt.Println("11111, pa:", pa)
 		for _, pattern := range withoutPaths {
 			if len(pattern) == 0 {
 				continue
@@ -28,11 +50,67 @@ func authHeaderMiddlewareWithoutPaths(withoutPaths ...string) gin.HandlerFunc {
 			}
 		}
 
-		secret := ctx.GetHeader(authHeaderKey)
-		if secret != authHeaderSecret {
+		var client *models.APIClient
+		var err error
+		if reqsig.IsSigned(ctx.Request) {
+			client, err = authenticateSignedRequest(ctx.Request)
+		} else {
+			client, err = authenticateAPIClient(ctx.GetHeader(authHeaderKey))
+		}
+		if err != nil {
+			code := http.StatusUnauthorized
+			if errors.Is(err, reqsig.ErrBodyTooLarge) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			ctx.AbortWithStatusJSON(code, common.M{
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		ctx.Set(apiClientCtxKey, client)
+		ctx.Next()
+	}
+}
+
+func authenticateAPIClient(secret string) (*models.APIClient, error) {
+	if models.IsAPIKey(secret) {
+		return models.AuthenticateAPIKey(secret, time.Now())
+	}
+	if len(config.APISecret) > 0 &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(config.APISecret)) == 1 {
+		return legacyAPIClient, nil
+	}
+	return nil, fmt.Errorf("api secret is invalid")
+}
+
+// requireScope 调用方需要有scope权限，在路由上使用
+func requireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c := currentAPIClient(ctx); c == nil || !c.HasScope(scope) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, common.M{
+				"status": "error",
+				"error":  "api client has no scope: " + scope,
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// adminAuthMiddleware 管理接口需要调用方有admin权限，或者X_GGP_KEY之外再带X_GGP_ADMIN_KEY
+func adminAuthMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c := currentAPIClient(ctx); c != nil && c.HasScope(models.API_SCOPE_ADMIN) {
+			ctx.Next()
+			return
+		}
+		secret := ctx.GetHeader(adminAuthHeaderKey)
+		if len(config.AdminAPISecret) == 0 ||
+			subtle.ConstantTimeCompare([]byte(secret), []byte(config.AdminAPISecret)) != 1 {
 			ctx.AbortWithStatusJSON(401, common.M{
 				"status": "error",
-				"error":  "api secret is invalid",
+				"error":  "admin api secret is invalid",
 			})
 			return
 		}
@@ -5,8 +5,8 @@ import (
 	"net/http"
 	"time"
 
-	"go-gin-payment/ext"
 	"go-gin-payment/ext/logger"
+	"go-gin-payment/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -25,6 +25,11 @@ type paymentState struct {
 	PaymentMethod string      `json:"payment_method"`
 	PayNo         string      `json:"pay_no,omitempty"` // 第三方订单号
 	Raw           interface{} `json:"raw"`
+
+	status models.PaymentStatus // 对应我们的状态，处理通知和查询时设置，无法对应时为空
+	rawRsp string               // 保存到PaymentResponse的原始内容
+	// notExist 查询时第三方明确返回没有这个订单(比如用户没有扫码)，和网络等错误区分
+	notExist bool
 }
 
 func l() *logrus.Entry {
@@ -51,37 +56,33 @@ func RunAPI() *gin.Engine {
 		)
 	}))
 	r.Use(gin.Recovery())
+	r.Use(httpMetricsMiddleware())
 
-	r.Use(authHeaderMiddlewareWithoutPaths(
-		"/eggman/wechat/payment_notify",
-		"/swagger/*any",
-	))
+	// 浏览器订阅支付状态使用token验证
+	// /metrics使用config.MetricsSecret验证
+	publicPaths := []string{"/swagger/*any", "/payment_events/:transNo", metricsPath}
+	eachPaymentProvider(func(_ string, p PaymentProvider) {
+		publicPaths = append(publicPaths, p.PublicPaths()...)
+	})
+	r.Use(authHeaderMiddlewareWithoutPaths(publicPaths...))
+	r.Use(rateLimitMiddleware())
 
-	apiWechat(r)
+	apiPayments(r)
+	apiPaymentEvents(r)
+	admin := r.Group("/admin", adminAuthMiddleware())
+	apiAdminWebhooks(admin)
+	apiAdminPaymentAccounts(admin)
+	apiAdminStores(admin)
+	apiAdminReconciliations(admin)
+	apiAdminAPIClients(admin)
+	eachPaymentProvider(func(_ string, p PaymentProvider) {
+		p.Routes(r)
+	})
 
 	r.GET("/ping", func(ctx *gin.Context) {
 		ctx.String(http.StatusOK, "pong, i am running!")
 	})
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	r.GET(metricsPath, metricsHandler())
 	return r
 }
-
-// notifyToWeb 一直通知保证成功
-func notifyToWeb(uri string, b []byte) {
-	wait := time.After(30 * time.Second)
-	for {
-		select {
-		case <-wait:
-			l().Error("notify to web timeout:", string(b))
-			return
-		default:
-			rsp, err := ext.SendToWeb(uri, b)
-			// !!! web端必须返回`ok`表示处理成功，否则这里会一直尝试直到超时
-			if err != nil || string(rsp) != "ok" {
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return
-		}
-	}
-}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// Prometheus指标，GET /metrics，需要header `Authorization: Bearer <config.MetricsSecret>`，
+// 只有development和test环境可以不设置secret(见config.Config.Validate)
+//
+// 这里是HTTP请求、微信API调用和支付通知的指标，支付记录的指标在models/metrics.go，
+// 通知发送在jobs/webhook，数据库和redis连接池在conn/metrics.go
+//
+
+const (
+	metricsPath = "/metrics"
+
+	// notifyResultCtxKey 通知处理的结果，没有设置时按返回的状态码，见notifyMetrics
+	notifyResultCtxKey = "notify_result"
+
+	NOTIFY_RESULT_OK        = "ok"
+	NOTIFY_RESULT_DUPLICATE = "duplicate" // 已经处理过的重复通知
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("ggp_http_requests_total",
+		"HTTP requests by route and status code.", "method", "route", "status")
+	httpDuration = metrics.NewHistogramVec("ggp_http_request_duration_seconds",
+		"Latency of HTTP requests by route.", nil, "method", "route")
+
+	wechatAPIRequests = metrics.NewCounterVec("ggp_wechat_api_requests_total",
+		"WeChat Pay API calls by endpoint, merchant account and status code.", "endpoint", "account", "status")
+	wechatAPIDuration = metrics.NewHistogramVec("ggp_wechat_api_request_duration_seconds",
+		"Latency of WeChat Pay API calls.", nil, "endpoint", "account")
+	wechatAPIErrors = metrics.NewCounterVec("ggp_wechat_api_errors_total",
+		"WeChat Pay API calls failed with a network error or a non 2xx status code.", "endpoint", "account")
+
+	notifyResults = metrics.NewCounterVec("ggp_payment_notify_total",
+		"Payment provider notifications handled, by provider, type and result.", "provider", "type", "result")
+)
+
+// httpMetricsMiddleware route为注册的路由，比如/payments/:transNo，没有匹配的路由为unmatched，避免label过多
+func httpMetricsMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		httpRequests.Inc(method, route, strconv.Itoa(ctx.Writer.Status()))
+		httpDuration.ObserveSince(start, method, route)
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	h := metrics.Handler()
+	return func(ctx *gin.Context) {
+		if len(config.MetricsSecret) > 0 {
+			token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(config.MetricsSecret)) != 1 {
+				ctx.String(http.StatusUnauthorized, "metrics secret is invalid")
+				return
+			}
+		}
+		h.ServeHTTP(ctx.Writer, ctx.Request)
+	}
+}
+
+// notifyMetrics 加在第三方通知的路由上，按处理结果计数
+// 2xx为ok(handler可以用setNotifyResult改为duplicate)，其他按状态码，比如404为not_found、401为unauthorized(签名错误)
+func notifyMetrics(provider, typ string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Next()
+		notifyResults.Inc(provider, typ, notifyResult(ctx))
+	}
+}
+
+func setNotifyResult(ctx *gin.Context, result string) {
+	ctx.Set(notifyResultCtxKey, result)
+}
+
+func notifyResult(ctx *gin.Context) string {
+	code := ctx.Writer.Status()
+	if code >= 200 && code <= 299 {
+		if r := ctx.GetString(notifyResultCtxKey); len(r) > 0 {
+			return r
+		}
+		return NOTIFY_RESULT_OK
+	}
+	switch code {
+	case http.StatusBadRequest:
+		return "invalid"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusNotFound:
+		return "not_found"
+	}
+	return "error"
+}
+
+// wechatMetricsTransport 记录每次调用微信API的结果，endpoint为去掉订单号等参数后的路径
+type wechatMetricsTransport struct {
+	account string // 商户号
+	base    http.RoundTripper
+}
+
+func (t *wechatMetricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	endpoint := wechatAPIEndpoint(r.URL.Path)
+	start := time.Now()
+	rsp, err := base.RoundTrip(r)
+	wechatAPIDuration.ObserveSince(start, endpoint, t.account)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(rsp.StatusCode)
+	}
+	wechatAPIRequests.Inc(endpoint, t.account, status)
+	if err != nil || rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		wechatAPIErrors.Inc(endpoint, t.account)
+	}
+	return rsp, err
+}
+
+// wechatHTTPClient 传给core.NewClient，超时时间由option.WithTimeout设置
+func wechatHTTPClient(merID string) *http.Client {
+	return &http.Client{Transport: &wechatMetricsTransport{account: merID}}
+}
+
+// wechatIDSegments 后面一段为订单号、退款号等参数的路径
+var wechatIDSegments = map[string]bool{
+	"out-trade-no":  true,
+	"id":            true,
+	"refunds":       true,
+	"orders":        true,
+	"return-orders": true,
+	"transactions":  true,
+}
+
+// wechatIDSegmentExcept 这些是接口名，不是参数
+var wechatIDSegmentExcept = map[string]bool{
+	"out-trade-no": true,
+	"id":           true,
+	"unfreeze":     true,
+	"jsapi":        true,
+	"app":          true,
+	"native":       true,
+	"h5":           true,
+}
+
+// wechatAPIEndpoint 比如/v3/pay/transactions/out-trade-no/abc/close为/v3/pay/transactions/out-trade-no/:id/close
+func wechatAPIEndpoint(path string) string {
+	// 测试和模拟器的地址可能有前缀
+	if i := strings.Index(path, "/v3/"); i > 0 {
+		path = path[i:]
+	}
+	ps := strings.Split(path, "/")
+	for i := 1; i < len(ps); i++ {
+		if wechatIDSegments[ps[i-1]] && len(ps[i]) > 0 && !wechatIDSegmentExcept[ps[i]] {
+			ps[i] = ":id"
+		}
+	}
+	return strings.Join(ps, "/")
+}
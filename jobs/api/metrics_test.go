@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWechatAPIEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"/v3/pay/transactions/jsapi":                           "/v3/pay/transactions/jsapi",
+		"/v3/pay/transactions/out-trade-no/T123":               "/v3/pay/transactions/out-trade-no/:id",
+		"/v3/pay/partner/transactions/out-trade-no/T123/close": "/v3/pay/partner/transactions/out-trade-no/:id/close",
+		"/v3/pay/transactions/id/4200000":                      "/v3/pay/transactions/id/:id",
+		"/v3/combine-transactions/out-trade-no/C123":           "/v3/combine-transactions/out-trade-no/:id",
+		"/v3/refund/domestic/refunds/R123":                     "/v3/refund/domestic/refunds/:id",
+		"/v3/profitsharing/orders/unfreeze":                    "/v3/profitsharing/orders/unfreeze",
+		"/v3/profitsharing/orders/P123":                        "/v3/profitsharing/orders/:id",
+		"/v3/profitsharing/transactions/4200000/amounts":       "/v3/profitsharing/transactions/:id/amounts",
+		"/sim/v3/certificates":                                 "/v3/certificates",
+	}
+	for path, expected := range cases {
+		assert.Equal(t, expected, wechatAPIEndpoint(path), path)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	router := RunAPI()
+	before := httpRequests.Value("GET", "/ping", "200")
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set(authHeaderKey, config.APISecret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, before+1, httpRequests.Value("GET", "/ping", "200"))
+
+	old := config.MetricsSecret
+	defer func() { config.MetricsSecret = old }()
+	config.MetricsSecret = "metrics-secret"
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer metrics-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `ggp_http_requests_total{method="GET",route="/ping",status="200"}`)
+	assert.Contains(t, body, `ggp_http_request_duration_seconds_count{method="GET",route="/ping"}`)
+	// 没有连接数据库时不输出连接池和通知队列，抓取也不会去连接
+	if !conn.Connected() {
+		assert.NotContains(t, body, "ggp_db_open_connections")
+		assert.NotContains(t, body, "ggp_webhook_queue_depth")
+	}
+}
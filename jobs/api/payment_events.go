@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+//
+// 支付状态推送，浏览器按trans_no订阅(SSE或者WebSocket)，处理完通知后立即推送
+//
+// 1. web端用X_GGP_KEY调用POST /payments/:transNo/events/token拿到短期token，交给浏览器
+// 2. 浏览器用token连接GET /payment_events/:transNo(SSE)或者/payment_events/:transNo/ws(WebSocket)
+// 3. notifyPaymentState通过redis pub/sub发布事件，每个实例转发给自己的订阅者
+//
+// 连接后先推送一次当前状态，订单不再是待支付后推送完成关闭连接
+//
+
+const (
+	paymentEventChannel = "payment_events:"
+
+	// paymentEventTokenTTL token只用于建立连接，连接的时长由paymentEventMaxDuration限制
+	paymentEventTokenTTL    = 10 * time.Minute
+	paymentEventMaxDuration = 30 * time.Minute
+	paymentEventHeartbeat   = 25 * time.Second
+	// paymentEventBuffer 订阅者处理不过来时丢弃事件
+	paymentEventBuffer = 8
+)
+
+var errPaymentEventToken = errors.New("payment event token is invalid or expired")
+
+// paymentEvent 推送给浏览器的事件，只有状态，不包含第三方返回的原始内容和付款人信息
+type paymentEvent struct {
+	Event    string               `json:"event"`
+	TransNo  string               `json:"trans_no"`
+	RefundNo string               `json:"refund_no,omitempty"`
+	Status   models.PaymentStatus `json:"status,omitempty"`
+	State    string               `json:"state,omitempty"` // 第三方的状态，比如SUCCESS、CLOSED
+}
+
+// isFinal 订单不再是待支付，推送后可以关闭连接
+func (e *paymentEvent) isFinal() bool {
+	return e.Event == "payment.state" && len(e.Status) > 0 && e.Status != models.PAYMENT_STATUS_PENDING
+}
+
+type paymentEventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *paymentEvent]struct{}
+}
+
+var eventHub = &paymentEventHub{subs: make(map[string]map[chan *paymentEvent]struct{})}
+
+// subscribe 返回的函数用于取消订阅
+func (h *paymentEventHub) subscribe(transNo string) (chan *paymentEvent, func()) {
+	ch := make(chan *paymentEvent, paymentEventBuffer)
+	h.mu.Lock()
+	if h.subs[transNo] == nil {
+		h.subs[transNo] = make(map[chan *paymentEvent]struct{})
+	}
+	h.subs[transNo][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[transNo], ch)
+		if len(h.subs[transNo]) == 0 {
+			delete(h.subs, transNo)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *paymentEventHub) dispatch(e *paymentEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[e.TransNo] {
+		select {
+		case ch <- e:
+		default:
+			l().Warnf("payment event subscriber is full, drop event: %s, trans_no: %s", e.Event, e.TransNo)
+		}
+	}
+}
+
+// StartPaymentEventHub 订阅redis中所有实例发布的支付事件，没有连接redis时只在本实例内推送
+func StartPaymentEventHub() func() {
+	if conn.Redis == nil {
+		return func() {}
+	}
+	ps := conn.Redis.PSubscribe(context.TODO(), paymentEventChannel+"*")
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				l().Errorf("payment event hub panic: %s\n%s", err, debug.Stack())
+			}
+		}()
+		for msg := range ps.Channel() {
+			var e paymentEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				l().Warnf("invalid payment event on %s: %s", msg.Channel, err)
+				continue
+			}
+			eventHub.dispatch(&e)
+		}
+	}()
+	return func() {
+		ps.Close()
+	}
+}
+
+// publishPaymentEvent 发布失败时只推送给本实例的订阅者
+func publishPaymentEvent(event string, data *paymentState) {
+	if len(data.TransNo) == 0 {
+		return
+	}
+	e := &paymentEvent{Event: event, TransNo: data.TransNo, RefundNo: data.RefundNo, Status: data.status, State: data.State}
+	if conn.Redis == nil {
+		eventHub.dispatch(e)
+		return
+	}
+	d, _ := json.Marshal(e)
+	if err := conn.Redis.Publish(context.TODO(), paymentEventChannel+e.TransNo, d).Err(); err != nil {
+		l().Warnf("publish payment event, trans_no: %s error: %s", e.TransNo, err)
+		eventHub.dispatch(e)
+	}
+}
+
+// signPaymentEventToken token格式: <过期时间戳>.<hex(hmac-sha256(transNo.过期时间戳))>
+func signPaymentEventToken(transNo string, expireAt time.Time) string {
+	exp := strconv.FormatInt(expireAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(config.PaymentEventSecret))
+	mac.Write([]byte(transNo + "." + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyPaymentEventToken(transNo, token string, now time.Time) error {
+	i := strings.IndexByte(token, '.')
+	if i <= 0 {
+		return errPaymentEventToken
+	}
+	exp, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || now.Unix() > exp {
+		return errPaymentEventToken
+	}
+	expected := signPaymentEventToken(transNo, time.Unix(exp, 0))
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return errPaymentEventToken
+	}
+	return nil
+}
+
+// paymentEventSnapshot 连接后推送的当前状态
+func paymentEventSnapshot(rec *models.PaymentRecord) *paymentEvent {
+	status := rec.Status
+	if rec.IsPending() {
+		status = models.PAYMENT_STATUS_PENDING
+	}
+	return &paymentEvent{Event: "payment.snapshot", TransNo: rec.TransNo, Status: status}
+}
+
+// subscribePaymentEvents 验证token，先订阅再查询当前状态，避免漏掉中间的事件
+func subscribePaymentEvents(ctx *gin.Context) (*paymentEvent, chan *paymentEvent, func(), bool) {
+	transNo := ctx.Param("transNo")
+	if err := verifyPaymentEventToken(transNo, ctx.Query("token"), time.Now()); err != nil {
+		ctx.JSON(http.StatusUnauthorized, common.M{"status": "error", "error": err.Error()})
+		return nil, nil, nil, false
+	}
+	ch, unsubscribe := eventHub.subscribe(transNo)
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		unsubscribe()
+		ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+		return nil, nil, nil, false
+	}
+	return paymentEventSnapshot(rec), ch, unsubscribe, true
+}
+
+func apiPaymentEvents(r *gin.Engine) {
+	// 生成浏览器订阅支付状态的token，需要X_GGP_KEY
+	r.POST("/payments/:transNo/events/token", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		rec, err := findClientPaymentRecord(ctx, ctx.Param("transNo"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		expireAt := time.Now().Add(paymentEventTokenTTL)
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{
+			"token":      signPaymentEventToken(rec.TransNo, expireAt),
+			"expires_at": expireAt.Unix(),
+		}})
+	})
+
+	// SSE，事件名为payment.snapshot/payment.state/refund.state
+	r.GET("/payment_events/:transNo", func(ctx *gin.Context) {
+		snapshot, ch, unsubscribe, ok := subscribePaymentEvents(ctx)
+		if !ok {
+			return
+		}
+		defer unsubscribe()
+
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("Connection", "keep-alive")
+		// 关闭nginx的缓冲
+		ctx.Header("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+
+		send := func(e *paymentEvent) {
+			ctx.SSEvent(e.Event, e)
+			ctx.Writer.Flush()
+		}
+		send(snapshot)
+		if snapshot.Status != models.PAYMENT_STATUS_PENDING {
+			return
+		}
+
+		heartbeat := time.NewTicker(paymentEventHeartbeat)
+		defer heartbeat.Stop()
+		timeout := time.NewTimer(paymentEventMaxDuration)
+		defer timeout.Stop()
+		for {
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-timeout.C:
+				return
+			case <-heartbeat.C:
+				_, _ = ctx.Writer.WriteString(": ping\n\n")
+				ctx.Writer.Flush()
+			case e := <-ch:
+				send(e)
+				if e.isFinal() {
+					return
+				}
+			}
+		}
+	})
+
+	// WebSocket，每条消息为一个paymentEvent的json
+	r.GET("/payment_events/:transNo/ws", func(ctx *gin.Context) {
+		snapshot, ch, unsubscribe, ok := subscribePaymentEvents(ctx)
+		if !ok {
+			return
+		}
+		defer unsubscribe()
+
+		websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// 浏览器不会发送消息，读取只用于发现连接断开
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var msg string
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+			}()
+
+			if websocket.JSON.Send(ws, snapshot) != nil || snapshot.Status != models.PAYMENT_STATUS_PENDING {
+				return
+			}
+			heartbeat := time.NewTicker(paymentEventHeartbeat)
+			defer heartbeat.Stop()
+			timeout := time.NewTimer(paymentEventMaxDuration)
+			defer timeout.Stop()
+			for {
+				select {
+				case <-closed:
+					return
+				case <-timeout.C:
+					return
+				case <-heartbeat.C:
+					if websocket.JSON.Send(ws, &paymentEvent{Event: "ping", TransNo: snapshot.TransNo}) != nil {
+						return
+					}
+				case e := <-ch:
+					if websocket.JSON.Send(ws, e) != nil || e.isFinal() {
+						return
+					}
+				}
+			}
+		}).ServeHTTP(ctx.Writer, ctx.Request)
+	})
+}
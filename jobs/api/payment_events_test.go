@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentEventToken(t *testing.T) {
+	now := time.Now()
+	token := signPaymentEventToken("t1", now.Add(paymentEventTokenTTL))
+	assert.Nil(t, verifyPaymentEventToken("t1", token, now))
+
+	assert.NotNil(t, verifyPaymentEventToken("t2", token, now))
+	assert.NotNil(t, verifyPaymentEventToken("t1", token, now.Add(paymentEventTokenTTL+time.Second)))
+	assert.NotNil(t, verifyPaymentEventToken("t1", "", now))
+	// 修改过期时间后签名不一致
+	forged := signPaymentEventToken("t1", now.Add(time.Hour))[:11] + token[11:]
+	assert.NotNil(t, verifyPaymentEventToken("t1", forged, now))
+}
+
+func TestPaymentEventHubDispatch(t *testing.T) {
+	ch1, unsubscribe1 := eventHub.subscribe("t1")
+	ch2, unsubscribe2 := eventHub.subscribe("t2")
+	defer unsubscribe2()
+
+	publishPaymentEvent("payment.state", &paymentState{TransNo: "t1", State: "SUCCESS", status: models.PAYMENT_STATUS_SUCCESS,
+		Raw: map[string]interface{}{"payer": map[string]interface{}{"openid": "o1"}}})
+	select {
+	case e := <-ch1:
+		assert.Equal(t, "payment.state", e.Event)
+		assert.True(t, e.isFinal())
+		// 不推送第三方的原始内容
+		d, _ := json.Marshal(e)
+		assert.JSONEq(t, `{"event":"payment.state","trans_no":"t1","status":"success","state":"SUCCESS"}`, string(d))
+	default:
+		t.Fatal("event not dispatched")
+	}
+	assert.Len(t, ch2, 0)
+
+	unsubscribe1()
+	publishPaymentEvent("payment.state", &paymentState{TransNo: "t1"})
+	assert.Len(t, ch1, 0)
+	assert.NotContains(t, eventHub.subs, "t1")
+
+	e := &paymentEvent{Event: "refund.state", Status: models.PAYMENT_STATUS_REFUNDED}
+	assert.False(t, e.isFinal())
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/go-redis/redis/v8"
+)
+
+//
+// 下单幂等，web端超时重试时不会用同一个trans_no重复调用第三方
+//
+// 1. 下单期间在redis中锁住trans_no，同时到达的请求返回errPaymentCreating，稍后可以重试
+// 2. 下单成功后按fingerprint缓存返回的支付参数(prepay_id/code_url等)，有效期内参数相同的请求直接返回缓存
+// 3. 参数不同或者订单已经不是pending时返回models.ErrTransNoConflict
+//
+// 没有连接redis时(开发环境)不加锁也不缓存，仍然由CreatePendingPaymentRecord检查参数
+//
+
+const (
+	paymentCreateLockKey = "payment_create_lock:"
+	// paymentCreateLockTTL 需要比调用第三方的超时时间长
+	paymentCreateLockTTL = 30 * time.Second
+	paymentParamsKey     = "payment_params:"
+
+	// wechatPrepayValidity prepay_id和code_url的有效期
+	wechatPrepayValidity = 2 * time.Hour
+	// wechatH5URLValidity h5_url的有效期
+	wechatH5URLValidity = 5 * time.Minute
+)
+
+// errPaymentCreating 同一个trans_no正在下单，和ErrTransNoConflict不同，稍后用相同的参数重试会返回同样的支付参数
+var errPaymentCreating = errors.New("payment is being created, retry later")
+
+// unlockScript 只删除自己加的锁
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+type cachedPaymentParams struct {
+	Fingerprint string   `json:"fingerprint"`
+	Data        common.M `json:"data"`
+}
+
+// fingerprint 影响第三方下单参数的字段，paymentAccount需要已经确定
+func (o *paymentOps) fingerprint() string {
+	d, _ := json.Marshal([]interface{}{
+		o.paymentAccount.ID, o.StoreID, o.TotalPrice, o.From, o.AppID, o.OpenID, o.Desp,
+		o.TimeExpire, o.ReturnURL, o.QuitURL, o.ProfitSharing,
+	})
+	sum := sha256.Sum256(d)
+	return hex.EncodeToString(sum[:])
+}
+
+// paramsValidity 返回的支付参数的有效期，不超过订单的失效时间
+func (o *paymentOps) paramsValidity(now time.Time) time.Duration {
+	ttl := wechatPrepayValidity
+	if o.From == "h5" {
+		ttl = wechatH5URLValidity
+	}
+	if left := o.expireAt.Sub(now); left < ttl {
+		ttl = left
+	}
+	return ttl
+}
+
+// lockPaymentCreate 返回的函数用于解锁
+func lockPaymentCreate(transNo string) (func(), error) {
+	if conn.Redis == nil {
+		return func() {}, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	key := paymentCreateLockKey + transNo
+	ok, err := conn.Redis.SetNX(context.TODO(), key, token, paymentCreateLockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("lock trans_no error: %s", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w, trans_no: %s", errPaymentCreating, transNo)
+	}
+	return func() {
+		if err := unlockScript.Run(context.TODO(), conn.Redis, []string{key}, token).Err(); err != nil && !errors.Is(err, redis.Nil) {
+			l().Warnf("unlock trans_no: %s error: %s", transNo, err)
+		}
+	}, nil
+}
+
+// loadPaymentParams 没有缓存时返回nil，fingerprint不同时返回冲突
+func loadPaymentParams(transNo, fingerprint string) (common.M, error) {
+	if conn.Redis == nil {
+		return nil, nil
+	}
+	s, err := conn.Redis.Get(context.TODO(), paymentParamsKey+transNo).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			l().Warnf("load payment params, trans_no: %s error: %s", transNo, err)
+		}
+		return nil, nil
+	}
+	var c cachedPaymentParams
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		return nil, nil
+	}
+	if c.Fingerprint != fingerprint {
+		return nil, fmt.Errorf("%w: trans_no already used with different params, trans_no: %s", models.ErrTransNoConflict, transNo)
+	}
+	return c.Data, nil
+}
+
+func savePaymentParams(transNo, fingerprint string, data common.M, ttl time.Duration) {
+	if conn.Redis == nil || ttl <= 0 {
+		return
+	}
+	d, _ := json.Marshal(cachedPaymentParams{Fingerprint: fingerprint, Data: data})
+	if err := conn.Redis.Set(context.TODO(), paymentParamsKey+transNo, d, ttl).Err(); err != nil {
+		l().Warnf("save payment params, trans_no: %s error: %s", transNo, err)
+	}
+}
+
+// deletePaymentParams 订单关闭后缓存的支付参数不再可用
+func deletePaymentParams(transNo string) {
+	if conn.Redis == nil {
+		return
+	}
+	conn.Redis.Del(context.TODO(), paymentParamsKey+transNo)
+}
+
+// paymentErrorResponse trans_no冲突时返回code: trans_no_conflict，调用方不应该再用同一个trans_no重试
+// 正在下单时返回code: payment_creating，调用方可以稍后重试
+func paymentErrorResponse(err error) common.M {
+	res := common.M{"status": "error", "error": err.Error()}
+	switch {
+	case errors.Is(err, errPaymentCreating):
+		res["code"] = "payment_creating"
+	case errors.Is(err, models.ErrTransNoConflict):
+		res["code"] = "trans_no_conflict"
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentOpsFingerprint(t *testing.T) {
+	pa := &models.PaymentAccount{}
+	pa.ID = 2
+	newOps := func() *paymentOps {
+		return &paymentOps{StoreID: "1", TransNo: "t1", From: "mp", OpenID: "o1", TotalPrice: 10, paymentAccount: pa}
+	}
+	o := newOps()
+	assert.Equal(t, o.fingerprint(), newOps().fingerprint())
+
+	// 重试时不需要一致的字段
+	o.AddiNotifyURL = "https://xx.com/notify"
+	o.PayerClientIP = "14.23.150.211"
+	assert.Equal(t, o.fingerprint(), newOps().fingerprint())
+
+	o = newOps()
+	o.TotalPrice = 11
+	assert.NotEqual(t, o.fingerprint(), newOps().fingerprint())
+
+	o = newOps()
+	o.paymentAccount = &models.PaymentAccount{}
+	o.paymentAccount.ID = 3
+	assert.NotEqual(t, o.fingerprint(), newOps().fingerprint())
+}
+
+func TestPaymentOpsParamsValidity(t *testing.T) {
+	now := time.Now()
+	o := &paymentOps{From: "mp", expireAt: now.Add(3 * time.Hour)}
+	assert.Equal(t, wechatPrepayValidity, o.paramsValidity(now))
+
+	o.From = "h5"
+	assert.Equal(t, wechatH5URLValidity, o.paramsValidity(now))
+
+	o = &paymentOps{From: "native", expireAt: now.Add(10 * time.Minute)}
+	assert.Equal(t, 10*time.Minute, o.paramsValidity(now))
+}
+
+func TestPaymentErrorResponse(t *testing.T) {
+	res := paymentErrorResponse(fmt.Errorf("%w: trans_no already used, trans_no: t1", models.ErrTransNoConflict))
+	assert.Equal(t, "error", res["status"])
+	assert.Equal(t, "trans_no_conflict", res["code"])
+
+	res = paymentErrorResponse(errPaymentCreating)
+	assert.Equal(t, "payment_creating", res["code"])
+
+	res = paymentErrorResponse(errors.New("prepay_id is empty"))
+	assert.NotContains(t, res, "code")
+}
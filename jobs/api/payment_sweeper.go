@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// defaultPaymentExpire 下单时没有指定time_expire的订单的有效期
+	defaultPaymentExpire = 2 * time.Hour
+
+	paymentSweepInterval = time.Minute
+	paymentSweepBatch    = 100
+	paymentSweepLockKey  = "payment_sweeper_lock"
+	// paymentSweepLockTTL 执行期间每paymentSweepLockTTL/3续期一次，实例退出后锁最多保留这么久
+	paymentSweepLockTTL = 2 * time.Minute
+
+	// refundQueryDelay 退款申请后等待这段时间再查询
+	refundQueryDelay = time.Minute
+	// refundSweepAlertAttempts 查询这么多次(约3天)仍然没有结果的退款每次推迟时告警，需要人工处理
+	refundSweepAlertAttempts = 20
+)
+
+// StartPaymentSweeper 定时处理过期仍为pending的订单，返回的函数用于停止
+//
+// 先向第三方查询最终状态，已支付或已关闭的只是没有收到通知，直接更新记录；
+// 确认未支付的调用第三方关单后改为closed，最后都会通知web端；
+// 查询失败、用户支付中等没有处理完成的按models.PaymentSweepRetryWait推迟再处理
+//
+// 同时查询实现了refundQuerier的渠道中超过refundQueryDelay还在processing的退款
+func StartPaymentSweeper() func() {
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(paymentSweepInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				sweepExpiredPayments(now)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+func sweepExpiredPayments(now time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			l().Errorf("payment sweeper panic: %s\n%s", err, debug.Stack())
+		}
+	}()
+
+	unlock, ok := lockPaymentSweep()
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	rs := models.FindExpiredPendingPaymentRecords(now, paymentSweepBatch)
+	for i := range rs {
+		if sweepExpiredPayment(&rs[i]) {
+			continue
+		}
+		if err := rs[i].DelaySweep(time.Now()); err != nil {
+			l().Warnf("payment sweeper, delay sweep error, trans_no: %s, err: %s", rs[i].TransNo, err)
+		}
+	}
+
+	eachPaymentProvider(func(accountType string, p PaymentProvider) {
+		q, ok := p.(refundQuerier)
+		if !ok {
+			return
+		}
+		rrs := models.FindProcessingRefundRecords(accountType, now.Add(-refundQueryDelay), now, paymentSweepBatch)
+		for i := range rrs {
+			if sweepProcessingRefund(q, &rrs[i]) {
+				continue
+			}
+			delayRefundSweep(&rrs[i])
+		}
+	})
+}
+
+// renewLockScript 只续期自己加的锁
+var renewLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// lockPaymentSweep 多个实例同时运行时，同一时间只有一个实例执行
+// 一轮最多会调用几百次第三方接口，执行期间定时续期，返回的函数用于停止续期并解锁
+func lockPaymentSweep() (func(), bool) {
+	if conn.Redis == nil {
+		return func() {}, true
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false
+	}
+	token := hex.EncodeToString(b)
+	ok, err := conn.Redis.SetNX(context.TODO(), paymentSweepLockKey, token, paymentSweepLockTTL).Result()
+	if err != nil || !ok {
+		return nil, false
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(paymentSweepLockTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				err := renewLockScript.Run(context.TODO(), conn.Redis, []string{paymentSweepLockKey}, token, paymentSweepLockTTL.Milliseconds()).Err()
+				if err != nil && !errors.Is(err, redis.Nil) {
+					l().Warnf("payment sweeper, renew lock error: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		if err := unlockScript.Run(context.TODO(), conn.Redis, []string{paymentSweepLockKey}, token).Err(); err != nil && !errors.Is(err, redis.Nil) {
+			l().Warnf("payment sweeper, unlock error: %s", err)
+		}
+	}, true
+}
+
+// delayRefundSweep 查询失败或者仍在处理的退款按models.PaymentSweepRetryWait推迟再查询
+func delayRefundSweep(rr *models.RefundRecord) {
+	if err := rr.DelaySweep(time.Now()); err != nil {
+		l().Warnf("payment sweeper, delay refund sweep error, refund_no: %s, err: %s", rr.RefundNo, err)
+		return
+	}
+	if rr.SweepAttempts >= refundSweepAlertAttempts {
+		l().WithField("alert", true).Errorf("payment sweeper, refund still processing after %d queries, refund_no: %s, check it manually",
+			rr.SweepAttempts, rr.RefundNo)
+	}
+}
+
+// sweepProcessingRefund 查询到最终状态后更新记录并通知，返回false表示没有处理完成，需要推迟再查询
+func sweepProcessingRefund(q refundQuerier, rr *models.RefundRecord) bool {
+	rec, err := models.FindPaymentRecordByID(rr.PaymentRecordID)
+	if err != nil {
+		l().Warnf("payment sweeper, refund_no: %s, err: %s", rr.RefundNo, err)
+		return false
+	}
+	pa, err := models.FindPaymentAccount(rr.PaymentAccountID)
+	if err != nil {
+		l().Warnf("payment sweeper, load pa error, refund_no: %s, err: %s", rr.RefundNo, err)
+		return false
+	}
+	res, err := q.QueryRefund(rec, rr, pa)
+	if err != nil {
+		l().Warnf("payment sweeper, query refund error, refund_no: %s, err: %s", rr.RefundNo, err)
+		return false
+	}
+	status := strings.ToLower(res.Status)
+	if status == models.REFUND_STATUS_PROCESSING {
+		return false
+	}
+	st := &paymentState{
+		State:         res.Status,
+		IsSuccess:     status == models.REFUND_STATUS_SUCCESS,
+		TransNo:       rr.TransNo,
+		RefundNo:      rr.RefundNo,
+		PaymentMethod: pa.AccountType,
+		PayNo:         res.RefundPayNo,
+		Raw:           gjson.Parse(res.Raw).Value(),
+	}
+	changed, err := rr.UpdateRefundResult(res.RefundPayNo, status, res.Raw, paymentStateDeliveries(st, rr.AddiNotifyURL)...)
+	if err != nil {
+		l().Warnf("payment sweeper, update refund record error, refund_no: %s, err: %s", rr.RefundNo, err)
+		return false
+	}
+	// 已经被退款通知确认
+	if !changed {
+		return true
+	}
+	syncRefundStatus(rec)
+	l().Infof("payment sweeper, refund confirmed, refund_no: %s, status: %s", rr.RefundNo, status)
+	paymentStateNotified(st)
+	return true
+}
+
+// sweepExpiredPayment 返回false表示没有处理完成，需要推迟再处理
+func sweepExpiredPayment(rec *models.PaymentRecord) bool {
+	pa, err := models.FindPaymentAccount(rec.PaymentAccountID)
+	if err != nil {
+		l().Warnf("payment sweeper, load pa error, trans_no: %s, err: %s", rec.TransNo, err)
+		return false
+	}
+	p, err := paymentProviderFor(pa)
+	if err != nil {
+		l().Warnf("payment sweeper, trans_no: %s, err: %s", rec.TransNo, err)
+		return false
+	}
+	source := pa.AccountType + "_sweep"
+
+	st := p.QueryPayment(rec, pa)
+	if st.Err == "" && (st.status == models.PAYMENT_STATUS_SUCCESS || st.status == models.PAYMENT_STATUS_CLOSED) {
+		ds := paymentStateDeliveries(st, rec.AddiNotifyURL)
+		if err := rec.UpdatePayResult(st.status, source, st.State, st.PayNo, st.rawRsp, ds...); err != nil {
+			l().Warnf("payment sweeper, update payment record error, trans_no: %s, err: %s", rec.TransNo, err)
+			return false
+		}
+		paymentStateNotified(st)
+		return true
+	}
+
+	// 只有第三方明确未支付或者没有这个订单时才关单，网络错误等推迟后再查询
+	// 关单失败的(比如用户刚好支付了)推迟后再处理
+	if !shouldCloseExpiredPayment(st) {
+		l().Warnf("payment sweeper, skip trans_no: %s, state: %s, err: %s", rec.TransNo, st.State, st.Err)
+		return false
+	}
+	if err := p.ClosePayment(rec, pa); err != nil {
+		l().Warnf("payment sweeper, close payment error, trans_no: %s, err: %s", rec.TransNo, err)
+		return false
+	}
+	detail := st.State
+	if st.Err != "" {
+		detail = st.Err
+	}
+	closed := &paymentState{
+		State:         "CLOSED",
+		StateDesc:     "订单已过期关闭",
+		TransNo:       rec.TransNo,
+		PaymentMethod: st.PaymentMethod,
+		Raw:           st.Raw,
+	}
+	ds := paymentStateDeliveries(closed, rec.AddiNotifyURL)
+	if err := rec.TransitTo(models.PAYMENT_STATUS_CLOSED, source, detail, nil, ds...); err != nil {
+		l().Warnf("payment sweeper, close payment record error, trans_no: %s, err: %s", rec.TransNo, err)
+		return false
+	}
+	l().Infof("payment sweeper, expired payment closed, trans_no: %s", rec.TransNo)
+	paymentStateNotified(closed)
+	return true
+}
+
+// shouldCloseExpiredPayment 第三方返回未支付、支付失败或者订单不存在
+// 微信的USERPAYING(用户正在输入密码等)也是pending，这时不能关单，推迟后再查询
+func shouldCloseExpiredPayment(st *paymentState) bool {
+	if st.Err != "" {
+		return st.notExist
+	}
+	if st.State == "USERPAYING" {
+		return false
+	}
+	return st.status == models.PAYMENT_STATUS_PENDING || st.status == models.PAYMENT_STATUS_FAILED
+}
@@ -0,0 +1,538 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go-gin-payment/jobs/webhook"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+)
+
+//
+// 支付渠道抽象，按PaymentAccount.AccountType选择对应的PaymentProvider
+//
+// 新的渠道只需要在自己的文件中实现PaymentProvider，并在init中调用registerPaymentProvider，
+// 渠道自己的路由(比如支付通知)通过Routes注册，不需要修改RunAPI
+//
+// 统一的接口:
+// POST /payments                   下单，body中的from决定支付方式
+// GET  /payments/:transNo          查询
+// POST /payments/:transNo/close    关闭未支付的订单
+// POST /payments/:transNo/refunds  退款
+//
+
+// PaymentProvider 支付渠道需要实现的接口
+type PaymentProvider interface {
+	// Routes 注册渠道自己的路由，比如支付通知和兼容旧版本的接口
+	Routes(r *gin.Engine)
+	// PublicPaths 不需要验证X_GGP_KEY的路由前缀，一般是第三方的通知
+	PublicPaths() []string
+
+	// CreatePayment 调用第三方下单，返回给调用方的支付参数
+	CreatePayment(o *paymentOps) (common.M, error)
+	// QueryPayment 查询第三方的订单状态
+	QueryPayment(rec *models.PaymentRecord, pa *models.PaymentAccount) *paymentState
+	// ClosePayment 关闭第三方的订单，本地记录由调用方修改
+	ClosePayment(rec *models.PaymentRecord, pa *models.PaymentAccount) error
+	// Refund 申请退款，rr已经保存
+	Refund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error)
+	// ParseNotify 验签、解析并校验支付通知，返回的paymentState需要包含status
+	ParseNotify(ctx *gin.Context, rec *models.PaymentRecord, pa *models.PaymentAccount) (*paymentState, error)
+	// NotifyResponse 按第三方要求的格式响应通知，err为nil表示处理成功
+	NotifyResponse(ctx *gin.Context, err error)
+}
+
+// refundQuerier 支付清理任务查询一段时间后仍然processing的退款，确认没有通知(支付宝)或者申请时超时的退款
+// 返回的Status为第三方的最终状态时更新退款记录，第三方没有受理的退款返回abnormal释放占用的金额
+type refundQuerier interface {
+	QueryRefund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error)
+}
+
+var paymentProviders = map[string]PaymentProvider{}
+
+func registerPaymentProvider(accountType string, p PaymentProvider) {
+	if _, ok := paymentProviders[accountType]; ok {
+		panic("payment provider already registered: " + accountType)
+	}
+	paymentProviders[accountType] = p
+}
+
+// eachPaymentProvider 按名称顺序遍历，保证路由注册的顺序稳定
+func eachPaymentProvider(fn func(accountType string, p PaymentProvider)) {
+	names := make([]string, 0, len(paymentProviders))
+	for k := range paymentProviders {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fn(k, paymentProviders[k])
+	}
+}
+
+func paymentProviderFor(pa *models.PaymentAccount) (PaymentProvider, error) {
+	p, ok := paymentProviders[pa.AccountType]
+	if !ok {
+		return nil, fmt.Errorf("payment provider not supported, account type: %s", pa.AccountType)
+	}
+	return p, nil
+}
+
+// paymentOps 下单参数，不同渠道只使用其中的一部分
+type paymentOps struct {
+	StoreID          string `json:"store_id"`
+	PaymentAccountID string `json:"payment_account_id"` // 不传时使用店铺在Provider渠道的默认支付账号
+	Provider         string `json:"provider"`           // wechat|alipay，/payments不传payment_account_id时必须
+	TransNo          string `json:"trans_no"`
+	AppID            string `json:"app_id"`  // 微信
+	OpenID           string `json:"open_id"` // 微信JSAPI
+	Desp             string `json:"desp"`
+	TotalPrice       int64  `json:"total_price"`     // 金额单位为分
+	From             string `json:"from"`            // 微信: mp|app|native|h5，支付宝: page_pay|wap_pay|app_pay|precreate
+	ReturnURL        string `json:"return_url"`      // 支付宝电脑网站和手机网站支付、微信H5支付完成后跳转的地址
+	PayerClientIP    string `json:"payer_client_ip"` // 微信H5支付用户的IP，不传时使用请求的IP
+	QuitURL          string `json:"quit_url"`        // 支付宝手机网站支付中途退出返回的地址
+	AddiNotifyURL    string `json:"addi_notify_url"`
+	TimeExpire       string `json:"time_expire"`    // 订单失效时间，rfc3339格式，比如2018-06-08T10:34:56+08:00，不传则为defaultPaymentExpire后
+	ProfitSharing    bool   `json:"profit_sharing"` // 微信服务商分账，支付成功后资金冻结，需要分账或者解冻
+
+	paymentAccount *models.PaymentAccount `json:"-"`
+	expireAt       time.Time              `json:"-"`
+}
+
+// parseExpireAt 解析time_expire，必须晚于当前时间
+func (o *paymentOps) parseExpireAt(now time.Time) error {
+	t, err := parseTimeExpire(o.TimeExpire, now)
+	if err != nil {
+		return err
+	}
+	o.expireAt = t
+	return nil
+}
+
+// parseTimeExpire 为空时返回defaultPaymentExpire后
+func parseTimeExpire(timeExpire string, now time.Time) (time.Time, error) {
+	if len(timeExpire) == 0 {
+		return now.Add(defaultPaymentExpire), nil
+	}
+	t, err := time.Parse(time.RFC3339, timeExpire)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time_expire: %s, should be rfc3339 format", timeExpire)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("time_expire should be later than now: %s", timeExpire)
+	}
+	return t, nil
+}
+
+type refundOps struct {
+	TransNo       string `json:"trans_no"`
+	RefundNo      string `json:"refund_no"`
+	RefundPrice   int64  `json:"refund_price"` // 退款金额，单位为分，为0表示退剩余全部金额
+	Reason        string `json:"reason"`
+	AddiNotifyURL string `json:"addi_notify_url"`
+}
+
+// validateAddiNotifyURL addi_notify_url可选，传了必须是完整的https地址，并且有匹配的WebhookTarget，通知使用它的secret签名
+func validateAddiNotifyURL(u string) error {
+	if len(u) == 0 {
+		return nil
+	}
+	if err := webhook.ValidateNotifyURL(u); err != nil {
+		return err
+	}
+	if _, err := models.FindWebhookTargetForURL(u); err != nil {
+		if errors.Is(err, models.ErrNoWebhookTarget) {
+			return fmt.Errorf("addi_notify_url does not match any webhook target: %s", u)
+		}
+		return fmt.Errorf("load webhook target error: %s", err)
+	}
+	return nil
+}
+
+// refundResult 第三方退款接口的返回，Status为第三方的退款状态
+type refundResult struct {
+	RefundPayNo string
+	Status      string
+	Raw         string
+}
+
+// notifyError 处理通知时的错误，code为响应给第三方的http状态码
+type notifyError struct {
+	code int
+	err  error
+}
+
+func (e *notifyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notifyError) Unwrap() error {
+	return e.err
+}
+
+func newNotifyError(code int, err error) error {
+	return &notifyError{code: code, err: err}
+}
+
+func notifyErrorCode(err error) int {
+	var ne *notifyError
+	if errors.As(err, &ne) {
+		return ne.code
+	}
+	return http.StatusInternalServerError
+}
+
+func apiPayments(r *gin.Engine) {
+	// 下单，不同渠道返回的data不同
+	// 微信: mp/app返回调起支付的参数，native返回code_url，h5返回h5_url
+	// 支付宝: page_pay/wap_pay返回url，app_pay返回order_string，precreate返回qr_code
+	r.POST("/payments", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o paymentOps
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if len(o.PayerClientIP) == 0 {
+			o.PayerClientIP = ctx.ClientIP()
+		}
+		data, err := createClientPayment(ctx, &o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, paymentErrorResponse(err))
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
+	})
+
+	// 查询第三方的订单状态，同时返回我们记录的状态
+	r.GET("/payments/:transNo", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		rec, pa, p, err := findPaymentWithProvider(ctx.Param("transNo"))
+		if err == nil {
+			err = checkClientStore(ctx, rec.StoreID)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		res := p.QueryPayment(rec, pa)
+		if res.Err != "" {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "check trans_no state error: " + res.Err})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{
+			"payment_state": res,
+			"status":        rec.Status,
+		}})
+	})
+
+	r.POST("/payments/:transNo/close", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		rec, err := findClientPaymentRecord(ctx, ctx.Param("transNo"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := closePayment(rec); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+
+	// body:
+	// {
+	// 	"refund_no": "r_abcssscascscds_1",
+	// 	"refund_price": 10, 可选，不传或为0表示全额退款
+	// 	"reason": "商品已售完",
+	// 	"addi_notify_url": "https://xx.com/notify" 可选
+	// }
+	r.POST("/payments/:transNo/refunds", requireScope(models.API_SCOPE_REFUND), func(ctx *gin.Context) {
+		var o refundOps
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		o.TransNo = ctx.Param("transNo")
+		data, err := createClientRefund(ctx, &o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
+	})
+}
+
+func findPaymentWithProvider(transNo string) (*models.PaymentRecord, *models.PaymentAccount, PaymentProvider, error) {
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pa, err := models.FindPaymentAccount(rec.PaymentAccountID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("load pa error: %s", err)
+	}
+	p, err := paymentProviderFor(pa)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return rec, pa, p, nil
+}
+
+// createPayment 先保存待支付的记录再调用第三方下单，支付通知和查询都依赖这条记录
+// 同一个trans_no重复下单时参数相同则返回缓存的支付参数，见payment_idempotency.go
+func createPayment(o *paymentOps) (common.M, error) {
+	now := time.Now()
+	if err := o.parseExpireAt(now); err != nil {
+		return nil, err
+	}
+	if err := validateAddiNotifyURL(o.AddiNotifyURL); err != nil {
+		return nil, err
+	}
+	pa, err := resolvePaymentAccount(o)
+	if err != nil {
+		return nil, err
+	}
+	o.paymentAccount = pa
+	if o.ProfitSharing && !pa.IsWechatServiceProviderAccount() {
+		return nil, fmt.Errorf("profit_sharing is only supported by wechat service provider payment account, payment account: %d", pa.ID)
+	}
+	p, err := paymentProviderFor(pa)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockPaymentCreate(o.TransNo)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	_, err = models.CreatePendingPaymentRecord(&models.PaymentRecord{
+		TransNo:          o.TransNo,
+		PaymentAccountID: pa.ID,
+		StoreID:          cast.ToInt64(o.StoreID),
+		TotalMoney:       models.FenToYuan(o.TotalPrice),
+		AddiNotifyURL:    o.AddiNotifyURL,
+		AppID:            o.AppID,
+		ExpireAt:         &o.expireAt,
+		ProfitSharing:    o.ProfitSharing,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fp := o.fingerprint()
+	if data, err := loadPaymentParams(o.TransNo, fp); err != nil || data != nil {
+		return data, err
+	}
+	data, err := p.CreatePayment(o)
+	if err != nil {
+		return nil, err
+	}
+	savePaymentParams(o.TransNo, fp, data, o.paramsValidity(now))
+	return data, nil
+}
+
+// resolvePaymentAccount 没有传payment_account_id时使用店铺的默认账号，并检查店铺是否可以使用该账号
+func resolvePaymentAccount(o *paymentOps) (*models.PaymentAccount, error) {
+	storeID := cast.ToInt64(o.StoreID)
+	if len(o.PaymentAccountID) == 0 {
+		if len(o.Provider) == 0 {
+			return nil, errors.New("payment_account_id or provider is required")
+		}
+		id, err := models.FindDefaultStorePaymentAccountID(storeID, o.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("payment_account_id is not given and %s", err)
+		}
+		o.PaymentAccountID = cast.ToString(id)
+	}
+	pa, err := models.FindPaymentAccount(o.PaymentAccountID)
+	if err != nil {
+		return nil, fmt.Errorf("err to find payment account with id: %s, err: %s", o.PaymentAccountID, err)
+	}
+	if len(o.Provider) > 0 && pa.AccountType != o.Provider {
+		return nil, fmt.Errorf("payment account %d is not a %s account", pa.ID, o.Provider)
+	}
+	if err := models.CheckStorePaymentAccount(storeID, pa); err != nil {
+		return nil, err
+	}
+	if pa.IsWechatServiceProviderAccount() {
+		if _, err := models.FindWechatSubMerchantStore(storeID, pa); err != nil {
+			return nil, err
+		}
+	}
+	return pa, nil
+}
+
+func closePayment(rec *models.PaymentRecord) error {
+	if !rec.IsPending() {
+		return fmt.Errorf("payment can not close, trans_no: %s, status: %s", rec.TransNo, rec.Status)
+	}
+	if rec.IsCombineSubOrder() {
+		// 关闭合单支付会关闭所有子单
+		return fmt.Errorf("trans_no %s belongs to combine payment %s, close the combine payment instead", rec.TransNo, rec.CombineTransNo)
+	}
+	pa, err := models.FindPaymentAccount(rec.PaymentAccountID)
+	if err != nil {
+		return fmt.Errorf("load pa error: %s", err)
+	}
+	p, err := paymentProviderFor(pa)
+	if err != nil {
+		return err
+	}
+	if err := p.ClosePayment(rec, pa); err != nil {
+		return err
+	}
+	deletePaymentParams(rec.TransNo)
+	return rec.TransitTo(models.PAYMENT_STATUS_CLOSED, pa.AccountType+"_close", "", nil)
+}
+
+// createRefund 支持全额和部分退款，所有退款金额之和不能超过订单金额
+func createRefund(o *refundOps) (common.M, error) {
+	if len(o.TransNo) == 0 || len(o.RefundNo) == 0 {
+		return nil, errors.New("trans_no and refund_no are required")
+	}
+	if err := validateAddiNotifyURL(o.AddiNotifyURL); err != nil {
+		return nil, err
+	}
+	rec, pa, p, err := findPaymentWithProvider(o.TransNo)
+	if err != nil {
+		return nil, err
+	}
+	if !rec.CanRefund() {
+		return nil, fmt.Errorf("payment can not refund, trans_no: %s, status: %s", o.TransNo, rec.Status)
+	}
+
+	remain := rec.TotalFen() - models.RefundedFen(rec.ID)
+	if o.RefundPrice == 0 {
+		o.RefundPrice = remain
+	}
+	if o.RefundPrice <= 0 || o.RefundPrice > remain {
+		return nil, fmt.Errorf("invalid refund_price: %d, refundable: %d", o.RefundPrice, remain)
+	}
+
+	rr := models.RefundRecord{
+		PaymentRecordID:  rec.ID,
+		PaymentAccountID: rec.PaymentAccountID,
+		StoreID:          rec.StoreID,
+		TransNo:          rec.TransNo,
+		RefundNo:         o.RefundNo,
+		RefundMoney:      models.FenToYuan(o.RefundPrice),
+		Reason:           o.Reason,
+		Status:           models.REFUND_STATUS_PROCESSING,
+		AddiNotifyURL:    o.AddiNotifyURL,
+	}
+	// 并发的部分退款在事务中锁住支付记录后再检查一次金额，refund_no重复由唯一索引检查
+	if err := models.CreateRefundRecord(&rr, rec.TotalFen()); err != nil {
+		if errors.Is(err, models.ErrRefundNoConflict) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("create refund record error: %s", err)
+	}
+	if err := rec.TransitTo(models.PAYMENT_STATUS_REFUNDING, "refund", rr.RefundNo, nil); err != nil {
+		_, _ = rr.UpdateRefundResult("", models.REFUND_STATUS_ABNORMAL, err.Error())
+		return nil, err
+	}
+
+	res, err := p.Refund(rec, &rr, pa)
+	if err != nil {
+		// 超时和5xx时第三方可能已经受理了退款，保持processing占用退款金额，由退款通知或支付清理任务的退款查询确认
+		if reason, ok := refundRejectedReason(err); ok {
+			_, _ = rr.UpdateRefundResult("", models.REFUND_STATUS_ABNORMAL, reason)
+			syncRefundStatus(rec)
+			return nil, fmt.Errorf("%s refund rejected: %s", pa.AccountType, err)
+		}
+		l().Warnf("%s refund error, keep processing, refund_no: %s, err: %s", pa.AccountType, rr.RefundNo, err)
+		return nil, fmt.Errorf("%s refund error, refund_no %s is processing and will be confirmed later: %s", pa.AccountType, rr.RefundNo, err)
+	}
+	if _, err := rr.UpdateRefundResult(res.RefundPayNo, res.Status, res.Raw); err != nil {
+		l().Warnf("update refund record error, refund_no: %s, err: %s", rr.RefundNo, err)
+	}
+	syncRefundStatus(rec)
+
+	return common.M{
+		"refund_no":    rr.RefundNo,
+		"refund_id":    rr.RefundPayNo,
+		"refund_price": o.RefundPrice,
+		"state":        res.Status,
+	}, nil
+}
+
+// refundRejectedReason 第三方明确拒绝了退款申请，这时退款记录才可以改为abnormal
+func refundRejectedReason(err error) (string, bool) {
+	if reason, ok := wechatRejectedReason(err); ok {
+		return reason, true
+	}
+	return alipayRejectedReason(err)
+}
+
+func syncRefundStatus(rec *models.PaymentRecord) {
+	if err := rec.SyncRefundStatus("refund"); err != nil {
+		l().Warnf("sync refund status error, trans_no: %s, err: %s", rec.TransNo, err)
+	}
+}
+
+// paymentNotifyHandler 各渠道共用的支付通知处理流程
+func paymentNotifyHandler(p PaymentProvider) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		transNo := ctx.Param("transNo")
+		rec, err := models.FindPaymentRecordByTransNo(transNo)
+		if err != nil {
+			p.NotifyResponse(ctx, newNotifyError(http.StatusNotFound, err))
+			return
+		}
+		if !rec.IsPending() {
+			setNotifyResult(ctx, NOTIFY_RESULT_DUPLICATE)
+			p.NotifyResponse(ctx, nil)
+			return
+		}
+
+		pa, err := models.FindPaymentAccount(rec.PaymentAccountID)
+		if err != nil {
+			p.NotifyResponse(ctx, fmt.Errorf("load pa error: %w", err))
+			return
+		}
+
+		data, err := p.ParseNotify(ctx, rec, pa)
+		if err != nil {
+			p.NotifyResponse(ctx, err)
+			return
+		}
+		// 通知和状态在同一个事务中保存，保存失败时返回错误让第三方重试
+		ds := paymentStateDeliveries(data, rec.AddiNotifyURL)
+		if err := rec.UpdatePayResult(data.status, pa.AccountType, data.State, data.PayNo, data.rawRsp, ds...); err != nil {
+			p.NotifyResponse(ctx, fmt.Errorf("update payment record error: %w", err))
+			return
+		}
+
+		paymentStateNotified(data)
+		p.NotifyResponse(ctx, nil)
+	}
+}
+
+func paymentStateEvent(data *paymentState) string {
+	if len(data.RefundNo) > 0 {
+		return "refund.state"
+	}
+	return "payment.state"
+}
+
+// paymentStateDeliveries 通知web端，如果有额外的通知地址也同时通知
+// 需要和状态的修改在同一个事务中保存(见models.PaymentRecord.TransitTo)，提交后调用paymentStateNotified
+func paymentStateDeliveries(data *paymentState, addiNotifyURL string) []*models.WebhookDelivery {
+	d, _ := json.Marshal(data)
+	return webhook.NewDeliveries(data.TransNo, paymentStateEvent(data), d, addiNotifyURL)
+}
+
+// paymentStateNotified 唤醒webhook worker发送保存的通知，同时推送给订阅的客户端
+func paymentStateNotified(data *paymentState) {
+	webhook.Wake()
+	publishPaymentEvent(paymentStateEvent(data), data)
+}
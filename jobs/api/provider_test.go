@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-gin-payment/ext/alipay"
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+	wxerrors "github.com/wechatpay-apiv3/wechatpay-go/core/errors"
+)
+
+func TestPaymentProviderRegistry(t *testing.T) {
+	for _, accountType := range []string{models.ACCOUNT_TYPE_WECHAT, models.ACCOUNT_TYPE_ALIPAY} {
+		p, err := paymentProviderFor(&models.PaymentAccount{AccountType: accountType})
+		assert.Nil(t, err)
+		assert.NotNil(t, p)
+		assert.NotEmpty(t, p.PublicPaths())
+	}
+
+	_, err := paymentProviderFor(&models.PaymentAccount{AccountType: "unknown"})
+	assert.NotNil(t, err)
+
+	assert.Panics(t, func() {
+		registerPaymentProvider(models.ACCOUNT_TYPE_WECHAT, &wechatProvider{})
+	})
+}
+
+// 支付宝退款没有通知，微信退款申请超时时不一定有通知，processing的退款由支付清理任务查询
+func TestRefundQuerier(t *testing.T) {
+	_, ok := paymentProviders[models.ACCOUNT_TYPE_ALIPAY].(refundQuerier)
+	assert.True(t, ok)
+	_, ok = paymentProviders[models.ACCOUNT_TYPE_WECHAT].(refundQuerier)
+	assert.True(t, ok)
+
+	assert.Equal(t, models.REFUND_STATUS_SUCCESS, alipayRefundStatus("REFUND_SUCCESS"))
+	assert.Equal(t, models.REFUND_STATUS_PROCESSING, alipayRefundStatus(""))
+}
+
+// 超时和5xx时第三方可能已经受理了退款，只有明确拒绝时退款才能改为abnormal
+func TestRefundRejectedReason(t *testing.T) {
+	reason, ok := refundRejectedReason(&wxerrors.Error{StatusCode: http.StatusBadRequest, Code: "NOT_ENOUGH", Message: "基本账户余额不足"})
+	assert.True(t, ok)
+	assert.Equal(t, "NOT_ENOUGH: 基本账户余额不足", reason)
+	reason, ok = refundRejectedReason(&alipay.Error{Code: "40004", SubCode: "ACQ.TRADE_HAS_CLOSE", SubMsg: "交易已经关闭"})
+	assert.True(t, ok)
+	assert.Equal(t, "ACQ.TRADE_HAS_CLOSE: 交易已经关闭", reason)
+
+	_, ok = refundRejectedReason(&wxerrors.Error{StatusCode: http.StatusInternalServerError, Code: "SYSTEM_ERROR"})
+	assert.False(t, ok)
+	_, ok = refundRejectedReason(&alipay.Error{Code: "20000", SubCode: "isp.unknow-error"})
+	assert.False(t, ok)
+	_, ok = refundRejectedReason(errors.New("context deadline exceeded"))
+	assert.False(t, ok)
+}
+
+// 查询失败时不能关单，只有第三方明确没有这个订单
+func TestShouldCloseExpiredPayment(t *testing.T) {
+	assert.True(t, shouldCloseExpiredPayment(&paymentState{status: models.PAYMENT_STATUS_PENDING}))
+	assert.True(t, shouldCloseExpiredPayment(&paymentState{State: "NOTPAY", status: models.PAYMENT_STATUS_PENDING}))
+	// 用户支付中推迟处理
+	assert.False(t, shouldCloseExpiredPayment(&paymentState{State: "USERPAYING", status: models.PAYMENT_STATUS_PENDING}))
+	assert.True(t, shouldCloseExpiredPayment(&paymentState{status: models.PAYMENT_STATUS_FAILED}))
+	assert.True(t, shouldCloseExpiredPayment(&paymentState{Err: "ORDER_NOT_EXIST", notExist: true}))
+	assert.False(t, shouldCloseExpiredPayment(&paymentState{Err: "timeout"}))
+	assert.False(t, shouldCloseExpiredPayment(&paymentState{Err: "timeout", status: models.PAYMENT_STATUS_PENDING}))
+	assert.False(t, shouldCloseExpiredPayment(&paymentState{State: "REFUND"}))
+
+	// 只相信验签通过的ACQ.TRADE_NOT_EXIST
+	assert.True(t, isAlipayTradeNotExist(fmt.Errorf("close: %w", &alipay.Error{Code: "40004", SubCode: "ACQ.TRADE_NOT_EXIST"})))
+	assert.False(t, isAlipayTradeNotExist(errors.New(`alipay alipay.trade.close error: {"error_response":{"sub_code":"ACQ.TRADE_NOT_EXIST"}}`)))
+
+	assert.True(t, isWechatOrderNotExist(&wxerrors.Error{StatusCode: http.StatusNotFound, Code: "ORDER_NOT_EXIST"}))
+	assert.False(t, isWechatOrderNotExist(errors.New("connection refused")))
+}
+
+func TestNotifyErrorCode(t *testing.T) {
+	assert.Equal(t, http.StatusUnauthorized, notifyErrorCode(newNotifyError(http.StatusUnauthorized, errors.New("sign"))))
+	assert.Equal(t, http.StatusInternalServerError, notifyErrorCode(errors.New("db")))
+}
+
+func TestPaymentOpsParseExpireAt(t *testing.T) {
+	now := time.Date(2024, 6, 8, 10, 0, 0, 0, models.ChinaTz)
+
+	o := paymentOps{}
+	assert.Nil(t, o.parseExpireAt(now))
+	assert.Equal(t, now.Add(defaultPaymentExpire), o.expireAt)
+
+	o = paymentOps{TimeExpire: "2024-06-08T10:34:56+08:00"}
+	assert.Nil(t, o.parseExpireAt(now))
+	assert.Equal(t, "2024-06-08T10:34:56+08:00", o.expireAt.In(models.ChinaTz).Format(time.RFC3339))
+
+	o = paymentOps{TimeExpire: "2024-06-08T09:34:56+08:00"}
+	assert.NotNil(t, o.parseExpireAt(now))
+
+	o = paymentOps{TimeExpire: "2024-06-08 10:34:56"}
+	assert.NotNil(t, o.parseExpireAt(now))
+}
+
+func TestResolvePaymentAccountWithoutProvider(t *testing.T) {
+	_, err := resolvePaymentAccount(&paymentOps{StoreID: "1"})
+	assert.EqualError(t, err, "payment_account_id or provider is required")
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/cast"
+	"github.com/tidwall/gjson"
+)
+
+//
+// 令牌桶限流，桶按 分组 + 调用方 + 店铺 + 路由 区分，另外每个调用方有一个所有店铺和路由共用的桶，
+// 分组和限制见config/rate_limit.go
+//
+// 桶保存在redis中，多个实例共享；没有连接redis时只在本实例内限流，redis出错时不限流
+// 店铺为query或者json body中的store_id，没有、不合法或者调用方不能操作这个店铺时所有店铺共用一个桶
+//
+
+const (
+	rateLimitKey = "rate_limit:"
+	// rateLimitClientGroup 调用方共用的桶的分组名，config中的分组不能使用
+	rateLimitClientGroup = "client"
+
+	// localRateLimitCleanSize 没有redis时本实例保存的桶超过这个数量后清理已经满的
+	localRateLimitCleanSize = 10000
+)
+
+// rateLimitScript 同时检查多个桶，ARGV[1]为当前的毫秒时间戳，之后每个key依次为每毫秒补充的令牌数和桶的容量
+// 所有桶都有令牌时每个桶各取一个，否则都不取；返回{第一个不允许的桶的序号(从1开始，0为允许), 需要等待的毫秒数}
+// 桶满之后自动过期
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens, ts, rates, bursts = {}, {}, {}, {}
+local denied = 0
+local wait = 0
+for i = 1, #KEYS do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	local v = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+	local t = tonumber(v[1])
+	local s = tonumber(v[2])
+	if t == nil or s == nil then
+		t = burst
+		s = now
+	end
+	if now > s then
+		t = math.min(burst, t + (now - s) * rate)
+		s = now
+	end
+	if t < 1 then
+		if denied == 0 then
+			denied = i
+		end
+		wait = math.max(wait, math.ceil((1 - t) / rate))
+	end
+	tokens[i], ts[i], rates[i], bursts[i] = t, s, rate, burst
+end
+for i = 1, #KEYS do
+	if denied == 0 then
+		tokens[i] = tokens[i] - 1
+	end
+	redis.call('HSET', KEYS[i], 'tokens', tostring(tokens[i]), 'ts', tostring(ts[i]))
+	redis.call('PEXPIRE', KEYS[i], math.ceil(bursts[i] / rates[i]) + 1000)
+end
+return {denied, wait}
+`)
+
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time
+	fullAt time.Time // 桶补满的时间，之后可以删除
+}
+
+// refill 按经过的时间补充令牌，返回令牌不足1个时需要等待的时间
+func (b *tokenBucket) refill(rule config.RateLimitRule, now time.Time) time.Duration {
+	rate := rule.PerSecond()
+	if now.After(b.ts) {
+		b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.ts).Seconds()*rate)
+		b.ts = now
+	}
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1-b.tokens)/rate*1000)) * time.Millisecond
+}
+
+func (b *tokenBucket) setFullAt(rule config.RateLimitRule) {
+	b.fullAt = b.ts.Add(time.Duration((float64(rule.Burst) - b.tokens) / rule.PerSecond() * float64(time.Second)))
+}
+
+// take 和rateLimitScript只有一个桶时的逻辑相同
+func (b *tokenBucket) take(rule config.RateLimitRule, now time.Time) (bool, time.Duration) {
+	wait := b.refill(rule, now)
+	if wait == 0 {
+		b.tokens--
+	}
+	b.setFullAt(rule)
+	return wait == 0, wait
+}
+
+type localRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var localRateLimits = &localRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// take 和rateLimitScript的逻辑相同
+func (rl *localRateLimiter) take(keys []string, rules []config.RateLimitRule, now time.Time) (int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	bs := make([]*tokenBucket, len(keys))
+	denied := 0
+	var wait time.Duration
+	for i, key := range keys {
+		b, ok := rl.buckets[key]
+		if !ok {
+			if len(rl.buckets) >= localRateLimitCleanSize {
+				rl.clean(now)
+			}
+			b = &tokenBucket{tokens: float64(rules[i].Burst), ts: now}
+			rl.buckets[key] = b
+		}
+		if w := b.refill(rules[i], now); w > 0 {
+			if denied == 0 {
+				denied = i + 1
+			}
+			if w > wait {
+				wait = w
+			}
+		}
+		bs[i] = b
+	}
+	for i, b := range bs {
+		if denied == 0 {
+			b.tokens--
+		}
+		b.setFullAt(rules[i])
+	}
+	return denied, wait
+}
+
+// clean 删除已经补满的桶，和重新创建的效果相同
+func (rl *localRateLimiter) clean(now time.Time) {
+	for k, b := range rl.buckets {
+		if !now.Before(b.fullAt) {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// takeRateLimitTokens 所有桶都允许时每个桶取一个令牌，否则都不取
+// 返回第一个不允许的桶的序号(从1开始，0为允许)和需要等待的时间
+func takeRateLimitTokens(keys []string, rules []config.RateLimitRule, now time.Time) (int, time.Duration) {
+	if conn.Redis == nil {
+		return localRateLimits.take(keys, rules, now)
+	}
+	args := []interface{}{now.UnixMilli()}
+	for _, r := range rules {
+		args = append(args, r.PerSecond()/1000, r.Burst)
+	}
+	res, err := rateLimitScript.Run(context.TODO(), conn.Redis, keys, args...).Int64Slice()
+	if err != nil || len(res) != 2 {
+		l().Warnf("rate limit keys: %v error: %v", keys, err)
+		return 0, 0
+	}
+	return int(res[0]), time.Duration(res[1]) * time.Millisecond
+}
+
+// rateLimitStoreID 读取body后重置，后面的handler可以继续读取，body超过config.MaxBodyBytes时返回错误
+// 只使用调用方可以操作的店铺，避免每次换一个store_id拿到新的桶
+func rateLimitStoreID(ctx *gin.Context) (string, error) {
+	id := ctx.Query("store_id")
+	if len(id) == 0 && ctx.Request.Body != nil && strings.Contains(ctx.ContentType(), "json") {
+		body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, config.MaxBodyBytes))
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return "", err
+			}
+			return "", nil
+		}
+		id = gjson.GetBytes(body, "store_id").String()
+	}
+	storeID, err := cast.ToInt64E(id)
+	if err != nil || storeID <= 0 || checkClientStore(ctx, storeID) != nil {
+		return "", nil
+	}
+	return strconv.FormatInt(storeID, 10), nil
+}
+
+func rateLimitClientKey(ctx *gin.Context) string {
+	c := currentAPIClient(ctx)
+	if c == nil {
+		return ""
+	}
+	if c.ID == 0 {
+		return c.Name
+	}
+	return strconv.FormatInt(c.ID, 10)
+}
+
+// rateLimitMiddleware 在验证之后执行，只限制验证过的调用方，支付通知等不需要验证的路由不限制
+func rateLimitMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		cfg := &config.Current.RateLimit
+		client := rateLimitClientKey(ctx)
+		route := ctx.FullPath()
+		if !cfg.Enabled || len(client) == 0 || len(route) == 0 {
+			ctx.Next()
+			return
+		}
+		storeID, err := rateLimitStoreID(ctx)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, common.M{
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		group, rule := cfg.Match(ctx.Request.Method, route)
+		now := time.Now()
+		key := rateLimitKey + group + ":" + client + ":" + storeID + ":" + ctx.Request.Method + " " + route
+		// 两个桶都有令牌时才各取一个，被限流的请求不会继续消耗分组的桶
+		denied, wait := takeRateLimitTokens(
+			[]string{key, rateLimitKey + rateLimitClientGroup + ":" + client},
+			[]config.RateLimitRule{rule, cfg.Client}, now)
+		if denied == 2 {
+			group = rateLimitClientGroup
+		}
+		if denied > 0 {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, common.M{
+				"status": "error",
+				"error":  fmt.Sprintf("rate limit exceeded for %s, retry after %d seconds", group, retryAfter),
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
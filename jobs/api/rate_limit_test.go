@@ -0,0 +1,145 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rule := config.RateLimitRule{Requests: 2, Per: config.Duration{Duration: time.Second}, Burst: 2}
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, ts: now}
+	ok, _ := b.take(rule, now)
+	assert.True(t, ok)
+	ok, _ = b.take(rule, now)
+	assert.True(t, ok)
+	ok, wait := b.take(rule, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	assert.Equal(t, now.Add(time.Second), b.fullAt)
+
+	ok, _ = b.take(rule, now.Add(wait))
+	assert.True(t, ok)
+}
+
+func TestLocalRateLimiterTakeAll(t *testing.T) {
+	group := config.RateLimitRule{Requests: 1, Per: config.Duration{Duration: time.Minute}, Burst: 2}
+	client := config.RateLimitRule{Requests: 1, Per: config.Duration{Duration: time.Minute}, Burst: 1}
+	rl := &localRateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	keys := []string{"g", "c"}
+
+	denied, _ := rl.take(keys, []config.RateLimitRule{group, client}, now)
+	assert.Equal(t, 0, denied)
+	denied, wait := rl.take(keys, []config.RateLimitRule{group, client}, now)
+	assert.Equal(t, 2, denied)
+	assert.Equal(t, time.Minute, wait)
+	// 调用方的桶不允许时不消耗分组的桶
+	assert.Equal(t, float64(1), rl.buckets["g"].tokens)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	old := config.Current.RateLimit
+	defer func() { config.Current.RateLimit = old }()
+	config.Current.RateLimit = config.RateLimitConfig{
+		Enabled: true,
+		Default: old.Default,
+		Client:  old.Client,
+		Groups: []config.RateLimitGroup{{
+			Name:   "test_ping",
+			Routes: []string{"GET /ping"},
+			Limit:  config.RateLimitRule{Requests: 1, Per: config.Duration{Duration: time.Minute}, Burst: 2},
+		}},
+	}
+	router := RunAPI()
+
+	codes := make([]int, 0)
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set(authHeaderKey, config.APISecret)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, []int{200, 200, http.StatusTooManyRequests}, codes)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// 没有验证的请求不限流
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestRateLimitClientBucket(t *testing.T) {
+	old := config.Current.RateLimit
+	defer func() { config.Current.RateLimit = old }()
+	config.Current.RateLimit = config.RateLimitConfig{
+		Enabled: true,
+		Default: old.Default,
+		Client:  config.RateLimitRule{Requests: 1, Per: config.Duration{Duration: time.Minute}, Burst: 3},
+		Groups: []config.RateLimitGroup{{
+			Name:   "test_ping",
+			Routes: []string{"GET /ping"},
+			Limit:  config.RateLimitRule{Requests: 1, Per: config.Duration{Duration: time.Minute}, Burst: 2},
+		}},
+	}
+	localRateLimits = &localRateLimiter{buckets: make(map[string]*tokenBucket)}
+	router := RunAPI()
+
+	// 每次换一个store_id也会用完调用方共用的桶
+	codes := make([]int, 0)
+	var w *httptest.ResponseRecorder
+	for i := 1; i <= 4; i++ {
+		req, _ := http.NewRequest("GET", "/ping?store_id="+strconv.Itoa(i), nil)
+		req.Header.Set(authHeaderKey, config.APISecret)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, []int{200, 200, 200, http.StatusTooManyRequests}, codes)
+	assert.Contains(t, w.Body.String(), "rate limit exceeded for client")
+}
+
+func TestRateLimitStoreID(t *testing.T) {
+	newCtx := func(target, body string) *gin.Context {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("POST", target, strings.NewReader(body))
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		c := &models.APIClient{StoreIDs: []int64{2}}
+		c.ID = 5
+		ctx.Set(apiClientCtxKey, c)
+		return ctx
+	}
+
+	id, err := rateLimitStoreID(newCtx("/payments?store_id=2", ""))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", id)
+
+	// 不能操作的店铺和不合法的store_id共用一个桶，body可以继续读取
+	ctx := newCtx("/payments", `{"store_id": 3}`)
+	id, err = rateLimitStoreID(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+	b, _ := io.ReadAll(ctx.Request.Body)
+	assert.Equal(t, `{"store_id": 3}`, string(b))
+	id, _ = rateLimitStoreID(newCtx("/payments", `{"store_id": "abc"}`))
+	assert.Equal(t, "", id)
+
+	defer func(n int64) { config.MaxBodyBytes = n }(config.MaxBodyBytes)
+	config.MaxBodyBytes = 8
+	_, err = rateLimitStoreID(newCtx("/payments", `{"store_id": 2}`))
+	assert.NotNil(t, err)
+}
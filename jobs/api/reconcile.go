@@ -0,0 +1,418 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"github.com/tidwall/gjson"
+)
+
+//
+// 微信账单对账
+//
+// 每天reconcileHour后下载前一天每个微信支付账号的交易账单和资金账单(服务商账号下载每个子商户的)，
+// 和我们的支付记录、退款记录对比，差异保存为ReconciliationItem:
+//
+//	missing_in_ours    账单中有，我们没有记录
+//	missing_in_wechat  我们记录为当天支付成功或者退款成功，账单中没有
+//	amount_mismatch    金额不一致
+//	status_mismatch    账单中支付或退款成功，我们的记录不是
+//
+// 我们的支付时间使用微信返回的success_time，没有时使用记录变为success的时间
+//
+
+const (
+	// reconcileHour 微信在次日10点后才能下载前一天的账单
+	reconcileHour     = 10
+	reconcileInterval = time.Hour
+	reconcileLockKey  = "reconciler_lock"
+	// reconcileSlack 支付通知可能在第二天才收到，查询我们的记录时前后多查一段时间再按支付时间过滤
+	reconcileSlack = time.Hour
+
+	billDateFormat = "2006-01-02"
+)
+
+// StartReconciler 定时对前一天的账单，已经对完的账号跳过，失败的下次重试，返回的函数用于停止
+func StartReconciler() func() {
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(reconcileInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				reconcileDue(now)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+func reconcileDue(now time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			l().Errorf("reconciler panic: %s\n%s", err, debug.Stack())
+		}
+	}()
+	now = now.In(models.ChinaTz)
+	if now.Hour() < reconcileHour {
+		return
+	}
+	// 多个实例同时运行时，同一时间只有一个实例执行
+	if conn.Redis != nil {
+		ok, err := conn.Redis.SetNX(context.TODO(), reconcileLockKey, 1, reconcileInterval/2).Result()
+		if err != nil || !ok {
+			return
+		}
+	}
+
+	billDate := now.AddDate(0, 0, -1).Format(billDateFormat)
+	pas, err := findWechatPaymentAccounts(0)
+	if err != nil {
+		l().Warnf("reconciler, load payment accounts error: %s", err)
+		return
+	}
+	for i := range pas {
+		if r, err := models.FindReconciliationByDate(pas[i].ID, billDate); err == nil && r.Status != models.RECONCILIATION_STATUS_FAILED {
+			continue
+		}
+		if _, err := reconcileWechatAccount(&pas[i], billDate, time.Now()); err != nil {
+			l().Warnf("reconcile payment account %d, bill_date: %s, err: %s", pas[i].ID, billDate, err)
+		}
+	}
+}
+
+// ReconcileWechatBills 对账并返回结果，paymentAccountID为0时对所有的微信支付账号，用于接口和命令行重新对账
+func ReconcileWechatBills(billDate string, paymentAccountID int64) ([]*models.Reconciliation, error) {
+	if _, err := time.ParseInLocation(billDateFormat, billDate, models.ChinaTz); err != nil {
+		return nil, fmt.Errorf("invalid bill_date: %s, should be %s", billDate, billDateFormat)
+	}
+	pas, err := findWechatPaymentAccounts(paymentAccountID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*models.Reconciliation, 0, len(pas))
+	for i := range pas {
+		r, err := reconcileWechatAccount(&pas[i], billDate, time.Now())
+		if r == nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func findWechatPaymentAccounts(paymentAccountID int64) ([]models.PaymentAccount, error) {
+	if paymentAccountID > 0 {
+		pa, err := models.FindPaLoadPrivateCert(paymentAccountID, true)
+		if err != nil {
+			return nil, err
+		}
+		if pa.AccountType != models.ACCOUNT_TYPE_WECHAT {
+			return nil, fmt.Errorf("payment account %d is not a wechat account", pa.ID)
+		}
+		return []models.PaymentAccount{*pa}, nil
+	}
+	all, err := models.FindPaymentAccounts()
+	if err != nil {
+		return nil, err
+	}
+	pas := make([]models.PaymentAccount, 0, len(all))
+	for _, pa := range all {
+		if pa.AccountType == models.ACCOUNT_TYPE_WECHAT {
+			pas = append(pas, pa)
+		}
+	}
+	return pas, nil
+}
+
+// reconcileWechatAccount 对账失败时也会返回保存了错误的Reconciliation，正在对账时返回nil
+func reconcileWechatAccount(pa *models.PaymentAccount, billDate string, now time.Time) (*models.Reconciliation, error) {
+	r, err := models.StartReconciliation(pa.ID, billDate, now)
+	if err != nil {
+		return nil, err
+	}
+	items, err := runWechatReconciliation(pa, r)
+	if err != nil {
+		if ferr := r.Fail(err, time.Now()); ferr != nil {
+			l().Warnf("save reconciliation %d error: %s", r.ID, ferr)
+		}
+		return r, err
+	}
+	if err := r.Finish(items, time.Now()); err != nil {
+		return r, err
+	}
+	if len(items) > 0 {
+		l().WithField("alert", true).Errorf("reconciliation mismatch, payment account: %d, bill_date: %s, count: %d", pa.ID, billDate, len(items))
+	}
+	return r, nil
+}
+
+// runWechatReconciliation 下载账单并对比，统计字段保存到r中
+func runWechatReconciliation(pa *models.PaymentAccount, r *models.Reconciliation) ([]models.ReconciliationItem, error) {
+	start, _ := time.ParseInLocation(billDateFormat, r.BillDate, models.ChinaTz)
+	end := start.AddDate(0, 0, 1)
+
+	var rows []wechatTradeBillRow
+	var flow wechatFundFlowSummary
+	if pa.IsWechatServiceProviderAccount() {
+		for _, s := range models.FindWechatSubMerchantStores(pa.ID) {
+			rs, f, err := downloadWechatSubMerchantBills(pa, s.WechatPaymentMerID, r.BillDate)
+			if err != nil {
+				return nil, fmt.Errorf("sub_mchid %s: %s", s.WechatPaymentMerID, err)
+			}
+			rows = append(rows, rs...)
+			flow.add(f)
+		}
+	} else {
+		rs, f, err := downloadWechatMerchantBills(pa, r.BillDate)
+		if err != nil {
+			return nil, err
+		}
+		rows = rs
+		flow = f
+	}
+
+	var ours []models.PaymentRecord
+	for _, rec := range models.FindPaidPaymentRecords(pa.ID, start.Add(-reconcileSlack), end.Add(reconcileSlack)) {
+		if t := wechatPaidAt(&rec); !t.Before(start) && t.Before(end) {
+			ours = append(ours, rec)
+		}
+	}
+
+	var ourRefunds []models.RefundRecord
+	for _, rr := range models.FindSuccessRefundRecords(pa.ID, start.Add(-reconcileSlack), end.Add(reconcileSlack)) {
+		if t := wechatRefundedAt(&rr); !t.Before(start) && t.Before(end) {
+			ourRefunds = append(ourRefunds, rr)
+		}
+	}
+
+	r.TradeCount, r.TradeMoney, r.RefundCount, r.RefundMoney = 0, 0, 0, 0
+	for _, row := range rows {
+		switch row.Status {
+		case "SUCCESS":
+			r.TradeCount++
+			r.TradeMoney += models.FenToYuan(row.Fen)
+		case "REFUND":
+			r.RefundCount++
+			r.RefundMoney += models.FenToYuan(row.RefundFen)
+		}
+	}
+	r.FundFlowCount = flow.Count
+	r.FundFlowIncome = models.FenToYuan(flow.IncomeFen)
+	r.FundFlowExpense = models.FenToYuan(flow.ExpenseFen)
+	r.OurTradeCount = len(ours)
+	r.OurTradeMoney = 0
+	for _, rec := range ours {
+		r.OurTradeMoney += rec.TotalMoney
+	}
+
+	return compareWechatTradeBill(rows, ours, ourRefunds, findPaymentRecordOrNil, findRefundRecordOrNil), nil
+}
+
+// downloadWechatMerchantBills 普通商户的交易账单和资金账单，没有交易时微信不生成账单
+func downloadWechatMerchantBills(pa *models.PaymentAccount, billDate string) ([]wechatTradeBillRow, wechatFundFlowSummary, error) {
+	var flow wechatFundFlowSummary
+	rows, err := downloadAndParseWechatTradeBill(pa, "", billDate)
+	if err != nil {
+		return nil, flow, err
+	}
+	d, err := downloadWechatFundFlowBill(pa, billDate)
+	if errors.Is(err, errWechatNoStatement) {
+		return rows, flow, nil
+	}
+	if err != nil {
+		return nil, flow, fmt.Errorf("fund flow bill: %s", err)
+	}
+	flow, err = parseWechatFundFlowBill(d)
+	return rows, flow, err
+}
+
+// downloadWechatSubMerchantBills 服务商下载子商户的交易账单和资金账单
+func downloadWechatSubMerchantBills(pa *models.PaymentAccount, subMchID, billDate string) ([]wechatTradeBillRow, wechatFundFlowSummary, error) {
+	var flow wechatFundFlowSummary
+	rows, err := downloadAndParseWechatTradeBill(pa, subMchID, billDate)
+	if err != nil {
+		return nil, flow, err
+	}
+	files, err := downloadWechatSubMerchantFundFlowBill(pa, subMchID, billDate)
+	if errors.Is(err, errWechatNoStatement) {
+		return rows, flow, nil
+	}
+	if err != nil {
+		return nil, flow, fmt.Errorf("fund flow bill: %s", err)
+	}
+	for _, d := range files {
+		f, err := parseWechatFundFlowBill(d)
+		if err != nil {
+			return nil, flow, err
+		}
+		flow.add(f)
+	}
+	return rows, flow, nil
+}
+
+func downloadAndParseWechatTradeBill(pa *models.PaymentAccount, subMchID, billDate string) ([]wechatTradeBillRow, error) {
+	d, err := downloadWechatTradeBill(pa, subMchID, billDate)
+	if errors.Is(err, errWechatNoStatement) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trade bill: %s", err)
+	}
+	return parseWechatTradeBill(d)
+}
+
+// wechatPaidAt 微信返回的success_time，没有时使用记录变为success的时间
+func wechatPaidAt(rec *models.PaymentRecord) time.Time {
+	if s := gjson.Get(rec.PaymentResponse, "success_time").String(); len(s) > 0 {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+	}
+	return rec.PaidAt()
+}
+
+// wechatRefundedAt 微信返回的退款success_time，没有时使用记录最后更新的时间
+func wechatRefundedAt(rr *models.RefundRecord) time.Time {
+	if s := gjson.Get(rr.RefundResponse, "success_time").String(); len(s) > 0 {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+	}
+	return rr.UpdatedAt
+}
+
+func findPaymentRecordOrNil(transNo string) *models.PaymentRecord {
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		return nil
+	}
+	return rec
+}
+
+func findRefundRecordOrNil(refundNo string) *models.RefundRecord {
+	rr, err := models.FindRefundRecordByRefundNo(refundNo)
+	if err != nil {
+		return nil
+	}
+	return rr
+}
+
+// compareWechatTradeBill ours为我们记录的当天支付成功的订单，ourRefunds为当天退款成功的退款，
+// 账单中有但是不在ours中的单据(比如前一天下单、通知延迟)用findPayment/findRefund查找
+func compareWechatTradeBill(rows []wechatTradeBillRow, ours []models.PaymentRecord, ourRefunds []models.RefundRecord,
+	findPayment func(transNo string) *models.PaymentRecord, findRefund func(refundNo string) *models.RefundRecord) []models.ReconciliationItem {
+	oursByNo := make(map[string]*models.PaymentRecord, len(ours))
+	for i := range ours {
+		oursByNo[ours[i].TransNo] = &ours[i]
+	}
+
+	items := make([]models.ReconciliationItem, 0)
+	seen := make(map[string]bool)
+	seenRefunds := make(map[string]bool)
+	for _, row := range rows {
+		switch row.Status {
+		case "SUCCESS":
+			seen[row.TransNo] = true
+			item := models.ReconciliationItem{
+				Kind:       models.RECONCILE_KIND_PAYMENT,
+				TransNo:    row.TransNo,
+				PayNo:      row.PayNo,
+				BillMoney:  models.FenToYuan(row.Fen),
+				BillStatus: row.Status,
+			}
+			rec, ok := oursByNo[row.TransNo]
+			if !ok {
+				rec = findPayment(row.TransNo)
+			}
+			if rec == nil {
+				item.Type = models.RECONCILE_MISSING_IN_OURS
+				items = append(items, item)
+				continue
+			}
+			item.OurMoney = rec.TotalMoney
+			item.OurStatus = string(rec.Status)
+			if !rec.IsPaid() {
+				item.Type = models.RECONCILE_STATUS_MISMATCH
+				items = append(items, item)
+			} else if rec.TotalFen() != row.Fen {
+				item.Type = models.RECONCILE_AMOUNT_MISMATCH
+				items = append(items, item)
+			}
+		case "REFUND":
+			seenRefunds[row.RefundNo] = true
+			item := models.ReconciliationItem{
+				Kind:       models.RECONCILE_KIND_REFUND,
+				TransNo:    row.TransNo,
+				RefundNo:   row.RefundNo,
+				PayNo:      row.RefundPayNo,
+				BillMoney:  models.FenToYuan(row.RefundFen),
+				BillStatus: row.RefundStatus,
+			}
+			rr := findRefund(row.RefundNo)
+			if rr == nil {
+				item.Type = models.RECONCILE_MISSING_IN_OURS
+				items = append(items, item)
+				continue
+			}
+			item.OurMoney = rr.RefundMoney
+			item.OurStatus = rr.Status
+			if row.RefundStatus == "SUCCESS" && rr.Status != models.REFUND_STATUS_SUCCESS {
+				item.Type = models.RECONCILE_STATUS_MISMATCH
+				items = append(items, item)
+			} else if models.YuanToFen(rr.RefundMoney) != row.RefundFen {
+				item.Type = models.RECONCILE_AMOUNT_MISMATCH
+				items = append(items, item)
+			}
+		}
+	}
+
+	for _, rec := range ours {
+		if seen[rec.TransNo] {
+			continue
+		}
+		items = append(items, models.ReconciliationItem{
+			Kind:      models.RECONCILE_KIND_PAYMENT,
+			Type:      models.RECONCILE_MISSING_IN_WECHAT,
+			TransNo:   rec.TransNo,
+			PayNo:     rec.PayNo,
+			OurMoney:  rec.TotalMoney,
+			OurStatus: string(rec.Status),
+		})
+	}
+	for _, rr := range ourRefunds {
+		if seenRefunds[rr.RefundNo] {
+			continue
+		}
+		items = append(items, models.ReconciliationItem{
+			Kind:      models.RECONCILE_KIND_REFUND,
+			Type:      models.RECONCILE_MISSING_IN_WECHAT,
+			TransNo:   rr.TransNo,
+			RefundNo:  rr.RefundNo,
+			PayNo:     rr.RefundPayNo,
+			OurMoney:  rr.RefundMoney,
+			OurStatus: rr.Status,
+		})
+	}
+	return items
+}
+
+// reconciliationSummary 按差异类型计数，用于接口和命令行展示
+func reconciliationSummary(items []models.ReconciliationItem) map[string]int {
+	m := make(map[string]int)
+	for _, item := range items {
+		m[item.Kind+"."+item.Type]++
+	}
+	return m
+}
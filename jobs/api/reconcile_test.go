@@ -0,0 +1,71 @@
+package api
+
+import (
+	"testing"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareWechatTradeBill(t *testing.T) {
+	rows := []wechatTradeBillRow{
+		{TransNo: "ok", Status: "SUCCESS", Fen: 100},
+		{TransNo: "amount", Status: "SUCCESS", Fen: 100},
+		{TransNo: "yesterday", Status: "SUCCESS", Fen: 100},
+		{TransNo: "pending", Status: "SUCCESS", Fen: 100},
+		{TransNo: "unknown", Status: "SUCCESS", Fen: 100},
+		{TransNo: "ok", Status: "REFUND", RefundNo: "r_ok", RefundFen: 50, RefundStatus: "SUCCESS"},
+		{TransNo: "ok", Status: "REFUND", RefundNo: "r_processing", RefundFen: 50, RefundStatus: "SUCCESS"},
+		{TransNo: "ok", Status: "REFUND", RefundNo: "r_unknown", RefundFen: 50, RefundStatus: "SUCCESS"},
+	}
+	ours := []models.PaymentRecord{
+		{TransNo: "ok", TotalMoney: 1, Status: models.PAYMENT_STATUS_PARTIALLY_REFUNDED},
+		{TransNo: "amount", TotalMoney: 0.99, Status: models.PAYMENT_STATUS_SUCCESS},
+		{TransNo: "not_in_bill", TotalMoney: 1, Status: models.PAYMENT_STATUS_SUCCESS},
+	}
+	others := map[string]*models.PaymentRecord{
+		"yesterday": {TransNo: "yesterday", TotalMoney: 1, Status: models.PAYMENT_STATUS_SUCCESS},
+		"pending":   {TransNo: "pending", TotalMoney: 1, Status: models.PAYMENT_STATUS_PENDING},
+	}
+	refunds := map[string]*models.RefundRecord{
+		"r_ok":         {RefundNo: "r_ok", RefundMoney: 0.5, Status: models.REFUND_STATUS_SUCCESS},
+		"r_processing": {RefundNo: "r_processing", RefundMoney: 0.5, Status: models.REFUND_STATUS_PROCESSING},
+	}
+
+	ourRefunds := []models.RefundRecord{
+		{TransNo: "ok", RefundNo: "r_ok", RefundMoney: 0.5, Status: models.REFUND_STATUS_SUCCESS},
+		{TransNo: "ok", RefundNo: "r_not_in_bill", RefundMoney: 0.5, Status: models.REFUND_STATUS_SUCCESS},
+	}
+
+	items := compareWechatTradeBill(rows, ours, ourRefunds,
+		func(transNo string) *models.PaymentRecord { return others[transNo] },
+		func(refundNo string) *models.RefundRecord { return refunds[refundNo] })
+
+	got := make(map[string]string)
+	for _, item := range items {
+		no := item.TransNo
+		if item.Kind == models.RECONCILE_KIND_REFUND {
+			no = item.RefundNo
+		}
+		got[no] = item.Type
+	}
+	assert.Equal(t, map[string]string{
+		"amount":        models.RECONCILE_AMOUNT_MISMATCH,
+		"pending":       models.RECONCILE_STATUS_MISMATCH,
+		"unknown":       models.RECONCILE_MISSING_IN_OURS,
+		"r_processing":  models.RECONCILE_STATUS_MISMATCH,
+		"r_unknown":     models.RECONCILE_MISSING_IN_OURS,
+		"not_in_bill":   models.RECONCILE_MISSING_IN_WECHAT,
+		"r_not_in_bill": models.RECONCILE_MISSING_IN_WECHAT,
+	}, got)
+	assert.Equal(t, map[string]int{
+		"payment.amount_mismatch":   1,
+		"payment.status_mismatch":   1,
+		"payment.missing_in_ours":   1,
+		"payment.missing_in_wechat": 1,
+		"refund.status_mismatch":    1,
+		"refund.missing_in_ours":    1,
+		"refund.missing_in_wechat":  1,
+	}, reconciliationSummary(items))
+}
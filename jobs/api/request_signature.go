@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/reqsig"
+	"go-gin-payment/models"
+)
+
+//
+// 签名的请求，见ext/reqsig。时间超过reqsig.DefaultTolerance的请求拒绝，
+// nonce在redis中保存两倍的时间，同一个key的nonce只能使用一次
+//
+
+const (
+	requestNonceKey = "request_nonce:"
+	requestNonceTTL = 2 * reqsig.DefaultTolerance
+
+	// localNonceCleanSize 没有redis时本实例保存的nonce超过这个数量后清理过期的
+	localNonceCleanSize = 10000
+)
+
+var errRequestNonceUsed = errors.New("request nonce has already been used")
+
+type localNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+var localNonces = &localNonceStore{nonces: make(map[string]time.Time)}
+
+func (s *localNonceStore) use(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if exp, ok := s.nonces[key]; ok && now.Before(exp) {
+		return false
+	}
+	if len(s.nonces) >= localNonceCleanSize {
+		for k, exp := range s.nonces {
+			if !now.Before(exp) {
+				delete(s.nonces, k)
+			}
+		}
+	}
+	s.nonces[key] = now.Add(requestNonceTTL)
+	return true
+}
+
+// useRequestNonce 没有连接redis时只在本实例内去重
+func useRequestNonce(keyID, nonce string, now time.Time) error {
+	key := requestNonceKey + keyID + ":" + nonce
+	if conn.Redis == nil {
+		if !localNonces.use(key, now) {
+			return errRequestNonceUsed
+		}
+		return nil
+	}
+	ok, err := conn.Redis.SetNX(context.TODO(), key, now.Unix(), requestNonceTTL).Result()
+	if err != nil {
+		return fmt.Errorf("check request nonce error: %s", err)
+	}
+	if !ok {
+		return errRequestNonceUsed
+	}
+	return nil
+}
+
+// authenticateSignedRequest 签名正确后才记录nonce，避免别人用错误的签名占用nonce
+func authenticateSignedRequest(r *http.Request) (*models.APIClient, error) {
+	now := time.Now()
+	s, err := reqsig.ParseRequest(r, now, reqsig.DefaultTolerance, config.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	client, err := models.AuthenticateSignedAPIKey(s.KeyID, now, s.Verify)
+	if err != nil {
+		return nil, err
+	}
+	if err := useRequestNonce(s.KeyID, s.Nonce, now); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
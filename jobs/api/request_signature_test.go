@@ -0,0 +1,30 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"go-gin-payment/ext/reqsig"
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestSignatureSecret(t *testing.T) {
+	// 调用方用key计算的secret和加密保存的签名secret相同，和数据库中保存的哈希不同
+	key, k := models.GenAPIKey()
+	keyID, secret, err := reqsig.FromAPIKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, k.KeyID, keyID)
+	assert.Equal(t, k.SigningSecret, secret)
+	assert.NotEqual(t, k.KeyHash, secret)
+}
+
+func TestUseRequestNonce(t *testing.T) {
+	now := time.Now()
+	assert.Nil(t, useRequestNonce("kid", "nonce_test_1", now))
+	assert.Equal(t, errRequestNonceUsed, useRequestNonce("kid", "nonce_test_1", now.Add(time.Minute)))
+	assert.Nil(t, useRequestNonce("kid2", "nonce_test_1", now))
+	// 超过保存时间后签名的时间已经不在允许的范围内
+	assert.Nil(t, useRequestNonce("kid", "nonce_test_1", now.Add(requestNonceTTL)))
+}
@@ -3,11 +3,11 @@ package api
 import (
 	"context"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -22,6 +22,7 @@ import (
 	"github.com/tidwall/gjson"
 	"github.com/wechatpay-apiv3/wechatpay-go/core"
 	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/signers"
+	wxerrors "github.com/wechatpay-apiv3/wechatpay-go/core/errors"
 	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
 	"github.com/wechatpay-apiv3/wechatpay-go/utils"
 )
@@ -43,21 +44,36 @@ func wclg() *logrus.Entry {
 // 1 如果为空表示使用的我们的支付账号，也就是对应微信的“普通商户支付”
 // 2 不为空表示使用的服务商支付
 
-type wechatPaymentOps struct {
-	StoreID          string `json:"store_id"`
-	PaymentAccountID string `json:"payment_account_id"`
-	TransNo          string `json:"trans_no"`
-	AppID            string `json:"app_id"`
-	OpenID           string `json:"open_id"`
-	Desp             string `json:"desp"`
-	TotalPrice       int64  `json:"total_price"`
-	From             string `json:"from"`
-
-	paymentAccount *models.PaymentAccount `json:"-"`
+// wechatNotifyBody 微信支付通知和退款通知的通用结构，resource需要用APIv3密钥解密
+type wechatNotifyBody struct {
+	EventType    string `json:"event_type"`
+	Summary      string `json:"summary"`
+	ResourceType string `json:"resource_type"`
+	Resource     struct {
+		Cipher string `json:"ciphertext"`
+		Nonce  string `json:"nonce"`
+		Data   string `json:"associated_data"`
+	} `json:"resource"`
+}
+
+func (o *wechatNotifyBody) decrypt(pa *models.PaymentAccount) (gjson.Result, error) {
+	cstr, err := utils.DecryptToString(
+		pa.APIV3Secret,
+		o.Resource.Data,
+		o.Resource.Nonce,
+		o.Resource.Cipher,
+	)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.Parse(cstr), nil
 }
 
 func apiWechat(r *gin.Engine) {
 	apiWechatNativePay(r)
+	apiWechatRefund(r)
+	apiWechatCombine(r)
+	apiWechatProfitSharing(r)
 
 	// JSAPI支付, 生成支付信息，这个接口支持小程序，公众号网页和APP支付
 	// 其中小程序和公众号逻辑是完全一样的，需要指定from: mp
@@ -68,121 +84,84 @@ func apiWechat(r *gin.Engine) {
 	// body:
 	// {
 	//  "store_id": "1",
-	// 	"payment_account_id": "1609845740",
+	// 	"payment_account_id": "1609845740", 可选，不传时使用店铺默认的微信支付账号
 	// 	"trans_no": "abcssscascscds",
 	// 	"app_id": "wx923152915c597acc",
 	// 	"open_id": "ovgfD4hx1cAmnEuFoM9A4phM9h2Y", from==app则没有此key
 	// 	"desp": "hello",
 	// 	"total_price": 10
 	//  "from": "app"|"mp"
+	//  "time_expire": "2018-06-08T10:34:56+08:00" 可选，订单失效时间，过期未支付的订单会被自动关闭
+	//  "addi_notify_url": "https://xx.com/notify" 可选，支付结果会额外通知到这个地址
+	//  "profit_sharing": true 可选，服务商账号分账，支付成功后资金冻结，见wechat_profit_sharing.go
 	// }
-	r.POST("/wechat/gen_mp_prepay", func(ctx *gin.Context) {
-		var o wechatPaymentOps
+	r.POST("/wechat/gen_mp_prepay", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o paymentOps
 		err := ctx.ShouldBindJSON(&o)
 		if err != nil {
 			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
 			return
 		}
-
-		pa, err := models.FindPaLoadPrivateCert(o.PaymentAccountID, true)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf("err to find payment account with id: %s, err: %s", o.PaymentAccountID, err)})
-			return
+		if o.From != "mp" && o.From != "app" {
+			o.From = "app"
 		}
-		o.paymentAccount = pa
+		o.Provider = models.ACCOUNT_TYPE_WECHAT
 
-		d, err := createWechatPaymentOrder(&o)
+		payParams, err := createClientPayment(ctx, &o)
 		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
-		} else {
-			prepayID := gjson.ParseBytes(d).Get("prepay_id").String()
-			if len(prepayID) == 0 {
-				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "prepay_id is empty"})
-			} else {
-				payParams, err := buildWechatPaymentParams(&o, prepayID)
-				if err != nil {
-					ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "build pay params error:" + err.Error()})
-				} else {
-					ctx.JSON(http.StatusOK, common.M{
-						"status": "ok",
-						"data":   payParams,
-					})
-				}
-			}
+			ctx.JSON(http.StatusOK, paymentErrorResponse(err))
+			return
 		}
+		ctx.JSON(http.StatusOK, common.M{
+			"status": "ok",
+			"data":   payParams,
+		})
 	})
 
-	// 小程序支付通知
-	// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_5.shtml
-	r.POST("/wechat/payment_notify/:transNo", func(ctx *gin.Context) {
-		succRsp := common.M{
-			"code":    "SUCCESS",
-			"message": "成功",
-		}
-		transNo := ctx.Param("transNo")
-		rec, err := models.FindPaymentRecordByTransNo(transNo)
+	// H5支付，用于微信外的手机浏览器，返回跳转到微信支付的h5_url
+	//
+	// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_3_1.shtml
+	//
+	// body:
+	// {
+	//  "store_id": "1",
+	// 	"payment_account_id": "2", 可选，不传时使用店铺默认的微信支付账号
+	// 	"trans_no": "abcssscascscds",
+	// 	"app_id": "wx923152915c597acc",
+	// 	"desp": "hello",
+	// 	"total_price": 10,
+	// 	"payer_client_ip": "14.23.150.211", 可选，用户的IP，不传时使用请求的IP
+	// 	"return_url": "https://eggman.tv/paid", 可选，支付完成后跳转的地址
+	//  "time_expire": "2018-06-08T10:34:56+08:00" 可选
+	//  "addi_notify_url": "https://xx.com/notify" 可选
+	// }
+	r.POST("/wechat/h5_pay", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o paymentOps
+		err := ctx.ShouldBindJSON(&o)
 		if err != nil {
 			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
 			return
 		}
-		if rec.IsSuccess() {
-			ctx.JSON(http.StatusOK, succRsp)
-			return
-		}
-
-		o := struct {
-			EventType    string `json:"event_type"`
-			Summary      string `json:"summary"`
-			ResourceType string `json:"resource_type"`
-			Resource     struct {
-				Cipher string `json:"ciphertext"`
-				Nonce  string `json:"nonce"`
-				Data   string `json:"associated_data"`
-			} `json:"resource"`
-		}{}
-		err = ctx.ShouldBindJSON(&o)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
-			return
+		o.From = "h5"
+		o.Provider = models.ACCOUNT_TYPE_WECHAT
+		if len(o.PayerClientIP) == 0 {
+			o.PayerClientIP = ctx.ClientIP()
 		}
 
-		pa, err := models.FindPaLoadPrivateCert(rec.PaymentAccountID, true)
+		data, err := createClientPayment(ctx, &o)
 		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "load pa error:" + err.Error()})
+			ctx.JSON(http.StatusOK, paymentErrorResponse(err))
 			return
 		}
-
-		cstr, err := utils.DecryptToString(
-			pa.APIV3Secret,
-			o.Resource.Data,
-			o.Resource.Nonce,
-			o.Resource.Cipher,
-		)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "decode wechat refund notify data error:" + err.Error()})
-			return
-		}
-		doc := gjson.Parse(cstr)
-		data := paymentState{
-			State:         doc.Get("trade_state").String(),
-			StateDesc:     doc.Get("trade_state_desc").String(),
-			IsSuccess:     doc.Get("trade_state").String() == "SUCCESS",
-			TransNo:       transNo,
-			PaymentMethod: "wechat",
-			PayNo:         doc.Get("transaction_id").String(),
-			Raw:           doc.Value(),
-		}
-		d, _ := json.Marshal(data)
-		go notifyToWeb("/api/payment/notify_state", d)
-		if len(rec.AddiNotifyURL) > 0 {
-			go notifyToWeb(rec.AddiNotifyURL, d)
-		}
-
-		ctx.JSON(http.StatusOK, succRsp)
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
 	})
 
+	// 小程序支付通知
+	// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_5.shtml
+	r.POST("/wechat/payment_notify/:transNo", notifyMetrics(models.ACCOUNT_TYPE_WECHAT, "payment"), paymentNotifyHandler(&wechatProvider{}))
+
 	// 使用我们的支付号检查订单状态
-	r.POST("/wechat/payment_check", func(ctx *gin.Context) {
+	r.POST("/wechat/payment_check", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
 		o := struct {
 			StoreID          string `json:"store_id"`
 			PaymentAccountID string `json:"payment_account_id"`
@@ -193,13 +172,25 @@ func apiWechat(r *gin.Engine) {
 			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
 			return
 		}
+		o.PaymentAccountID, o.StoreID, err = clientPaymentCheckAccount(ctx, o.TransNo, o.PaymentAccountID, o.StoreID)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
 
 		pa, err := models.FindPaLoadPrivateCert(o.PaymentAccountID, true)
 		if err != nil {
 			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "load pa error:" + err.Error()})
 			return
 		}
-		store, _ := models.FindStoreWithOnlyMerID(o.StoreID)
+		var store *models.Store
+		if pa.IsWechatServiceProviderAccount() {
+			store, err = models.FindWechatSubMerchantStore(o.StoreID, pa)
+			if err != nil {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+				return
+			}
+		}
 		res := getWechatPaymentStateByTransNo(store, pa, o.TransNo)
 		if res.Err != "" {
 			ctx.JSON(http.StatusOK, common.M{
@@ -212,6 +203,35 @@ func apiWechat(r *gin.Engine) {
 
 		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{"payment_state": res}})
 	})
+
+	// 关闭未支付的订单，关闭后不能再支付，需要用新的trans_no重新下单
+	// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_3.shtml
+	//
+	// body:
+	// {
+	// 	"trans_no": "abcssscascscds"
+	// }
+	r.POST("/wechat/payment_close", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		o := struct {
+			TransNo string `json:"trans_no"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+
+		rec, err := findClientPaymentRecord(ctx, o.TransNo)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := closePayment(rec); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
 }
 
 func getWechatPaymentStateByTransNo(store *models.Store, pa *models.PaymentAccount, transNo string) *paymentState {
@@ -227,16 +247,17 @@ func getWechatPaymentStateByTransNo(store *models.Store, pa *models.PaymentAccou
 	}
 	var url string
 	if pa.IsWechatServiceProviderAccount() {
-		url = fmt.Sprintf("https://api.mch.weixin.qq.com/v3/pay/partner/transactions/out-trade-no/%s?sp_mchid=%s&sub_mchid=%s",
-			transNo, pa.MerID, store.WechatPaymentMerID)
+		url = wechatAPIURL(fmt.Sprintf("/v3/pay/partner/transactions/out-trade-no/%s?sp_mchid=%s&sub_mchid=%s",
+			transNo, pa.MerID, store.WechatPaymentMerID))
 	} else {
-		url = fmt.Sprintf("https://api.mch.weixin.qq.com/v3/pay/transactions/out-trade-no/%s?mchid=%s",
-			transNo, pa.MerID)
+		url = wechatAPIURL(fmt.Sprintf("/v3/pay/transactions/out-trade-no/%s?mchid=%s",
+			transNo, pa.MerID))
 	}
 	// 发起请求
 	rsp, err := client.Get(context.TODO(), url)
 	if err != nil {
 		res.Err = "wechat, get trans_no state error:" + err.Error()
+		res.notExist = isWechatOrderNotExist(err)
 		return &res
 	}
 	// 校验回包内容是否有逻辑错误
@@ -258,10 +279,63 @@ func getWechatPaymentStateByTransNo(store *models.Store, pa *models.PaymentAccou
 	res.StateDesc = doc.Get("trade_state_desc").String()
 	res.PayNo = doc.Get("transaction_id").String()
 	res.IsSuccess = res.State == "SUCCESS"
+	res.status, _ = models.WechatTradeStateToStatus(res.State)
+	res.rawRsp = string(body)
 	return &res
 }
 
-func buildWechatPaymentParams(o *wechatPaymentOps, prepayID string) (common.M, error) {
+// isWechatOrderNotExist 微信返回ORDER_NOT_EXIST，订单不存在
+func isWechatOrderNotExist(err error) bool {
+	var werr *wxerrors.Error
+	return errors.As(err, &werr) && werr.Code == "ORDER_NOT_EXIST"
+}
+
+// isWechatResourceNotExist 微信返回404，查询的单据不存在
+func isWechatResourceNotExist(err error) bool {
+	var werr *wxerrors.Error
+	return errors.As(err, &werr) && werr.StatusCode == http.StatusNotFound
+}
+
+// wechatRejectedReason 微信明确拒绝的请求(4xx，频率限制除外)，同样的参数重试也不会成功，返回微信的错误码和描述
+func wechatRejectedReason(err error) (string, bool) {
+	var werr *wxerrors.Error
+	if !errors.As(err, &werr) || werr.StatusCode < 400 || werr.StatusCode >= 500 || werr.StatusCode == http.StatusTooManyRequests {
+		return "", false
+	}
+	return werr.Code + ": " + werr.Message, true
+}
+
+// closeWechatPayment 关闭订单，关单成功微信返回204
+// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_3.shtml
+func closeWechatPayment(store *models.Store, pa *models.PaymentAccount, transNo string) error {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return err
+	}
+	var url string
+	var body map[string]interface{}
+	if pa.IsWechatServiceProviderAccount() {
+		url = wechatAPIURL(fmt.Sprintf("/v3/pay/partner/transactions/out-trade-no/%s/close", transNo))
+		body = map[string]interface{}{
+			"sp_mchid":  pa.MerID,
+			"sub_mchid": store.WechatPaymentMerID,
+		}
+	} else {
+		url = wechatAPIURL(fmt.Sprintf("/v3/pay/transactions/out-trade-no/%s/close", transNo))
+		body = map[string]interface{}{
+			"mchid": pa.MerID,
+		}
+	}
+	rsp, err := client.Post(context.TODO(), url, body)
+	if err != nil {
+		wclg().Warnf("close trans_no: %s err: %s", transNo, err)
+		return err
+	}
+	_, err = validateWechatClientRsp(rsp)
+	return err
+}
+
+func buildWechatPaymentParams(o *paymentOps, prepayID string) (common.M, error) {
 	t := cast.ToString(time.Now().In(models.ChinaTz).Unix())
 	nonce := common.GenRandomStr(32)
 	res := make(common.M)
@@ -311,7 +385,7 @@ func buildWechatPaymentParams(o *wechatPaymentOps, prepayID string) (common.M, e
 	return res, nil
 }
 
-func createWechatPaymentOrder(o *wechatPaymentOps) ([]byte, error) {
+func createWechatPaymentOrder(o *paymentOps) ([]byte, error) {
 	// 初始化客户端
 	ctx := context.TODO()
 	client, err := setUpWechatClient(o.paymentAccount, true)
@@ -328,32 +402,61 @@ func createWechatPaymentOrder(o *wechatPaymentOps) ([]byte, error) {
 			"currency": "CNY",
 		},
 	}
+	if len(o.TimeExpire) > 0 {
+		mapInfo["time_expire"] = o.expireAt.In(models.ChinaTz).Format(time.RFC3339)
+	}
 	var url string
 	if o.paymentAccount.IsWechatServiceProviderAccount() {
-		store, _ := models.FindStoreWithOnlyMerID(o.StoreID)
+		store, err := models.FindWechatSubMerchantStore(o.StoreID, o.paymentAccount)
+		if err != nil {
+			return nil, err
+		}
 		mapInfo["sp_appid"] = o.paymentAccount.AppID
 		mapInfo["sp_mchid"] = o.paymentAccount.MerID
 		mapInfo["sub_appid"] = o.AppID
 		mapInfo["sub_mchid"] = store.WechatPaymentMerID
-		if o.From == "mp" {
+		if o.ProfitSharing {
+			mapInfo["settle_info"] = map[string]interface{}{
+				"profit_sharing": true,
+			}
+		}
+		switch o.From {
+		case "mp":
 			mapInfo["payer"] = map[string]interface{}{
 				"sub_openid": o.OpenID,
 			}
-			url = "https://api.mch.weixin.qq.com/v3/pay/partner/transactions/jsapi"
-		} else {
-			url = "https://api.mch.weixin.qq.com/v3/pay/partner/transactions/app"
+			url = wechatAPIURL("/v3/pay/partner/transactions/jsapi")
+		case "native":
+			url = wechatAPIURL("/v3/pay/partner/transactions/native")
+		case "h5":
+			url = wechatAPIURL("/v3/pay/partner/transactions/h5")
+		default:
+			url = wechatAPIURL("/v3/pay/partner/transactions/app")
 		}
 	} else {
 		mapInfo["mchid"] = o.paymentAccount.MerID
 		mapInfo["appid"] = o.AppID
-		if o.From == "mp" {
+		switch o.From {
+		case "mp":
 			mapInfo["payer"] = map[string]interface{}{
 				"openid": o.OpenID,
 			}
-			url = "https://api.mch.weixin.qq.com/v3/pay/transactions/jsapi"
-		} else {
-			url = "https://api.mch.weixin.qq.com/v3/pay/transactions/app"
+			url = wechatAPIURL("/v3/pay/transactions/jsapi")
+		case "native":
+			url = wechatAPIURL("/v3/pay/transactions/native")
+		case "h5":
+			url = wechatAPIURL("/v3/pay/transactions/h5")
+		default:
+			url = wechatAPIURL("/v3/pay/transactions/app")
+		}
+	}
+
+	if o.From == "h5" {
+		sceneInfo, err := wechatH5SceneInfo(o.PayerClientIP)
+		if err != nil {
+			return nil, err
 		}
+		mapInfo["scene_info"] = sceneInfo
 	}
 
 	// 发起请求
@@ -371,35 +474,53 @@ func createWechatPaymentOrder(o *wechatPaymentOps) ([]byte, error) {
 	return body, nil
 }
 
+// wechatH5SceneInfo H5支付必须传用户的IP和场景类型
+// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_3_1.shtml
+func wechatH5SceneInfo(payerClientIP string) (map[string]interface{}, error) {
+	if len(payerClientIP) == 0 {
+		return nil, errors.New("payer_client_ip is required for wechat h5 payment")
+	}
+	return map[string]interface{}{
+		"payer_client_ip": payerClientIP,
+		"h5_info": map[string]interface{}{
+			"type": "Wap",
+		},
+	}, nil
+}
+
+// wechatH5URL 支付完成后微信会跳转到redirect_url，需要urlencode后拼接到h5_url
+func wechatH5URL(h5URL, redirectURL string) string {
+	if len(redirectURL) == 0 {
+		return h5URL
+	}
+	sep := "&"
+	if !strings.Contains(h5URL, "?") {
+		sep = "?"
+	}
+	return h5URL + sep + "redirect_url=" + url.QueryEscape(redirectURL)
+}
+
+// wechatAPIURL path为/v3开头的接口路径
+func wechatAPIURL(path string) string {
+	return config.WechatPayBaseURL + path
+}
+
+// setUpWechatClient needValidator为true时使用缓存的client，false只用于下载平台证书
 func setUpWechatClient(pa *models.PaymentAccount, needValidator bool) (*core.Client, error) {
-	//设置header头中authorization信息
-	var opts []option.ClientOption
 	if needValidator {
-		cs, err := getWechatPlatformCert(pa)
-		if err != nil {
+		return wechatCerts.Client(pa)
+	}
+	if pa.LoadedCertPrivate == nil {
+		if err := pa.LoadPrivCert(); err != nil {
 			return nil, err
 		}
-		if len(cs) == 0 {
-			return nil, errors.New("platform cert is 0")
-		}
-
-		opts = []option.ClientOption{
-			option.WithMerchant(pa.MerID, pa.CertSerialNumber, pa.LoadedCertPrivate), // 设置商户相关配置
-			option.WithWechatPay(cs), // 设置微信支付平台证书，用于校验回包信息用
-		}
-	} else {
-		opts = []option.ClientOption{
-			option.WithMerchant(pa.MerID, pa.CertSerialNumber, pa.LoadedCertPrivate), // 设置商户相关配置
-			option.WithoutValidator(),
-		}
 	}
-
-	client, err := core.NewClient(context.TODO(), opts...)
-	if err != nil {
-		return nil, err
-	}
-
-	return client, nil
+	return core.NewClient(context.TODO(),
+		option.WithMerchant(pa.MerID, pa.CertSerialNumber, pa.LoadedCertPrivate), // 设置商户相关配置
+		option.WithoutValidator(),
+		option.WithTimeout(config.WechatPayTimeout),
+		option.WithHTTPClient(wechatHTTPClient(pa.MerID)),
+	)
 }
 
 func validateWechatClientRsp(rsp *http.Response) ([]byte, error) {
@@ -418,15 +539,34 @@ func validateWechatClientRsp(rsp *http.Response) ([]byte, error) {
 	return body, nil
 }
 
-// getWechatPlatformCert 获取微信的平台证书，注意这个和我们自己的公钥和私钥不是一回事
-// 平台证书用于验证请求的合法性
+// getWechatPlatformCert 下载微信的平台证书，注意这个和我们自己的公钥和私钥不是一回事
+// 平台证书用于验证请求的合法性，不要直接调用，使用wechatCerts中缓存的证书
 func getWechatPlatformCert(pa *models.PaymentAccount) ([]*x509.Certificate, error) {
+	ecs, err := downloadWechatPlatformCerts(pa)
+	if err != nil {
+		return nil, err
+	}
+	certs, _ := decryptWechatPlatformCerts(pa, ecs, time.Now())
+	return certs, nil
+}
+
+// wechatEncryptedCert 微信用APIv3密钥加密的平台证书，redis中也只保存加密的内容，每次使用前重新解密校验
+type wechatEncryptedCert struct {
+	SerialNo       string `json:"serial_no"`
+	AssociatedData string `json:"associated_data"`
+	Nonce          string `json:"nonce"`
+	Ciphertext     string `json:"ciphertext"`
+}
+
+// downloadWechatPlatformCerts 下载加密的平台证书
+// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/wechatpay5_1.shtml
+func downloadWechatPlatformCerts(pa *models.PaymentAccount) ([]wechatEncryptedCert, error) {
 	ctx := context.TODO()
 	client, err := setUpWechatClient(pa, false)
 	if err != nil {
 		return nil, err
 	}
-	rsp, err := client.Get(ctx, "https://api.mch.weixin.qq.com/v3/certificates")
+	rsp, err := client.Get(ctx, wechatAPIURL("/v3/certificates"))
 	if err != nil {
 		wclg().Warnf("get platform cert err:%s", err)
 		return nil, err
@@ -440,26 +580,46 @@ func getWechatPlatformCert(pa *models.PaymentAccount) ([]*x509.Certificate, erro
 		wclg().Warnf("read rsp body err:%s", err.Error())
 		return nil, err
 	}
-	certs := make([]*x509.Certificate, 0)
+	var ecs []wechatEncryptedCert
 	gjson.ParseBytes(body).Get("data").ForEach(func(k, v gjson.Result) bool {
-		cstr, err := utils.DecryptToString(
-			pa.APIV3Secret,
-			v.Get("encrypt_certificate.associated_data").String(),
-			v.Get("encrypt_certificate.nonce").String(),
-			v.Get("encrypt_certificate.ciphertext").String(),
-		)
+		ecs = append(ecs, wechatEncryptedCert{
+			SerialNo:       v.Get("serial_no").String(),
+			AssociatedData: v.Get("encrypt_certificate.associated_data").String(),
+			Nonce:          v.Get("encrypt_certificate.nonce").String(),
+			Ciphertext:     v.Get("encrypt_certificate.ciphertext").String(),
+		})
+		return true
+	})
+	return ecs, nil
+}
+
+// decryptWechatPlatformCerts AEAD解密成功说明证书是用我们的APIv3密钥加密的，没有APIv3密钥不能伪造
+// 序列号和serial_no不一致或者不在有效期内的证书跳过，同时返回通过校验的加密证书用于缓存
+func decryptWechatPlatformCerts(pa *models.PaymentAccount, ecs []wechatEncryptedCert, now time.Time) ([]*x509.Certificate, []wechatEncryptedCert) {
+	certs := make([]*x509.Certificate, 0, len(ecs))
+	valid := make([]wechatEncryptedCert, 0, len(ecs))
+	for _, ec := range ecs {
+		cstr, err := utils.DecryptToString(pa.APIV3Secret, ec.AssociatedData, ec.Nonce, ec.Ciphertext)
 		if err != nil {
-			wclg().Warnln("decode wechat platform cert error:", err)
-			return true
+			wclg().Warnf("decode wechat platform cert error, mer_id: %s, serial_no: %s, err: %s", pa.MerID, ec.SerialNo, err)
+			continue
 		}
-
 		c, err := utils.LoadCertificate(cstr)
 		if err != nil {
-			wclg().Warnln("load wechat platform cert error:", err)
-		} else {
-			certs = append(certs, c)
+			wclg().Warnf("load wechat platform cert error, mer_id: %s, serial_no: %s, err: %s", pa.MerID, ec.SerialNo, err)
+			continue
 		}
-		return true
-	})
-	return certs, nil
+		if serial := fmt.Sprintf("%X", c.SerialNumber); len(ec.SerialNo) > 0 && !strings.EqualFold(serial, ec.SerialNo) {
+			wclg().Warnf("wechat platform cert serial mismatch, mer_id: %s, serial_no: %s, cert: %s", pa.MerID, ec.SerialNo, serial)
+			continue
+		}
+		if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+			wclg().Warnf("wechat platform cert not valid now, mer_id: %s, serial_no: %s, not_before: %s, not_after: %s",
+				pa.MerID, ec.SerialNo, c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		certs = append(certs, c)
+		valid = append(valid, ec)
+	}
+	return certs, valid
 }
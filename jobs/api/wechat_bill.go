@@ -0,0 +1,310 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-gin-payment/models"
+
+	"github.com/tidwall/gjson"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	wxerrors "github.com/wechatpay-apiv3/wechatpay-go/core/errors"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+//
+// 微信账单下载和解析，对账见reconcile.go
+//
+// 交易账单: https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter4_1_6.shtml
+// 资金账单: https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter4_1_7.shtml
+// 子商户资金账单: https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter4_1_12.shtml
+//
+// 申请账单接口返回下载地址和摘要，下载后需要校验摘要；子商户资金账单是加密的，需要先解密再校验
+// 账单为csv格式，第一行为表头，之后是明细，最后两行为汇总，每个字段前有一个`
+//
+
+// errWechatNoStatement 当天没有交易时微信不生成账单
+var errWechatNoStatement = errors.New("wechat statement not exist")
+
+// wechatTradeBillRow 交易账单中的一行，金额单位为分
+type wechatTradeBillRow struct {
+	SubMchID     string
+	PayNo        string // 微信订单号
+	TransNo      string // 商户订单号
+	Status       string // SUCCESS|REFUND|REVOKED
+	Fen          int64  // 订单金额
+	RefundPayNo  string
+	RefundNo     string
+	RefundFen    int64
+	RefundStatus string
+}
+
+// wechatFundFlowSummary 资金账单的汇总，金额单位为分
+type wechatFundFlowSummary struct {
+	Count      int
+	IncomeFen  int64
+	ExpenseFen int64
+}
+
+func (s *wechatFundFlowSummary) add(o wechatFundFlowSummary) {
+	s.Count += o.Count
+	s.IncomeFen += o.IncomeFen
+	s.ExpenseFen += o.ExpenseFen
+}
+
+// downloadWechatTradeBill subMchID不为空时下载子商户的交易账单
+func downloadWechatTradeBill(pa *models.PaymentAccount, subMchID, billDate string) ([]byte, error) {
+	u := wechatAPIURL("/v3/bill/tradebill?bill_type=ALL&bill_date=" + billDate)
+	if len(subMchID) > 0 {
+		u += "&sub_mchid=" + subMchID
+	}
+	doc, err := applyWechatBill(pa, u)
+	if err != nil {
+		return nil, err
+	}
+	return downloadWechatBill(pa, doc.Get("download_url").String(), doc.Get("hash_type").String(), doc.Get("hash_value").String())
+}
+
+// downloadWechatFundFlowBill 账号自己的基本账户资金账单
+func downloadWechatFundFlowBill(pa *models.PaymentAccount, billDate string) ([]byte, error) {
+	doc, err := applyWechatBill(pa, wechatAPIURL("/v3/bill/fundflowbill?account_type=BASIC&bill_date="+billDate))
+	if err != nil {
+		return nil, err
+	}
+	return downloadWechatBill(pa, doc.Get("download_url").String(), doc.Get("hash_type").String(), doc.Get("hash_value").String())
+}
+
+// downloadWechatSubMerchantFundFlowBill 服务商下载子商户的资金账单，可能分为多个文件
+func downloadWechatSubMerchantFundFlowBill(pa *models.PaymentAccount, subMchID, billDate string) ([][]byte, error) {
+	doc, err := applyWechatBill(pa, wechatAPIURL(fmt.Sprintf(
+		"/v3/bill/sub-merchant-fundflowbill?sub_mchid=%s&bill_date=%s&account_type=BASIC&algorithm=AEAD_AES_256_GCM",
+		subMchID, billDate)))
+	if err != nil {
+		return nil, err
+	}
+	files := make([][]byte, 0)
+	for _, f := range doc.Get("download_bill_list").Array() {
+		d, err := downloadWechatBill(pa, f.Get("download_url").String(), "", "")
+		if err != nil {
+			return nil, err
+		}
+		d, err = decryptWechatBill(pa, d, f.Get("encrypt_key").String(), f.Get("nonce").String())
+		if err != nil {
+			return nil, fmt.Errorf("decrypt bill %d error: %s", f.Get("bill_sequence").Int(), err)
+		}
+		if err := verifyWechatBillHash(d, f.Get("hash_type").String(), f.Get("hash_value").String()); err != nil {
+			return nil, err
+		}
+		files = append(files, d)
+	}
+	return files, nil
+}
+
+// applyWechatBill 申请账单，返回下载地址和摘要
+func applyWechatBill(pa *models.PaymentAccount, u string) (gjson.Result, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	rsp, err := client.Get(context.TODO(), u)
+	if err != nil {
+		var werr *wxerrors.Error
+		if errors.As(err, &werr) && werr.Code == "NO_STATEMENT_EXIST" {
+			return gjson.Result{}, errWechatNoStatement
+		}
+		wclg().Warnf("apply bill %s err: %s", u, err)
+		return gjson.Result{}, err
+	}
+	body, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(body), nil
+}
+
+// downloadWechatBill 下载的账单文件没有微信的签名，使用不校验回包的client，hashType为空时不校验摘要
+func downloadWechatBill(pa *models.PaymentAccount, downloadURL, hashType, hashValue string) ([]byte, error) {
+	if len(downloadURL) == 0 {
+		return nil, errors.New("empty bill download_url")
+	}
+	client, err := setUpWechatClient(pa, false)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Get(context.TODO(), downloadURL)
+	if err != nil {
+		wclg().Warnf("download bill err: %s", err)
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if err := core.CheckResponse(rsp); err != nil {
+		return nil, err
+	}
+	d, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(hashType) > 0 {
+		if err := verifyWechatBillHash(d, hashType, hashValue); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// verifyWechatBillHash 微信目前只使用SHA1
+func verifyWechatBillHash(d []byte, hashType, hashValue string) error {
+	if !strings.EqualFold(hashType, "SHA1") {
+		return fmt.Errorf("unsupported bill hash_type: %s", hashType)
+	}
+	sum := sha1.Sum(d)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), hashValue) {
+		return fmt.Errorf("bill hash mismatch, expected: %s, got: %x", hashValue, sum)
+	}
+	return nil
+}
+
+// decryptWechatBill encrypt_key使用商户证书的公钥加密，解密后为AES-256-GCM的密钥
+func decryptWechatBill(pa *models.PaymentAccount, d []byte, encryptKey, nonce string) ([]byte, error) {
+	if pa.LoadedCertPrivate == nil {
+		if err := pa.LoadPrivCert(); err != nil {
+			return nil, err
+		}
+	}
+	key, err := utils.DecryptOAEP(encryptKey, pa.LoadedCertPrivate)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, []byte(nonce), d, nil)
+}
+
+// readWechatBill 返回表头和明细，去掉汇总和每个字段前的`
+func readWechatBill(d []byte) (map[string]int, [][]string, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("empty wechat bill")
+	}
+	header := make(map[string]int, len(records[0]))
+	for i, h := range records[0] {
+		header[cleanWechatBillField(h)] = i
+	}
+	rows := make([][]string, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		// 汇总的表头，比如"总交易单数"、"资金流水总笔数"
+		if len(rec) > 0 && !strings.HasPrefix(strings.TrimSpace(rec[0]), "`") {
+			break
+		}
+		for i := range rec {
+			rec[i] = cleanWechatBillField(rec[i])
+		}
+		rows = append(rows, rec)
+	}
+	return header, rows, nil
+}
+
+func cleanWechatBillField(s string) string {
+	return strings.TrimPrefix(strings.TrimSpace(s), "`")
+}
+
+// wechatBillColumn 按表头名称取值，names按顺序使用第一个存在的列
+func wechatBillColumn(header map[string]int, row []string, names ...string) string {
+	for _, n := range names {
+		if i, ok := header[n]; ok && i < len(row) {
+			return row[i]
+		}
+	}
+	return ""
+}
+
+func wechatBillFen(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bill amount: %s", s)
+	}
+	return models.YuanToFen(v), nil
+}
+
+// parseWechatTradeBill 订单金额优先使用"订单金额"(包含代金券)，旧的账单没有该列时使用"应结订单金额"
+func parseWechatTradeBill(d []byte) ([]wechatTradeBillRow, error) {
+	header, rows, err := readWechatBill(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"商户订单号", "微信订单号", "交易状态"} {
+		if _, ok := header[h]; !ok {
+			return nil, fmt.Errorf("invalid wechat trade bill, missing column: %s", h)
+		}
+	}
+	res := make([]wechatTradeBillRow, 0, len(rows))
+	for _, row := range rows {
+		fen, err := wechatBillFen(wechatBillColumn(header, row, "订单金额", "应结订单金额"))
+		if err != nil {
+			return nil, err
+		}
+		refundFen, err := wechatBillFen(wechatBillColumn(header, row, "退款金额"))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, wechatTradeBillRow{
+			SubMchID:     wechatBillColumn(header, row, "特约商户号"),
+			PayNo:        wechatBillColumn(header, row, "微信订单号"),
+			TransNo:      wechatBillColumn(header, row, "商户订单号"),
+			Status:       wechatBillColumn(header, row, "交易状态"),
+			Fen:          fen,
+			RefundPayNo:  wechatBillColumn(header, row, "微信退款单号"),
+			RefundNo:     wechatBillColumn(header, row, "商户退款单号"),
+			RefundFen:    refundFen,
+			RefundStatus: wechatBillColumn(header, row, "退款状态"),
+		})
+	}
+	return res, nil
+}
+
+func parseWechatFundFlowBill(d []byte) (wechatFundFlowSummary, error) {
+	var s wechatFundFlowSummary
+	header, rows, err := readWechatBill(d)
+	if err != nil {
+		return s, err
+	}
+	for _, row := range rows {
+		fen, err := wechatBillFen(wechatBillColumn(header, row, "收支金额(元)", "收支金额（元）"))
+		if err != nil {
+			return s, err
+		}
+		s.Count++
+		switch wechatBillColumn(header, row, "收支类型") {
+		case "收入":
+			s.IncomeFen += fen
+		case "支出":
+			s.ExpenseFen += fen
+		}
+	}
+	return s, nil
+}
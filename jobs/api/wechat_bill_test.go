@@ -0,0 +1,79 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+const testWechatTradeBill = "交易时间,公众账号ID,商户号,特约商户号,设备号,微信订单号,商户订单号,用户标识,交易类型,交易状态,付款银行,货币种类,应结订单金额,代金券金额,微信退款单号,商户退款单号,退款金额,充值券退款金额,退款类型,退款状态,商品名称,商户数据包,手续费,费率,订单金额,申请退款金额,费率备注\n" +
+	"`2021-06-01 10:20:30,`wx8888888888888888,`1900000100,`1900000109,`,`4200001100202106011234567890,`t1,`oUpF8uMuAJO_M2pxb1Q9zNjWeS6o,`JSAPI,`SUCCESS,`OTHERS,`CNY,`0.90,`0.10,`0,`0,`0.00,`0.00,`,`,`hello,`,`0.00000,`0.60%,`1.00,`0.00,`\n" +
+	"`2021-06-01 11:20:30,`wx8888888888888888,`1900000100,`1900000109,`,`4200001100202106011234567891,`t2,`oUpF8uMuAJO_M2pxb1Q9zNjWeS6o,`JSAPI,`REFUND,`OTHERS,`CNY,`0.00,`0.00,`50300000012021060112345678,`r2,`0.50,`0.00,`ORIGINAL,`SUCCESS,`world,`,`0.00000,`0.60%,`0.00,`0.50,`\n" +
+	"总交易单数,应结订单总金额,退款总金额,充值券退款总金额,手续费总金额,订单总金额,申请退款总金额\n" +
+	"`2,`0.90,`0.50,`0.00,`0.00000,`1.00,`0.50\n"
+
+const testWechatFundFlowBill = "记账时间,微信支付业务单号,资金流水单号,业务名称,业务类型,收支类型,收支金额(元),账户结余(元),资金变更提交申请人,备注,业务凭证号\n" +
+	"`2021-06-01 10:20:30,`4200001100202106011234567890,`1900000100202106011234,`交易,`交易,`收入,`1.00,`1.00,`system,`,`t1\n" +
+	"`2021-06-01 11:20:30,`50300000012021060112345678,`1900000100202106011235,`退款,`退款,`支出,`0.50,`0.50,`system,`,`r2\n" +
+	"资金流水总笔数,收入笔数,收入金额,支出笔数,支出金额\n" +
+	"`2,`1,`1.00,`1,`0.50\n"
+
+func TestParseWechatTradeBill(t *testing.T) {
+	rows, err := parseWechatTradeBill([]byte("\xef\xbb\xbf" + testWechatTradeBill))
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+
+	assert.Equal(t, "t1", rows[0].TransNo)
+	assert.Equal(t, "1900000109", rows[0].SubMchID)
+	assert.Equal(t, "SUCCESS", rows[0].Status)
+	assert.Equal(t, int64(100), rows[0].Fen)
+
+	assert.Equal(t, "REFUND", rows[1].Status)
+	assert.Equal(t, "r2", rows[1].RefundNo)
+	assert.Equal(t, int64(50), rows[1].RefundFen)
+	assert.Equal(t, "SUCCESS", rows[1].RefundStatus)
+
+	_, err = parseWechatTradeBill([]byte("交易时间,商户号\n"))
+	assert.NotNil(t, err)
+}
+
+func TestParseWechatFundFlowBill(t *testing.T) {
+	s, err := parseWechatFundFlowBill([]byte(testWechatFundFlowBill))
+	assert.Nil(t, err)
+	assert.Equal(t, wechatFundFlowSummary{Count: 2, IncomeFen: 100, ExpenseFen: 50}, s)
+}
+
+func TestVerifyWechatBillHash(t *testing.T) {
+	d := []byte(testWechatTradeBill)
+	sum := sha1.Sum(d)
+	assert.Nil(t, verifyWechatBillHash(d, "SHA1", hex.EncodeToString(sum[:])))
+	assert.NotNil(t, verifyWechatBillHash(append(d, '\n'), "SHA1", hex.EncodeToString(sum[:])))
+	assert.NotNil(t, verifyWechatBillHash(d, "MD5", hex.EncodeToString(sum[:])))
+}
+
+func TestDecryptWechatBill(t *testing.T) {
+	pa := newTestWechatAccount(t)
+	assert.Nil(t, pa.LoadPrivCert())
+
+	key := "0123456789abcdef0123456789abcdef"
+	nonce := "0123456789ab"
+	encryptKey, err := utils.EncryptOAEPWithPublicKey(key, &pa.LoadedCertPrivate.PublicKey)
+	assert.Nil(t, err)
+	block, err := aes.NewCipher([]byte(key))
+	assert.Nil(t, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+	ciphertext := gcm.Seal(nil, []byte(nonce), []byte(testWechatFundFlowBill), nil)
+
+	d, err := decryptWechatBill(pa, ciphertext, encryptKey, nonce)
+	assert.Nil(t, err)
+	assert.Equal(t, testWechatFundFlowBill, string(d))
+
+	_, err = decryptWechatBill(pa, ciphertext[1:], encryptKey, nonce)
+	assert.NotNil(t, err)
+}
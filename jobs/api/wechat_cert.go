@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+)
+
+//
+// 微信平台证书和core.Client的缓存
+//
+// 平台证书按商户号保存在内存和redis中(多个实例共享)，超过wechatCertRefreshAfter或者
+// 有证书快要过期时由后台任务重新下载；通知中的Wechatpay-Serial找不到时也会立即重新下载一次
+//
+// redis中只保存微信返回的加密证书，读取后用账号的APIv3密钥重新解密并检查有效期，
+// 能写redis但没有APIv3密钥时不能注入伪造的平台证书
+//
+// core.Client按PaymentAccount缓存，账号的配置(Fingerprint)变化或者平台证书更新后重新创建
+//
+
+const (
+	// wechatCertRefreshAfter 微信建议定期更新平台证书
+	wechatCertRefreshAfter = 12 * time.Hour
+	// wechatCertExpireAhead 证书在这个时间内过期时提前更新
+	wechatCertExpireAhead = 7 * 24 * time.Hour
+	// wechatCertForceRefreshInterval 找不到序列号时强制更新的最小间隔，防止被伪造的序列号刷接口
+	wechatCertForceRefreshInterval = time.Minute
+	wechatCertRefreshTick          = time.Hour
+
+	wechatCertRedisKey = "wechat_platform_certs:"
+)
+
+var wechatCerts *wechatCertManager
+
+func init() {
+	wechatCerts = newWechatCertManager(downloadWechatPlatformCerts)
+}
+
+type wechatCertManager struct {
+	mu      sync.Mutex
+	entries map[int64]*wechatAccountEntry
+	fetch   func(pa *models.PaymentAccount) ([]wechatEncryptedCert, error)
+}
+
+type wechatAccountEntry struct {
+	mu          sync.Mutex
+	pa          *models.PaymentAccount
+	fingerprint string
+	certs       map[string]*x509.Certificate
+	fetchedAt   time.Time
+	client      *core.Client
+}
+
+// wechatCachedCerts 保存到redis的内容，之前保存明文证书(certs)的缓存读取时为空，会重新下载
+type wechatCachedCerts struct {
+	FetchedAt      int64                 `json:"fetched_at"`
+	EncryptedCerts []wechatEncryptedCert `json:"encrypted_certs"`
+}
+
+func newWechatCertManager(fetch func(pa *models.PaymentAccount) ([]wechatEncryptedCert, error)) *wechatCertManager {
+	return &wechatCertManager{
+		entries: make(map[int64]*wechatAccountEntry),
+		fetch:   fetch,
+	}
+}
+
+// entry 账号配置有变化时丢弃之前的缓存
+func (m *wechatCertManager) entry(pa *models.PaymentAccount) (*wechatAccountEntry, error) {
+	if pa.LoadedCertPrivate == nil {
+		if err := pa.LoadPrivCert(); err != nil {
+			return nil, err
+		}
+	}
+	fp := pa.Fingerprint()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[pa.ID]
+	if !ok || e.fingerprint != fp {
+		e = &wechatAccountEntry{pa: pa, fingerprint: fp}
+		m.entries[pa.ID] = e
+	}
+	return e, nil
+}
+
+// Invalidate 账号修改或删除后调用
+func (m *wechatCertManager) Invalidate(paymentAccountID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, paymentAccountID)
+}
+
+// Certs 返回序列号到证书的map
+func (m *wechatCertManager) Certs(pa *models.PaymentAccount) (map[string]*x509.Certificate, error) {
+	e, err := m.entry(pa)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := m.ensureCerts(e); err != nil {
+		return nil, err
+	}
+	return e.certs, nil
+}
+
+// CertsWithSerial 和Certs一样，但是serial不存在时会重新下载一次，用于微信更换平台证书的情况
+func (m *wechatCertManager) CertsWithSerial(pa *models.PaymentAccount, serial string) (map[string]*x509.Certificate, error) {
+	e, err := m.entry(pa)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := m.ensureCerts(e); err != nil {
+		return nil, err
+	}
+	if _, ok := e.certs[serial]; ok || time.Since(e.fetchedAt) < wechatCertForceRefreshInterval {
+		return e.certs, nil
+	}
+	wclg().Infof("wechat platform cert serial not found: %s, mer_id: %s, refresh", serial, pa.MerID)
+	if err := m.refresh(e); err != nil {
+		return nil, err
+	}
+	return e.certs, nil
+}
+
+// Client 带有平台证书校验的client
+func (m *wechatCertManager) Client(pa *models.PaymentAccount) (*core.Client, error) {
+	e, err := m.entry(pa)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client != nil {
+		return e.client, nil
+	}
+	if err := m.ensureCerts(e); err != nil {
+		return nil, err
+	}
+
+	cs := make([]*x509.Certificate, 0, len(e.certs))
+	for _, c := range e.certs {
+		cs = append(cs, c)
+	}
+	client, err := core.NewClient(context.TODO(),
+		option.WithMerchant(pa.MerID, pa.CertSerialNumber, pa.LoadedCertPrivate), // 设置商户相关配置
+		option.WithWechatPay(cs), // 设置微信支付平台证书，用于校验回包信息用
+		option.WithTimeout(config.WechatPayTimeout),
+		option.WithHTTPClient(wechatHTTPClient(pa.MerID)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	return client, nil
+}
+
+// ensureCerts 需要持有e.mu，内存中没有时先从redis读取，都没有再下载
+func (m *wechatCertManager) ensureCerts(e *wechatAccountEntry) error {
+	if e.certs != nil {
+		return nil
+	}
+	if certs, fetchedAt, ok := loadWechatCertsFromRedis(e.pa, time.Now()); ok && !wechatCertsNeedRefresh(certs, fetchedAt, time.Now()) {
+		e.certs = certs
+		e.fetchedAt = fetchedAt
+		return nil
+	}
+	return m.refresh(e)
+}
+
+// refresh 需要持有e.mu，下载失败时保留原来的证书
+func (m *wechatCertManager) refresh(e *wechatAccountEntry) error {
+	ecs, err := m.fetch(e.pa)
+	if err != nil {
+		return fmt.Errorf("get platform cert error: %w", err)
+	}
+	now := time.Now()
+	cs, valid := decryptWechatPlatformCerts(e.pa, ecs, now)
+	if len(cs) == 0 {
+		return errors.New("platform cert is 0")
+	}
+	e.certs = wechatCertsBySerial(cs)
+	e.fetchedAt = now
+	e.client = nil
+	saveWechatCertsToRedis(e.pa.MerID, valid, e.fetchedAt)
+	return nil
+}
+
+// refreshDue 后台任务调用，更新快要过期的证书
+func (m *wechatCertManager) refreshDue(now time.Time) {
+	m.mu.Lock()
+	es := make([]*wechatAccountEntry, 0, len(m.entries))
+	for _, e := range m.entries {
+		es = append(es, e)
+	}
+	m.mu.Unlock()
+
+	for _, e := range es {
+		e.mu.Lock()
+		if e.certs != nil && wechatCertsNeedRefresh(e.certs, e.fetchedAt, now) {
+			if err := m.refresh(e); err != nil {
+				wclg().Warnf("refresh wechat platform cert error, mer_id: %s, err: %s", e.pa.MerID, err)
+			} else {
+				wclg().Infof("wechat platform cert refreshed, mer_id: %s", e.pa.MerID)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+func wechatCertsNeedRefresh(certs map[string]*x509.Certificate, fetchedAt, now time.Time) bool {
+	if now.Sub(fetchedAt) > wechatCertRefreshAfter {
+		return true
+	}
+	for _, c := range certs {
+		if c.NotAfter.Sub(now) < wechatCertExpireAhead {
+			return true
+		}
+	}
+	return false
+}
+
+// StartWechatCertRefresher 定时更新缓存的平台证书，返回的函数用于停止
+func StartWechatCertRefresher() func() {
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(wechatCertRefreshTick)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				func() {
+					defer func() {
+						if err := recover(); err != nil {
+							wclg().Errorf("wechat cert refresher panic: %s\n%s", err, debug.Stack())
+						}
+					}()
+					wechatCerts.refreshDue(now)
+				}()
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+func loadWechatCertsFromRedis(pa *models.PaymentAccount, now time.Time) (map[string]*x509.Certificate, time.Time, bool) {
+	if conn.Redis == nil {
+		return nil, time.Time{}, false
+	}
+	d, err := conn.Redis.Get(context.TODO(), wechatCertRedisKey+pa.MerID).Bytes()
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return decodeWechatCachedCerts(pa, d, now)
+}
+
+// decodeWechatCachedCerts 重新解密redis中的证书，有一个解密或者校验失败就重新下载
+func decodeWechatCachedCerts(pa *models.PaymentAccount, d []byte, now time.Time) (map[string]*x509.Certificate, time.Time, bool) {
+	var cached wechatCachedCerts
+	if err := json.Unmarshal(d, &cached); err != nil || len(cached.EncryptedCerts) == 0 {
+		return nil, time.Time{}, false
+	}
+	cs, _ := decryptWechatPlatformCerts(pa, cached.EncryptedCerts, now)
+	if len(cs) != len(cached.EncryptedCerts) {
+		wclg().Warnf("invalid cached wechat platform cert, mer_id: %s, refresh", pa.MerID)
+		return nil, time.Time{}, false
+	}
+	return wechatCertsBySerial(cs), time.Unix(cached.FetchedAt, 0), true
+}
+
+func saveWechatCertsToRedis(merID string, ecs []wechatEncryptedCert, fetchedAt time.Time) {
+	if conn.Redis == nil {
+		return
+	}
+	cached := wechatCachedCerts{FetchedAt: fetchedAt.Unix(), EncryptedCerts: ecs}
+	d, _ := json.Marshal(cached)
+	if err := conn.Redis.Set(context.TODO(), wechatCertRedisKey+merID, d, 2*wechatCertRefreshAfter).Err(); err != nil {
+		wclg().Warnf("save wechat platform cert to redis error, mer_id: %s, err: %s", merID, err)
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"go-gin-payment/ext/logger"
+	"go-gin-payment/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWechatAccount(t *testing.T) *models.PaymentAccount {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	pa := &models.PaymentAccount{
+		AccountType:      models.ACCOUNT_TYPE_WECHAT,
+		MerID:            "1609845740",
+		CertSerialNumber: "3775B6A45ACD588826D15E583A95F5DD********",
+		CertPrivate:      string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		APIV3Secret:      "0123456789abcdef0123456789abcdef",
+	}
+	pa.ID = 1
+	return pa
+}
+
+func TestWechatCertManager(t *testing.T) {
+	if logger.L == nil {
+		logger.L = logrus.New()
+	}
+	_, cert := genTestPlatformCert(t)
+	serial := fmt.Sprintf("%X", cert.SerialNumber)
+	pa := newTestWechatAccount(t)
+	fetched := 0
+	m := newWechatCertManager(func(pa *models.PaymentAccount) ([]wechatEncryptedCert, error) {
+		fetched++
+		return []wechatEncryptedCert{encryptTestPlatformCert(t, pa.APIV3Secret, cert)}, nil
+	})
+
+	certs, err := m.Certs(pa)
+	assert.Nil(t, err)
+	assert.NotNil(t, certs[serial])
+	_, err = m.Certs(pa)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetched)
+
+	c1, err := m.Client(pa)
+	assert.Nil(t, err)
+	c2, err := m.Client(pa)
+	assert.Nil(t, err)
+	assert.Same(t, c1, c2)
+
+	// 刚下载过，不存在的序列号不会马上重新下载
+	_, err = m.CertsWithSerial(pa, "UNKNOWN")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetched)
+
+	e, _ := m.entry(pa)
+	e.fetchedAt = time.Now().Add(-2 * wechatCertForceRefreshInterval)
+	_, err = m.CertsWithSerial(pa, "UNKNOWN")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fetched)
+
+	// 证书更新后client重新创建
+	c3, err := m.Client(pa)
+	assert.Nil(t, err)
+	assert.NotSame(t, c1, c3)
+
+	// 账号修改后缓存失效
+	pa.UpdatedAt = time.Now()
+	_, err = m.Certs(pa)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fetched)
+
+	m.Invalidate(pa.ID)
+	_, err = m.Certs(pa)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, fetched)
+}
+
+// encryptTestPlatformCert 和微信下载平台证书接口一样用APIv3密钥加密
+func encryptTestPlatformCert(t *testing.T, apiV3Key string, cert *x509.Certificate) wechatEncryptedCert {
+	block, err := aes.NewCipher([]byte(apiV3Key))
+	assert.Nil(t, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+	nonce := "0123456789ab"
+	plain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return wechatEncryptedCert{
+		SerialNo:       fmt.Sprintf("%X", cert.SerialNumber),
+		AssociatedData: "certificate",
+		Nonce:          nonce,
+		Ciphertext:     base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plain, []byte("certificate"))),
+	}
+}
+
+// redis中的证书每次读取都重新解密，没有APIv3密钥不能注入证书
+func TestDecodeWechatCachedCerts(t *testing.T) {
+	if logger.L == nil {
+		logger.L = logrus.New()
+	}
+	pa := newTestWechatAccount(t)
+	_, cert := genTestPlatformCert(t)
+	now := time.Now()
+	encode := func(ecs ...wechatEncryptedCert) []byte {
+		d, _ := json.Marshal(wechatCachedCerts{FetchedAt: now.Unix(), EncryptedCerts: ecs})
+		return d
+	}
+
+	certs, fetchedAt, ok := decodeWechatCachedCerts(pa, encode(encryptTestPlatformCert(t, pa.APIV3Secret, cert)), now)
+	assert.True(t, ok)
+	assert.NotNil(t, certs[fmt.Sprintf("%X", cert.SerialNumber)])
+	assert.Equal(t, now.Unix(), fetchedAt.Unix())
+
+	// 用其他密钥加密的证书
+	_, _, ok = decodeWechatCachedCerts(pa, encode(encryptTestPlatformCert(t, "fedcba9876543210fedcba9876543210", cert)), now)
+	assert.False(t, ok)
+	// 序列号不一致
+	ec := encryptTestPlatformCert(t, pa.APIV3Secret, cert)
+	ec.SerialNo = "5157F09EFDC096DF"
+	_, _, ok = decodeWechatCachedCerts(pa, encode(ec), now)
+	assert.False(t, ok)
+	// 已经过期
+	_, _, ok = decodeWechatCachedCerts(pa, encode(encryptTestPlatformCert(t, pa.APIV3Secret, cert)), now.Add(2*time.Hour))
+	assert.False(t, ok)
+	// 之前保存的明文证书
+	_, _, ok = decodeWechatCachedCerts(pa, []byte(`{"fetched_at":1,"certs":["-----BEGIN CERTIFICATE-----"]}`), now)
+	assert.False(t, ok)
+}
+
+func TestWechatCertsNeedRefresh(t *testing.T) {
+	_, cert := genTestPlatformCert(t)
+	certs := wechatCertsBySerial([]*x509.Certificate{cert})
+	now := time.Now()
+
+	// 测试证书一个小时后过期
+	assert.True(t, wechatCertsNeedRefresh(certs, now, now))
+	before := now.Add(-wechatCertExpireAhead - 2*time.Hour)
+	assert.False(t, wechatCertsNeedRefresh(certs, before, before))
+	assert.True(t, wechatCertsNeedRefresh(certs, before.Add(-13*time.Hour), before))
+}
@@ -0,0 +1,556 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/tidwall/gjson"
+)
+
+//
+// 微信合单支付，一次支付多个店铺(子商户)的订单，只支持服务商账号
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter5_1_1.shtml
+//
+// 主单保存为CombinePaymentRecord，每个子单保存为PaymentRecord(CombineTransNo为主单号)，
+// 支付通知按子单更新状态并分别通知web端，退款按子单使用普通的退款接口
+//
+
+const (
+	combineSubOrdersMin = 2
+	combineSubOrdersMax = 50
+)
+
+var combineTradeTypes = map[string]string{
+	"mp":     "jsapi",
+	"app":    "app",
+	"native": "native",
+	"h5":     "h5",
+}
+
+type combineSubOrderOps struct {
+	StoreID    string `json:"store_id"`
+	TransNo    string `json:"trans_no"`
+	Desp       string `json:"desp"`
+	TotalPrice int64  `json:"total_price"` // 金额单位为分
+}
+
+// combinePaymentOps 合单下单参数，app_id使用服务商账号的AppID
+type combinePaymentOps struct {
+	CombineTransNo   string               `json:"combine_trans_no"`
+	PaymentAccountID string               `json:"payment_account_id"`
+	OpenID           string               `json:"open_id"` // from为mp时必须
+	From             string               `json:"from"`    // mp|app|native|h5
+	PayerClientIP    string               `json:"payer_client_ip"`
+	ReturnURL        string               `json:"return_url"` // h5支付完成后跳转的地址
+	TimeExpire       string               `json:"time_expire"`
+	AddiNotifyURL    string               `json:"addi_notify_url"`
+	SubOrders        []combineSubOrderOps `json:"sub_orders"`
+
+	paymentAccount *models.PaymentAccount `json:"-"`
+	expireAt       time.Time              `json:"-"`
+}
+
+func (o *combinePaymentOps) validate() error {
+	if len(o.CombineTransNo) == 0 {
+		return errors.New("combine_trans_no is required")
+	}
+	if _, ok := combineTradeTypes[o.From]; !ok {
+		return fmt.Errorf("invalid from: %s, should be mp|app|native|h5", o.From)
+	}
+	if o.From == "mp" && len(o.OpenID) == 0 {
+		return errors.New("open_id is required for mp")
+	}
+	if n := len(o.SubOrders); n < combineSubOrdersMin || n > combineSubOrdersMax {
+		return fmt.Errorf("sub_orders should be %d to %d", combineSubOrdersMin, combineSubOrdersMax)
+	}
+	seen := make(map[string]bool, len(o.SubOrders))
+	for _, s := range o.SubOrders {
+		if len(s.TransNo) == 0 || len(s.StoreID) == 0 || len(s.Desp) == 0 || s.TotalPrice <= 0 {
+			return errors.New("trans_no, store_id, desp and total_price are required for each sub order")
+		}
+		if seen[s.TransNo] {
+			return fmt.Errorf("duplicated sub order trans_no: %s", s.TransNo)
+		}
+		seen[s.TransNo] = true
+	}
+	return validateAddiNotifyURL(o.AddiNotifyURL)
+}
+
+func apiWechatCombine(r *gin.Engine) {
+	// 合单下单，mp/app返回调起支付的参数，native返回code_url，h5返回h5_url
+	//
+	// body:
+	// {
+	// 	"combine_trans_no": "c_abcssscascscds",
+	// 	"payment_account_id": "2", 必须是服务商账号
+	// 	"from": "mp"|"app"|"native"|"h5",
+	// 	"open_id": "ovgfD4hx1cAmnEuFoM9A4phM9h2Y", from为mp时必须，为服务商AppID下的openid
+	// 	"payer_client_ip": "14.23.150.211", 可选，不传时使用请求的IP
+	// 	"return_url": "https://eggman.tv/paid", 可选，h5支付完成后跳转的地址
+	// 	"time_expire": "2018-06-08T10:34:56+08:00", 可选
+	// 	"addi_notify_url": "https://xx.com/notify", 可选，每个子单都会通知
+	// 	"sub_orders": [
+	// 		{"store_id": "1", "trans_no": "abcssscascscds1", "desp": "hello", "total_price": 10},
+	// 		{"store_id": "2", "trans_no": "abcssscascscds2", "desp": "world", "total_price": 20}
+	// 	]
+	// }
+	r.POST("/wechat/combine_pay", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o combinePaymentOps
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		for _, sub := range o.SubOrders {
+			if err := checkClientStore(ctx, cast.ToInt64(sub.StoreID)); err != nil {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+				return
+			}
+		}
+		if len(o.PayerClientIP) == 0 {
+			o.PayerClientIP = ctx.ClientIP()
+		}
+		data, err := createCombinePayment(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, paymentErrorResponse(err))
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
+	})
+
+	// 合单支付通知，所有子单的结果在一个通知中
+	// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter5_1_13.shtml
+	r.POST("/wechat/combine_payment_notify/:combineTransNo", notifyMetrics(models.ACCOUNT_TYPE_WECHAT, "combine_payment"), wechatCombineNotifyHandler)
+
+	// 查询合单，返回每个子单微信的状态和我们记录的状态
+	//
+	// body:
+	// {
+	// 	"combine_trans_no": "c_abcssscascscds"
+	// }
+	r.POST("/wechat/combine_payment_check", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		o := struct {
+			CombineTransNo string `json:"combine_trans_no"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		c, pa, err := findClientCombinePayment(ctx, o.CombineTransNo)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		doc, err := queryWechatCombinePayment(pa, c.CombineTransNo)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": "check combine_trans_no state error: " + err.Error()})
+			return
+		}
+		states := make(map[string]*paymentState)
+		doc.Get("sub_orders").ForEach(func(_, sub gjson.Result) bool {
+			st := wechatCombineSubOrderState(sub)
+			states[st.TransNo] = st
+			return true
+		})
+		res := make([]common.M, 0)
+		for _, rec := range c.SubRecords() {
+			res = append(res, common.M{
+				"trans_no":      rec.TransNo,
+				"status":        rec.Status,
+				"payment_state": states[rec.TransNo],
+			})
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": res})
+	})
+
+	// 关闭合单，所有子单都会关闭
+	//
+	// body:
+	// {
+	// 	"combine_trans_no": "c_abcssscascscds"
+	// }
+	r.POST("/wechat/combine_payment_close", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		o := struct {
+			CombineTransNo string `json:"combine_trans_no"`
+		}{}
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		c, pa, err := findClientCombinePayment(ctx, o.CombineTransNo)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		subs := c.SubRecords()
+		for _, rec := range subs {
+			if !rec.IsPending() {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf(
+					"combine payment can not close, trans_no: %s, status: %s", rec.TransNo, rec.Status)})
+				return
+			}
+		}
+		if err := closeWechatCombinePayment(c.CombineTransNo, pa); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		for i := range subs {
+			if err := subs[i].TransitTo(models.PAYMENT_STATUS_CLOSED, "wechat_combine_close", "", nil); err != nil {
+				wclg().Warnf("close combine sub order error, trans_no: %s, err: %s", subs[i].TransNo, err)
+			}
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+}
+
+func findCombinePayment(combineTransNo string) (*models.CombinePaymentRecord, *models.PaymentAccount, error) {
+	c, err := models.FindCombinePaymentRecord(combineTransNo)
+	if err != nil {
+		return nil, nil, err
+	}
+	pa, err := models.FindPaymentAccount(c.PaymentAccountID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load pa error: %s", err)
+	}
+	return c, pa, nil
+}
+
+// findClientCombinePayment 检查调用方可以操作所有子单的店铺
+func findClientCombinePayment(ctx *gin.Context, combineTransNo string) (*models.CombinePaymentRecord, *models.PaymentAccount, error) {
+	c, pa, err := findCombinePayment(combineTransNo)
+	if err != nil || !isClientStoreRestricted(ctx) {
+		return c, pa, err
+	}
+	for _, rec := range c.SubRecords() {
+		if err := checkClientStore(ctx, rec.StoreID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, pa, nil
+}
+
+// createCombinePayment 先保存主单和子单再调用微信下单
+func createCombinePayment(o *combinePaymentOps) (common.M, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	t, err := parseTimeExpire(o.TimeExpire, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	o.expireAt = t
+
+	pa, err := models.FindPaymentAccount(o.PaymentAccountID)
+	if err != nil {
+		return nil, fmt.Errorf("err to find payment account with id: %s, err: %s", o.PaymentAccountID, err)
+	}
+	if !pa.IsWechatServiceProviderAccount() {
+		return nil, fmt.Errorf("payment account %d is not a wechat service provider account, combine payment is not supported", pa.ID)
+	}
+	o.paymentAccount = pa
+
+	stores := make([]*models.Store, 0, len(o.SubOrders))
+	subs := make([]models.PaymentRecord, 0, len(o.SubOrders))
+	for _, s := range o.SubOrders {
+		storeID := cast.ToInt64(s.StoreID)
+		store, err := models.FindWechatSubMerchantStore(storeID, pa)
+		if err != nil {
+			return nil, err
+		}
+		if err := models.CheckStorePaymentAccount(storeID, pa); err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+		subs = append(subs, models.PaymentRecord{
+			TransNo:    s.TransNo,
+			StoreID:    storeID,
+			TotalMoney: models.FenToYuan(s.TotalPrice),
+		})
+	}
+
+	_, err = models.CreatePendingCombinePaymentRecord(&models.CombinePaymentRecord{
+		CombineTransNo:   o.CombineTransNo,
+		PaymentAccountID: pa.ID,
+		AppID:            pa.AppID,
+		AddiNotifyURL:    o.AddiNotifyURL,
+		ExpireAt:         &o.expireAt,
+	}, subs)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := buildWechatCombineOrder(o, stores)
+	if err != nil {
+		return nil, err
+	}
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Post(context.TODO(), wechatAPIURL("/v3/combine-transactions/"+combineTradeTypes[o.From]), body)
+	if err != nil {
+		wclg().Warnf("client post combine order err: %s", err)
+		return nil, err
+	}
+	d, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := gjson.ParseBytes(d)
+	switch o.From {
+	case "native":
+		codeURL := doc.Get("code_url").String()
+		if len(codeURL) == 0 {
+			return nil, errors.New("code_url is empty, rsp: " + string(d))
+		}
+		return common.M{"code_url": codeURL}, nil
+	case "h5":
+		h5URL := doc.Get("h5_url").String()
+		if len(h5URL) == 0 {
+			return nil, errors.New("h5_url is empty, rsp: " + string(d))
+		}
+		return common.M{"h5_url": wechatH5URL(h5URL, o.ReturnURL)}, nil
+	}
+	prepayID := doc.Get("prepay_id").String()
+	if len(prepayID) == 0 {
+		return nil, errors.New("prepay_id is empty")
+	}
+	payParams, err := buildWechatPaymentParams(&paymentOps{AppID: pa.AppID, From: o.From, paymentAccount: pa}, prepayID)
+	if err != nil {
+		return nil, errors.New("build pay params error:" + err.Error())
+	}
+	return payParams, nil
+}
+
+// buildWechatCombineOrder 合单下单的请求内容，stores和o.SubOrders一一对应
+func buildWechatCombineOrder(o *combinePaymentOps, stores []*models.Store) (map[string]interface{}, error) {
+	pa := o.paymentAccount
+	subOrders := make([]map[string]interface{}, 0, len(o.SubOrders))
+	for i, s := range o.SubOrders {
+		subOrders = append(subOrders, map[string]interface{}{
+			"mchid":        pa.MerID,
+			"sub_mchid":    stores[i].WechatPaymentMerID,
+			"out_trade_no": s.TransNo,
+			"description":  s.Desp,
+			"attach":       s.StoreID,
+			"amount": map[string]interface{}{
+				"total_amount": s.TotalPrice,
+				"currency":     "CNY",
+			},
+		})
+	}
+	body := map[string]interface{}{
+		"combine_appid":        pa.AppID,
+		"combine_mchid":        pa.MerID,
+		"combine_out_trade_no": o.CombineTransNo,
+		"notify_url":           config.SelfAPIURL + "/wechat/combine_payment_notify/" + o.CombineTransNo,
+		"sub_orders":           subOrders,
+	}
+	if len(o.TimeExpire) > 0 {
+		body["time_expire"] = o.expireAt.In(models.ChinaTz).Format(time.RFC3339)
+	}
+	switch o.From {
+	case "mp":
+		body["combine_payer_info"] = map[string]interface{}{"openid": o.OpenID}
+	case "h5":
+		sceneInfo, err := wechatH5SceneInfo(o.PayerClientIP)
+		if err != nil {
+			return nil, err
+		}
+		body["scene_info"] = sceneInfo
+	}
+	return body, nil
+}
+
+// queryWechatCombinePayment 返回的sub_orders包含每个子单的状态
+func queryWechatCombinePayment(pa *models.PaymentAccount, combineTransNo string) (gjson.Result, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	rsp, err := client.Get(context.TODO(), wechatAPIURL("/v3/combine-transactions/out-trade-no/"+combineTransNo))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	body, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	wclg().Printf("wechat, combine_trans_no state check rsp: %s", body)
+	return gjson.ParseBytes(body), nil
+}
+
+// queryWechatCombineSubOrder 查询子单所在的合单，返回子单的状态
+func queryWechatCombineSubOrder(rec *models.PaymentRecord, pa *models.PaymentAccount) *paymentState {
+	doc, err := queryWechatCombinePayment(pa, rec.CombineTransNo)
+	if err != nil {
+		return &paymentState{TransNo: rec.TransNo, PaymentMethod: "wechat", Err: "wechat, get combine_trans_no state error:" + err.Error(),
+			notExist: isWechatOrderNotExist(err)}
+	}
+	for _, sub := range doc.Get("sub_orders").Array() {
+		if sub.Get("out_trade_no").String() == rec.TransNo {
+			return wechatCombineSubOrderState(sub)
+		}
+	}
+	return &paymentState{TransNo: rec.TransNo, PaymentMethod: "wechat", Err: "sub order not found in combine payment: " + rec.CombineTransNo}
+}
+
+func wechatCombineSubOrderState(sub gjson.Result) *paymentState {
+	state := sub.Get("trade_state").String()
+	status, _ := models.WechatTradeStateToStatus(state)
+	return &paymentState{
+		State:         state,
+		IsSuccess:     state == "SUCCESS",
+		TransNo:       sub.Get("out_trade_no").String(),
+		PaymentMethod: "wechat",
+		PayNo:         sub.Get("transaction_id").String(),
+		Raw:           sub.Value(),
+		status:        status,
+		rawRsp:        sub.Raw,
+	}
+}
+
+// closeWechatCombinePayment 关闭合单下所有的子单，成功微信返回204
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter5_1_12.shtml
+func closeWechatCombinePayment(combineTransNo string, pa *models.PaymentAccount) error {
+	c, err := models.FindCombinePaymentRecord(combineTransNo)
+	if err != nil {
+		return err
+	}
+	subOrders := make([]map[string]interface{}, 0)
+	for _, rec := range c.SubRecords() {
+		store, err := models.FindWechatSubMerchantStore(rec.StoreID, pa)
+		if err != nil {
+			return err
+		}
+		subOrders = append(subOrders, map[string]interface{}{
+			"mchid":        pa.MerID,
+			"sub_mchid":    store.WechatPaymentMerID,
+			"out_trade_no": rec.TransNo,
+		})
+	}
+
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Post(context.TODO(),
+		wechatAPIURL(fmt.Sprintf("/v3/combine-transactions/out-trade-no/%s/close", combineTransNo)),
+		map[string]interface{}{
+			"combine_appid": c.AppID,
+			"sub_orders":    subOrders,
+		})
+	if err != nil {
+		wclg().Warnf("close combine_trans_no: %s err: %s", combineTransNo, err)
+		return err
+	}
+	_, err = validateWechatClientRsp(rsp)
+	return err
+}
+
+// wechatCombineNotifyHandler 先校验所有子单再更新，更新失败时返回错误让微信重新通知，已经更新的子单会跳过
+func wechatCombineNotifyHandler(ctx *gin.Context) {
+	c, pa, err := findCombinePayment(ctx.Param("combineTransNo"))
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusNotFound, err.Error())
+		return
+	}
+	if !verifyWechatNotifyOrFail(ctx, pa) {
+		return
+	}
+	var o wechatNotifyBody
+	if err := ctx.ShouldBindJSON(&o); err != nil {
+		wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	doc, err := o.decrypt(pa)
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusBadRequest, "decode wechat combine notify data error:"+err.Error())
+		return
+	}
+
+	subs := c.SubRecords()
+	if err := checkWechatCombineNotify(c, pa, subs, doc); err != nil {
+		wclg().WithField("alert", true).Errorf("combine_trans_no: %s, %s, data: %s", c.CombineTransNo, err, doc.Raw)
+		wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	states := make(map[string]*paymentState)
+	for _, sub := range doc.Get("sub_orders").Array() {
+		st := wechatCombineSubOrderState(sub)
+		states[st.TransNo] = st
+	}
+	for i := range subs {
+		rec := &subs[i]
+		st := states[rec.TransNo]
+		if !rec.IsPending() || st.status == "" {
+			continue
+		}
+		ds := paymentStateDeliveries(st, rec.AddiNotifyURL)
+		if err := rec.UpdatePayResult(st.status, "wechat_combine", st.State, st.PayNo, st.rawRsp, ds...); err != nil {
+			wechatNotifyFail(ctx, http.StatusInternalServerError, "update payment record error: "+err.Error())
+			return
+		}
+		paymentStateNotified(st)
+	}
+	ctx.JSON(http.StatusOK, common.M{
+		"code":    "SUCCESS",
+		"message": "成功",
+	})
+}
+
+// checkWechatCombineNotify 校验通知和我们保存的主单、子单是否一致
+func checkWechatCombineNotify(c *models.CombinePaymentRecord, pa *models.PaymentAccount, subs []models.PaymentRecord, doc gjson.Result) error {
+	var errs []string
+	check := func(field, got, expected string) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("%s: got %q, expected %q", field, got, expected))
+		}
+	}
+	check("combine_out_trade_no", doc.Get("combine_out_trade_no").String(), c.CombineTransNo)
+	check("combine_mchid", doc.Get("combine_mchid").String(), pa.MerID)
+	check("combine_appid", doc.Get("combine_appid").String(), c.AppID)
+
+	notified := make(map[string]gjson.Result)
+	for _, sub := range doc.Get("sub_orders").Array() {
+		notified[sub.Get("out_trade_no").String()] = sub
+	}
+	if len(notified) != len(subs) {
+		errs = append(errs, fmt.Sprintf("sub_orders: got %d, expected %d", len(notified), len(subs)))
+	}
+	for _, rec := range subs {
+		sub, ok := notified[rec.TransNo]
+		if !ok {
+			errs = append(errs, "sub_orders: missing out_trade_no "+rec.TransNo)
+			continue
+		}
+		prefix := "sub_orders[" + rec.TransNo + "]."
+		check(prefix+"mchid", sub.Get("mchid").String(), pa.MerID)
+		check(prefix+"amount.total_amount", sub.Get("amount.total_amount").String(), strconv.FormatInt(rec.TotalFen(), 10))
+		if store, err := models.FindWechatSubMerchantStore(rec.StoreID, pa); err != nil {
+			errs = append(errs, prefix+"sub_mchid: "+err.Error())
+		} else {
+			check(prefix+"sub_mchid", sub.Get("sub_mchid").String(), store.WechatPaymentMerID)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("wechat combine notify mismatch, " + strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCombineOps() *combinePaymentOps {
+	pa := &models.PaymentAccount{AccountType: models.ACCOUNT_TYPE_WECHAT, MerID: "1900000100", AppID: "wxd678efh567hg6787"}
+	return &combinePaymentOps{
+		CombineTransNo: "c_abcssscascscds",
+		From:           "native",
+		SubOrders: []combineSubOrderOps{
+			{StoreID: "1", TransNo: "abcssscascscds1", Desp: "hello", TotalPrice: 10},
+			{StoreID: "2", TransNo: "abcssscascscds2", Desp: "world", TotalPrice: 20},
+		},
+		paymentAccount: pa,
+	}
+}
+
+func TestCombinePaymentOpsValidate(t *testing.T) {
+	assert.Nil(t, newTestCombineOps().validate())
+
+	o := newTestCombineOps()
+	o.From = "mp"
+	assert.NotNil(t, o.validate())
+	o.OpenID = "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+	assert.Nil(t, o.validate())
+
+	o = newTestCombineOps()
+	o.SubOrders = o.SubOrders[:1]
+	assert.NotNil(t, o.validate())
+
+	o = newTestCombineOps()
+	o.SubOrders[1].TransNo = o.SubOrders[0].TransNo
+	assert.NotNil(t, o.validate())
+
+	o = newTestCombineOps()
+	o.SubOrders[1].TotalPrice = 0
+	assert.NotNil(t, o.validate())
+
+	o = newTestCombineOps()
+	o.AddiNotifyURL = "/api/payment/notify_state"
+	assert.NotNil(t, o.validate())
+}
+
+func TestBuildWechatCombineOrder(t *testing.T) {
+	o := newTestCombineOps()
+	stores := []*models.Store{{WechatPaymentMerID: "1900000109"}, {WechatPaymentMerID: "1900000110"}}
+
+	body, err := buildWechatCombineOrder(o, stores)
+	assert.Nil(t, err)
+	assert.Equal(t, "wxd678efh567hg6787", body["combine_appid"])
+	assert.Equal(t, "1900000100", body["combine_mchid"])
+	assert.Nil(t, body["time_expire"])
+	subs := body["sub_orders"].([]map[string]interface{})
+	assert.Len(t, subs, 2)
+	assert.Equal(t, "1900000100", subs[1]["mchid"])
+	assert.Equal(t, "1900000110", subs[1]["sub_mchid"])
+	assert.Equal(t, int64(20), subs[1]["amount"].(map[string]interface{})["total_amount"])
+
+	o.From = "h5"
+	_, err = buildWechatCombineOrder(o, stores)
+	assert.NotNil(t, err)
+	o.PayerClientIP = "14.23.150.211"
+	o.TimeExpire = "2018-06-08T10:34:56+08:00"
+	o.expireAt, _ = time.Parse(time.RFC3339, o.TimeExpire)
+	body, err = buildWechatCombineOrder(o, stores)
+	assert.Nil(t, err)
+	assert.NotNil(t, body["scene_info"])
+	assert.Equal(t, "2018-06-08T10:34:56+08:00", body["time_expire"])
+}
@@ -1,16 +1,12 @@
 package api
 
 import (
-	"context"
-	"fmt"
 	"net/http"
 
-	"go-gin-payment/config"
 	"go-gin-payment/models"
 
 	"bitbucket.org/343_3rd/gmodels/common"
 	"github.com/gin-gonic/gin"
-	"github.com/tidwall/gjson"
 )
 
 // @title           Go Gin Payment API
@@ -31,11 +27,13 @@ import (
 // @Accept       json
 // @Produce      json
 // @Param        store_id formData string true "店铺ID，我们内部的模型ID，用于标识店铺"
-// @Param        payment_account_id formData string true "支付账号ID，我们内部的模型ID，用于标识支付账号。"
+// @Param        payment_account_id formData string false "支付账号ID，我们内部的模型ID，用于标识支付账号。不传时使用店铺默认的微信支付账号"
 // @Param        trans_no formData string true "商户系统内部订单号，由我们自己随机生成，要求6-32个字符内，只能是数字、大小写字母_-|* 且在同一个商户号下唯一。"
 // @Param        app_id formData string true "应用ID，微信公众号、小程序的app_id。"
 // @Param        desp formData string true "商品信息描述。"
 // @Param        total_price formData string true "商品总金额，单位为分"
+// @Param        time_expire formData string false "订单失效时间，rfc3339格式，比如2018-06-08T10:34:56+08:00"
+// @Param        profit_sharing formData bool false "服务商账号分账，支付成功后资金冻结，需要分账或者解冻"
 // @Success      200  {object} 	string "{"status": "ok", "data": {"code_url": "weixin://wxpay/bizpayurl?pr=YoETTdkz1"}}"
 // @Failure      500  {string}  string "{"status": "error", "error": "error message"}"
 // return code or default,{param type},data type,comment
@@ -45,88 +43,32 @@ func apiWechatNativePay(r *gin.Engine) {
 	//
 	// {
 	//  "store_id": "1",
-	// 	"payment_account_id": "2",
+	// 	"payment_account_id": "2", 可选，不传时使用店铺默认的微信支付账号
 	// 	"trans_no": "5d45e2b694e1435993edb008cf21bf33",
 	//  "app_id": "wx123151115c597abc",
 	//  "desp": "343科技-Audiom软件购买"
 	//  "total_price": 30,
+	//  "addi_notify_url": "https://xx.com/notify" 可选
+	//  "time_expire": "2018-06-08T10:34:56+08:00" 可选，订单失效时间，过期未支付的订单会被自动关闭
 	// }
-	r.POST("/wechat/native_pay", func(ctx *gin.Context) {
-		o := struct {
-			StoreID          string `json:"store_id"`
-			PaymentAccountID string `json:"payment_account_id"`
-			AppID            string `json:"app_id"`
-			TransNo          string `json:"trans_no"`
-			Desp             string `json:"desp"`
-			TotalPrice       int64  `json:"total_price"` // 金额单位为分
-		}{}
+	r.POST("/wechat/native_pay", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o paymentOps
 		err := ctx.ShouldBindJSON(&o)
 		if err != nil {
 			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
 			return
 		}
+		o.From = "native"
+		o.Provider = models.ACCOUNT_TYPE_WECHAT
 
-		// 查找商户号、私有证书等
-		pa, err := models.FindPaLoadPrivateCert(o.PaymentAccountID, true)
+		data, err := createClientPayment(ctx, &o)
 		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf("err to find payment account with id: %s, err: %s", o.PaymentAccountID, err)})
+			ctx.JSON(http.StatusOK, paymentErrorResponse(err))
 			return
 		}
-		store, _ := models.FindStoreWithOnlyMerID(o.StoreID)
-
-		data := map[string]interface{}{
-			"out_trade_no": o.TransNo,
-			"description":  o.Desp,
-			"notify_url":   config.SelfAPIURL + "/wechat/payment_notify/" + o.TransNo, // 支付通知回调地址
-			"amount": map[string]interface{}{
-				"total":    o.TotalPrice,
-				"currency": "CNY",
-			},
-		}
-		var url string
-		// 服务商模式
-		if pa.IsWechatServiceProviderAccount() {
-			data["sp_appid"] = pa.AppID
-			data["sp_mchid"] = pa.MerID
-			data["sub_appid"] = o.AppID
-			data["sub_mchid"] = store.WechatPaymentMerID
-
-			url = "https://api.mch.weixin.qq.com/v3/pay/partner/transactions/native"
-		} else {
-			// 普通商户
-			data["appid"] = o.AppID
-			data["mchid"] = pa.MerID
-
-			url = "https://api.mch.weixin.qq.com/v3/pay/transactions/native"
-		}
-
-		client, err := setUpWechatClient(pa, true)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf("setup wechat client err: %s", err.Error())})
-			return
-		}
-		response, err := client.Post(context.TODO(), url, data)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf("err: %s, code: %d", err.Error(), response.StatusCode)})
-			return
-		}
-		// 校验回包内容是否有逻辑错误
-		body, err := validateWechatClientRsp(response)
-		if err != nil {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": fmt.Sprintf("rsp: %s", string(body))})
-			return
-		}
-
-		codeURL := gjson.ParseBytes(body).Get("code_url").String()
-		if len(codeURL) > 0 {
-			ctx.JSON(http.StatusOK, common.M{
-				"status": "ok",
-				"data": common.M{
-					"code_url": codeURL,
-				},
-			})
-		} else {
-			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": string(body)})
-		}
+		ctx.JSON(http.StatusOK, common.M{
+			"status": "ok",
+			"data":   data,
+		})
 	})
 }
@@ -2,14 +2,22 @@ package api
 
 import (
 	"encoding/json"
-	"flag"
-	"go-gin-payment/cmd/cmd_lib"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"go-gin-payment/cmd/cmd_lib"
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/wechatsim"
+	"go-gin-payment/models"
 
+	"github.com/spf13/cast"
 	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
 )
 
 func TestApiAuthFailed(t *testing.T) {
@@ -22,18 +30,51 @@ func TestApiAuthFailed(t *testing.T) {
 	assert.Equal(t, 401, w.Code)
 }
 
+// setupTestDB 连接本地的mysql，所有操作在一个事务中，返回的函数回滚；没有mysql时跳过测试
+func setupTestDB(t *testing.T) func() {
+	if c, err := net.DialTimeout("tcp", "localhost:3306", time.Second); err != nil {
+		t.Skip("mysql is not available:", err)
+	} else {
+		c.Close()
+	}
+	cleaner := cmd_lib.SetupLog("development")
+	config.Env = "test"
+	conn.NewConn()
+	assert.Nil(t, models.AutoMigrate())
+	conn.SetTestDBAsTx()
+
+	masterKey := config.PaymentMasterKey
+	config.PaymentMasterKey = make([]byte, 32)
+	return func() {
+		config.PaymentMasterKey = masterKey
+		conn.DB().Rollback()
+		cleaner()
+	}
+}
+
+// createTestWechatAccountAndStore 保存测试的微信账号和店铺，微信接口指向模拟器
+func createTestWechatAccountAndStore(t *testing.T) (*models.PaymentAccount, *models.Store, *wechatsim.Server, func()) {
+	pa := newTestWechatAccount(t)
+	pa.Name = "test"
+	pa.APIV3Secret = "0123456789abcdef0123456789abcdef"
+	assert.Nil(t, models.CreatePaymentAccount(pa, models.AuditActor{Name: "test", IP: "127.0.0.1"}))
+	store := &models.Store{Name: "test"}
+	assert.Nil(t, models.CreateStore(store))
+	sim, stop := startWechatSimulator(t, pa)
+	return pa, store, sim, stop
+}
+
+// TestApiWechatNativePay 需要本地的mysql，微信接口使用模拟器
 func TestApiWechatNativePay(t *testing.T) {
-	e := flag.String("e", "development", "production | development")
-	flag.Parse()
+	defer setupTestDB(t)()
+	pa, store, sim, stop := createTestWechatAccountAndStore(t)
+	defer stop()
 
-	cleaner := cmd_lib.SetupLog(*e)
-	defer cleaner()
 	router := RunAPI()
-
 	w := httptest.NewRecorder()
 	data := make(map[string]interface{})
-	data["store_id"] = "21"
-	data["payment_account_id"] = "3"
+	data["store_id"] = cast.ToString(store.ID)
+	data["payment_account_id"] = cast.ToString(pa.ID)
 	data["trans_no"] = "2ss1e32q0ok87pfxui2"
 	data["app_id"] = "wx12345678972ca148"
 	data["total_price"] = 29800
@@ -44,4 +85,10 @@ func TestApiWechatNativePay(t *testing.T) {
 	req.Header.Add("X_GGP_KEY", "xxx")
 	router.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ok", gjson.Get(w.Body.String(), "status").String(), w.Body.String())
+	assert.Contains(t, gjson.Get(w.Body.String(), "data.code_url").String(), "weixin://")
+
+	o, ok := sim.Order("2ss1e32q0ok87pfxui2")
+	assert.True(t, ok)
+	assert.Equal(t, int64(29800), o.Total)
 }
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/verifiers"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/consts"
+)
+
+//
+// 回调通知签名验证: https://pay.weixin.qq.com/wiki/doc/apiv3/wechatpay/wechatpay4_1.shtml
+//
+// 验签串为: 应答时间戳\n应答随机串\n应答报文主体\n
+// 使用Wechatpay-Serial对应的平台证书校验Wechatpay-Signature
+//
+// 注意: 微信会不定期发送签名错误的探测通知(签名以WECHATPAY/SIGNTEST/开头)，我们必须拒绝
+//
+
+// wechatNotifyTimeWindow 通知时间戳和当前时间的最大偏差，超过则认为是重放
+const wechatNotifyTimeWindow = 5 * time.Minute
+
+var (
+	errWechatNotifySignature = errors.New("wechat notify signature invalid")
+	errWechatNotifyTooLarge  = errors.New("wechat notify body too large")
+)
+
+// wechatNotifyFail 返回非2xx状态码和微信要求的错误格式，微信会按策略重新通知
+func wechatNotifyFail(ctx *gin.Context, code int, msg string) {
+	wclg().Warnf("wechat notify rejected, path: %s, code: %d, msg: %s", ctx.Request.URL.Path, code, msg)
+	ctx.AbortWithStatusJSON(code, common.M{
+		"code":    "FAIL",
+		"message": msg,
+	})
+}
+
+// verifyWechatNotify 校验微信通知的签名和时间戳，通过后body可以再次读取
+// 通知的路由不需要验证，验签之前读取body时限制大小，超过config.MaxBodyBytes时返回errWechatNotifyTooLarge
+func verifyWechatNotify(ctx *gin.Context, pa *models.PaymentAccount) error {
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, config.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return errWechatNotifyTooLarge
+		}
+		return err
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	serial := strings.TrimSpace(ctx.Request.Header.Get(consts.WechatPaySerial))
+	certs, err := wechatCerts.CertsWithSerial(pa, serial)
+	if err != nil {
+		return err
+	}
+	if err := checkWechatNotifySignature(ctx.Request.Header, body, certs, time.Now()); err != nil {
+		return err
+	}
+
+	// 时间窗口内同一个nonce只接受一次
+	if conn.Redis != nil {
+		nonce := strings.TrimSpace(ctx.Request.Header.Get(consts.WechatPayNonce))
+		ok, err := conn.Redis.SetNX(context.TODO(), "wechat_notify_nonce:"+nonce, 1, 2*wechatNotifyTimeWindow).Result()
+		if err == nil && !ok {
+			return fmt.Errorf("%w: nonce replayed: %s", errWechatNotifySignature, nonce)
+		}
+	}
+	return nil
+}
+
+func checkWechatNotifySignature(h http.Header, body []byte, certs map[string]*x509.Certificate, now time.Time) error {
+	serial := strings.TrimSpace(h.Get(consts.WechatPaySerial))
+	signature := strings.TrimSpace(h.Get(consts.WechatPaySignature))
+	timestamp := strings.TrimSpace(h.Get(consts.WechatPayTimestamp))
+	nonce := strings.TrimSpace(h.Get(consts.WechatPayNonce))
+	if serial == "" || signature == "" || timestamp == "" || nonce == "" {
+		return fmt.Errorf("%w: missing wechatpay headers", errWechatNotifySignature)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp: %s", errWechatNotifySignature, timestamp)
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > wechatNotifyTimeWindow || d < -wechatNotifyTimeWindow {
+		return fmt.Errorf("%w: timestamp expired: %s", errWechatNotifySignature, timestamp)
+	}
+
+	sign, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: decode signature error: %s", errWechatNotifySignature, err)
+	}
+	verifier := verifiers.WechatPayVerifier{Certificates: certs}
+	message := fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, body)
+	if err := verifier.Verify(context.TODO(), serial, message, string(sign)); err != nil {
+		return fmt.Errorf("%w: %s", errWechatNotifySignature, err)
+	}
+	return nil
+}
+
+// verifyWechatNotifyOrFail 验签失败时直接返回错误给微信，返回false表示已经响应
+func verifyWechatNotifyOrFail(ctx *gin.Context, pa *models.PaymentAccount) bool {
+	err := verifyWechatNotify(ctx, pa)
+	if err == nil {
+		return true
+	}
+	wechatNotifyFail(ctx, wechatNotifyVerifyCode(err), err.Error())
+	return false
+}
+
+// wechatNotifyVerifyCode verifyWechatNotify的错误响应给微信的状态码，签名错误401，body太大413，其他500
+func wechatNotifyVerifyCode(err error) int {
+	switch {
+	case errors.Is(err, errWechatNotifySignature):
+		return http.StatusUnauthorized
+	case errors.Is(err, errWechatNotifyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// wechatCertsBySerial 证书序列号为大写的16进制字符串，和Wechatpay-Serial一致
+func wechatCertsBySerial(cs []*x509.Certificate) map[string]*x509.Certificate {
+	m := make(map[string]*x509.Certificate, len(cs))
+	for _, c := range cs {
+		m[fmt.Sprintf("%X", c.SerialNumber)] = c
+	}
+	return m
+}
+
+// checkWechatPaymentNotify 校验解密后的支付通知和我们保存的订单是否一致，防止用其他订单的通知冒充
+func checkWechatPaymentNotify(rec *models.PaymentRecord, pa *models.PaymentAccount, store *models.Store, doc gjson.Result) error {
+	var errs []string
+	check := func(field, got, expected string) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("%s: got %q, expected %q", field, got, expected))
+		}
+	}
+
+	check("out_trade_no", doc.Get("out_trade_no").String(), rec.TransNo)
+	check("amount.total", doc.Get("amount.total").String(), strconv.FormatInt(rec.TotalFen(), 10))
+	if pa.IsWechatServiceProviderAccount() {
+		check("sp_mchid", doc.Get("sp_mchid").String(), pa.MerID)
+		check("sp_appid", doc.Get("sp_appid").String(), pa.AppID)
+		if store == nil {
+			errs = append(errs, fmt.Sprintf("sub_mchid: store not found, store_id: %d", rec.StoreID))
+		} else {
+			check("sub_mchid", doc.Get("sub_mchid").String(), store.WechatPaymentMerID)
+		}
+		if len(rec.AppID) > 0 {
+			check("sub_appid", doc.Get("sub_appid").String(), rec.AppID)
+		}
+	} else {
+		check("mchid", doc.Get("mchid").String(), pa.MerID)
+		if len(rec.AppID) > 0 {
+			check("appid", doc.Get("appid").String(), rec.AppID)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("wechat payment notify mismatch, " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// checkWechatRefundNotify 校验解密后的退款通知和我们保存的退款记录是否一致
+func checkWechatRefundNotify(rr *models.RefundRecord, pa *models.PaymentAccount, store *models.Store, doc gjson.Result) error {
+	var errs []string
+	check := func(field, got, expected string) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("%s: got %q, expected %q", field, got, expected))
+		}
+	}
+
+	check("out_refund_no", doc.Get("out_refund_no").String(), rr.RefundNo)
+	check("out_trade_no", doc.Get("out_trade_no").String(), rr.TransNo)
+	check("amount.refund", doc.Get("amount.refund").String(), strconv.FormatInt(models.YuanToFen(rr.RefundMoney), 10))
+	if pa.IsWechatServiceProviderAccount() {
+		check("sp_mchid", doc.Get("sp_mchid").String(), pa.MerID)
+		if store == nil {
+			errs = append(errs, fmt.Sprintf("sub_mchid: store not found, store_id: %d", rr.StoreID))
+		} else {
+			check("sub_mchid", doc.Get("sub_mchid").String(), store.WechatPaymentMerID)
+		}
+	} else {
+		check("mchid", doc.Get("mchid").String(), pa.MerID)
+	}
+
+	if len(errs) > 0 {
+		return errors.New("wechat refund notify mismatch, " + strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/signers"
+)
+
+func genTestPlatformCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x5157F09EFDC096DE),
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return key, cert
+}
+
+func signTestNotify(t *testing.T, key *rsa.PrivateKey, serial string, ts time.Time, body string) http.Header {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	nonce := "5K8264ILTKCH16CQ2502SI8ZNMTM67VS"
+	sign, err := signers.Sha256WithRsa(fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, body), key)
+	assert.Nil(t, err)
+
+	h := http.Header{}
+	h.Set("Wechatpay-Serial", serial)
+	h.Set("Wechatpay-Signature", sign)
+	h.Set("Wechatpay-Timestamp", timestamp)
+	h.Set("Wechatpay-Nonce", nonce)
+	return h
+}
+
+func TestCheckWechatNotifySignature(t *testing.T) {
+	key, cert := genTestPlatformCert(t)
+	certs := wechatCertsBySerial([]*x509.Certificate{cert})
+	serial := fmt.Sprintf("%X", cert.SerialNumber)
+	body := `{"id":"EV-2018022511223320873","event_type":"TRANSACTION.SUCCESS"}`
+	now := time.Now()
+
+	h := signTestNotify(t, key, serial, now, body)
+	assert.Nil(t, checkWechatNotifySignature(h, []byte(body), certs, now))
+
+	// 报文被篡改
+	err := checkWechatNotifySignature(h, []byte(body+" "), certs, now)
+	assert.ErrorIs(t, err, errWechatNotifySignature)
+
+	// 未知的平台证书
+	h = signTestNotify(t, key, "ABCDEF", now, body)
+	err = checkWechatNotifySignature(h, []byte(body), certs, now)
+	assert.ErrorIs(t, err, errWechatNotifySignature)
+
+	// 超出时间窗口
+	h = signTestNotify(t, key, serial, now.Add(-10*time.Minute), body)
+	err = checkWechatNotifySignature(h, []byte(body), certs, now)
+	assert.ErrorIs(t, err, errWechatNotifySignature)
+
+	// 缺少header
+	err = checkWechatNotifySignature(http.Header{}, []byte(body), certs, now)
+	assert.ErrorIs(t, err, errWechatNotifySignature)
+}
+
+func TestCheckWechatPaymentNotify(t *testing.T) {
+	rec := &models.PaymentRecord{TransNo: "1217752501201407033233368018", TotalMoney: 1.5, StoreID: 21, AppID: "wxd678efh567hg6787"}
+	pa := &models.PaymentAccount{AccountType: models.ACCOUNT_TYPE_WECHAT, MerID: "1230000109"}
+
+	doc := gjson.Parse(`{"mchid":"1230000109","appid":"wxd678efh567hg6787","out_trade_no":"1217752501201407033233368018","amount":{"total":150}}`)
+	assert.Nil(t, checkWechatPaymentNotify(rec, pa, nil, doc))
+
+	doc = gjson.Parse(`{"mchid":"1230000109","appid":"wxd678efh567hg6787","out_trade_no":"1217752501201407033233368018","amount":{"total":1}}`)
+	assert.NotNil(t, checkWechatPaymentNotify(rec, pa, nil, doc))
+
+	// 服务商模式
+	pa.AppID = "wx8888888888888888"
+	store := &models.Store{WechatPaymentMerID: "1900000109"}
+	doc = gjson.Parse(`{"sp_mchid":"1230000109","sp_appid":"wx8888888888888888","sub_mchid":"1900000109","sub_appid":"wxd678efh567hg6787","out_trade_no":"1217752501201407033233368018","amount":{"total":150}}`)
+	assert.Nil(t, checkWechatPaymentNotify(rec, pa, store, doc))
+	assert.NotNil(t, checkWechatPaymentNotify(rec, pa, nil, doc))
+	assert.NotNil(t, checkWechatPaymentNotify(rec, pa, &models.Store{WechatPaymentMerID: "1900000110"}, doc))
+}
+
+func TestCheckWechatRefundNotify(t *testing.T) {
+	rr := &models.RefundRecord{TransNo: "1217752501201407033233368018", RefundNo: "r_1", RefundMoney: 0.5, StoreID: 21}
+	pa := &models.PaymentAccount{AccountType: models.ACCOUNT_TYPE_WECHAT, MerID: "1230000109"}
+
+	doc := gjson.Parse(`{"mchid":"1230000109","out_trade_no":"1217752501201407033233368018","out_refund_no":"r_1","amount":{"refund":50,"total":150}}`)
+	assert.Nil(t, checkWechatRefundNotify(rr, pa, nil, doc))
+
+	// 其他退款单或者金额不同
+	doc = gjson.Parse(`{"mchid":"1230000109","out_trade_no":"1217752501201407033233368018","out_refund_no":"r_2","amount":{"refund":50,"total":150}}`)
+	assert.NotNil(t, checkWechatRefundNotify(rr, pa, nil, doc))
+	doc = gjson.Parse(`{"mchid":"1230000109","out_trade_no":"1217752501201407033233368018","out_refund_no":"r_1","amount":{"refund":150,"total":150}}`)
+	assert.NotNil(t, checkWechatRefundNotify(rr, pa, nil, doc))
+
+	// 服务商模式
+	pa.AppID = "wx8888888888888888"
+	store := &models.Store{WechatPaymentMerID: "1900000109"}
+	doc = gjson.Parse(`{"sp_mchid":"1230000109","sub_mchid":"1900000109","out_trade_no":"1217752501201407033233368018","out_refund_no":"r_1","amount":{"refund":50,"total":150}}`)
+	assert.Nil(t, checkWechatRefundNotify(rr, pa, store, doc))
+	assert.NotNil(t, checkWechatRefundNotify(rr, pa, &models.Store{WechatPaymentMerID: "1900000110"}, doc))
+}
+
+func TestVerifyWechatNotifyBodyTooLarge(t *testing.T) {
+	defer func(n int64) { config.MaxBodyBytes = n }(config.MaxBodyBytes)
+	config.MaxBodyBytes = 16
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest("POST", "/wechat/refund_notify/r_1", strings.NewReader(strings.Repeat("a", 17)))
+	pa := &models.PaymentAccount{AccountType: models.ACCOUNT_TYPE_WECHAT, MerID: "1230000109"}
+	assert.False(t, verifyWechatNotifyOrFail(ctx, pa))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// 支付通知走PaymentProvider，同样返回413，微信不会一直重试
+	ctx, _ = gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("POST", "/wechat/payment_notify/t_1", strings.NewReader(strings.Repeat("a", 17)))
+	_, err := (&wechatProvider{}).ParseNotify(ctx, &models.PaymentRecord{TransNo: "t_1"}, pa)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, notifyErrorCode(err))
+}
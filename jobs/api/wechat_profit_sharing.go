@@ -0,0 +1,990 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go-gin-payment/config"
+	"go-gin-payment/jobs/webhook"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/tidwall/gjson"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+//
+// 微信服务商分账，只支持服务商账号
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_1.shtml
+//
+// 1. 先给店铺(子商户)添加分账接收方
+// 2. 下单时传profit_sharing为true，支付成功后资金冻结在子商户
+// 3. 请求分账，可以多次分账，最后一次传unfreeze_unsplit或者调用解冻接口把剩余资金解冻给子商户
+// 4. 分账结果是异步的，通过查询接口或者分账动账通知更新，通知地址需要在商户平台配置为
+//    SelfAPIURL/wechat/profit_sharing_notify/<payment_account_id>
+// 5. 分给商户的资金可以回退给子商户
+//
+// 分账、解冻和回退都是先保存再请求微信，微信明确拒绝时改为closed/failed，其他错误(比如超时)保持processing，
+// 用同一个out_order_no/out_return_no再次请求时先查询微信，微信没有时重新发送
+//
+// 分账单、每个接收方的结果和回退都关联到原来的PaymentRecord
+//
+
+const wechatProfitSharingMaxReceivers = 50
+
+var profitSharingReceiverTypes = map[string]bool{
+	"MERCHANT_ID":     true,
+	"PERSONAL_OPENID": true,
+}
+
+type profitSharingReceiverOps struct {
+	StoreID          string `json:"store_id"`
+	PaymentAccountID string `json:"payment_account_id"` // 不传时使用店铺默认的微信账号
+	Type             string `json:"type"`               // MERCHANT_ID|PERSONAL_OPENID
+	Account          string `json:"account"`            // 商户号或者服务商AppID下的openid
+	Name             string `json:"name"`               // MERCHANT_ID时必须，为商户全称
+	RelationType     string `json:"relation_type"`      // STORE|STAFF|STORE_OWNER|PARTNER|HEADQUARTER|BRAND|DISTRIBUTOR|USER|SUPPLIER|CUSTOM
+	CustomRelation   string `json:"custom_relation"`    // relation_type为CUSTOM时必须
+}
+
+func (o *profitSharingReceiverOps) validate() error {
+	if !profitSharingReceiverTypes[o.Type] {
+		return fmt.Errorf("invalid type: %s, should be MERCHANT_ID|PERSONAL_OPENID", o.Type)
+	}
+	if len(o.Account) == 0 || len(o.RelationType) == 0 {
+		return errors.New("account and relation_type are required")
+	}
+	if o.Type == "MERCHANT_ID" && len(o.Name) == 0 {
+		return errors.New("name is required for MERCHANT_ID")
+	}
+	if o.RelationType == "CUSTOM" && len(o.CustomRelation) == 0 {
+		return errors.New("custom_relation is required when relation_type is CUSTOM")
+	}
+	return nil
+}
+
+type profitSharingOrderReceiverOps struct {
+	Type        string `json:"type"`
+	Account     string `json:"account"`
+	Amount      int64  `json:"amount"` // 单位为分
+	Description string `json:"description"`
+}
+
+type profitSharingOrderOps struct {
+	TransNo         string                          `json:"trans_no"`
+	OutOrderNo      string                          `json:"out_order_no"`
+	UnfreezeUnsplit bool                            `json:"unfreeze_unsplit"` // 分账后解冻剩余资金
+	Receivers       []profitSharingOrderReceiverOps `json:"receivers"`
+}
+
+// validate total为订单金额，shared为之前已经分出或者正在分的金额，单位都为分
+func (o *profitSharingOrderOps) validate(total, shared int64) error {
+	if len(o.OutOrderNo) == 0 {
+		return errors.New("out_order_no is required")
+	}
+	if n := len(o.Receivers); n == 0 || n > wechatProfitSharingMaxReceivers {
+		return fmt.Errorf("receivers should be 1 to %d", wechatProfitSharingMaxReceivers)
+	}
+	var sum int64
+	seen := make(map[string]bool, len(o.Receivers))
+	for _, r := range o.Receivers {
+		if !profitSharingReceiverTypes[r.Type] || len(r.Account) == 0 || len(r.Description) == 0 || r.Amount <= 0 {
+			return errors.New("type, account, amount and description are required for each receiver")
+		}
+		k := r.Type + ":" + r.Account
+		if seen[k] {
+			return fmt.Errorf("duplicated receiver: %s", k)
+		}
+		seen[k] = true
+		sum += r.Amount
+	}
+	if sum+shared > total {
+		return fmt.Errorf("profit sharing amount exceeded, total: %d, shared: %d, requested: %d", total, shared, sum)
+	}
+	return nil
+}
+
+type profitSharingReturnOps struct {
+	OutOrderNo  string `json:"out_order_no"`
+	OutReturnNo string `json:"out_return_no"`
+	ReturnMchID string `json:"return_mchid"` // 只能从商户类型的接收方回退
+	Amount      int64  `json:"amount"`       // 单位为分
+	Description string `json:"description"`
+}
+
+// profitSharingState 分账单和每个接收方的结果，查询接口返回和通知web端(profit_sharing.state)都使用这个结构
+type profitSharingState struct {
+	models.ProfitSharingOrder
+	Details []models.ProfitSharingDetail `json:"details"`
+}
+
+func newProfitSharingState(o *models.ProfitSharingOrder) *profitSharingState {
+	return &profitSharingState{*o, models.FindProfitSharingDetails(o.ID)}
+}
+
+func apiWechatProfitSharing(r *gin.Engine) {
+	// 添加分账接收方，已经添加过的会更新
+	//
+	// body:
+	// {
+	// 	"store_id": "1",
+	// 	"payment_account_id": "2", 可选，不传时使用店铺默认的微信账号
+	// 	"type": "MERCHANT_ID"|"PERSONAL_OPENID",
+	// 	"account": "86693852",
+	// 	"name": "腾讯科技有限公司", MERCHANT_ID时必须
+	// 	"relation_type": "STORE",
+	// 	"custom_relation": "" relation_type为CUSTOM时必须
+	// }
+	r.POST("/wechat/profit_sharing/receivers", requireScope(models.API_SCOPE_ADMIN), func(ctx *gin.Context) {
+		var o profitSharingReceiverOps
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := checkClientStore(ctx, cast.ToInt64(o.StoreID)); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		rcv, err := addWechatProfitSharingReceiver(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": rcv})
+	})
+
+	r.GET("/wechat/profit_sharing/receivers", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		storeID := cast.ToInt64(ctx.Query("store_id"))
+		if err := checkClientStore(ctx, storeID); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{
+			"status": "ok",
+			"data":   models.FindProfitSharingReceivers(storeID),
+		})
+	})
+
+	r.DELETE("/wechat/profit_sharing/receivers/:id", requireScope(models.API_SCOPE_ADMIN), func(ctx *gin.Context) {
+		rcv, err := models.FindProfitSharingReceiver(cast.ToInt64(ctx.Param("id")))
+		if err == nil {
+			err = checkClientStore(ctx, rcv.StoreID)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := deleteWechatProfitSharingReceiver(rcv); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok"})
+	})
+
+	// 请求分账，结果为异步，返回的接收方result可能为pending
+	//
+	// body:
+	// {
+	// 	"trans_no": "abcssscascscds",
+	// 	"out_order_no": "P20150806125346",
+	// 	"unfreeze_unsplit": true, 可选，分账后解冻剩余资金
+	// 	"receivers": [
+	// 		{"type": "MERCHANT_ID", "account": "86693852", "amount": 888, "description": "分给商户A"}
+	// 	]
+	// }
+	r.POST("/wechat/profit_sharing/orders", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		var o profitSharingOrderOps
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := checkClientTransNo(ctx, o.TransNo); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		st, err := createWechatProfitSharingOrder(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": st})
+	})
+
+	// 查询微信的分账结果并更新
+	r.GET("/wechat/profit_sharing/orders/:outOrderNo", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		o, err := models.FindProfitSharingOrder(ctx.Param("outOrderNo"))
+		if err == nil {
+			err = checkClientStore(ctx, o.StoreID)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := queryWechatProfitSharingOrder(o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": newProfitSharingState(o)})
+	})
+
+	// 不再分账时解冻剩余资金给子商户
+	//
+	// body:
+	// {
+	// 	"trans_no": "abcssscascscds",
+	// 	"out_order_no": "P20150806125347",
+	// 	"description": "解冻全部剩余资金"
+	// }
+	r.POST("/wechat/profit_sharing/unfreeze", requireScope(models.API_SCOPE_PAYMENT), func(ctx *gin.Context) {
+		o := struct {
+			TransNo     string `json:"trans_no"`
+			OutOrderNo  string `json:"out_order_no"`
+			Description string `json:"description"`
+		}{}
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := checkClientTransNo(ctx, o.TransNo); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		st, err := unfreezeWechatProfitSharing(o.TransNo, o.OutOrderNo, o.Description)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": st})
+	})
+
+	// 分账回退，把分给商户的资金退回子商户
+	//
+	// body:
+	// {
+	// 	"out_order_no": "P20150806125346",
+	// 	"out_return_no": "R20190516001",
+	// 	"return_mchid": "86693852",
+	// 	"amount": 10,
+	// 	"description": "用户退款"
+	// }
+	r.POST("/wechat/profit_sharing/returns", requireScope(models.API_SCOPE_REFUND), func(ctx *gin.Context) {
+		var o profitSharingReturnOps
+		if err := ctx.ShouldBindJSON(&o); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if isClientStoreRestricted(ctx) {
+			order, err := models.FindProfitSharingOrder(o.OutOrderNo)
+			if err == nil {
+				err = checkClientStore(ctx, order.StoreID)
+			}
+			if err != nil {
+				ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+				return
+			}
+		}
+		ret, err := createWechatProfitSharingReturn(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": ret})
+	})
+
+	r.GET("/wechat/profit_sharing/returns/:outReturnNo", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		ret, err := models.FindProfitSharingReturn(ctx.Param("outReturnNo"))
+		if err == nil {
+			err = checkClientPaymentRecordID(ctx, ret.PaymentRecordID)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		if err := queryWechatProfitSharingReturn(ret); err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": ret})
+	})
+
+	// 支付记录的所有分账单(包括解冻)和回退
+	r.GET("/wechat/profit_sharing/payments/:transNo", requireScope(models.API_SCOPE_READ), func(ctx *gin.Context) {
+		rec, err := findClientPaymentRecord(ctx, ctx.Param("transNo"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		orders := models.FindProfitSharingOrders(rec.ID)
+		states := make([]*profitSharingState, 0, len(orders))
+		for i := range orders {
+			states = append(states, newProfitSharingState(&orders[i]))
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": common.M{
+			"trans_no": rec.TransNo,
+			"orders":   states,
+			"returns":  models.FindProfitSharingReturns(rec.ID),
+		}})
+	})
+
+	r.POST("/wechat/profit_sharing_notify/:paymentAccountID", notifyMetrics(models.ACCOUNT_TYPE_WECHAT, "profit_sharing"), wechatProfitSharingNotifyHandler)
+}
+
+// findProfitSharingPayment 分账需要下单时指定了profit_sharing且已经支付成功，transaction_id为支付记录的PayNo
+func findProfitSharingPayment(transNo string) (*models.PaymentRecord, *models.PaymentAccount, *models.Store, error) {
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !rec.ProfitSharing {
+		return nil, nil, nil, fmt.Errorf("trans_no %s is not a profit sharing payment", transNo)
+	}
+	if !rec.CanRefund() || len(rec.PayNo) == 0 {
+		return nil, nil, nil, fmt.Errorf("trans_no %s is not paid, status: %s", transNo, rec.Status)
+	}
+	pa, store, err := findProfitSharingAccount(rec.PaymentAccountID, rec.StoreID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return rec, pa, store, nil
+}
+
+func findProfitSharingAccount(paymentAccountID, storeID int64) (*models.PaymentAccount, *models.Store, error) {
+	pa, err := models.FindPaLoadPrivateCert(paymentAccountID, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load pa error: %s", err)
+	}
+	if pa.AccountType != models.ACCOUNT_TYPE_WECHAT || !pa.IsWechatServiceProviderAccount() {
+		return nil, nil, fmt.Errorf("payment account %d is not a wechat service provider account", pa.ID)
+	}
+	store, err := models.FindWechatSubMerchantStore(storeID, pa)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pa, store, nil
+}
+
+// addWechatProfitSharingReceiver 先添加到微信再保存
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_8.shtml
+func addWechatProfitSharingReceiver(o *profitSharingReceiverOps) (*models.ProfitSharingReceiver, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	storeID := cast.ToInt64(o.StoreID)
+	paID := cast.ToInt64(o.PaymentAccountID)
+	if paID == 0 {
+		id, err := models.FindDefaultStorePaymentAccountID(storeID, models.ACCOUNT_TYPE_WECHAT)
+		if err != nil {
+			return nil, fmt.Errorf("payment_account_id is not given and %s", err)
+		}
+		paID = id
+	}
+	pa, store, err := findProfitSharingAccount(paID, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	client, cert, err := wechatSensitiveClient(pa)
+	if err != nil {
+		return nil, err
+	}
+	mapInfo, err := buildWechatProfitSharingReceiver(o, pa, store, cert)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Post(context.TODO(), wechatAPIURL("/v3/profitsharing/receivers/add"), mapInfo)
+	if err != nil {
+		wclg().Warnf("add profit sharing receiver %s:%s err: %s", o.Type, o.Account, err)
+		return nil, err
+	}
+	if _, err := validateWechatClientRsp(rsp); err != nil {
+		return nil, err
+	}
+
+	rcv := &models.ProfitSharingReceiver{
+		PaymentAccountID: pa.ID,
+		StoreID:          store.ID,
+		Type:             o.Type,
+		Account:          o.Account,
+		Name:             o.Name,
+		RelationType:     o.RelationType,
+		CustomRelation:   o.CustomRelation,
+	}
+	if err := models.CreateProfitSharingReceiver(rcv); err != nil {
+		return nil, err
+	}
+	return rcv, nil
+}
+
+// buildWechatProfitSharingReceiver name需要用平台证书加密，请求头的Wechatpay-Serial必须是cert的序列号
+func buildWechatProfitSharingReceiver(o *profitSharingReceiverOps, pa *models.PaymentAccount, store *models.Store, cert *x509.Certificate) (map[string]interface{}, error) {
+	mapInfo := map[string]interface{}{
+		"sub_mchid":     store.WechatPaymentMerID,
+		"appid":         pa.AppID,
+		"type":          o.Type,
+		"account":       o.Account,
+		"relation_type": o.RelationType,
+	}
+	if len(o.Name) > 0 {
+		name, err := utils.EncryptOAEPWithCertificate(o.Name, cert)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt receiver name error: %s", err)
+		}
+		mapInfo["name"] = name
+	}
+	if o.RelationType == "CUSTOM" {
+		mapInfo["custom_relation"] = o.CustomRelation
+	}
+	return mapInfo, nil
+}
+
+// wechatSensitiveClient 请求中有加密的敏感字段时使用，header中带上加密使用的平台证书序列号
+func wechatSensitiveClient(pa *models.PaymentAccount) (*core.Client, *x509.Certificate, error) {
+	certs, err := wechatCerts.Certs(pa)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := latestWechatCert(certs)
+	if cert == nil {
+		return nil, nil, fmt.Errorf("no wechat platform cert, mer_id: %s", pa.MerID)
+	}
+	cs := make([]*x509.Certificate, 0, len(certs))
+	for _, c := range certs {
+		cs = append(cs, c)
+	}
+	h := http.Header{}
+	h.Set("Wechatpay-Serial", fmt.Sprintf("%X", cert.SerialNumber))
+	client, err := core.NewClient(context.TODO(),
+		option.WithMerchant(pa.MerID, pa.CertSerialNumber, pa.LoadedCertPrivate),
+		option.WithWechatPay(cs),
+		option.WithHeader(&h),
+		option.WithTimeout(config.WechatPayTimeout),
+		option.WithHTTPClient(wechatHTTPClient(pa.MerID)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, cert, nil
+}
+
+// latestWechatCert 有多个平台证书时(更换证书期间)使用最晚过期的
+func latestWechatCert(certs map[string]*x509.Certificate) *x509.Certificate {
+	var latest *x509.Certificate
+	for _, c := range certs {
+		if latest == nil || c.NotAfter.After(latest.NotAfter) {
+			latest = c
+		}
+	}
+	return latest
+}
+
+// deleteWechatProfitSharingReceiver 先从微信删除再删除本地记录
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_9.shtml
+func deleteWechatProfitSharingReceiver(rcv *models.ProfitSharingReceiver) error {
+	pa, store, err := findProfitSharingAccount(rcv.PaymentAccountID, rcv.StoreID)
+	if err != nil {
+		return err
+	}
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Post(context.TODO(), wechatAPIURL("/v3/profitsharing/receivers/delete"), map[string]interface{}{
+		"sub_mchid": store.WechatPaymentMerID,
+		"appid":     pa.AppID,
+		"type":      rcv.Type,
+		"account":   rcv.Account,
+	})
+	if err != nil {
+		wclg().Warnf("delete profit sharing receiver %d err: %s", rcv.ID, err)
+		return err
+	}
+	if _, err := validateWechatClientRsp(rsp); err != nil {
+		return err
+	}
+	return rcv.Delete()
+}
+
+// createWechatProfitSharingOrder 先保存分账单再请求微信，微信明确拒绝(4xx)时分账单改为closed
+// 其他错误分账单保持processing，同一个out_order_no再次请求时先查询微信，微信没有这个分账单时重新发送
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_1.shtml
+func createWechatProfitSharingOrder(o *profitSharingOrderOps) (*profitSharingState, error) {
+	rec, pa, store, err := findProfitSharingPayment(o.TransNo)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := models.FindProfitSharingOrder(o.OutOrderNo); err == nil {
+		return retryWechatProfitSharingOrder(old, rec.TransNo, false, func() (*profitSharingState, error) {
+			// 使用保存的接收方重新发送，和第一次请求的内容一致
+			return postWechatProfitSharingOrder(old, pa, "/v3/profitsharing/orders",
+				buildWechatProfitSharingOrder(savedProfitSharingOrderOps(old), pa, store, rec.PayNo))
+		})
+	}
+	if err := o.validate(rec.TotalFen(), models.ProfitSharedFen(rec.ID)); err != nil {
+		return nil, err
+	}
+
+	order := &models.ProfitSharingOrder{
+		PaymentRecordID:  rec.ID,
+		PaymentAccountID: pa.ID,
+		StoreID:          store.ID,
+		TransNo:          rec.TransNo,
+		OutOrderNo:       o.OutOrderNo,
+		TransactionID:    rec.PayNo,
+		UnfreezeUnsplit:  o.UnfreezeUnsplit,
+	}
+	details := make([]models.ProfitSharingDetail, 0, len(o.Receivers))
+	for _, r := range o.Receivers {
+		details = append(details, models.ProfitSharingDetail{
+			Type:        r.Type,
+			Account:     r.Account,
+			Money:       models.FenToYuan(r.Amount),
+			Description: r.Description,
+		})
+	}
+	if err := models.CreateProfitSharingOrder(order, details); err != nil {
+		return nil, err
+	}
+	return postWechatProfitSharingOrder(order, pa, "/v3/profitsharing/orders", buildWechatProfitSharingOrder(o, pa, store, rec.PayNo))
+}
+
+// retryWechatProfitSharingOrder 同一个out_order_no的分账单已经保存过，只能用于同一个支付记录的同一种请求
+// 还在processing的先查询微信，微信没有这个分账单(之前的请求没有到达微信)时调用resend重新发送
+func retryWechatProfitSharingOrder(order *models.ProfitSharingOrder, transNo string, unfreeze bool, resend func() (*profitSharingState, error)) (*profitSharingState, error) {
+	if order.TransNo != transNo || order.Unfreeze != unfreeze {
+		return nil, fmt.Errorf("out_order_no already used: %s", order.OutOrderNo)
+	}
+	switch order.Status {
+	case models.PROFIT_SHARING_STATUS_CLOSED:
+		return nil, fmt.Errorf("out_order_no %s was rejected by wechat, use a new out_order_no", order.OutOrderNo)
+	case models.PROFIT_SHARING_STATUS_PROCESSING:
+	default:
+		return newProfitSharingState(order), nil
+	}
+	err := queryWechatProfitSharingOrder(order)
+	if err == nil {
+		return newProfitSharingState(order), nil
+	}
+	if !isWechatResourceNotExist(err) {
+		return nil, err
+	}
+	wclg().Infof("profit sharing out_order_no: %s not found in wechat, resend", order.OutOrderNo)
+	return resend()
+}
+
+// postWechatProfitSharingOrder 请求分账或者解冻，保存返回的结果
+func postWechatProfitSharingOrder(order *models.ProfitSharingOrder, pa *models.PaymentAccount, path string, body map[string]interface{}) (*profitSharingState, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Post(context.TODO(), wechatAPIURL(path), body)
+	if err != nil {
+		wclg().Warnf("profit sharing out_order_no: %s err: %s", order.OutOrderNo, err)
+		if reason, ok := wechatRejectedReason(err); ok {
+			if cerr := order.Close(reason); cerr != nil {
+				wclg().Warnf("close profit sharing out_order_no: %s err: %s", order.OutOrderNo, cerr)
+			}
+		}
+		return nil, err
+	}
+	rspBody, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncWechatProfitSharingOrder(order, rspBody); err != nil {
+		return nil, err
+	}
+	return newProfitSharingState(order), nil
+}
+
+// savedProfitSharingOrderOps 用保存的分账单和接收方生成请求参数，重新发送时使用
+func savedProfitSharingOrderOps(order *models.ProfitSharingOrder) *profitSharingOrderOps {
+	o := &profitSharingOrderOps{
+		TransNo:         order.TransNo,
+		OutOrderNo:      order.OutOrderNo,
+		UnfreezeUnsplit: order.UnfreezeUnsplit,
+	}
+	for _, d := range models.FindProfitSharingDetails(order.ID) {
+		o.Receivers = append(o.Receivers, profitSharingOrderReceiverOps{
+			Type:        d.Type,
+			Account:     d.Account,
+			Amount:      models.YuanToFen(d.Money),
+			Description: d.Description,
+		})
+	}
+	return o
+}
+
+func buildWechatProfitSharingOrder(o *profitSharingOrderOps, pa *models.PaymentAccount, store *models.Store, transactionID string) map[string]interface{} {
+	receivers := make([]map[string]interface{}, 0, len(o.Receivers))
+	for _, r := range o.Receivers {
+		receivers = append(receivers, map[string]interface{}{
+			"type":        r.Type,
+			"account":     r.Account,
+			"amount":      r.Amount,
+			"description": r.Description,
+		})
+	}
+	return map[string]interface{}{
+		"sub_mchid":        store.WechatPaymentMerID,
+		"appid":            pa.AppID,
+		"transaction_id":   transactionID,
+		"out_order_no":     o.OutOrderNo,
+		"receivers":        receivers,
+		"unfreeze_unsplit": o.UnfreezeUnsplit,
+	}
+}
+
+// queryWechatProfitSharingOrder 分账和解冻都使用这个接口查询
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_2.shtml
+func queryWechatProfitSharingOrder(o *models.ProfitSharingOrder) error {
+	pa, store, err := findProfitSharingAccount(o.PaymentAccountID, o.StoreID)
+	if err != nil {
+		return err
+	}
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Get(context.TODO(), wechatAPIURL(fmt.Sprintf(
+		"/v3/profitsharing/orders/%s?sub_mchid=%s&transaction_id=%s",
+		url.PathEscape(o.OutOrderNo), store.WechatPaymentMerID, o.TransactionID)))
+	if err != nil {
+		wclg().Warnf("query profit sharing out_order_no: %s err: %s", o.OutOrderNo, err)
+		return err
+	}
+	body, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return err
+	}
+	return syncWechatProfitSharingOrder(o, body)
+}
+
+// syncWechatProfitSharingOrder 请求分账、解冻和查询的返回格式相同
+func syncWechatProfitSharingOrder(o *models.ProfitSharingOrder, body []byte) error {
+	doc := gjson.ParseBytes(body)
+	if err := o.UpdateResult(doc.Get("order_id").String(), doc.Get("state").String(), string(body), wechatProfitSharingReceivers(doc), nil); err != nil {
+		return err
+	}
+	o2, err := models.FindProfitSharingOrder(o.OutOrderNo)
+	if err != nil {
+		return err
+	}
+	*o = *o2
+	return nil
+}
+
+// wechatProfitSharingReceivers 解析返回中的receivers，金额转换为元
+func wechatProfitSharingReceivers(doc gjson.Result) []models.ProfitSharingReceiverResult {
+	rs := make([]models.ProfitSharingReceiverResult, 0)
+	for _, r := range doc.Get("receivers").Array() {
+		rs = append(rs, models.ProfitSharingReceiverResult{
+			Type:       r.Get("type").String(),
+			Account:    r.Get("account").String(),
+			Money:      models.FenToYuan(r.Get("amount").Int()),
+			DetailID:   r.Get("detail_id").String(),
+			Result:     r.Get("result").String(),
+			FailReason: r.Get("fail_reason").String(),
+			FinishTime: r.Get("finish_time").String(),
+		})
+	}
+	return rs
+}
+
+// unfreezeWechatProfitSharing 解冻也需要一个新的out_order_no，保存为Unfreeze的分账单，失败时的处理同createWechatProfitSharingOrder
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_5.shtml
+func unfreezeWechatProfitSharing(transNo, outOrderNo, description string) (*profitSharingState, error) {
+	if len(outOrderNo) == 0 || len(description) == 0 {
+		return nil, errors.New("out_order_no and description are required")
+	}
+	rec, pa, store, err := findProfitSharingPayment(transNo)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{
+		"sub_mchid":      store.WechatPaymentMerID,
+		"transaction_id": rec.PayNo,
+		"out_order_no":   outOrderNo,
+		"description":    description,
+	}
+	if old, err := models.FindProfitSharingOrder(outOrderNo); err == nil {
+		return retryWechatProfitSharingOrder(old, rec.TransNo, true, func() (*profitSharingState, error) {
+			return postWechatProfitSharingOrder(old, pa, "/v3/profitsharing/orders/unfreeze", body)
+		})
+	}
+	order := &models.ProfitSharingOrder{
+		PaymentRecordID:  rec.ID,
+		PaymentAccountID: pa.ID,
+		StoreID:          store.ID,
+		TransNo:          rec.TransNo,
+		OutOrderNo:       outOrderNo,
+		TransactionID:    rec.PayNo,
+		Unfreeze:         true,
+	}
+	if err := models.CreateProfitSharingOrder(order, nil); err != nil {
+		return nil, err
+	}
+	return postWechatProfitSharingOrder(order, pa, "/v3/profitsharing/orders/unfreeze", body)
+}
+
+// createWechatProfitSharingReturn 回退金额不能超过分给该商户且还没有回退的金额
+// 微信明确拒绝(4xx)时回退单改为failed，其他错误保持processing，同一个out_return_no再次请求时先查询微信
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_3.shtml
+func createWechatProfitSharingReturn(o *profitSharingReturnOps) (*models.ProfitSharingReturn, error) {
+	if len(o.OutReturnNo) == 0 || len(o.ReturnMchID) == 0 || len(o.Description) == 0 || o.Amount <= 0 {
+		return nil, errors.New("out_return_no, return_mchid, amount and description are required")
+	}
+	order, err := models.FindProfitSharingOrder(o.OutOrderNo)
+	if err != nil {
+		return nil, err
+	}
+	if order.Unfreeze {
+		return nil, fmt.Errorf("out_order_no %s is an unfreeze order, can not return", o.OutOrderNo)
+	}
+	pa, store, err := findProfitSharingAccount(order.PaymentAccountID, order.StoreID)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := models.FindProfitSharingReturn(o.OutReturnNo); err == nil {
+		return retryWechatProfitSharingReturn(old, order, pa, store)
+	}
+	if err := checkProfitSharingReturnAmount(models.FindProfitSharingDetails(order.ID), models.FindProfitSharingReturns(order.PaymentRecordID), o); err != nil {
+		return nil, err
+	}
+
+	ret := &models.ProfitSharingReturn{
+		PaymentRecordID:      order.PaymentRecordID,
+		ProfitSharingOrderID: order.ID,
+		OutOrderNo:           order.OutOrderNo,
+		OutReturnNo:          o.OutReturnNo,
+		ReturnMchID:          o.ReturnMchID,
+		Money:                models.FenToYuan(o.Amount),
+		Description:          o.Description,
+	}
+	if err := models.CreateProfitSharingReturn(ret); err != nil {
+		return nil, err
+	}
+	return postWechatProfitSharingReturn(ret, pa, store)
+}
+
+// retryWechatProfitSharingReturn 同一个out_return_no的回退单已经保存过，还在processing的先查询微信，微信没有时重新发送
+func retryWechatProfitSharingReturn(ret *models.ProfitSharingReturn, order *models.ProfitSharingOrder, pa *models.PaymentAccount, store *models.Store) (*models.ProfitSharingReturn, error) {
+	if ret.OutOrderNo != order.OutOrderNo {
+		return nil, fmt.Errorf("out_return_no already used: %s", ret.OutReturnNo)
+	}
+	if ret.Result != models.PROFIT_SHARING_RETURN_PROCESSING {
+		return ret, nil
+	}
+	err := queryWechatProfitSharingReturn(ret)
+	if err == nil {
+		return ret, nil
+	}
+	if !isWechatResourceNotExist(err) {
+		return nil, err
+	}
+	wclg().Infof("profit sharing return out_return_no: %s not found in wechat, resend", ret.OutReturnNo)
+	return postWechatProfitSharingReturn(ret, pa, store)
+}
+
+// postWechatProfitSharingReturn 使用保存的回退单请求微信
+func postWechatProfitSharingReturn(ret *models.ProfitSharingReturn, pa *models.PaymentAccount, store *models.Store) (*models.ProfitSharingReturn, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Post(context.TODO(), wechatAPIURL("/v3/profitsharing/return-orders"), map[string]interface{}{
+		"sub_mchid":     store.WechatPaymentMerID,
+		"out_order_no":  ret.OutOrderNo,
+		"out_return_no": ret.OutReturnNo,
+		"return_mchid":  ret.ReturnMchID,
+		"amount":        models.YuanToFen(ret.Money),
+		"description":   ret.Description,
+	})
+	if err != nil {
+		wclg().Warnf("profit sharing return out_return_no: %s err: %s", ret.OutReturnNo, err)
+		if reason, ok := wechatRejectedReason(err); ok {
+			if uerr := ret.UpdateResult("", models.PROFIT_SHARING_RETURN_FAILED, reason, ""); uerr != nil {
+				wclg().Warnf("update profit sharing return out_return_no: %s err: %s", ret.OutReturnNo, uerr)
+			}
+		}
+		return nil, err
+	}
+	body, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncWechatProfitSharingReturn(ret, body); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// checkProfitSharingReturnAmount 只能从分账成功的商户接收方回退，失败的回退不算
+func checkProfitSharingReturnAmount(details []models.ProfitSharingDetail, returns []models.ProfitSharingReturn, o *profitSharingReturnOps) error {
+	var shared int64
+	for _, d := range details {
+		if d.Type == "MERCHANT_ID" && d.Account == o.ReturnMchID && d.Result == models.PROFIT_SHARING_RESULT_SUCCESS {
+			shared += models.YuanToFen(d.Money)
+		}
+	}
+	if shared == 0 {
+		return fmt.Errorf("no successful profit sharing to merchant %s in out_order_no %s", o.ReturnMchID, o.OutOrderNo)
+	}
+	var returned int64
+	for _, r := range returns {
+		if r.OutOrderNo == o.OutOrderNo && r.ReturnMchID == o.ReturnMchID && r.Result != models.PROFIT_SHARING_RETURN_FAILED {
+			returned += models.YuanToFen(r.Money)
+		}
+	}
+	if o.Amount+returned > shared {
+		return fmt.Errorf("return amount exceeded, shared: %d, returned: %d, requested: %d", shared, returned, o.Amount)
+	}
+	return nil
+}
+
+// queryWechatProfitSharingReturn
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_4.shtml
+func queryWechatProfitSharingReturn(ret *models.ProfitSharingReturn) error {
+	order, err := models.FindProfitSharingOrder(ret.OutOrderNo)
+	if err != nil {
+		return err
+	}
+	pa, store, err := findProfitSharingAccount(order.PaymentAccountID, order.StoreID)
+	if err != nil {
+		return err
+	}
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Get(context.TODO(), wechatAPIURL(fmt.Sprintf(
+		"/v3/profitsharing/return-orders/%s?sub_mchid=%s&out_order_no=%s",
+		url.PathEscape(ret.OutReturnNo), store.WechatPaymentMerID, url.QueryEscape(ret.OutOrderNo))))
+	if err != nil {
+		wclg().Warnf("query profit sharing return out_return_no: %s err: %s", ret.OutReturnNo, err)
+		return err
+	}
+	body, err := validateWechatClientRsp(rsp)
+	if err != nil {
+		return err
+	}
+	return syncWechatProfitSharingReturn(ret, body)
+}
+
+func syncWechatProfitSharingReturn(ret *models.ProfitSharingReturn, body []byte) error {
+	doc := gjson.ParseBytes(body)
+	if err := ret.UpdateResult(doc.Get("return_id").String(), doc.Get("result").String(), doc.Get("fail_reason").String(), string(body)); err != nil {
+		return err
+	}
+	r2, err := models.FindProfitSharingReturn(ret.OutReturnNo)
+	if err != nil {
+		return err
+	}
+	*ret = *r2
+	return nil
+}
+
+// wechatProfitSharingNotifyHandler 分账动账通知，每个接收方一次通知，更新后通知web端profit_sharing.state
+// 通知中没有分账单的状态，所有接收方都有结果后分账单改为finished(见models.ProfitSharingOrder.UpdateResult)
+// https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter8_1_10.shtml
+func wechatProfitSharingNotifyHandler(ctx *gin.Context) {
+	pa, err := models.FindPaLoadPrivateCert(cast.ToInt64(ctx.Param("paymentAccountID")), true)
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusNotFound, "load pa error:"+err.Error())
+		return
+	}
+	if !verifyWechatNotifyOrFail(ctx, pa) {
+		return
+	}
+	var o wechatNotifyBody
+	if err := ctx.ShouldBindJSON(&o); err != nil {
+		wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	doc, err := o.decrypt(pa)
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusBadRequest, "decode wechat profit sharing notify data error:"+err.Error())
+		return
+	}
+
+	order, err := models.FindProfitSharingOrder(doc.Get("out_order_no").String())
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := checkWechatProfitSharingNotify(order, pa, doc); err != nil {
+		wclg().WithField("alert", true).Errorf("out_order_no: %s, %s, data: %s", order.OutOrderNo, err, doc.Raw)
+		wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := models.PROFIT_SHARING_RESULT_SUCCESS
+	if o.EventType == "PROFITSHARING.CLOSED" {
+		result = models.PROFIT_SHARING_RESULT_CLOSED
+	}
+	rec, err := models.FindPaymentRecordByID(order.PaymentRecordID)
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// 通知和分账结果在同一个事务中保存，保存失败时返回错误让微信重试
+	receiver := doc.Get("receiver")
+	err = order.UpdateResult(doc.Get("order_id").String(), "", "", []models.ProfitSharingReceiverResult{{
+		Type:       receiver.Get("type").String(),
+		Account:    receiver.Get("account").String(),
+		Money:      models.FenToYuan(receiver.Get("amount").Int()),
+		Result:     result,
+		FinishTime: doc.Get("success_time").String(),
+	}}, profitSharingStateDeliveries(rec))
+	if err != nil {
+		wechatNotifyFail(ctx, http.StatusInternalServerError, "update profit sharing order error: "+err.Error())
+		return
+	}
+	webhook.Wake()
+	ctx.JSON(http.StatusOK, common.M{
+		"code":    "SUCCESS",
+		"message": "成功",
+	})
+}
+
+// checkWechatProfitSharingNotify 校验通知和我们保存的分账单是否一致
+func checkWechatProfitSharingNotify(order *models.ProfitSharingOrder, pa *models.PaymentAccount, doc gjson.Result) error {
+	var errs []string
+	check := func(field, got, expected string) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("%s: got %q, expected %q", field, got, expected))
+		}
+	}
+	if order.PaymentAccountID != pa.ID {
+		errs = append(errs, fmt.Sprintf("payment_account_id: got %d, expected %d", pa.ID, order.PaymentAccountID))
+	}
+	check("sp_mchid", doc.Get("sp_mchid").String(), pa.MerID)
+	check("transaction_id", doc.Get("transaction_id").String(), order.TransactionID)
+	if store, err := models.FindWechatSubMerchantStore(order.StoreID, pa); err != nil {
+		errs = append(errs, "sub_mchid: "+err.Error())
+	} else {
+		check("sub_mchid", doc.Get("sub_mchid").String(), store.WechatPaymentMerID)
+	}
+	if len(errs) > 0 {
+		return errors.New("wechat profit sharing notify mismatch, " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// profitSharingStateDeliveries 通知web端profit_sharing.state，见models.ProfitSharingOrder.UpdateResult
+func profitSharingStateDeliveries(rec *models.PaymentRecord) func(*models.ProfitSharingOrder, []models.ProfitSharingDetail) []*models.WebhookDelivery {
+	return func(o *models.ProfitSharingOrder, details []models.ProfitSharingDetail) []*models.WebhookDelivery {
+		d, _ := json.Marshal(&profitSharingState{*o, details})
+		return webhook.NewDeliveries(o.TransNo, "profit_sharing.state", d, rec.AddiNotifyURL)
+	}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go-gin-payment/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	wxerrors "github.com/wechatpay-apiv3/wechatpay-go/core/errors"
+)
+
+func TestProfitSharingOrderOpsValidate(t *testing.T) {
+	newOps := func() *profitSharingOrderOps {
+		return &profitSharingOrderOps{
+			TransNo:    "abcssscascscds",
+			OutOrderNo: "P20150806125346",
+			Receivers: []profitSharingOrderReceiverOps{
+				{Type: "MERCHANT_ID", Account: "86693852", Amount: 20, Description: "分给商户A"},
+				{Type: "PERSONAL_OPENID", Account: "oxTWIuGaIt6gTKsQRLau2M0yL16E", Amount: 10, Description: "分给个人"},
+			},
+		}
+	}
+	assert.Nil(t, newOps().validate(100, 0))
+	assert.Nil(t, newOps().validate(100, 70))
+	assert.Contains(t, newOps().validate(100, 71).Error(), "exceeded")
+
+	o := newOps()
+	o.OutOrderNo = ""
+	assert.NotNil(t, o.validate(100, 0))
+
+	o = newOps()
+	o.Receivers = nil
+	assert.NotNil(t, o.validate(100, 0))
+
+	o = newOps()
+	o.Receivers[1].Amount = 0
+	assert.NotNil(t, o.validate(100, 0))
+
+	o = newOps()
+	o.Receivers[1].Type = "PERSONAL_NAME"
+	assert.NotNil(t, o.validate(100, 0))
+
+	o = newOps()
+	o.Receivers[1] = o.Receivers[0]
+	assert.Contains(t, o.validate(100, 0).Error(), "duplicated")
+}
+
+func TestProfitSharingReceiverOpsValidate(t *testing.T) {
+	o := profitSharingReceiverOps{Type: "MERCHANT_ID", Account: "86693852", Name: "腾讯科技有限公司", RelationType: "STORE"}
+	assert.Nil(t, o.validate())
+
+	o.Name = ""
+	assert.NotNil(t, o.validate())
+
+	o = profitSharingReceiverOps{Type: "PERSONAL_OPENID", Account: "oxTWIuGaIt6gTKsQRLau2M0yL16E", RelationType: "CUSTOM"}
+	assert.NotNil(t, o.validate())
+	o.CustomRelation = "代理商"
+	assert.Nil(t, o.validate())
+}
+
+func TestBuildWechatProfitSharingReceiver(t *testing.T) {
+	key, cert := genTestPlatformCert(t)
+	pa := &models.PaymentAccount{AppID: "wx8888888888888888"}
+	store := &models.Store{WechatPaymentMerID: "1900000109"}
+	o := &profitSharingReceiverOps{Type: "MERCHANT_ID", Account: "86693852", Name: "腾讯科技有限公司", RelationType: "STORE"}
+
+	m, err := buildWechatProfitSharingReceiver(o, pa, store, cert)
+	assert.Nil(t, err)
+	assert.Equal(t, "1900000109", m["sub_mchid"])
+	assert.Equal(t, "wx8888888888888888", m["appid"])
+	assert.NotContains(t, m, "custom_relation")
+
+	ciphertext, err := base64.StdEncoding.DecodeString(m["name"].(string))
+	assert.Nil(t, err)
+	name, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, ciphertext, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, o.Name, string(name))
+}
+
+func TestCheckProfitSharingReturnAmount(t *testing.T) {
+	details := []models.ProfitSharingDetail{
+		{Type: "MERCHANT_ID", Account: "86693852", Money: 1, Result: models.PROFIT_SHARING_RESULT_SUCCESS},
+		{Type: "MERCHANT_ID", Account: "86693853", Money: 1, Result: models.PROFIT_SHARING_RESULT_PENDING},
+	}
+	returns := []models.ProfitSharingReturn{
+		{OutOrderNo: "P1", ReturnMchID: "86693852", Money: 0.3, Result: models.PROFIT_SHARING_RETURN_SUCCESS},
+		{OutOrderNo: "P1", ReturnMchID: "86693852", Money: 0.5, Result: models.PROFIT_SHARING_RETURN_FAILED},
+	}
+	o := &profitSharingReturnOps{OutOrderNo: "P1", ReturnMchID: "86693852", Amount: 70}
+	assert.Nil(t, checkProfitSharingReturnAmount(details, returns, o))
+
+	o.Amount = 71
+	assert.Contains(t, checkProfitSharingReturnAmount(details, returns, o).Error(), "exceeded")
+
+	o = &profitSharingReturnOps{OutOrderNo: "P1", ReturnMchID: "86693853", Amount: 1}
+	assert.NotNil(t, checkProfitSharingReturnAmount(details, returns, o))
+}
+
+func TestWechatProfitSharingReceivers(t *testing.T) {
+	doc := gjson.Parse(`{
+		"order_id": "3008450740201411110007820472",
+		"state": "FINISHED",
+		"receivers": [
+			{"type": "MERCHANT_ID", "account": "86693852", "amount": 888, "result": "SUCCESS", "detail_id": "36011111111111111111111", "finish_time": "2015-05-20T13:29:35.120+08:00"},
+			{"type": "MERCHANT_ID", "account": "1900000109", "amount": 112, "result": "PENDING", "detail_id": "36011111111111111111112"}
+		]
+	}`)
+	rs := wechatProfitSharingReceivers(doc)
+	assert.Len(t, rs, 2)
+	assert.Equal(t, 8.88, rs[0].Money)
+	assert.Equal(t, "SUCCESS", rs[0].Result)
+	assert.Equal(t, "36011111111111111111112", rs[1].DetailID)
+}
+
+// 只有微信明确拒绝的请求才关闭分账单，超时和频率限制保持processing
+func TestWechatRejectedReason(t *testing.T) {
+	reason, ok := wechatRejectedReason(&wxerrors.Error{StatusCode: http.StatusForbidden, Code: "NOT_ENOUGH", Message: "分账金额不足"})
+	assert.True(t, ok)
+	assert.Equal(t, "NOT_ENOUGH: 分账金额不足", reason)
+
+	_, ok = wechatRejectedReason(&wxerrors.Error{StatusCode: http.StatusTooManyRequests, Code: "FREQUENCY_LIMITED"})
+	assert.False(t, ok)
+	_, ok = wechatRejectedReason(&wxerrors.Error{StatusCode: http.StatusInternalServerError, Code: "SYSTEM_ERROR"})
+	assert.False(t, ok)
+	_, ok = wechatRejectedReason(errors.New("context deadline exceeded"))
+	assert.False(t, ok)
+
+	assert.True(t, isWechatResourceNotExist(&wxerrors.Error{StatusCode: http.StatusNotFound, Code: "RESOURCE_NOT_EXISTS"}))
+}
+
+func TestRetryWechatProfitSharingOrder(t *testing.T) {
+	resend := func() (*profitSharingState, error) {
+		t.Fatal("should not resend")
+		return nil, nil
+	}
+	order := &models.ProfitSharingOrder{TransNo: "t1", OutOrderNo: "o1", Status: models.PROFIT_SHARING_STATUS_CLOSED}
+	_, err := retryWechatProfitSharingOrder(order, "t2", false, resend)
+	assert.EqualError(t, err, "out_order_no already used: o1")
+	_, err = retryWechatProfitSharingOrder(order, "t1", true, resend)
+	assert.EqualError(t, err, "out_order_no already used: o1")
+	_, err = retryWechatProfitSharingOrder(order, "t1", false, resend)
+	assert.Contains(t, err.Error(), "use a new out_order_no")
+}
+
+func TestProfitSharingStateDeliveries(t *testing.T) {
+	rec := &models.PaymentRecord{TransNo: "abcssscascscds", AddiNotifyURL: "https://xx.com/notify"}
+	o := &models.ProfitSharingOrder{TransNo: rec.TransNo, OutOrderNo: "P20150806125346", Status: models.PROFIT_SHARING_STATUS_FINISHED}
+	details := []models.ProfitSharingDetail{{Type: "MERCHANT_ID", Account: "86693852", Result: models.PROFIT_SHARING_RESULT_SUCCESS}}
+
+	ds := profitSharingStateDeliveries(rec)(o, details)
+	assert.Len(t, ds, 2)
+	assert.Equal(t, "profit_sharing.state", ds[0].Event)
+	assert.Equal(t, rec.TransNo, ds[0].TransNo)
+	assert.Equal(t, rec.AddiNotifyURL, ds[1].URL)
+	assert.Equal(t, models.PROFIT_SHARING_STATUS_FINISHED, gjson.Get(ds[0].Payload, "status").String())
+	assert.Equal(t, "86693852", gjson.Get(ds[0].Payload, "details.0.account").String())
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerPaymentProvider(models.ACCOUNT_TYPE_WECHAT, &wechatProvider{})
+}
+
+type wechatProvider struct{}
+
+func (p *wechatProvider) Routes(r *gin.Engine) {
+	apiWechat(r)
+}
+
+func (p *wechatProvider) PublicPaths() []string {
+	return []string{
+		"/wechat/payment_notify",
+		"/wechat/refund_notify",
+		"/wechat/combine_payment_notify",
+		"/wechat/profit_sharing_notify",
+	}
+}
+
+// CreatePayment mp/app返回调起支付的参数，native返回code_url
+func (p *wechatProvider) CreatePayment(o *paymentOps) (common.M, error) {
+	d, err := createWechatPaymentOrder(o)
+	if err != nil {
+		return nil, err
+	}
+	doc := gjson.ParseBytes(d)
+
+	if o.From == "native" {
+		codeURL := doc.Get("code_url").String()
+		if len(codeURL) == 0 {
+			return nil, errors.New("code_url is empty, rsp: " + string(d))
+		}
+		return common.M{"code_url": codeURL}, nil
+	}
+	if o.From == "h5" {
+		h5URL := doc.Get("h5_url").String()
+		if len(h5URL) == 0 {
+			return nil, errors.New("h5_url is empty, rsp: " + string(d))
+		}
+		return common.M{"h5_url": wechatH5URL(h5URL, o.ReturnURL)}, nil
+	}
+
+	prepayID := doc.Get("prepay_id").String()
+	if len(prepayID) == 0 {
+		return nil, errors.New("prepay_id is empty")
+	}
+	payParams, err := buildWechatPaymentParams(o, prepayID)
+	if err != nil {
+		return nil, errors.New("build pay params error:" + err.Error())
+	}
+	return payParams, nil
+}
+
+func (p *wechatProvider) QueryPayment(rec *models.PaymentRecord, pa *models.PaymentAccount) *paymentState {
+	if rec.IsCombineSubOrder() {
+		return queryWechatCombineSubOrder(rec, pa)
+	}
+	store, err := wechatStoreFor(rec, pa)
+	if err != nil {
+		return &paymentState{TransNo: rec.TransNo, PaymentMethod: "wechat", Err: err.Error()}
+	}
+	return getWechatPaymentStateByTransNo(store, pa, rec.TransNo)
+}
+
+// ClosePayment 合单支付的子单会关闭整个合单
+func (p *wechatProvider) ClosePayment(rec *models.PaymentRecord, pa *models.PaymentAccount) error {
+	if rec.IsCombineSubOrder() {
+		return closeWechatCombinePayment(rec.CombineTransNo, pa)
+	}
+	store, err := wechatStoreFor(rec, pa)
+	if err != nil {
+		return err
+	}
+	return closeWechatPayment(store, pa, rec.TransNo)
+}
+
+func (p *wechatProvider) Refund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error) {
+	body, err := createWechatRefund(pa, rr, rec.TotalFen())
+	if err != nil {
+		return nil, err
+	}
+	doc := gjson.ParseBytes(body)
+	return &refundResult{
+		RefundPayNo: doc.Get("refund_id").String(),
+		Status:      doc.Get("status").String(),
+		Raw:         string(body),
+	}, nil
+}
+
+// QueryRefund 申请退款超时或者5xx时微信不一定受理了，受理了才会有退款通知，由支付清理任务查询确认
+// 微信返回404表示没有受理这笔退款，改为abnormal释放占用的退款金额
+func (p *wechatProvider) QueryRefund(rec *models.PaymentRecord, rr *models.RefundRecord, pa *models.PaymentAccount) (*refundResult, error) {
+	body, err := queryWechatRefund(pa, rr)
+	if isWechatResourceNotExist(err) {
+		raw, _ := json.Marshal(common.M{"out_refund_no": rr.RefundNo, "status": "ABNORMAL", "message": err.Error()})
+		return &refundResult{Status: "ABNORMAL", Raw: string(raw)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := gjson.ParseBytes(body)
+	return &refundResult{
+		RefundPayNo: doc.Get("refund_id").String(),
+		Status:      doc.Get("status").String(),
+		Raw:         string(body),
+	}, nil
+}
+
+func (p *wechatProvider) ParseNotify(ctx *gin.Context, rec *models.PaymentRecord, pa *models.PaymentAccount) (*paymentState, error) {
+	if err := verifyWechatNotify(ctx, pa); err != nil {
+		return nil, newNotifyError(wechatNotifyVerifyCode(err), err)
+	}
+
+	var o wechatNotifyBody
+	if err := ctx.ShouldBindJSON(&o); err != nil {
+		return nil, newNotifyError(http.StatusBadRequest, err)
+	}
+	doc, err := o.decrypt(pa)
+	if err != nil {
+		return nil, newNotifyError(http.StatusBadRequest, errors.New("decode wechat payment notify data error:"+err.Error()))
+	}
+
+	var store *models.Store
+	if pa.IsWechatServiceProviderAccount() {
+		store, _ = models.FindStoreWithOnlyMerID(rec.StoreID)
+	}
+	if err := checkWechatPaymentNotify(rec, pa, store, doc); err != nil {
+		wclg().WithField("alert", true).Errorf("trans_no: %s, %s, data: %s", rec.TransNo, err, doc.Raw)
+		return nil, newNotifyError(http.StatusBadRequest, err)
+	}
+
+	state := doc.Get("trade_state").String()
+	status, ok := models.WechatTradeStateToStatus(state)
+	if !ok {
+		return nil, fmt.Errorf("unsupported wechat trade_state: %s", state)
+	}
+	return &paymentState{
+		State:         state,
+		StateDesc:     doc.Get("trade_state_desc").String(),
+		IsSuccess:     state == "SUCCESS",
+		TransNo:       rec.TransNo,
+		PaymentMethod: "wechat",
+		PayNo:         doc.Get("transaction_id").String(),
+		Raw:           doc.Value(),
+		status:        status,
+		rawRsp:        doc.Raw,
+	}, nil
+}
+
+// NotifyResponse 成功返回200，失败返回4xx/5xx，微信会按策略重新通知
+func (p *wechatProvider) NotifyResponse(ctx *gin.Context, err error) {
+	if err != nil {
+		wechatNotifyFail(ctx, notifyErrorCode(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, common.M{
+		"code":    "SUCCESS",
+		"message": "成功",
+	})
+}
+
+// wechatStoreFor 服务商模式需要店铺的子商户号
+func wechatStoreFor(rec *models.PaymentRecord, pa *models.PaymentAccount) (*models.Store, error) {
+	if !pa.IsWechatServiceProviderAccount() {
+		return nil, nil
+	}
+	return models.FindWechatSubMerchantStore(rec.StoreID, pa)
+}
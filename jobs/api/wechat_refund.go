@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"bitbucket.org/343_3rd/gmodels/common"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// 退款文档: https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_9.shtml
+// 服务商退款文档: https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter4_5_9.shtml
+//
+// 普通商户和服务商使用同一个退款接口，服务商需要额外传递sub_mchid
+// 一笔订单可以多次部分退款，但所有退款金额之和不能超过订单金额
+//
+
+func apiWechatRefund(r *gin.Engine) {
+	// 申请退款，支持全额退款和部分退款
+	//
+	// body:
+	// {
+	// 	"trans_no": "abcssscascscds",
+	// 	"refund_no": "r_abcssscascscds_1",
+	// 	"refund_price": 10, 可选，不传或为0表示全额退款
+	// 	"reason": "商品已售完",
+	// 	"addi_notify_url": "https://xx.com/notify" 可选
+	// }
+	r.POST("/wechat/refund", requireScope(models.API_SCOPE_REFUND), func(ctx *gin.Context) {
+		var o refundOps
+		err := ctx.ShouldBindJSON(&o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		data, err := createClientRefund(ctx, &o)
+		if err != nil {
+			ctx.JSON(http.StatusOK, common.M{"status": "error", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, common.M{"status": "ok", "data": data})
+	})
+
+	// 退款结果通知
+	// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_11.shtml
+	r.POST("/wechat/refund_notify/:refundNo", notifyMetrics(models.ACCOUNT_TYPE_WECHAT, "refund"), func(ctx *gin.Context) {
+		succRsp := common.M{
+			"code":    "SUCCESS",
+			"message": "成功",
+		}
+		refundNo := ctx.Param("refundNo")
+		rr, err := models.FindRefundRecordByRefundNo(refundNo)
+		if err != nil {
+			wechatNotifyFail(ctx, http.StatusNotFound, err.Error())
+			return
+		}
+		if rr.IsFinished() {
+			setNotifyResult(ctx, NOTIFY_RESULT_DUPLICATE)
+			ctx.JSON(http.StatusOK, succRsp)
+			return
+		}
+
+		pa, err := models.FindPaLoadPrivateCert(rr.PaymentAccountID, true)
+		if err != nil {
+			wechatNotifyFail(ctx, http.StatusInternalServerError, "load pa error:"+err.Error())
+			return
+		}
+		if !verifyWechatNotifyOrFail(ctx, pa) {
+			return
+		}
+
+		var o wechatNotifyBody
+		err = ctx.ShouldBindJSON(&o)
+		if err != nil {
+			wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		doc, err := o.decrypt(pa)
+		if err != nil {
+			wechatNotifyFail(ctx, http.StatusBadRequest, "decode wechat refund notify data error:"+err.Error())
+			return
+		}
+		var store *models.Store
+		if pa.IsWechatServiceProviderAccount() {
+			store, _ = models.FindStoreWithOnlyMerID(rr.StoreID)
+		}
+		if err := checkWechatRefundNotify(rr, pa, store, doc); err != nil {
+			wclg().WithField("alert", true).Errorf("refund_no: %s, %s, data: %s", rr.RefundNo, err, doc.Raw)
+			wechatNotifyFail(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		state := doc.Get("refund_status").String()
+		data := paymentState{
+			State:         state,
+			StateDesc:     o.Summary,
+			IsSuccess:     state == "SUCCESS",
+			TransNo:       rr.TransNo,
+			RefundNo:      refundNo,
+			PaymentMethod: "wechat",
+			PayNo:         doc.Get("refund_id").String(),
+			Raw:           doc.Value(),
+		}
+		ds := paymentStateDeliveries(&data, rr.AddiNotifyURL)
+		changed, err := rr.UpdateRefundResult(doc.Get("refund_id").String(), state, doc.Raw, ds...)
+		if err != nil {
+			wechatNotifyFail(ctx, http.StatusInternalServerError, "update refund record error:"+err.Error())
+			return
+		}
+		// 重复的通知或者已经被退款查询确认时状态没有变化，不再通知web端
+		if !changed {
+			setNotifyResult(ctx, NOTIFY_RESULT_DUPLICATE)
+			ctx.JSON(http.StatusOK, succRsp)
+			return
+		}
+		if rec, err := models.FindPaymentRecordByID(rr.PaymentRecordID); err == nil {
+			syncRefundStatus(rec)
+		}
+		paymentStateNotified(&data)
+
+		ctx.JSON(http.StatusOK, succRsp)
+	})
+}
+
+// createWechatRefund 调用微信申请退款接口，total为原订单金额，单位为分
+func createWechatRefund(pa *models.PaymentAccount, rr *models.RefundRecord, total int64) ([]byte, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return nil, err
+	}
+
+	mapInfo := map[string]interface{}{
+		"out_trade_no":  rr.TransNo,
+		"out_refund_no": rr.RefundNo,
+		"notify_url":    config.SelfAPIURL + "/wechat/refund_notify/" + rr.RefundNo,
+		"amount": map[string]interface{}{
+			"refund":   models.YuanToFen(rr.RefundMoney),
+			"total":    total,
+			"currency": "CNY",
+		},
+	}
+	if len(rr.Reason) > 0 {
+		mapInfo["reason"] = rr.Reason
+	}
+	if pa.IsWechatServiceProviderAccount() {
+		store, err := models.FindWechatSubMerchantStore(rr.StoreID, pa)
+		if err != nil {
+			return nil, err
+		}
+		mapInfo["sub_mchid"] = store.WechatPaymentMerID
+	}
+
+	response, err := client.Post(context.TODO(), wechatAPIURL("/v3/refund/domestic/refunds"), mapInfo)
+	if err != nil {
+		wclg().Warnf("client post refund err: %s", err)
+		return nil, err
+	}
+	body, err := validateWechatClientRsp(response)
+	if err != nil {
+		return nil, err
+	}
+	wclg().Printf("wechat, refund rsp: %s", body)
+	return body, nil
+}
+
+// queryWechatRefund 按退款号查询退款，服务商需要传sub_mchid
+// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_10.shtml
+func queryWechatRefund(pa *models.PaymentAccount, rr *models.RefundRecord) ([]byte, error) {
+	client, err := setUpWechatClient(pa, true)
+	if err != nil {
+		return nil, err
+	}
+	url := wechatAPIURL("/v3/refund/domestic/refunds/" + rr.RefundNo)
+	if pa.IsWechatServiceProviderAccount() {
+		store, err := models.FindWechatSubMerchantStore(rr.StoreID, pa)
+		if err != nil {
+			return nil, err
+		}
+		url += "?sub_mchid=" + store.WechatPaymentMerID
+	}
+	response, err := client.Get(context.TODO(), url)
+	if err != nil {
+		wclg().Warnf("query refund_no: %s err: %s", rr.RefundNo, err)
+		return nil, err
+	}
+	body, err := validateWechatClientRsp(response)
+	if err != nil {
+		return nil, err
+	}
+	wclg().Printf("wechat, refund query rsp: %s", body)
+	return body, nil
+}
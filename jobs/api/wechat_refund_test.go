@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/models"
+
+	"github.com/spf13/cast"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func postTestJSON(router http.Handler, path string, data interface{}) *httptest.ResponseRecorder {
+	d, _ := json.Marshal(data)
+	req, _ := http.NewRequest("POST", path, strings.NewReader(string(d)))
+	req.Header.Set(authHeaderKey, config.APISecret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestApiWechatRefundValidation(t *testing.T) {
+	router := RunAPI()
+
+	req, _ := http.NewRequest("POST", "/wechat/refund", strings.NewReader("{"))
+	req.Header.Set(authHeaderKey, config.APISecret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "error", gjson.Get(w.Body.String(), "status").String())
+
+	for _, data := range []map[string]interface{}{
+		{"refund_no": "r_1"},
+		{"trans_no": "t_1"},
+	} {
+		w = postTestJSON(router, "/wechat/refund", data)
+		assert.Equal(t, "error", gjson.Get(w.Body.String(), "status").String())
+		assert.Equal(t, "trans_no and refund_no are required", gjson.Get(w.Body.String(), "error").String())
+	}
+
+	// 没有验证
+	req, _ = http.NewRequest("POST", "/wechat/refund", strings.NewReader(`{"trans_no": "t_1", "refund_no": "r_1"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+// TestApiWechatRefundNotify 支付、退款、退款通知，需要本地的mysql，微信接口使用模拟器
+func TestApiWechatRefundNotify(t *testing.T) {
+	defer setupTestDB(t)()
+	pa, store, sim, stop := createTestWechatAccountAndStore(t)
+	defer stop()
+
+	router := RunAPI()
+	// 模拟器的通知发送到router
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	selfURL := config.SelfAPIURL
+	config.SelfAPIURL = srv.URL
+	defer func() { config.SelfAPIURL = selfURL }()
+
+	transNo := "refund_t1"
+	w := postTestJSON(router, "/wechat/native_pay", map[string]interface{}{
+		"store_id":           cast.ToString(store.ID),
+		"payment_account_id": cast.ToString(pa.ID),
+		"trans_no":           transNo,
+		"app_id":             "wx12345678972ca148",
+		"total_price":        1000,
+		"desp":               "test",
+	})
+	assert.Equal(t, "ok", gjson.Get(w.Body.String(), "status").String(), w.Body.String())
+	assert.Nil(t, sim.Pay(transNo, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"))
+	rec, err := models.FindPaymentRecordByTransNo(transNo)
+	assert.Nil(t, err)
+	assert.Equal(t, models.PAYMENT_STATUS_SUCCESS, rec.Status)
+
+	// 查询时使用支付记录的账号，请求中的账号不一致时拒绝
+	w = postTestJSON(router, "/wechat/payment_check", map[string]interface{}{"trans_no": transNo})
+	assert.Equal(t, "ok", gjson.Get(w.Body.String(), "status").String(), w.Body.String())
+	w = postTestJSON(router, "/wechat/payment_check", map[string]interface{}{"trans_no": transNo, "payment_account_id": cast.ToString(pa.ID + 1)})
+	assert.Contains(t, gjson.Get(w.Body.String(), "error").String(), "does not match the payment record")
+
+	// addi_notify_url没有配置webhook target，通知无法签名
+	w = postTestJSON(router, "/wechat/refund", map[string]interface{}{"trans_no": transNo, "refund_no": "r_refund_t1_addi", "refund_price": 1,
+		"addi_notify_url": "https://unknown.example.com/notify"})
+	assert.Contains(t, gjson.Get(w.Body.String(), "error").String(), "does not match any webhook target")
+
+	// 超过订单金额
+	w = postTestJSON(router, "/wechat/refund", map[string]interface{}{"trans_no": transNo, "refund_no": "r_refund_t1_0", "refund_price": 1001})
+	assert.Equal(t, "error", gjson.Get(w.Body.String(), "status").String())
+	assert.Contains(t, gjson.Get(w.Body.String(), "error").String(), "invalid refund_price")
+
+	w = postTestJSON(router, "/wechat/refund", map[string]interface{}{"trans_no": transNo, "refund_no": "r_refund_t1", "refund_price": 400})
+	assert.Equal(t, "ok", gjson.Get(w.Body.String(), "status").String(), w.Body.String())
+	rr, err := models.FindRefundRecordByRefundNo("r_refund_t1")
+	assert.Nil(t, err)
+	assert.Equal(t, models.REFUND_STATUS_PROCESSING, rr.Status)
+	rec, _ = models.FindPaymentRecordByTransNo(transNo)
+	assert.Equal(t, models.PAYMENT_STATUS_REFUNDING, rec.Status)
+
+	// 相同的退款号
+	w = postTestJSON(router, "/wechat/refund", map[string]interface{}{"trans_no": transNo, "refund_no": "r_refund_t1"})
+	assert.Contains(t, gjson.Get(w.Body.String(), "error").String(), "refund_no already exists")
+
+	// 微信还在处理，推迟后本轮不再查询
+	now := time.Now()
+	assert.False(t, sweepProcessingRefund(&wechatProvider{}, rr))
+	delayRefundSweep(rr)
+	assert.Equal(t, 1, rr.SweepAttempts)
+	assert.Empty(t, models.FindProcessingRefundRecords(models.ACCOUNT_TYPE_WECHAT, now.Add(time.Hour), now, 10))
+	assert.Len(t, models.FindProcessingRefundRecords(models.ACCOUNT_TYPE_WECHAT, now.Add(time.Hour), now.Add(2*time.Minute), 10), 1)
+
+	assert.Nil(t, sim.CompleteRefund("r_refund_t1"))
+	rr, _ = models.FindRefundRecordByRefundNo("r_refund_t1")
+	assert.Equal(t, models.REFUND_STATUS_SUCCESS, rr.Status)
+	assert.NotEmpty(t, rr.RefundPayNo)
+	rec, _ = models.FindPaymentRecordByTransNo(transNo)
+	assert.Equal(t, models.PAYMENT_STATUS_PARTIALLY_REFUNDED, rec.Status)
+
+	// 重复的通知直接返回成功
+	req, _ := http.NewRequest("POST", "/wechat/refund_notify/r_refund_t1", strings.NewReader("{}"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "SUCCESS", gjson.Get(w.Body.String(), "code").String())
+
+	// 申请退款超时，微信没有受理，支付清理任务查询到404后改为abnormal，释放退款金额
+	lost := models.RefundRecord{PaymentRecordID: rec.ID, PaymentAccountID: pa.ID, StoreID: store.ID, TransNo: transNo,
+		RefundNo: "r_refund_t1_lost", RefundMoney: 1, Status: models.REFUND_STATUS_PROCESSING}
+	assert.Nil(t, models.CreateRefundRecord(&lost, rec.TotalFen()))
+	assert.True(t, errors.Is(models.CreateRefundRecord(&models.RefundRecord{PaymentRecordID: rec.ID, RefundNo: lost.RefundNo}, rec.TotalFen()), models.ErrRefundNoConflict))
+	syncRefundStatus(rec)
+	sweepProcessingRefund(&wechatProvider{}, &lost)
+	rr, _ = models.FindRefundRecordByRefundNo(lost.RefundNo)
+	assert.Equal(t, models.REFUND_STATUS_ABNORMAL, rr.Status)
+	rec, _ = models.FindPaymentRecordByTransNo(transNo)
+	assert.Equal(t, models.PAYMENT_STATUS_PARTIALLY_REFUNDED, rec.Status)
+	assert.Equal(t, int64(400), models.RefundedFen(rec.ID))
+
+	req, _ = http.NewRequest("POST", "/wechat/refund_notify/not_exists", strings.NewReader("{}"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/logger"
+	"go-gin-payment/ext/wechatsim"
+	"go-gin-payment/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// startWechatSimulator 微信接口指向模拟器，返回的函数用于恢复配置
+func startWechatSimulator(t *testing.T, pa *models.PaymentAccount) (*wechatsim.Server, func()) {
+	if logger.L == nil {
+		logger.L = logrus.New()
+	}
+	assert.Nil(t, pa.LoadPrivCert())
+	s, err := wechatsim.New("", wechatsim.Merchant{
+		MchID:     pa.MerID,
+		APIV3Key:  pa.APIV3Secret,
+		PublicKey: &pa.LoadedCertPrivate.PublicKey,
+	})
+	assert.Nil(t, err)
+	baseURL := config.WechatPayBaseURL
+	config.WechatPayBaseURL = s.URL
+	return s, func() {
+		config.WechatPayBaseURL = baseURL
+		wechatCerts.Invalidate(pa.ID)
+		s.Close()
+	}
+}
+
+func TestWechatSimulatorPayment(t *testing.T) {
+	pa := newTestWechatAccount(t)
+	pa.ID = 9001
+	pa.APIV3Secret = "0123456789abcdef0123456789abcdef"
+	sim, stop := startWechatSimulator(t, pa)
+	defer stop()
+
+	// 验签并解密通知，和/wechat/payment_notify一样
+	notified := make(chan gjson.Result, 1)
+	r := gin.New()
+	r.POST("/wechat/payment_notify/:transNo", func(ctx *gin.Context) {
+		if !verifyWechatNotifyOrFail(ctx, pa) {
+			return
+		}
+		var o wechatNotifyBody
+		assert.Nil(t, ctx.ShouldBindJSON(&o))
+		doc, err := o.decrypt(pa)
+		assert.Nil(t, err)
+		notified <- doc
+		ctx.JSON(http.StatusOK, gin.H{"code": "SUCCESS"})
+	})
+	notifySrv := httptest.NewServer(r)
+	defer notifySrv.Close()
+	selfURL := config.SelfAPIURL
+	config.SelfAPIURL = notifySrv.URL
+	defer func() { config.SelfAPIURL = selfURL }()
+
+	o := &paymentOps{TransNo: "sim_t1", Desp: "test", TotalPrice: 100, From: "native", AppID: "wxd678efh567hg6787", paymentAccount: pa}
+	body, err := createWechatPaymentOrder(o)
+	assert.Nil(t, err)
+	assert.Contains(t, gjson.GetBytes(body, "code_url").String(), "weixin://")
+
+	st := getWechatPaymentStateByTransNo(nil, pa, "sim_t1")
+	assert.Empty(t, st.Err)
+	assert.Equal(t, models.PAYMENT_STATUS_PENDING, st.status)
+
+	assert.Nil(t, sim.Pay("sim_t1", "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"))
+	doc := <-notified
+	rec := &models.PaymentRecord{TransNo: "sim_t1", TotalMoney: 1, AppID: o.AppID}
+	assert.Nil(t, checkWechatPaymentNotify(rec, pa, nil, doc))
+
+	st = getWechatPaymentStateByTransNo(nil, pa, "sim_t1")
+	assert.True(t, st.IsSuccess)
+	assert.Equal(t, models.PAYMENT_STATUS_SUCCESS, st.status)
+
+	body, err = createWechatRefund(pa, &models.RefundRecord{TransNo: "sim_t1", RefundNo: "sim_r1", RefundMoney: 0.5}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "PROCESSING", gjson.GetBytes(body, "status").String())
+	res, err := (&wechatProvider{}).QueryRefund(rec, &models.RefundRecord{RefundNo: "sim_r1"}, pa)
+	assert.Nil(t, err)
+	assert.Equal(t, "PROCESSING", res.Status)
+	assert.NotEmpty(t, res.RefundPayNo)
+	// 微信没有受理的退款
+	res, err = (&wechatProvider{}).QueryRefund(rec, &models.RefundRecord{RefundNo: "sim_r_lost"}, pa)
+	assert.Nil(t, err)
+	assert.Equal(t, "ABNORMAL", res.Status)
+	// 已支付的订单不能关闭
+	assert.NotNil(t, closeWechatPayment(nil, pa, "sim_t1"))
+
+	o = &paymentOps{TransNo: "sim_t2", Desp: "test", TotalPrice: 100, From: "mp", OpenID: "o1", AppID: "wxd678efh567hg6787", paymentAccount: pa}
+	body, err = createWechatPaymentOrder(o)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, gjson.GetBytes(body, "prepay_id").String())
+	assert.Nil(t, closeWechatPayment(nil, pa, "sim_t2"))
+	st = getWechatPaymentStateByTransNo(nil, pa, "sim_t2")
+	assert.Equal(t, models.PAYMENT_STATUS_CLOSED, st.status)
+}
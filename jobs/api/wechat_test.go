@@ -0,0 +1,23 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWechatH5SceneInfo(t *testing.T) {
+	_, err := wechatH5SceneInfo("")
+	assert.NotNil(t, err)
+
+	info, err := wechatH5SceneInfo("14.23.150.211")
+	assert.Nil(t, err)
+	assert.Equal(t, "14.23.150.211", info["payer_client_ip"])
+	assert.Equal(t, "Wap", info["h5_info"].(map[string]interface{})["type"])
+}
+
+func TestWechatH5URL(t *testing.T) {
+	h5URL := "https://wx.tenpay.com/cgi-bin/mmpayweb-bin/checkmweb?prepay_id=wx2016121516420242444321ca0631331346&package=1405458241"
+	assert.Equal(t, h5URL, wechatH5URL(h5URL, ""))
+	assert.Equal(t, h5URL+"&redirect_url=https%3A%2F%2Feggman.tv%2Fpaid%3Fid%3D1", wechatH5URL(h5URL, "https://eggman.tv/paid?id=1"))
+}
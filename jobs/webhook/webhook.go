@@ -0,0 +1,339 @@
+package webhook
+
+import (
+	"fmt"
+	neturl "net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext"
+	"go-gin-payment/ext/logger"
+	"go-gin-payment/ext/metrics"
+	"go-gin-payment/ext/webhooksig"
+	"go-gin-payment/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+//
+// 发送给web端和addi_notify_url的通知
+//
+// 通知先保存到webhook_deliveries，再由worker发送，失败后按models.WebhookRetryWait重试，
+// 超过models.WebhookMaxAttempts次后改为dead并报警。每次发送的结果保存在webhook_attempts
+//
+// !!! 对方必须返回2xx并且内容为`ok`才表示处理成功
+//
+// 请求使用HMAC-SHA256签名，见ext/webhooksig，web端使用config.WebWebhookSecret，
+// addi_notify_url使用webhook_targets中匹配的secret
+//
+
+const (
+	WebNotifyURI = "/api/payment/notify_state"
+
+	pollInterval = 5 * time.Second
+	pollBatch    = 100
+	// claimLease 领取后这段时间内其他worker不会再发送，要大于一次请求的超时时间
+	claimLease      = 2 * time.Minute
+	maxResponseSize = 2000
+)
+
+func l() *logrus.Entry {
+	return logger.LF("webhook")
+}
+
+var wakeup = make(chan struct{}, 1)
+
+var (
+	deliveryAttempts = metrics.NewCounterVec("ggp_webhook_delivery_attempts_total",
+		"Webhook delivery attempts by target, result is success or failed.", "target", "event", "result")
+	deliveryDuration = metrics.NewHistogramVec("ggp_webhook_delivery_duration_seconds",
+		"Latency of webhook delivery attempts.", nil, "target")
+	deliveriesDead = metrics.NewCounterVec("ggp_webhook_deliveries_dead_total",
+		"Webhook deliveries given up after max attempts.", "target", "event")
+)
+
+func init() {
+	// 抓取时查询数据库，没有连接数据库(比如只启动了api的测试)时不输出
+	metrics.NewGaugeFunc("ggp_webhook_queue_depth", "Webhook deliveries pending to be sent or retried.", func() (float64, bool) {
+		if !conn.Connected() {
+			return 0, false
+		}
+		n, err := models.CountPendingWebhookDeliveries()
+		return float64(n), err == nil
+	})
+}
+
+// NewDeliveries 需要发送给web端的通知，addiNotifyURL不为空时也发送一份，两份使用相同的event_id
+// 由调用方和状态的修改在同一个事务中保存，提交后调用Wake
+func NewDeliveries(transNo, event string, payload []byte, addiNotifyURL string) []*models.WebhookDelivery {
+	d := models.WebhookDelivery{
+		TransNo: transNo,
+		EventID: models.NewWebhookEventID(),
+		Event:   event,
+		Target:  models.WEBHOOK_TARGET_WEB,
+		URL:     WebNotifyURI,
+		Payload: string(payload),
+	}
+	ds := []*models.WebhookDelivery{&d}
+	if len(addiNotifyURL) > 0 {
+		addi := d
+		addi.Target = models.WEBHOOK_TARGET_ADDI
+		addi.URL = addiNotifyURL
+		ds = append(ds, &addi)
+	}
+	return ds
+}
+
+// ValidateNotifyURL 调用方传的addi_notify_url必须是完整的https地址，不能是相对路径(会发送到web端)
+func ValidateNotifyURL(u string) error {
+	p, err := neturl.Parse(u)
+	if err != nil || p.Scheme != "https" || len(p.Host) == 0 || p.User != nil {
+		return fmt.Errorf("invalid addi_notify_url: %q, should be an absolute https url", u)
+	}
+	return nil
+}
+
+// Enqueue 保存需要发送的通知，见NewDeliveries，保存失败时返回错误，调用方需要让对方重试
+func Enqueue(transNo, event string, payload []byte, addiNotifyURL string) error {
+	for _, d := range NewDeliveries(transNo, event, payload, addiNotifyURL) {
+		if err := models.CreateWebhookDelivery(d); err != nil {
+			l().WithField("alert", true).Errorf("save webhook delivery error, trans_no: %s, url: %s, err: %s, payload: %s",
+				d.TransNo, d.URL, err, d.Payload)
+			return err
+		}
+	}
+	Wake()
+	return nil
+}
+
+// Redeliver 重新发送d，target为web、addi或url(发送到指定的url)，会创建一条新的通知，event_id不变
+// d为dead时改为redelivered
+func Redeliver(d *models.WebhookDelivery, target, url string) (*models.WebhookDelivery, error) {
+	nd := models.WebhookDelivery{
+		TransNo:      d.TransNo,
+		EventID:      d.EventID,
+		Event:        d.Event,
+		Target:       target,
+		Payload:      d.Payload,
+		RedeliveryOf: d.ID,
+	}
+	switch target {
+	case models.WEBHOOK_TARGET_WEB:
+		nd.URL = WebNotifyURI
+	case models.WEBHOOK_TARGET_ADDI:
+		if d.Target == models.WEBHOOK_TARGET_ADDI {
+			nd.URL = d.URL
+		} else if o, ok := models.FindWebhookDeliveryByEventTarget(d.EventID, models.WEBHOOK_TARGET_ADDI); ok {
+			nd.URL = o.URL
+		} else {
+			return nil, fmt.Errorf("no addi_notify_url for delivery: %d", d.ID)
+		}
+	case models.WEBHOOK_TARGET_URL:
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("invalid url: %s", url)
+		}
+		// 发送时使用匹配的WebhookTarget签名
+		if _, err := models.FindWebhookTargetForURL(url); err != nil {
+			return nil, err
+		}
+		nd.URL = url
+	default:
+		return nil, fmt.Errorf("invalid target: %s", target)
+	}
+
+	if err := models.RedeliverWebhookDelivery(d, &nd); err != nil {
+		return nil, err
+	}
+	Wake()
+	return &nd, nil
+}
+
+// Wake 有新的通知时唤醒worker立即发送
+func Wake() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Start 启动n个worker，启动时会立即发送重启前没有完成的通知，返回的函数用于停止并等待正在发送的完成
+func Start(n int) func() {
+	stop := make(chan struct{})
+	jobs := make(chan models.WebhookDelivery)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				d := d
+				deliver(&d)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
+		for {
+			poll(jobs, stop)
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			case <-wakeup:
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func poll(jobs chan<- models.WebhookDelivery, stop <-chan struct{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			l().Errorf("webhook poll panic: %s\n%s", err, debug.Stack())
+		}
+	}()
+
+	for _, d := range models.FindDueWebhookDeliveries(time.Now(), pollBatch) {
+		if !d.Claim(claimLease) {
+			continue
+		}
+		select {
+		case jobs <- d:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func deliver(d *models.WebhookDelivery) {
+	defer func() {
+		if err := recover(); err != nil {
+			l().Errorf("webhook deliver panic: %s\n%s", err, debug.Stack())
+		}
+	}()
+
+	a := Send(d)
+	result := "failed"
+	if a.Success {
+		result = "success"
+	}
+	deliveryAttempts.Inc(d.Target, d.Event, result)
+	deliveryDuration.Observe(float64(a.LatencyMs)/1000, d.Target)
+	if err := d.RecordAttempt(a); err != nil {
+		l().Warnf("save webhook attempt error, id: %d, err: %s", d.ID, err)
+		return
+	}
+
+	switch d.Status {
+	case models.WEBHOOK_STATUS_SUCCESS:
+		l().Infof("webhook delivered, id: %d, trans_no: %s, url: %s, attempts: %d", d.ID, d.TransNo, d.URL, d.Attempts)
+	case models.WEBHOOK_STATUS_DEAD:
+		deliveriesDead.Inc(d.Target, d.Event)
+		l().WithField("alert", true).Errorf("webhook dead after %d attempts, id: %d, trans_no: %s, url: %s, err: %s",
+			d.Attempts, d.ID, d.TransNo, d.URL, d.LastError)
+	default:
+		l().Warnf("webhook failed, id: %d, trans_no: %s, url: %s, attempts: %d, next: %s, err: %s",
+			d.ID, d.TransNo, d.URL, d.Attempts, d.NextAttemptAt.Format(time.RFC3339), d.LastError)
+	}
+}
+
+// Send 签名后发送一次，返回的结果还没有保存
+func Send(d *models.WebhookDelivery) *models.WebhookAttempt {
+	url, err := deliveryURL(d)
+	if err != nil {
+		return &models.WebhookAttempt{Error: err.Error()}
+	}
+	payload := []byte(d.Payload)
+	now := time.Now()
+	secrets, err := secretsFor(d, now)
+	if err != nil {
+		// 数据库或者主密钥暂时不可用时不能降级为不签名，记为失败后重试
+		return &models.WebhookAttempt{Error: "load webhook secret error: " + err.Error()}
+	}
+	if len(secrets) == 0 {
+		return post(url, signHeaders(d, "", payload, now), payload)
+	}
+	return post(url, signHeaders(d, secrets[0], payload, now, secrets[1:]...), payload)
+}
+
+// deliveryURL 只有web端的通知使用相对路径，其他的必须是完整的地址，不能被拼接到web端
+func deliveryURL(d *models.WebhookDelivery) (string, error) {
+	if d.Target == models.WEBHOOK_TARGET_WEB {
+		return config.WebURL + d.URL, nil
+	}
+	if !strings.HasPrefix(d.URL, "http://") && !strings.HasPrefix(d.URL, "https://") {
+		return "", fmt.Errorf("invalid url: %s", d.URL)
+	}
+	return d.URL, nil
+}
+
+// secretsFor web端使用配置的secret(没有配置时不签名)，其他地址必须有匹配的WebhookTarget(轮换期间包括旧secret)，
+// 都不能使用X_API_SECRET
+func secretsFor(d *models.WebhookDelivery, now time.Time) ([]string, error) {
+	if d.Target == models.WEBHOOK_TARGET_WEB {
+		if len(config.WebWebhookSecret) == 0 {
+			return nil, nil
+		}
+		return []string{config.WebWebhookSecret}, nil
+	}
+	t, err := models.FindWebhookTargetForURL(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	ss := t.SigningSecrets(now)
+	if len(ss) == 0 {
+		return nil, fmt.Errorf("webhook target %d has no secret", t.ID)
+	}
+	return ss, nil
+}
+
+// signHeaders previous为轮换期间仍然有效的旧secret
+func signHeaders(d *models.WebhookDelivery, secret string, payload []byte, now time.Time, previous ...string) map[string]string {
+	h := map[string]string{
+		"Content-Type":           "application/json",
+		webhooksig.HeaderEventID: d.EventID,
+		webhooksig.HeaderEvent:   d.Event,
+	}
+	if len(secret) == 0 {
+		return h
+	}
+	h[webhooksig.HeaderSignature] = webhooksig.Sign(secret, now, payload, previous...)
+	return h
+}
+
+func post(url string, headers map[string]string, payload []byte) *models.WebhookAttempt {
+	start := time.Now()
+	code, body, err := ext.PostToWeb(url, payload, headers)
+	a := models.WebhookAttempt{
+		StatusCode: code,
+		LatencyMs:  time.Since(start).Milliseconds(),
+	}
+	if len(body) > maxResponseSize {
+		body = body[:maxResponseSize]
+	}
+	a.ResponseBody = string(body)
+
+	switch {
+	case err != nil:
+		a.Error = err.Error()
+	case code < 200 || code > 299:
+		a.Error = "unexpected status code"
+	case strings.TrimSpace(a.ResponseBody) != "ok":
+		a.Error = "response is not ok"
+	default:
+		a.Success = true
+	}
+	return &a
+}
@@ -0,0 +1,398 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/envelope"
+	"go-gin-payment/ext/reqsig"
+
+	"gorm.io/gorm"
+)
+
+// 调用方的权限，一个调用方可以有多个
+const (
+	API_SCOPE_PAYMENT = "payment" // 下单、关单和分账
+	API_SCOPE_REFUND  = "refund"  // 退款和分账回退
+	API_SCOPE_READ    = "read"    // 查询订单和订阅支付状态
+	API_SCOPE_ADMIN   = "admin"   // 管理接口(/admin)和分账接收方
+)
+
+var apiScopes = []string{API_SCOPE_PAYMENT, API_SCOPE_REFUND, API_SCOPE_READ, API_SCOPE_ADMIN}
+
+const (
+	// apiKeyPrefix key的格式: ggpk_<key_id>_<secret>，key_id用于查找，数据库中只保存secret的sha256
+	apiKeyPrefix = "ggpk_"
+	apiKeyIDLen  = 16
+
+	// apiKeyTouchInterval 更新last_used_at的最小间隔，避免每个请求都写数据库
+	apiKeyTouchInterval = time.Minute
+
+	// apiKeySigningSecretAAD 加密签名secret时使用的aad
+	apiKeySigningSecretAAD = "api_key_signing_secret"
+)
+
+var ErrInvalidAPIKey = errors.New("api key is invalid or expired")
+
+// APIClient 调用我们接口的调用方，绑定了店铺时只能操作这些店铺的支付记录
+// 只有AllStores为true时不限制店铺；没有设置AllStores，绑定的店铺又被删除时不能操作任何店铺，不会变成不限制
+type APIClient struct {
+	BaseModel
+	Name      string  `gorm:"column:name" json:"name"`
+	Scopes    string  `gorm:"column:scopes" json:"scopes"` // 逗号分隔，比如payment,read
+	Disabled  bool    `gorm:"column:disabled" json:"disabled"`
+	AllStores bool    `gorm:"column:all_stores" json:"all_stores"`
+	StoreIDs  []int64 `gorm:"-" json:"store_ids"`
+}
+
+// APIClientStore 调用方可以操作的店铺
+type APIClientStore struct {
+	BaseModel
+	APIClientID int64 `gorm:"column:api_client_id;uniqueIndex:idx_api_client_store" json:"api_client_id"`
+	StoreID     int64 `gorm:"column:store_id;uniqueIndex:idx_api_client_store" json:"store_id"`
+}
+
+// APIKey 调用方的key，轮换时旧key在ExpiresAt之前仍然可以使用
+//
+// 请求签名的secret由key派生(见ext/reqsig)，和KeyHash不同，用信封加密保存，
+// 这样只能读到api_keys表时不能伪造签名。签名secret为空的key(之前创建的)需要轮换后才能签名
+type APIKey struct {
+	BaseModel
+	APIClientID      int64      `gorm:"column:api_client_id;index" json:"api_client_id"`
+	KeyID            string     `gorm:"column:key_id;uniqueIndex;size:32" json:"key_id"`
+	KeyHash          string     `gorm:"column:key_hash" json:"-"`
+	SigningSecret    string     `gorm:"column:signing_secret;type:text" json:"-"`
+	EncryptedDataKey string     `gorm:"column:encrypted_data_key;type:text" json:"-"`
+	ExpiresAt        *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	LastUsedAt       *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+}
+
+// NormalizeAPIScopes 去重排序后用逗号连接，有未知的scope时返回错误
+func NormalizeAPIScopes(scopes []string) (string, error) {
+	seen := make(map[string]bool)
+	res := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 || seen[s] {
+			continue
+		}
+		if !isAPIScope(s) {
+			return "", fmt.Errorf("unknown api scope: %s, should be one of %s", s, strings.Join(apiScopes, ","))
+		}
+		seen[s] = true
+		res = append(res, s)
+	}
+	if len(res) == 0 {
+		return "", errors.New("api client requires at least one scope")
+	}
+	sort.Strings(res)
+	return strings.Join(res, ","), nil
+}
+
+func isAPIScope(s string) bool {
+	for _, v := range apiScopes {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *APIClient) HasScope(scope string) bool {
+	for _, s := range strings.Split(c.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStoreRestricted 没有设置AllStores的调用方只能操作绑定的店铺
+func (c *APIClient) IsStoreRestricted() bool {
+	return !c.AllStores
+}
+
+func (c *APIClient) CanAccessStore(storeID int64) bool {
+	if !c.IsStoreRestricted() {
+		return true
+	}
+	for _, id := range c.StoreIDs {
+		if id == storeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) IsActive(now time.Time) bool {
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// GenAPIKey 返回给调用方的key只在创建时出现一次
+func GenAPIKey() (key string, k *APIKey) {
+	keyID := randomHex(apiKeyIDLen / 2)
+	key = apiKeyPrefix + keyID + "_" + randomHex(32)
+	_, secret, _ := reqsig.FromAPIKey(key)
+	return key, &APIKey{KeyID: keyID, KeyHash: hashAPIKey(key), SigningSecret: secret}
+}
+
+// IsAPIKey 是否为GenAPIKey生成的格式
+func IsAPIKey(key string) bool {
+	_, ok := parseAPIKeyID(key)
+	return ok
+}
+
+func parseAPIKeyID(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	rest := key[len(apiKeyPrefix):]
+	if len(rest) <= apiKeyIDLen+1 || rest[apiKeyIDLen] != '_' {
+		return "", false
+	}
+	return rest[:apiKeyIDLen], true
+}
+
+// hashAPIKey key是随机生成的，不需要慢哈希
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// encrypted 返回加密了签名secret的副本用于保存
+func (k *APIKey) encrypted() (*APIKey, error) {
+	if len(config.PaymentMasterKey) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	dek, err := envelope.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	c := *k
+	if c.EncryptedDataKey, err = envelope.WrapKey(config.PaymentMasterKey, dek); err != nil {
+		return nil, err
+	}
+	if c.SigningSecret, err = envelope.Encrypt(dek, k.SigningSecret, apiKeySigningSecretAAD); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// create 加密后保存，k中仍然是明文
+func (k *APIKey) create(tx *gorm.DB) error {
+	c, err := k.encrypted()
+	if err != nil {
+		return err
+	}
+	if err := tx.Create(c).Error; err != nil {
+		return err
+	}
+	k.BaseModel = c.BaseModel
+	return nil
+}
+
+// signingSecret 解密签名secret，只在校验签名时解密
+func (k *APIKey) signingSecret() (string, error) {
+	if len(k.SigningSecret) == 0 || len(k.EncryptedDataKey) == 0 {
+		return "", fmt.Errorf("api key %s has no signing secret, rotate the key to sign requests", k.KeyID)
+	}
+	if len(config.PaymentMasterKey) == 0 {
+		return "", ErrNoMasterKey
+	}
+	dek, err := envelope.UnwrapKey(config.PaymentMasterKey, k.EncryptedDataKey)
+	if err != nil {
+		return "", fmt.Errorf("unwrap api key data key error, key_id: %s, err: %w", k.KeyID, err)
+	}
+	return envelope.Decrypt(dek, k.SigningSecret, apiKeySigningSecretAAD)
+}
+
+func (c *APIClient) loadStoreIDs(db *gorm.DB) {
+	c.StoreIDs = make([]int64, 0)
+	db.Model(&APIClientStore{}).Where("api_client_id = ?", c.ID).Order("store_id").Pluck("store_id", &c.StoreIDs)
+}
+
+// checkStores 绑定店铺和AllStores只能设置一个
+func (c *APIClient) checkStores() error {
+	if c.AllStores && len(c.StoreIDs) > 0 {
+		return errors.New("api client can not set both store_ids and all_stores")
+	}
+	if !c.AllStores && len(c.StoreIDs) == 0 {
+		return errors.New("api client store_ids can not be empty, set all_stores to true to allow all stores")
+	}
+	return nil
+}
+
+func FindAPIClient(id interface{}) (*APIClient, error) {
+	var c APIClient
+	conn.DB().First(&c, "id = ?", id)
+	if !c.Exists() {
+		return nil, fmt.Errorf("not found api client with id: %v", id)
+	}
+	c.loadStoreIDs(conn.DB())
+	return &c, nil
+}
+
+func FindAPIClients() []APIClient {
+	var cs []APIClient
+	conn.DB().Order("id").Find(&cs)
+	for i := range cs {
+		cs[i].loadStoreIDs(conn.DB())
+	}
+	return cs
+}
+
+func FindAPIKeys(apiClientID int64) []APIKey {
+	var ks []APIKey
+	conn.DB().Where("api_client_id = ?", apiClientID).Order("id").Find(&ks)
+	return ks
+}
+
+// save 保存调用方并替换绑定的店铺，店铺必须存在，见checkStores
+func (c *APIClient) save(tx *gorm.DB) error {
+	if len(c.Name) == 0 {
+		return errors.New("api client name is required")
+	}
+	scopes, err := NormalizeAPIScopes(strings.Split(c.Scopes, ","))
+	if err != nil {
+		return err
+	}
+	c.Scopes = scopes
+	if err := c.checkStores(); err != nil {
+		return err
+	}
+	if err := tx.Save(c).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("api_client_id = ?", c.ID).Delete(&APIClientStore{}).Error; err != nil {
+		return err
+	}
+	for _, id := range c.StoreIDs {
+		var s Store
+		tx.Select("id").First(&s, "id = ?", id)
+		if !s.Exists() {
+			return fmt.Errorf("not found store with id: %d", id)
+		}
+		if err := tx.Create(&APIClientStore{APIClientID: c.ID, StoreID: id}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAPIClient 创建调用方和第一个key，返回的key需要交给调用方保存
+func CreateAPIClient(c *APIClient) (string, error) {
+	c.ID = 0
+	var key string
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := c.save(tx); err != nil {
+			return err
+		}
+		var k *APIKey
+		key, k = GenAPIKey()
+		k.APIClientID = c.ID
+		return k.create(tx)
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (c *APIClient) Update() error {
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		return c.save(tx)
+	})
+}
+
+// RotateAPIKey 生成新key，现有的key在overlap后失效，overlap为0时立即失效
+// 已经设置了更早失效时间的key不变
+func RotateAPIKey(c *APIClient, overlap time.Duration, now time.Time) (string, *APIKey, error) {
+	expireAt := now.Add(overlap)
+	key, k := GenAPIKey()
+	k.APIClientID = c.ID
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&APIKey{}).
+			Where("api_client_id = ? AND (expires_at IS NULL OR expires_at > ?)", c.ID, expireAt).
+			Update("expires_at", expireAt).Error
+		if err != nil {
+			return err
+		}
+		return k.create(tx)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// RevokeAPIKey 立即失效
+func RevokeAPIKey(apiClientID, keyID int64, now time.Time) error {
+	res := conn.DB().Model(&APIKey{}).
+		Where("id = ? AND api_client_id = ?", keyID, apiClientID).
+		Update("expires_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("not found api key %d of api client %d", keyID, apiClientID)
+	}
+	return nil
+}
+
+// AuthenticateAPIKey 验证key并返回调用方，同时更新key的last_used_at
+func AuthenticateAPIKey(key string, now time.Time) (*APIClient, error) {
+	keyID, ok := parseAPIKeyID(key)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	return authenticateAPIKey(keyID, now, func(k *APIKey) bool {
+		return subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(hashAPIKey(key))) == 1
+	})
+}
+
+// AuthenticateSignedAPIKey 验证签名的请求，签名的secret为加密保存的SigningSecret(见ext/reqsig)
+func AuthenticateSignedAPIKey(keyID string, now time.Time, verify func(secret string) error) (*APIClient, error) {
+	return authenticateAPIKey(keyID, now, func(k *APIKey) bool {
+		secret, err := k.signingSecret()
+		if err != nil {
+			l().Warnf("signed request with api key %s error: %s", k.KeyID, err)
+			return false
+		}
+		return verify(secret) == nil
+	})
+}
+
+func authenticateAPIKey(keyID string, now time.Time, check func(k *APIKey) bool) (*APIClient, error) {
+	var k APIKey
+	conn.DB().First(&k, "key_id = ?", keyID)
+	if !k.Exists() || !k.IsActive(now) || !check(&k) {
+		return nil, ErrInvalidAPIKey
+	}
+	c, err := FindAPIClient(k.APIClientID)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if c.Disabled {
+		return nil, fmt.Errorf("api client %d is disabled", c.ID)
+	}
+	k.touch(now)
+	return c, nil
+}
+
+func (k *APIKey) touch(now time.Time) {
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < apiKeyTouchInterval {
+		return
+	}
+	// 不修改updated_at
+	if err := conn.DB().Model(k).UpdateColumn("last_used_at", now).Error; err != nil {
+		l().Warnf("update api key %d last_used_at error: %s", k.ID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/envelope"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenAPIKey(t *testing.T) {
+	key, k := GenAPIKey()
+	assert.True(t, strings.HasPrefix(key, "ggpk_"+k.KeyID+"_"))
+	assert.Len(t, k.KeyID, apiKeyIDLen)
+	assert.True(t, IsAPIKey(key))
+	assert.Equal(t, hashAPIKey(key), k.KeyHash)
+	assert.NotContains(t, k.KeyHash, key)
+
+	key2, k2 := GenAPIKey()
+	assert.NotEqual(t, key, key2)
+	assert.NotEqual(t, k.KeyID, k2.KeyID)
+
+	assert.False(t, IsAPIKey("xxx"))
+	assert.False(t, IsAPIKey("ggpk_"+k.KeyID))
+	assert.False(t, IsAPIKey("ggpk_"+k.KeyID+"x"+strings.Repeat("a", 64)))
+}
+
+func TestAPIClientScopesAndStores(t *testing.T) {
+	s, err := NormalizeAPIScopes([]string{" read", "payment", "read", ""})
+	assert.Nil(t, err)
+	assert.Equal(t, "payment,read", s)
+	_, err = NormalizeAPIScopes([]string{"read", "write"})
+	assert.NotNil(t, err)
+	_, err = NormalizeAPIScopes(nil)
+	assert.NotNil(t, err)
+
+	c := APIClient{Scopes: s}
+	assert.True(t, c.HasScope(API_SCOPE_READ))
+	assert.False(t, c.HasScope(API_SCOPE_ADMIN))
+	// 没有all_stores也没有绑定店铺时不能操作任何店铺
+	assert.True(t, c.IsStoreRestricted())
+	assert.False(t, c.CanAccessStore(3))
+
+	assert.NotNil(t, c.checkStores())
+	c.AllStores = true
+	assert.Nil(t, c.checkStores())
+	assert.True(t, c.CanAccessStore(3))
+
+	c.StoreIDs = []int64{1, 2}
+	assert.NotNil(t, c.checkStores())
+	c.AllStores = false
+	assert.Nil(t, c.checkStores())
+	assert.True(t, c.CanAccessStore(2))
+	assert.False(t, c.CanAccessStore(3))
+}
+
+func TestAPIKeyIsActive(t *testing.T) {
+	now := time.Now()
+	var k APIKey
+	assert.True(t, k.IsActive(now))
+	exp := now.Add(time.Hour)
+	k.ExpiresAt = &exp
+	assert.True(t, k.IsActive(now))
+	assert.False(t, k.IsActive(exp))
+}
+
+func TestAPIKeySigningSecret(t *testing.T) {
+	defer func(k []byte) { config.PaymentMasterKey = k }(config.PaymentMasterKey)
+	config.PaymentMasterKey = nil
+	_, k := GenAPIKey()
+	_, err := k.encrypted()
+	assert.Equal(t, ErrNoMasterKey, err)
+
+	key, err := envelope.GenerateDataKey()
+	assert.Nil(t, err)
+	config.PaymentMasterKey = key
+	c, err := k.encrypted()
+	assert.Nil(t, err)
+	assert.NotEqual(t, k.SigningSecret, c.SigningSecret)
+	assert.True(t, envelope.IsEncrypted(c.SigningSecret))
+	secret, err := c.signingSecret()
+	assert.Nil(t, err)
+	assert.Equal(t, k.SigningSecret, secret)
+
+	// 之前创建的key没有签名secret
+	_, err = (&APIKey{KeyID: k.KeyID, KeyHash: k.KeyHash}).signingSecret()
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"time"
 
@@ -92,3 +93,12 @@ func NewTime(value string) time.Time {
 	t, _ := time.ParseInLocation(DateTimeFormat, value, ChinaTz)
 	return t
 }
+
+// YuanToFen 数据库中金额单位为元，微信接口中金额单位为分
+func YuanToFen(v float64) int64 {
+	return int64(math.Round(v * 100))
+}
+
+func FenToYuan(v int64) float64 {
+	return float64(v) / 100
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go-gin-payment/conn"
+
+	"gorm.io/gorm"
+)
+
+// CombinePaymentRecord 微信合单支付的主单，每个子单(一个店铺一笔)保存为PaymentRecord，
+// 子单的CombineTransNo为主单的CombineTransNo，状态、通知和退款都按子单处理
+type CombinePaymentRecord struct {
+	BaseModel
+	CombineTransNo   string     `gorm:"column:combine_trans_no;uniqueIndex;size:64" json:"combine_trans_no"`
+	PaymentAccountID int64      `gorm:"column:payment_account_id" json:"payment_account_id"`
+	AppID            string     `gorm:"column:app_id" json:"app_id"` // combine_appid
+	TotalMoney       float64    `gorm:"column:total_money" json:"total_money"`
+	AddiNotifyURL    string     `gorm:"column:addi_notify_url" json:"addi_notify_url"`
+	ExpireAt         *time.Time `gorm:"column:expire_at" json:"expire_at"`
+}
+
+func FindCombinePaymentRecord(combineTransNo string) (*CombinePaymentRecord, error) {
+	var c CombinePaymentRecord
+	conn.DB().First(&c, "combine_trans_no = ?", combineTransNo)
+	if !c.Exists() {
+		return nil, errors.New("not found combine payment record, combine_trans_no: " + combineTransNo)
+	}
+	return &c, nil
+}
+
+// SubRecords 按创建顺序返回子单
+func (c *CombinePaymentRecord) SubRecords() []PaymentRecord {
+	var rs []PaymentRecord
+	conn.DB().Where("combine_trans_no = ?", c.CombineTransNo).Order("id").Find(&rs)
+	return rs
+}
+
+// CreatePendingCombinePaymentRecord 创建主单和待支付的子单
+// 同一个combine_trans_no重复下单时，只有子单都仍为pending且参数一致时才返回已有的子单
+func CreatePendingCombinePaymentRecord(c *CombinePaymentRecord, subs []PaymentRecord) ([]PaymentRecord, error) {
+	if old, err := FindCombinePaymentRecord(c.CombineTransNo); err == nil {
+		return checkCombineRetry(old, c, subs)
+	}
+
+	var total int64
+	for i := range subs {
+		if _, err := FindPaymentRecordByTransNo(subs[i].TransNo); err == nil {
+			return nil, fmt.Errorf("%w: trans_no already used, trans_no: %s", ErrTransNoConflict, subs[i].TransNo)
+		}
+		subs[i].CombineTransNo = c.CombineTransNo
+		subs[i].PaymentAccountID = c.PaymentAccountID
+		subs[i].AddiNotifyURL = c.AddiNotifyURL
+		subs[i].ExpireAt = c.ExpireAt
+		subs[i].Status = PAYMENT_STATUS_PENDING
+		total += subs[i].TotalFen()
+	}
+	c.TotalMoney = FenToYuan(total)
+
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(c).Error; err != nil {
+			return err
+		}
+		for i := range subs {
+			if err := tx.Create(&subs[i]).Error; err != nil {
+				return transNoConflictError(err, subs[i].TransNo)
+			}
+			err := tx.Create(&PaymentRecordEvent{
+				PaymentRecordID: subs[i].ID,
+				ToStatus:        PAYMENT_STATUS_PENDING,
+				Source:          "create",
+				Detail:          "combine_trans_no: " + c.CombineTransNo,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func checkCombineRetry(old, c *CombinePaymentRecord, subs []PaymentRecord) ([]PaymentRecord, error) {
+	olds := old.SubRecords()
+	if old.PaymentAccountID != c.PaymentAccountID || len(olds) != len(subs) {
+		return nil, fmt.Errorf("%w: combine_trans_no already used with different params, combine_trans_no: %s", ErrTransNoConflict, c.CombineTransNo)
+	}
+	for i := range olds {
+		if !olds[i].IsPending() {
+			return nil, fmt.Errorf("%w: combine_trans_no already used, trans_no: %s, status: %s", ErrTransNoConflict, olds[i].TransNo, olds[i].Status)
+		}
+		if olds[i].TransNo != subs[i].TransNo || olds[i].StoreID != subs[i].StoreID || olds[i].TotalFen() != subs[i].TotalFen() {
+			return nil, fmt.Errorf("%w: combine_trans_no already used with different params, combine_trans_no: %s", ErrTransNoConflict, c.CombineTransNo)
+		}
+	}
+	*c = *old
+	return olds, nil
+}
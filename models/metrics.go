@@ -0,0 +1,49 @@
+package models
+
+import (
+	"strconv"
+	"sync"
+
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/metrics"
+)
+
+// 支付记录的指标，event为created、paid、closed、refunded，refunded按每次退款成功计算，金额为退款金额
+const (
+	ORDER_EVENT_CREATED  = "created"
+	ORDER_EVENT_PAID     = "paid"
+	ORDER_EVENT_CLOSED   = "closed"
+	ORDER_EVENT_REFUNDED = "refunded"
+)
+
+var (
+	orderEvents = metrics.NewCounterVec("ggp_payment_orders_total",
+		"Payment orders created, paid, closed and refunded.", "provider", "store", "event")
+	orderAmountFen = metrics.NewCounterVec("ggp_payment_amount_fen_total",
+		"Amount of payment orders in fen (cents).", "provider", "store", "event")
+)
+
+// accountTypes 支付账号的类型不会修改，缓存后记录指标时不需要每次查询
+var accountTypes sync.Map
+
+func accountTypeOf(paymentAccountID int64) string {
+	if t, ok := accountTypes.Load(paymentAccountID); ok {
+		return t.(string)
+	}
+	var pa PaymentAccount
+	conn.DB().Select("id", "account_type").First(&pa, "id = ?", paymentAccountID)
+	if !pa.Exists() {
+		return "unknown"
+	}
+	accountTypes.Store(paymentAccountID, pa.AccountType)
+	return pa.AccountType
+}
+
+func recordOrderEvent(paymentAccountID, storeID int64, event string, fen int64) {
+	provider := accountTypeOf(paymentAccountID)
+	store := strconv.FormatInt(storeID, 10)
+	orderEvents.Inc(provider, store, event)
+	if fen > 0 {
+		orderAmountFen.Add(float64(fen), provider, store, event)
+	}
+}
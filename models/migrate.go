@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"go-gin-payment/conn"
+)
+
+// AutoMigrate 只会创建缺少的表和字段，不会删除已有的数据
+func AutoMigrate() error {
+	db := conn.DB()
+	// 之前没有all_stores字段，没有绑定店铺的调用方不限制店铺，加字段后需要设置为true
+	fillAllStores := db.Migrator().HasTable(&APIClient{}) && !db.Migrator().HasColumn(&APIClient{}, "AllStores")
+	err := db.AutoMigrate(
+		&RefundRecord{},
+		&PaymentRecordEvent{},
+		&WebhookDelivery{},
+		&WebhookAttempt{},
+		&WebhookTarget{},
+		&PaymentAccountAudit{},
+		&StorePaymentAccount{},
+		&CombinePaymentRecord{},
+		&ProfitSharingReceiver{},
+		&ProfitSharingOrder{},
+		&ProfitSharingDetail{},
+		&ProfitSharingReturn{},
+		&Reconciliation{},
+		&ReconciliationItem{},
+		&APIClient{},
+		&APIClientStore{},
+		&APIKey{},
+	)
+	if err != nil {
+		return err
+	}
+	if fillAllStores {
+		err := db.Model(&APIClient{}).
+			Where("id NOT IN (?)", db.Model(&APIClientStore{}).Select("api_client_id")).
+			Update("all_stores", true).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// 已有的表只补充新增的字段，避免AutoMigrate修改已有字段的类型
+	m := db.Migrator()
+	for _, c := range []struct {
+		model interface{}
+		field string
+	}{
+		{&PaymentRecord{}, "AppID"},
+		{&PaymentRecord{}, "ExpireAt"},
+		{&PaymentAccount{}, "EncryptedDataKey"},
+		{&PaymentRecord{}, "CombineTransNo"},
+		{&PaymentRecord{}, "ProfitSharing"},
+		{&PaymentRecord{}, "SweepAttempts"},
+		{&PaymentRecord{}, "NextSweepAt"},
+		{&RefundRecord{}, "SweepAttempts"},
+		{&RefundRecord{}, "NextSweepAt"},
+	} {
+		if !m.HasColumn(c.model, c.field) {
+			if err := m.AddColumn(c.model, c.field); err != nil {
+				return err
+			}
+		}
+	}
+	// trans_no的唯一索引，已有重复的trans_no时需要先手动处理
+	if !m.HasIndex(&PaymentRecord{}, "idx_payment_records_trans_no") {
+		var dups []string
+		db.Model(&PaymentRecord{}).Group("trans_no").Having("COUNT(*) > 1").Limit(10).Pluck("trans_no", &dups)
+		if len(dups) > 0 {
+			return fmt.Errorf("can not add unique index on payment_records.trans_no, duplicated trans_no: %s", strings.Join(dups, ", "))
+		}
+		if err := m.CreateIndex(&PaymentRecord{}, "idx_payment_records_trans_no"); err != nil {
+			return err
+		}
+	}
+	for _, field := range []string{"ExpireAt", "CombineTransNo"} {
+		if !m.HasIndex(&PaymentRecord{}, field) {
+			if err := m.CreateIndex(&PaymentRecord{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
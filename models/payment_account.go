@@ -2,8 +2,12 @@ package models
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"go-gin-payment/conn"
 
@@ -19,48 +23,118 @@ type PaymentAccount struct {
 	BaseModel
 	AccountType      string `gorm:"column:account_type"`
 	Name             string `gorm:"column:name"`
-	MerID            string `gorm:"column:mer_id"`             // wechat商家ID, alipay的AppID
-	AppID            string `gorm:"column:app_id"`             // wechat服务商的AppID，如果不为空表示该支付账号为服务商支付账号，为空表示为普通商户账号
-	APIV3Secret      string `gorm:"column:api_v3_secret"`      // wechat，API秘钥和APIv3密钥我们设置的一样
-	CertSerialNumber string `gorm:"column:cert_serial_number"` // wechat
-	CertPublic       string `gorm:"column:cert_public"`        // wechat, alipay
-	CertPrivate      string `gorm:"column:cert_private"`       // wechat, alipay
+	MerID            string `gorm:"column:mer_id"`                 // wechat商家ID, alipay的AppID
+	AppID            string `gorm:"column:app_id"`                 // wechat服务商的AppID，如果不为空表示该支付账号为服务商支付账号，为空表示为普通商户账号
+	APIV3Secret      string `gorm:"column:api_v3_secret" json:"-"` // wechat，API秘钥和APIv3密钥我们设置的一样，加密保存
+	CertSerialNumber string `gorm:"column:cert_serial_number"`     // wechat
+	CertPublic       string `gorm:"column:cert_public"`            // wechat, alipay
+	CertPrivate      string `gorm:"column:cert_private" json:"-"`  // wechat, alipay，加密保存
 
 	AlipayCertPublicKey    string `gorm:"column:alipay_cert_public_key"`     // alipay
 	AlipayRootCert         string `gorm:"column:alipay_root_cert"`           // alipay
 	AlipayAppCertPublicKey string `gorm:"column:alipay_app_cert_public_key"` // alipay
 
+	EncryptedDataKey string `gorm:"column:encrypted_data_key;type:text" json:"-"` // 用主密钥加密后的数据密钥，为空表示没有加密
+
 	LoadedCertPrivate *rsa.PrivateKey `gorm:"-" json:"-"`
 }
 
 // FindPaLoadPrivateCert 只有微信支付需要加载私有证书
 func FindPaLoadPrivateCert(id interface{}, loadCert bool) (*PaymentAccount, error) {
+	return findPaymentAccount(id, func(pa *PaymentAccount) bool { return loadCert })
+}
+
+// FindPaymentAccount 按账号类型决定是否需要加载商户私钥
+func FindPaymentAccount(id interface{}) (*PaymentAccount, error) {
+	return findPaymentAccount(id, func(pa *PaymentAccount) bool { return pa.AccountType == ACCOUNT_TYPE_WECHAT })
+}
+
+// paymentAccountCache 解密并加载了私钥的账号，key为id，value为*PaymentAccount
+// 每次只查询updated_at，和缓存的一致时不再读取和解密私钥等字段，账号修改后updated_at变化自然不会命中
+var paymentAccountCache sync.Map
+
+// InvalidatePaymentAccount 账号修改或删除后调用，避免同一时间内的修改没有改变updated_at
+func InvalidatePaymentAccount(id int64) {
+	paymentAccountCache.Delete(id)
+}
+
+// findPaymentAccount 返回缓存的副本，调用方修改不会影响缓存
+func findPaymentAccount(id interface{}, loadCert func(pa *PaymentAccount) bool) (*PaymentAccount, error) {
+	var cur struct {
+		ID        int64
+		UpdatedAt time.Time
+	}
+	if err := conn.DB().Model(&PaymentAccount{}).Select("id", "updated_at").Where("id = ?", id).Limit(1).Scan(&cur).Error; err != nil {
+		return nil, err
+	}
+	if cur.ID == 0 {
+		return nil, fmt.Errorf("not found with payment account id: %v", id)
+	}
+	if v, ok := paymentAccountCache.Load(cur.ID); ok {
+		cached := v.(*PaymentAccount)
+		if cached.UpdatedAt.Equal(cur.UpdatedAt) && (cached.LoadedCertPrivate != nil || !loadCert(cached)) {
+			pa := *cached
+			return &pa, nil
+		}
+	}
+
 	var pa PaymentAccount
-	conn.DB().First(&pa, "id = ?", id)
+	err := conn.DB().First(&pa, "id = ?", cur.ID).Error
 	if !pa.Exists() {
 		return nil, fmt.Errorf("not found with payment account id: %v", id)
 	}
-
+	if err != nil {
+		// 解密失败
+		return nil, err
+	}
 	// load private key 微信需要加载商户私钥
-	if loadCert {
+	if loadCert(&pa) {
 		if err := pa.LoadPrivCert(); err != nil {
 			return nil, err
 		}
 	}
-
 	l().Infof("loaded PA, id: %d, name: %s, app_id: %s", pa.ID, pa.Name, pa.AppID)
+
+	cached := pa
+	paymentAccountCache.Store(pa.ID, &cached)
 	return &pa, nil
 }
 
+// privateKeyCache 解析后的私钥，key为私钥内容的sha256，私钥修改后自然不会命中
+var privateKeyCache sync.Map
+
 func (pa *PaymentAccount) LoadPrivCert() error {
+	sum := sha256.Sum256([]byte(pa.CertPrivate))
+	if cert, ok := privateKeyCache.Load(sum); ok {
+		pa.LoadedCertPrivate = cert.(*rsa.PrivateKey)
+		return nil
+	}
 	cert, err := utils.LoadPrivateKey(pa.CertPrivate)
 	if err != nil {
 		return errors.New("load pri cert error:" + err.Error())
 	}
+	privateKeyCache.Store(sum, cert)
 	pa.LoadedCertPrivate = cert
 	return nil
 }
 
+// Fingerprint 账号的配置有变化时会改变，用于判断缓存(比如微信的core.Client)是否失效
+func (pa *PaymentAccount) Fingerprint() string {
+	h := sha256.New()
+	for _, v := range []string{
+		pa.AccountType, pa.MerID, pa.AppID, pa.APIV3Secret, pa.CertSerialNumber, pa.CertPrivate,
+		pa.UpdatedAt.UTC().Format(time.RFC3339Nano),
+	} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (pa *PaymentAccount) IsWechatServiceProviderAccount() bool {
 	return pa.AccountType == ACCOUNT_TYPE_WECHAT && len(pa.AppID) > 0
 }
+
+func (pa *PaymentAccount) IsAlipayAccount() bool {
+	return pa.AccountType == ACCOUNT_TYPE_ALIPAY
+}
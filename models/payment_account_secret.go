@@ -0,0 +1,257 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/envelope"
+
+	"gorm.io/gorm"
+)
+
+//
+// 支付账号的私钥和APIv3密钥使用信封加密保存:
+// 每个账号生成自己的数据密钥加密这两个字段，数据密钥用config.PaymentMasterKey加密后保存在encrypted_data_key
+// 查询时在AfterFind中解密，所以除了保存之外其他代码拿到的都是明文
+//
+
+var ErrNoMasterKey = errors.New("payment master key is not configured")
+
+// 审计日志的操作
+const (
+	PA_AUDIT_CREATE  = "create"
+	PA_AUDIT_UPDATE  = "update"
+	PA_AUDIT_DELETE  = "delete"
+	PA_AUDIT_ENCRYPT = "encrypt"
+)
+
+// PaymentAccountAudit 支付账号的修改记录，私钥等敏感字段只记录有修改，不记录内容
+// api_client_id和actor为验证过的调用方，operator_note是调用方自己填写的操作人，只作为备注
+type PaymentAccountAudit struct {
+	BaseModel
+	PaymentAccountID int64  `gorm:"column:payment_account_id;index" json:"payment_account_id"`
+	Action           string `gorm:"column:action" json:"action"`
+	APIClientID      int64  `gorm:"column:api_client_id" json:"api_client_id"`
+	Actor            string `gorm:"column:actor" json:"actor"`
+	OperatorNote     string `gorm:"column:operator_note" json:"operator_note"`
+	IP               string `gorm:"column:ip" json:"ip"`
+	Changes          string `gorm:"column:changes;type:text" json:"changes"`
+}
+
+// AuditActor 修改支付账号的操作人
+type AuditActor struct {
+	APIClientID int64  // 验证过的调用方，共享的API_SECRET和系统操作为0
+	Name        string // 验证过的身份，比如api_client:3(web)
+	Note        string // 调用方自己填写的操作人，不能作为身份
+	IP          string
+}
+
+// systemAuditActor 启动时的自动操作
+var systemAuditActor = AuditActor{Name: "system"}
+
+func (a AuditActor) String() string {
+	if len(a.Note) == 0 {
+		return a.Name
+	}
+	return fmt.Sprintf("%s (note: %q)", a.Name, a.Note)
+}
+
+func (a AuditActor) audit(paymentAccountID int64, action string, changes string) *PaymentAccountAudit {
+	return &PaymentAccountAudit{
+		PaymentAccountID: paymentAccountID,
+		Action:           action,
+		APIClientID:      a.APIClientID,
+		Actor:            a.Name,
+		OperatorNote:     a.Note,
+		IP:               a.IP,
+		Changes:          changes,
+	}
+}
+
+// paymentAccountSecretFields 需要加密的字段，值为加密时使用的aad
+var paymentAccountSecretFields = []struct {
+	name string
+	get  func(pa *PaymentAccount) *string
+}{
+	{"cert_private", func(pa *PaymentAccount) *string { return &pa.CertPrivate }},
+	{"api_v3_secret", func(pa *PaymentAccount) *string { return &pa.APIV3Secret }},
+}
+
+func (pa *PaymentAccount) AfterFind(tx *gorm.DB) error {
+	return pa.decryptSecrets()
+}
+
+func (pa *PaymentAccount) decryptSecrets() error {
+	if len(pa.EncryptedDataKey) == 0 {
+		return nil
+	}
+	if len(config.PaymentMasterKey) == 0 {
+		return ErrNoMasterKey
+	}
+	dek, err := envelope.UnwrapKey(config.PaymentMasterKey, pa.EncryptedDataKey)
+	if err != nil {
+		return fmt.Errorf("unwrap payment account data key error, id: %d, err: %w", pa.ID, err)
+	}
+	for _, f := range paymentAccountSecretFields {
+		v := f.get(pa)
+		if *v, err = envelope.Decrypt(dek, *v, f.name); err != nil {
+			return fmt.Errorf("decrypt payment account %s error, id: %d, err: %w", f.name, pa.ID, err)
+		}
+	}
+	return nil
+}
+
+// encrypted 返回加密后的副本用于保存，已有数据密钥时继续使用
+func (pa *PaymentAccount) encrypted() (*PaymentAccount, error) {
+	if len(config.PaymentMasterKey) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	var dek []byte
+	var err error
+	if len(pa.EncryptedDataKey) > 0 {
+		dek, err = envelope.UnwrapKey(config.PaymentMasterKey, pa.EncryptedDataKey)
+	} else {
+		dek, err = envelope.GenerateDataKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := *pa
+	c.LoadedCertPrivate = nil
+	if c.EncryptedDataKey, err = envelope.WrapKey(config.PaymentMasterKey, dek); err != nil {
+		return nil, err
+	}
+	for _, f := range paymentAccountSecretFields {
+		v := f.get(&c)
+		if len(*v) == 0 {
+			continue
+		}
+		if *v, err = envelope.Encrypt(dek, *v, f.name); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// save 加密后保存并写审计日志，pa中仍然是明文
+func (pa *PaymentAccount) save(action string, actor AuditActor, changes interface{}) error {
+	c, err := pa.encrypted()
+	if err != nil {
+		return err
+	}
+	changesJSON, _ := json.Marshal(changes)
+	err = conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(c).Error; err != nil {
+			return err
+		}
+		return tx.Create(actor.audit(c.ID, action, string(changesJSON))).Error
+	})
+	if err != nil {
+		return err
+	}
+	pa.ID = c.ID
+	pa.CreatedAt = c.CreatedAt
+	pa.UpdatedAt = c.UpdatedAt
+	pa.EncryptedDataKey = c.EncryptedDataKey
+	return nil
+}
+
+func CreatePaymentAccount(pa *PaymentAccount, actor AuditActor) error {
+	pa.ID = 0
+	pa.EncryptedDataKey = ""
+	return pa.save(PA_AUDIT_CREATE, actor, paymentAccountChanges(&PaymentAccount{}, pa))
+}
+
+// UpdatePaymentAccount old为修改前的记录，用于记录修改了哪些字段
+func UpdatePaymentAccount(old, pa *PaymentAccount, actor AuditActor) error {
+	changes := paymentAccountChanges(old, pa)
+	if len(changes) == 0 {
+		return nil
+	}
+	return pa.save(PA_AUDIT_UPDATE, actor, changes)
+}
+
+// DeletePaymentAccount 已经有支付记录或者绑定了店铺的账号不能删除
+func DeletePaymentAccount(pa *PaymentAccount, actor AuditActor) error {
+	var n int64
+	conn.DB().Model(&PaymentRecord{}).Where("payment_account_id = ?", pa.ID).Count(&n)
+	if n > 0 {
+		return fmt.Errorf("payment account has %d payment records, can not delete", n)
+	}
+	conn.DB().Model(&StorePaymentAccount{}).Where("payment_account_id = ?", pa.ID).Count(&n)
+	if n > 0 {
+		return fmt.Errorf("payment account is bound to %d stores, unbind first", n)
+	}
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&PaymentAccount{}, pa.ID).Error; err != nil {
+			return err
+		}
+		return tx.Create(actor.audit(pa.ID, PA_AUDIT_DELETE, "")).Error
+	})
+}
+
+func FindPaymentAccounts() ([]PaymentAccount, error) {
+	var pas []PaymentAccount
+	err := conn.DB().Order("id").Find(&pas).Error
+	return pas, err
+}
+
+func FindPaymentAccountAudits(paymentAccountID int64) []PaymentAccountAudit {
+	var as []PaymentAccountAudit
+	conn.DB().Where("payment_account_id = ?", paymentAccountID).Order("id").Find(&as)
+	return as
+}
+
+// EncryptPlaintextPaymentAccounts 加密之前手动插入的明文账号，没有设置主密钥时不处理
+func EncryptPlaintextPaymentAccounts() (int, error) {
+	if len(config.PaymentMasterKey) == 0 {
+		return 0, nil
+	}
+	var pas []PaymentAccount
+	if err := conn.DB().Where("encrypted_data_key IS NULL OR encrypted_data_key = ''").Find(&pas).Error; err != nil {
+		return 0, err
+	}
+	for i := range pas {
+		if err := pas[i].save(PA_AUDIT_ENCRYPT, systemAuditActor, nil); err != nil {
+			return i, err
+		}
+	}
+	return len(pas), nil
+}
+
+// paymentAccountChanges 修改了的字段，敏感字段的值不记录
+func paymentAccountChanges(old, pa *PaymentAccount) map[string]interface{} {
+	changes := make(map[string]interface{})
+	for _, f := range []struct {
+		name     string
+		from, to string
+		secret   bool
+	}{
+		{"account_type", old.AccountType, pa.AccountType, false},
+		{"name", old.Name, pa.Name, false},
+		{"mer_id", old.MerID, pa.MerID, false},
+		{"app_id", old.AppID, pa.AppID, false},
+		{"cert_serial_number", old.CertSerialNumber, pa.CertSerialNumber, false},
+		{"cert_public", old.CertPublic, pa.CertPublic, true},
+		{"alipay_cert_public_key", old.AlipayCertPublicKey, pa.AlipayCertPublicKey, true},
+		{"alipay_root_cert", old.AlipayRootCert, pa.AlipayRootCert, true},
+		{"alipay_app_cert_public_key", old.AlipayAppCertPublicKey, pa.AlipayAppCertPublicKey, true},
+		{"cert_private", old.CertPrivate, pa.CertPrivate, true},
+		{"api_v3_secret", old.APIV3Secret, pa.APIV3Secret, true},
+	} {
+		if f.from == f.to {
+			continue
+		}
+		if f.secret {
+			// 证书内容太长，和私钥一样只记录有修改
+			changes[f.name] = "changed"
+		} else {
+			changes[f.name] = map[string]string{"from": f.from, "to": f.to}
+		}
+	}
+	return changes
+}
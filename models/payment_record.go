@@ -2,20 +2,132 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"go-gin-payment/conn"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
 )
 
+// PaymentStatus 支付记录的状态，只能按paymentStatusTransitions中定义的方向变化
+//
+//	pending -> success | closed | failed
+//	failed -> closed
+//	success -> refunding
+//	refunding -> refunded | partially_refunded | success(退款全部失败)
+//	partially_refunded -> refunding
+type PaymentStatus string
+
+const (
+	PAYMENT_STATUS_PENDING            PaymentStatus = "pending"
+	PAYMENT_STATUS_SUCCESS            PaymentStatus = "success"
+	PAYMENT_STATUS_CLOSED             PaymentStatus = "closed"
+	PAYMENT_STATUS_FAILED             PaymentStatus = "failed"
+	PAYMENT_STATUS_REFUNDING          PaymentStatus = "refunding"
+	PAYMENT_STATUS_REFUNDED           PaymentStatus = "refunded"
+	PAYMENT_STATUS_PARTIALLY_REFUNDED PaymentStatus = "partially_refunded"
+)
+
+var paymentStatusTransitions = map[PaymentStatus][]PaymentStatus{
+	PAYMENT_STATUS_PENDING:            {PAYMENT_STATUS_SUCCESS, PAYMENT_STATUS_CLOSED, PAYMENT_STATUS_FAILED},
+	PAYMENT_STATUS_FAILED:             {PAYMENT_STATUS_CLOSED},
+	PAYMENT_STATUS_SUCCESS:            {PAYMENT_STATUS_REFUNDING},
+	PAYMENT_STATUS_REFUNDING:          {PAYMENT_STATUS_REFUNDED, PAYMENT_STATUS_PARTIALLY_REFUNDED, PAYMENT_STATUS_SUCCESS},
+	PAYMENT_STATUS_PARTIALLY_REFUNDED: {PAYMENT_STATUS_REFUNDING},
+}
+
+var ErrInvalidStatusTransition = errors.New("invalid payment status transition")
+
+// ErrTransNoConflict 同一个trans_no重复下单但是参数不同，或者订单已经不是pending
+var ErrTransNoConflict = errors.New("trans_no conflict")
+
+// mysqlErrDuplicateEntry 唯一索引冲突
+const mysqlErrDuplicateEntry = 1062
+
+const (
+	paymentSweepFirstRetryWait = time.Minute
+	paymentSweepMaxRetryWait   = 6 * time.Hour
+)
+
+// normalize 历史数据(由web端创建的记录)状态可能为空，视为pending
+func (s PaymentStatus) normalize() PaymentStatus {
+	if s == "" {
+		return PAYMENT_STATUS_PENDING
+	}
+	return s
+}
+
+func (s PaymentStatus) CanTransitTo(to PaymentStatus) bool {
+	for _, v := range paymentStatusTransitions[s.normalize()] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+// WechatTradeStateToStatus 微信trade_state对应的状态，REFUND等状态由退款流程处理，返回false
+func WechatTradeStateToStatus(tradeState string) (PaymentStatus, bool) {
+	switch tradeState {
+	case "SUCCESS":
+		return PAYMENT_STATUS_SUCCESS, true
+	case "CLOSED", "REVOKED":
+		return PAYMENT_STATUS_CLOSED, true
+	case "PAYERROR":
+		return PAYMENT_STATUS_FAILED, true
+	case "NOTPAY", "USERPAYING":
+		return PAYMENT_STATUS_PENDING, true
+	}
+	return "", false
+}
+
+// AlipayTradeStatusToStatus 支付宝trade_status对应的状态
+// 注意全额退款后支付宝也会返回TRADE_CLOSED，只有pending的记录才需要处理
+func AlipayTradeStatusToStatus(tradeStatus string) (PaymentStatus, bool) {
+	switch tradeStatus {
+	case "TRADE_SUCCESS", "TRADE_FINISHED":
+		return PAYMENT_STATUS_SUCCESS, true
+	case "TRADE_CLOSED":
+		return PAYMENT_STATUS_CLOSED, true
+	case "WAIT_BUYER_PAY":
+		return PAYMENT_STATUS_PENDING, true
+	}
+	return "", false
+}
+
 type PaymentRecord struct {
 	BaseModel
-	TransNo          string  `gorm:"column:trans_no" json:"trans_no"`
-	PaymentAccountID int64   `gorm:"column:payment_account_id" json:"payment_account_id"`
-	PayNo            string  `gorm:"column:pay_no" json:"pay_no"` // 微信订单号/交易号
-	Status           string  `gorm:"column:status" json:"status"`
-	TotalMoney       float64 `gorm:"total_money"`
-	PaymentResponse  string  `gorm:"payment_response"`
-	StoreID          int64   `gorm:"store_id"`
-	AddiNotifyURL    string  `gorm:"addi_notify_url"`
+	TransNo          string        `gorm:"column:trans_no;uniqueIndex:idx_payment_records_trans_no;size:64" json:"trans_no"`
+	PaymentAccountID int64         `gorm:"column:payment_account_id" json:"payment_account_id"`
+	PayNo            string        `gorm:"column:pay_no" json:"pay_no"` // 微信订单号/支付宝交易号
+	Status           PaymentStatus `gorm:"column:status" json:"status"`
+	TotalMoney       float64       `gorm:"total_money"`
+	PaymentResponse  string        `gorm:"payment_response"`
+	StoreID          int64         `gorm:"store_id"`
+	AddiNotifyURL    string        `gorm:"addi_notify_url"`
+	AppID            string        `gorm:"column:app_id" json:"app_id"`                                   // 下单时使用的appid(服务商模式下为sub_appid)，为空则不校验
+	ExpireAt         *time.Time    `gorm:"column:expire_at;index" json:"expire_at"`                       // 过期后未支付的订单会被自动关闭
+	CombineTransNo   string        `gorm:"column:combine_trans_no;index;size:64" json:"combine_trans_no"` // 微信合单支付的主单号，不是合单支付时为空
+	ProfitSharing    bool          `gorm:"column:profit_sharing" json:"profit_sharing"`                   // 微信服务商分账，支付成功后资金冻结直到分账或解冻
+	SweepAttempts    int           `gorm:"column:sweep_attempts" json:"sweep_attempts"`                   // 过期后清理任务没有处理完成的次数
+	NextSweepAt      *time.Time    `gorm:"column:next_sweep_at" json:"next_sweep_at"`                     // 清理任务下次处理的时间，为空表示过期后立即处理
+}
+
+// IsCombineSubOrder 是否为微信合单支付的子单，查询和关单需要使用主单号
+func (r *PaymentRecord) IsCombineSubOrder() bool {
+	return len(r.CombineTransNo) > 0
+}
+
+// PaymentRecordEvent 支付记录状态变化的历史
+type PaymentRecordEvent struct {
+	BaseModel
+	PaymentRecordID int64         `gorm:"column:payment_record_id;index" json:"payment_record_id"`
+	FromStatus      PaymentStatus `gorm:"column:from_status" json:"from_status"`
+	ToStatus        PaymentStatus `gorm:"column:to_status" json:"to_status"`
+	Source          string        `gorm:"column:source" json:"source"` // 触发变化的来源，比如create, wechat_notify, refund
+	Detail          string        `gorm:"column:detail;type:text" json:"detail"`
 }
 
 func FindPaymentRecordByTransNo(transNo string) (*PaymentRecord, error) {
@@ -27,6 +139,202 @@ func FindPaymentRecordByTransNo(transNo string) (*PaymentRecord, error) {
 	return &r, nil
 }
 
-func (r *PaymentRecord) IsSuccess() bool {
-	return r.Status == "success"
+func FindPaymentRecordByID(id int64) (*PaymentRecord, error) {
+	var r PaymentRecord
+	conn.DB().First(&r, "id = ?", id)
+	if !r.Exists() {
+		return nil, fmt.Errorf("not found payment record, id: %d", id)
+	}
+	return &r, nil
+}
+
+// FindExpiredPendingPaymentRecords 已过期但仍为pending并且到了next_sweep_at的记录
+// 只处理明确为pending的记录，历史上状态为空的记录不自动关闭
+func FindExpiredPendingPaymentRecords(now time.Time, limit int) []PaymentRecord {
+	var rs []PaymentRecord
+	conn.DB().Where("status = ? AND expire_at IS NOT NULL AND expire_at < ? AND (next_sweep_at IS NULL OR next_sweep_at <= ?)",
+		PAYMENT_STATUS_PENDING, now, now).
+		Order("expire_at").Limit(limit).Find(&rs)
+	return rs
+}
+
+// PaymentSweepRetryWait 清理任务第n次没有处理完成后等待的时间，1分钟开始翻倍，最多6小时
+func PaymentSweepRetryWait(attempts int) time.Duration {
+	wait := paymentSweepFirstRetryWait
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= paymentSweepMaxRetryWait {
+			return paymentSweepMaxRetryWait
+		}
+	}
+	return wait
+}
+
+// DelaySweep 清理任务没有处理完成(查询失败、用户支付中等)，按PaymentSweepRetryWait推迟下次处理，
+// 一直处理不了的记录不会占住每一轮的批次
+func (r *PaymentRecord) DelaySweep(now time.Time) error {
+	attempts, next, err := delaySweep(&PaymentRecord{}, r.ID, r.SweepAttempts, now)
+	if err != nil {
+		return err
+	}
+	r.SweepAttempts, r.NextSweepAt = attempts, &next
+	return nil
+}
+
+// delaySweep 保存model(id)的sweep_attempts和next_sweep_at，支付记录和退款记录共用
+func delaySweep(model interface{}, id int64, attempts int, now time.Time) (int, time.Time, error) {
+	attempts++
+	next := now.Add(PaymentSweepRetryWait(attempts))
+	err := conn.DB().Model(model).Where("id = ?", id).Updates(map[string]interface{}{
+		"sweep_attempts": attempts,
+		"next_sweep_at":  next,
+	}).Error
+	return attempts, next, err
+}
+
+func FindPaymentRecordEvents(paymentRecordID int64) []PaymentRecordEvent {
+	var es []PaymentRecordEvent
+	conn.DB().Where("payment_record_id = ?", paymentRecordID).Order("id").Find(&es)
+	return es
+}
+
+// CreatePendingPaymentRecord 下单时创建待支付的记录
+// 同一个trans_no重复下单时，只有在仍为pending且金额、支付账号、店铺、是否分账一致时才返回已有的记录
+func CreatePendingPaymentRecord(r *PaymentRecord) (*PaymentRecord, error) {
+	if old, err := FindPaymentRecordByTransNo(r.TransNo); err == nil {
+		if !old.IsPending() {
+			return nil, fmt.Errorf("%w: trans_no already used, trans_no: %s, status: %s", ErrTransNoConflict, r.TransNo, old.Status)
+		}
+		if old.TotalFen() != r.TotalFen() || old.PaymentAccountID != r.PaymentAccountID || old.StoreID != r.StoreID ||
+			old.ProfitSharing != r.ProfitSharing {
+			return nil, fmt.Errorf("%w: trans_no already used with different params, trans_no: %s", ErrTransNoConflict, r.TransNo)
+		}
+		return old, nil
+	}
+
+	r.Status = PAYMENT_STATUS_PENDING
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(r).Error; err != nil {
+			return transNoConflictError(err, r.TransNo)
+		}
+		return tx.Create(&PaymentRecordEvent{
+			PaymentRecordID: r.ID,
+			ToStatus:        PAYMENT_STATUS_PENDING,
+			Source:          "create",
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordOrderEvent(r.PaymentAccountID, r.StoreID, ORDER_EVENT_CREATED, r.TotalFen())
+	return r, nil
+}
+
+// transNoConflictError 并发下单时trans_no的唯一索引冲突也返回ErrTransNoConflict
+func transNoConflictError(err error, transNo string) error {
+	var e *mysql.MySQLError
+	if errors.As(err, &e) && e.Number == mysqlErrDuplicateEntry {
+		return fmt.Errorf("%w: trans_no already used, trans_no: %s", ErrTransNoConflict, transNo)
+	}
+	return err
+}
+
+func (r *PaymentRecord) IsPending() bool {
+	return r.Status.normalize() == PAYMENT_STATUS_PENDING
+}
+
+// CanRefund 支付成功后才能退款，退款中也可以继续发起部分退款
+func (r *PaymentRecord) CanRefund() bool {
+	switch r.Status {
+	case PAYMENT_STATUS_SUCCESS, PAYMENT_STATUS_REFUNDING, PAYMENT_STATUS_PARTIALLY_REFUNDED:
+		return true
+	}
+	return false
+}
+
+// IsPaid 支付成功过，包括之后退款的
+func (r *PaymentRecord) IsPaid() bool {
+	return r.CanRefund() || r.Status == PAYMENT_STATUS_REFUNDED
+}
+
+// TotalFen 订单金额，单位为分
+func (r *PaymentRecord) TotalFen() int64 {
+	return YuanToFen(r.TotalMoney)
+}
+
+// TransitTo 按状态机修改状态并记录历史，fields为需要同时更新的字段，ds为需要发送的通知，在同一个事务中保存
+// 状态没有变化时只更新fields，不记录历史
+func (r *PaymentRecord) TransitTo(to PaymentStatus, source, detail string, fields map[string]interface{}, ds ...*WebhookDelivery) error {
+	from := r.Status
+	if from.normalize() == to {
+		if len(fields) == 0 && len(ds) == 0 {
+			return nil
+		}
+		return conn.DB().Transaction(func(tx *gorm.DB) error {
+			if len(fields) > 0 {
+				if err := tx.Model(r).Updates(fields).Error; err != nil {
+					return err
+				}
+			}
+			return createWebhookDeliveries(tx, ds)
+		})
+	}
+	if !from.CanTransitTo(to) {
+		return fmt.Errorf("%w: %s -> %s, trans_no: %s", ErrInvalidStatusTransition, from, to, r.TransNo)
+	}
+
+	updates := map[string]interface{}{"status": to}
+	for k, v := range fields {
+		updates[k] = v
+	}
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		// 带上原状态做条件，防止并发修改
+		res := tx.Model(&PaymentRecord{}).Where("id = ? AND status = ?", r.ID, from).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w: status changed concurrently, trans_no: %s", ErrInvalidStatusTransition, r.TransNo)
+		}
+		err := tx.Create(&PaymentRecordEvent{
+			PaymentRecordID: r.ID,
+			FromStatus:      from,
+			ToStatus:        to,
+			Source:          source,
+			Detail:          detail,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return createWebhookDeliveries(tx, ds)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.Status = to
+	switch {
+	case to == PAYMENT_STATUS_SUCCESS && from.normalize() == PAYMENT_STATUS_PENDING:
+		recordOrderEvent(r.PaymentAccountID, r.StoreID, ORDER_EVENT_PAID, r.TotalFen())
+	case to == PAYMENT_STATUS_CLOSED:
+		recordOrderEvent(r.PaymentAccountID, r.StoreID, ORDER_EVENT_CLOSED, r.TotalFen())
+	}
+	l().Infof("payment record status changed, trans_no: %s, %s -> %s, source: %s", r.TransNo, from, to, source)
+	return nil
+}
+
+// UpdatePayResult 保存第三方通知或查询的支付结果，state为第三方的原始状态，ds见TransitTo
+func (r *PaymentRecord) UpdatePayResult(to PaymentStatus, source, state, payNo, rsp string, ds ...*WebhookDelivery) error {
+	fields := map[string]interface{}{"payment_response": rsp}
+	if len(payNo) > 0 {
+		fields["pay_no"] = payNo
+	}
+	if err := r.TransitTo(to, source, state, fields, ds...); err != nil {
+		return err
+	}
+	if len(payNo) > 0 {
+		r.PayNo = payNo
+	}
+	r.PaymentResponse = rsp
+	return nil
 }
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentStatusTransitions(t *testing.T) {
+	assert.True(t, PAYMENT_STATUS_PENDING.CanTransitTo(PAYMENT_STATUS_SUCCESS))
+	assert.True(t, PaymentStatus("").CanTransitTo(PAYMENT_STATUS_CLOSED))
+	assert.True(t, PAYMENT_STATUS_SUCCESS.CanTransitTo(PAYMENT_STATUS_REFUNDING))
+	assert.True(t, PAYMENT_STATUS_REFUNDING.CanTransitTo(PAYMENT_STATUS_PARTIALLY_REFUNDED))
+	assert.True(t, PAYMENT_STATUS_PARTIALLY_REFUNDED.CanTransitTo(PAYMENT_STATUS_REFUNDING))
+
+	assert.False(t, PAYMENT_STATUS_PENDING.CanTransitTo(PAYMENT_STATUS_REFUNDED))
+	assert.False(t, PAYMENT_STATUS_CLOSED.CanTransitTo(PAYMENT_STATUS_SUCCESS))
+	assert.False(t, PAYMENT_STATUS_SUCCESS.CanTransitTo(PAYMENT_STATUS_PENDING))
+	assert.False(t, PAYMENT_STATUS_REFUNDED.CanTransitTo(PAYMENT_STATUS_REFUNDING))
+}
+
+func TestWechatTradeStateToStatus(t *testing.T) {
+	for state, expected := range map[string]PaymentStatus{
+		"SUCCESS":  PAYMENT_STATUS_SUCCESS,
+		"CLOSED":   PAYMENT_STATUS_CLOSED,
+		"REVOKED":  PAYMENT_STATUS_CLOSED,
+		"PAYERROR": PAYMENT_STATUS_FAILED,
+		"NOTPAY":   PAYMENT_STATUS_PENDING,
+	} {
+		s, ok := WechatTradeStateToStatus(state)
+		assert.True(t, ok)
+		assert.Equal(t, expected, s)
+	}
+	_, ok := WechatTradeStateToStatus("REFUND")
+	assert.False(t, ok)
+}
+
+func TestTransNoConflictError(t *testing.T) {
+	err := transNoConflictError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, "t1")
+	assert.True(t, errors.Is(err, ErrTransNoConflict))
+	other := errors.New("other")
+	assert.Equal(t, other, transNoConflictError(other, "t1"))
+}
+
+func TestPaymentSweepRetryWait(t *testing.T) {
+	assert.Equal(t, time.Minute, PaymentSweepRetryWait(1))
+	assert.Equal(t, 2*time.Minute, PaymentSweepRetryWait(2))
+	assert.Equal(t, 256*time.Minute, PaymentSweepRetryWait(9))
+	assert.Equal(t, 6*time.Hour, PaymentSweepRetryWait(10))
+	assert.Equal(t, 6*time.Hour, PaymentSweepRetryWait(100))
+}
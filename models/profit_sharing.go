@@ -0,0 +1,318 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go-gin-payment/conn"
+
+	"gorm.io/gorm"
+)
+
+//
+// 微信服务商分账，下单时需要指定profit_sharing，支付成功后资金冻结，分账或者解冻后子商户才能使用
+// 所有分账单、分账结果和分账回退都关联到原来的PaymentRecord
+//
+
+// 分账单状态，和微信的state一一对应(小写)
+// closed是我们自己的状态，微信明确拒绝(4xx)的分账单不会再处理，不占用可分账的金额
+const (
+	PROFIT_SHARING_STATUS_PROCESSING = "processing"
+	PROFIT_SHARING_STATUS_FINISHED   = "finished"
+	PROFIT_SHARING_STATUS_CLOSED     = "closed"
+)
+
+// 每个接收方的分账结果，和微信的result一一对应(小写)
+const (
+	PROFIT_SHARING_RESULT_PENDING = "pending"
+	PROFIT_SHARING_RESULT_SUCCESS = "success"
+	PROFIT_SHARING_RESULT_CLOSED  = "closed"
+)
+
+// 分账回退结果，和微信的result一一对应(小写)
+const (
+	PROFIT_SHARING_RETURN_PROCESSING = "processing"
+	PROFIT_SHARING_RETURN_SUCCESS    = "success"
+	PROFIT_SHARING_RETURN_FAILED     = "failed"
+)
+
+// ProfitSharingReceiver 子商户(店铺)的分账接收方，需要先添加到微信才能分账
+type ProfitSharingReceiver struct {
+	BaseModel
+	PaymentAccountID int64  `gorm:"column:payment_account_id" json:"payment_account_id"`
+	StoreID          int64  `gorm:"column:store_id;uniqueIndex:idx_profit_sharing_receiver" json:"store_id"`
+	Type             string `gorm:"column:type;uniqueIndex:idx_profit_sharing_receiver;size:32" json:"type"` // MERCHANT_ID|PERSONAL_OPENID
+	Account          string `gorm:"column:account;uniqueIndex:idx_profit_sharing_receiver;size:64" json:"account"`
+	Name             string `gorm:"column:name" json:"name"`
+	RelationType     string `gorm:"column:relation_type" json:"relation_type"`
+	CustomRelation   string `gorm:"column:custom_relation" json:"custom_relation"`
+}
+
+// ProfitSharingOrder 分账单，解冻剩余资金也是一个分账单(Unfreeze为true，没有接收方)
+type ProfitSharingOrder struct {
+	BaseModel
+	PaymentRecordID  int64  `gorm:"column:payment_record_id;index" json:"payment_record_id"`
+	PaymentAccountID int64  `gorm:"column:payment_account_id" json:"payment_account_id"`
+	StoreID          int64  `gorm:"column:store_id" json:"store_id"`
+	TransNo          string `gorm:"column:trans_no" json:"trans_no"`
+	OutOrderNo       string `gorm:"column:out_order_no;uniqueIndex;size:64" json:"out_order_no"` // 我们自己的分账单号
+	OrderID          string `gorm:"column:order_id" json:"order_id"`                             // 微信分账单号
+	TransactionID    string `gorm:"column:transaction_id" json:"transaction_id"`
+	Status           string `gorm:"column:status" json:"status"`
+	Unfreeze         bool   `gorm:"column:unfreeze" json:"unfreeze"`
+	UnfreezeUnsplit  bool   `gorm:"column:unfreeze_unsplit" json:"unfreeze_unsplit"`
+	Response         string `gorm:"column:response;type:text" json:"-"`
+}
+
+// ProfitSharingDetail 分账单中每个接收方的分账结果
+type ProfitSharingDetail struct {
+	BaseModel
+	ProfitSharingOrderID int64   `gorm:"column:profit_sharing_order_id;index" json:"profit_sharing_order_id"`
+	PaymentRecordID      int64   `gorm:"column:payment_record_id;index" json:"payment_record_id"`
+	Type                 string  `gorm:"column:type" json:"type"`
+	Account              string  `gorm:"column:account" json:"account"`
+	Money                float64 `gorm:"column:money" json:"money"`
+	Description          string  `gorm:"column:description" json:"description"`
+	DetailID             string  `gorm:"column:detail_id" json:"detail_id"` // 微信分账明细单号
+	Result               string  `gorm:"column:result" json:"result"`
+	FailReason           string  `gorm:"column:fail_reason" json:"fail_reason"`
+	FinishTime           string  `gorm:"column:finish_time" json:"finish_time"`
+}
+
+// ProfitSharingReturn 分账回退，把已经分给接收方(只支持商户)的资金退回子商户
+type ProfitSharingReturn struct {
+	BaseModel
+	PaymentRecordID      int64   `gorm:"column:payment_record_id;index" json:"payment_record_id"`
+	ProfitSharingOrderID int64   `gorm:"column:profit_sharing_order_id;index" json:"profit_sharing_order_id"`
+	OutOrderNo           string  `gorm:"column:out_order_no" json:"out_order_no"`
+	OutReturnNo          string  `gorm:"column:out_return_no;uniqueIndex;size:64" json:"out_return_no"`
+	ReturnID             string  `gorm:"column:return_id" json:"return_id"` // 微信回退单号
+	ReturnMchID          string  `gorm:"column:return_mchid" json:"return_mchid"`
+	Money                float64 `gorm:"column:money" json:"money"`
+	Description          string  `gorm:"column:description" json:"description"`
+	Result               string  `gorm:"column:result" json:"result"`
+	FailReason           string  `gorm:"column:fail_reason" json:"fail_reason"`
+	Response             string  `gorm:"column:response;type:text" json:"-"`
+}
+
+func CreateProfitSharingReceiver(r *ProfitSharingReceiver) error {
+	var old ProfitSharingReceiver
+	conn.DB().Where("store_id = ? AND type = ? AND account = ?", r.StoreID, r.Type, r.Account).First(&old)
+	if old.Exists() {
+		r.ID = old.ID
+		r.CreatedAt = old.CreatedAt
+		return conn.DB().Save(r).Error
+	}
+	return conn.DB().Create(r).Error
+}
+
+func FindProfitSharingReceiver(id int64) (*ProfitSharingReceiver, error) {
+	var r ProfitSharingReceiver
+	conn.DB().First(&r, "id = ?", id)
+	if !r.Exists() {
+		return nil, fmt.Errorf("not found profit sharing receiver, id: %d", id)
+	}
+	return &r, nil
+}
+
+func FindProfitSharingReceivers(storeID int64) []ProfitSharingReceiver {
+	var rs []ProfitSharingReceiver
+	conn.DB().Where("store_id = ?", storeID).Order("id").Find(&rs)
+	return rs
+}
+
+func (r *ProfitSharingReceiver) Delete() error {
+	return conn.DB().Delete(r).Error
+}
+
+func FindProfitSharingOrder(outOrderNo string) (*ProfitSharingOrder, error) {
+	var o ProfitSharingOrder
+	conn.DB().First(&o, "out_order_no = ?", outOrderNo)
+	if !o.Exists() {
+		return nil, errors.New("not found profit sharing order, out_order_no: " + outOrderNo)
+	}
+	return &o, nil
+}
+
+func FindProfitSharingOrders(paymentRecordID int64) []ProfitSharingOrder {
+	var os []ProfitSharingOrder
+	conn.DB().Where("payment_record_id = ?", paymentRecordID).Order("id").Find(&os)
+	return os
+}
+
+func FindProfitSharingDetails(profitSharingOrderID int64) []ProfitSharingDetail {
+	var ds []ProfitSharingDetail
+	conn.DB().Where("profit_sharing_order_id = ?", profitSharingOrderID).Order("id").Find(&ds)
+	return ds
+}
+
+func FindProfitSharingReturn(outReturnNo string) (*ProfitSharingReturn, error) {
+	var r ProfitSharingReturn
+	conn.DB().First(&r, "out_return_no = ?", outReturnNo)
+	if !r.Exists() {
+		return nil, errors.New("not found profit sharing return, out_return_no: " + outReturnNo)
+	}
+	return &r, nil
+}
+
+func FindProfitSharingReturns(paymentRecordID int64) []ProfitSharingReturn {
+	var rs []ProfitSharingReturn
+	conn.DB().Where("payment_record_id = ?", paymentRecordID).Order("id").Find(&rs)
+	return rs
+}
+
+// CreateProfitSharingOrder 调用微信前保存分账单和每个接收方，out_order_no不能重复
+// 已经保存过的由调用方先用FindProfitSharingOrder检查并重试
+func CreateProfitSharingOrder(o *ProfitSharingOrder, details []ProfitSharingDetail) error {
+	if _, err := FindProfitSharingOrder(o.OutOrderNo); err == nil {
+		return fmt.Errorf("out_order_no already used: %s", o.OutOrderNo)
+	}
+	o.Status = PROFIT_SHARING_STATUS_PROCESSING
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(o).Error; err != nil {
+			return err
+		}
+		for i := range details {
+			details[i].ProfitSharingOrderID = o.ID
+			details[i].PaymentRecordID = o.PaymentRecordID
+			details[i].Result = PROFIT_SHARING_RESULT_PENDING
+			if err := tx.Create(&details[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ProfitSharingReceiverResult 微信返回的接收方分账结果
+type ProfitSharingReceiverResult struct {
+	Type       string
+	Account    string
+	Money      float64
+	DetailID   string
+	Result     string
+	FailReason string
+	FinishTime string
+}
+
+// UpdateResult 保存微信返回的分账单状态，参数为空的不更新，receivers为空时只更新分账单
+// 解冻时微信会返回一个解冻给子商户的接收方，没有保存过的接收方会新增
+// 动账通知没有分账单的state，所有接收方都有结果后改为finished
+// notify不为nil时用更新后的分账单和接收方生成通知，和结果在同一个事务中保存
+func (o *ProfitSharingOrder) UpdateResult(orderID, state, rsp string, receivers []ProfitSharingReceiverResult,
+	notify func(o *ProfitSharingOrder, details []ProfitSharingDetail) []*WebhookDelivery) error {
+	finished := false
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{}
+		if len(rsp) > 0 {
+			updates["response"] = rsp
+		}
+		if len(orderID) > 0 {
+			updates["order_id"] = orderID
+		}
+		if len(state) > 0 {
+			updates["status"] = strings.ToLower(state)
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(o).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		for _, r := range receivers {
+			var d ProfitSharingDetail
+			tx.Where("profit_sharing_order_id = ? AND type = ? AND account = ?", o.ID, r.Type, r.Account).First(&d)
+			if !d.Exists() {
+				d = ProfitSharingDetail{
+					ProfitSharingOrderID: o.ID,
+					PaymentRecordID:      o.PaymentRecordID,
+					Type:                 r.Type,
+					Account:              r.Account,
+					Money:                r.Money,
+				}
+			}
+			if len(r.DetailID) > 0 {
+				d.DetailID = r.DetailID
+			}
+			d.Result = strings.ToLower(r.Result)
+			d.FailReason = r.FailReason
+			d.FinishTime = r.FinishTime
+			if err := tx.Save(&d).Error; err != nil {
+				return err
+			}
+		}
+		if len(state) == 0 && len(receivers) > 0 && o.Status == PROFIT_SHARING_STATUS_PROCESSING {
+			var pending int64
+			tx.Model(&ProfitSharingDetail{}).Where("profit_sharing_order_id = ? AND result = ?", o.ID, PROFIT_SHARING_RESULT_PENDING).Count(&pending)
+			if pending == 0 {
+				finished = true
+				if err := tx.Model(o).Update("status", PROFIT_SHARING_STATUS_FINISHED).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if notify == nil {
+			return nil
+		}
+		var cur ProfitSharingOrder
+		if err := tx.First(&cur, "id = ?", o.ID).Error; err != nil {
+			return err
+		}
+		var details []ProfitSharingDetail
+		if err := tx.Where("profit_sharing_order_id = ?", o.ID).Order("id").Find(&details).Error; err != nil {
+			return err
+		}
+		return createWebhookDeliveries(tx, notify(&cur, details))
+	})
+	if err == nil && finished {
+		o.Status = PROFIT_SHARING_STATUS_FINISHED
+	}
+	return err
+}
+
+// Close 微信明确拒绝的分账单改为closed，还没有结果的接收方也改为closed，reason为微信返回的错误
+func (o *ProfitSharingOrder) Close(reason string) error {
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(o).Updates(map[string]interface{}{"status": PROFIT_SHARING_STATUS_CLOSED, "response": reason}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&ProfitSharingDetail{}).
+			Where("profit_sharing_order_id = ? AND result = ?", o.ID, PROFIT_SHARING_RESULT_PENDING).
+			Updates(map[string]interface{}{"result": PROFIT_SHARING_RESULT_CLOSED, "fail_reason": reason}).Error
+	})
+}
+
+// ProfitSharedFen 分账单中已经分出或者正在分的金额，单位为分，解冻的部分不算
+func ProfitSharedFen(paymentRecordID int64) int64 {
+	var ds []ProfitSharingDetail
+	conn.DB().Joins("JOIN profit_sharing_orders ON profit_sharing_orders.id = profit_sharing_details.profit_sharing_order_id").
+		Where("profit_sharing_details.payment_record_id = ? AND profit_sharing_orders.unfreeze = ? AND profit_sharing_details.result IN ?",
+			paymentRecordID, false, []string{PROFIT_SHARING_RESULT_PENDING, PROFIT_SHARING_RESULT_SUCCESS}).
+		Find(&ds)
+	var total int64
+	for _, d := range ds {
+		total += YuanToFen(d.Money)
+	}
+	return total
+}
+
+func CreateProfitSharingReturn(r *ProfitSharingReturn) error {
+	if _, err := FindProfitSharingReturn(r.OutReturnNo); err == nil {
+		return fmt.Errorf("out_return_no already used: %s", r.OutReturnNo)
+	}
+	r.Result = PROFIT_SHARING_RETURN_PROCESSING
+	return conn.DB().Create(r).Error
+}
+
+func (r *ProfitSharingReturn) UpdateResult(returnID, result, failReason, rsp string) error {
+	updates := map[string]interface{}{
+		"result":      strings.ToLower(result),
+		"fail_reason": failReason,
+		"response":    rsp,
+	}
+	if len(returnID) > 0 {
+		updates["return_id"] = returnID
+	}
+	return conn.DB().Model(r).Updates(updates).Error
+}
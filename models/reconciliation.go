@@ -0,0 +1,196 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go-gin-payment/conn"
+
+	"gorm.io/gorm"
+)
+
+//
+// 微信账单对账，每个支付账号每天一条Reconciliation，差异保存为ReconciliationItem
+// 重新对账时会删除之前的差异
+//
+
+const (
+	RECONCILIATION_STATUS_RUNNING = "running"
+	RECONCILIATION_STATUS_DONE    = "done"
+	RECONCILIATION_STATUS_FAILED  = "failed"
+)
+
+// 差异类型
+const (
+	RECONCILE_MISSING_IN_OURS   = "missing_in_ours"   // 账单中有，我们没有记录
+	RECONCILE_MISSING_IN_WECHAT = "missing_in_wechat" // 我们记录为已支付或者已退款，账单中没有
+	RECONCILE_AMOUNT_MISMATCH   = "amount_mismatch"
+	RECONCILE_STATUS_MISMATCH   = "status_mismatch"
+)
+
+// 差异对应的单据
+const (
+	RECONCILE_KIND_PAYMENT = "payment"
+	RECONCILE_KIND_REFUND  = "refund"
+)
+
+// reconciliationRunningTimeout 超过这个时间仍为running的对账视为已经中断，可以重新执行
+const reconciliationRunningTimeout = 30 * time.Minute
+
+type Reconciliation struct {
+	BaseModel
+	PaymentAccountID int64      `gorm:"column:payment_account_id;uniqueIndex:idx_reconciliation" json:"payment_account_id"`
+	BillDate         string     `gorm:"column:bill_date;uniqueIndex:idx_reconciliation;size:10" json:"bill_date"` // 2006-01-02，中国时区
+	Status           string     `gorm:"column:status" json:"status"`
+	Error            string     `gorm:"column:error;type:text" json:"error"`
+	TradeCount       int        `gorm:"column:trade_count" json:"trade_count"` // 交易账单中支付成功的笔数
+	TradeMoney       float64    `gorm:"column:trade_money" json:"trade_money"`
+	RefundCount      int        `gorm:"column:refund_count" json:"refund_count"`
+	RefundMoney      float64    `gorm:"column:refund_money" json:"refund_money"`
+	FundFlowCount    int        `gorm:"column:fund_flow_count" json:"fund_flow_count"` // 资金账单的流水笔数
+	FundFlowIncome   float64    `gorm:"column:fund_flow_income" json:"fund_flow_income"`
+	FundFlowExpense  float64    `gorm:"column:fund_flow_expense" json:"fund_flow_expense"`
+	OurTradeCount    int        `gorm:"column:our_trade_count" json:"our_trade_count"` // 我们记录的当天支付成功的笔数
+	OurTradeMoney    float64    `gorm:"column:our_trade_money" json:"our_trade_money"`
+	MismatchCount    int        `gorm:"column:mismatch_count" json:"mismatch_count"`
+	FinishedAt       *time.Time `gorm:"column:finished_at" json:"finished_at"`
+}
+
+type ReconciliationItem struct {
+	BaseModel
+	ReconciliationID int64   `gorm:"column:reconciliation_id;index" json:"reconciliation_id"`
+	Kind             string  `gorm:"column:kind" json:"kind"`
+	Type             string  `gorm:"column:type" json:"type"`
+	TransNo          string  `gorm:"column:trans_no" json:"trans_no"`
+	RefundNo         string  `gorm:"column:refund_no" json:"refund_no"`
+	PayNo            string  `gorm:"column:pay_no" json:"pay_no"` // 微信订单号或者微信退款单号
+	OurMoney         float64 `gorm:"column:our_money" json:"our_money"`
+	BillMoney        float64 `gorm:"column:bill_money" json:"bill_money"`
+	OurStatus        string  `gorm:"column:our_status" json:"our_status"`
+	BillStatus       string  `gorm:"column:bill_status" json:"bill_status"`
+}
+
+func FindReconciliation(id int64) (*Reconciliation, error) {
+	var r Reconciliation
+	conn.DB().First(&r, "id = ?", id)
+	if !r.Exists() {
+		return nil, fmt.Errorf("not found reconciliation, id: %d", id)
+	}
+	return &r, nil
+}
+
+func FindReconciliationByDate(paymentAccountID int64, billDate string) (*Reconciliation, error) {
+	var r Reconciliation
+	conn.DB().First(&r, "payment_account_id = ? AND bill_date = ?", paymentAccountID, billDate)
+	if !r.Exists() {
+		return nil, fmt.Errorf("not found reconciliation, payment account: %d, bill_date: %s", paymentAccountID, billDate)
+	}
+	return &r, nil
+}
+
+// FindReconciliations 参数为空时不过滤，按账单日期倒序
+func FindReconciliations(billDate string, paymentAccountID int64, limit int) []Reconciliation {
+	var rs []Reconciliation
+	q := conn.DB().Order("bill_date DESC, payment_account_id")
+	if len(billDate) > 0 {
+		q = q.Where("bill_date = ?", billDate)
+	}
+	if paymentAccountID > 0 {
+		q = q.Where("payment_account_id = ?", paymentAccountID)
+	}
+	q.Limit(limit).Find(&rs)
+	return rs
+}
+
+func FindReconciliationItems(reconciliationID int64) []ReconciliationItem {
+	var items []ReconciliationItem
+	conn.DB().Where("reconciliation_id = ?", reconciliationID).Order("id").Find(&items)
+	return items
+}
+
+// StartReconciliation 开始对账，已经有记录时重置为running，正在执行的对账不能重复开始
+func StartReconciliation(paymentAccountID int64, billDate string, now time.Time) (*Reconciliation, error) {
+	var r Reconciliation
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		tx.First(&r, "payment_account_id = ? AND bill_date = ?", paymentAccountID, billDate)
+		if r.Exists() && r.Status == RECONCILIATION_STATUS_RUNNING && now.Sub(r.UpdatedAt) < reconciliationRunningTimeout {
+			return fmt.Errorf("reconciliation is running, payment account: %d, bill_date: %s", paymentAccountID, billDate)
+		}
+		if r.Exists() {
+			if err := tx.Where("reconciliation_id = ?", r.ID).Delete(&ReconciliationItem{}).Error; err != nil {
+				return err
+			}
+		}
+		id, createdAt := r.ID, r.CreatedAt
+		r = Reconciliation{
+			PaymentAccountID: paymentAccountID,
+			BillDate:         billDate,
+			Status:           RECONCILIATION_STATUS_RUNNING,
+		}
+		r.ID, r.CreatedAt = id, createdAt
+		return tx.Save(&r).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Finish 保存统计和差异，r中的统计字段由调用方填写
+func (r *Reconciliation) Finish(items []ReconciliationItem, now time.Time) error {
+	r.Status = RECONCILIATION_STATUS_DONE
+	r.Error = ""
+	r.MismatchCount = len(items)
+	r.FinishedAt = &now
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		for i := range items {
+			items[i].ReconciliationID = r.ID
+			if err := tx.Create(&items[i]).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(r).Error
+	})
+}
+
+func (r *Reconciliation) Fail(err error, now time.Time) error {
+	r.Status = RECONCILIATION_STATUS_FAILED
+	r.Error = err.Error()
+	r.FinishedAt = &now
+	return conn.DB().Save(r).Error
+}
+
+// FindPaidPaymentRecords 在[from, to)内变为success的支付记录，之后退款的也包括在内
+func FindPaidPaymentRecords(paymentAccountID int64, from, to time.Time) []PaymentRecord {
+	var rs []PaymentRecord
+	conn.DB().Where("payment_account_id = ? AND id IN (?)", paymentAccountID,
+		conn.DB().Model(&PaymentRecordEvent{}).Select("payment_record_id").
+			Where("to_status = ? AND created_at >= ? AND created_at < ?", PAYMENT_STATUS_SUCCESS, from, to)).
+		Order("id").Find(&rs)
+	return rs
+}
+
+// FindSuccessRefundRecords 退款成功并且在[from, to)内更新过的退款记录，对账时再按微信返回的退款成功时间过滤
+func FindSuccessRefundRecords(paymentAccountID int64, from, to time.Time) []RefundRecord {
+	var rs []RefundRecord
+	conn.DB().Where("payment_account_id = ? AND status = ? AND updated_at >= ? AND updated_at < ?",
+		paymentAccountID, REFUND_STATUS_SUCCESS, from, to).Order("id").Find(&rs)
+	return rs
+}
+
+// PaidAt 变为success的时间，没有支付成功时返回零值
+func (r *PaymentRecord) PaidAt() time.Time {
+	var e PaymentRecordEvent
+	conn.DB().Where("payment_record_id = ? AND to_status = ?", r.ID, PAYMENT_STATUS_SUCCESS).Order("id").First(&e)
+	return e.CreatedAt
+}
+
+// FindWechatSubMerchantStores 服务商账号下绑定的店铺和有支付记录的店铺，下载子商户的账单时使用
+func FindWechatSubMerchantStores(paymentAccountID int64) []Store {
+	var ss []Store
+	conn.DB().Where("wechat_payment_mer_id <> '' AND (id IN (?) OR id IN (?))",
+		conn.DB().Model(&StorePaymentAccount{}).Select("store_id").Where("payment_account_id = ?", paymentAccountID),
+		conn.DB().Model(&PaymentRecord{}).Select("DISTINCT store_id").Where("payment_account_id = ?", paymentAccountID)).
+		Order("id").Find(&ss)
+	return ss
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-gin-payment/conn"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 退款状态，和微信退款状态一一对应(小写)，支付宝退款是同步的，只有success和abnormal
+const (
+	REFUND_STATUS_PROCESSING = "processing"
+	REFUND_STATUS_SUCCESS    = "success"
+	REFUND_STATUS_CLOSED     = "closed"
+	REFUND_STATUS_ABNORMAL   = "abnormal"
+)
+
+// RefundRecord 退款记录，一个PaymentRecord可以对应多次(部分)退款
+type RefundRecord struct {
+	BaseModel
+	PaymentRecordID  int64   `gorm:"column:payment_record_id" json:"payment_record_id"`
+	PaymentAccountID int64   `gorm:"column:payment_account_id" json:"payment_account_id"`
+	StoreID          int64   `gorm:"column:store_id" json:"store_id"`
+	TransNo          string  `gorm:"column:trans_no" json:"trans_no"`
+	RefundNo         string  `gorm:"column:refund_no;uniqueIndex;size:64" json:"refund_no"` // 我们自己的退款号
+	RefundPayNo      string  `gorm:"column:refund_pay_no" json:"refund_pay_no"`             // 第三方退款单号
+	RefundMoney      float64 `gorm:"column:refund_money" json:"refund_money"`
+	Reason           string  `gorm:"column:reason" json:"reason"`
+	Status           string  `gorm:"column:status" json:"status"`
+	RefundResponse   string  `gorm:"column:refund_response;type:text" json:"-"`
+	AddiNotifyURL    string  `gorm:"column:addi_notify_url" json:"addi_notify_url"`
+
+	SweepAttempts int        `gorm:"column:sweep_attempts" json:"sweep_attempts"` // 清理任务查询后仍然没有最终结果的次数
+	NextSweepAt   *time.Time `gorm:"column:next_sweep_at" json:"next_sweep_at"`   // 清理任务下次查询的时间，为空表示到了refundQueryDelay就查询
+}
+
+var ErrRefundExceeded = errors.New("refund amount exceeds the refundable amount")
+
+// ErrRefundNoConflict refund_no已经使用过
+var ErrRefundNoConflict = errors.New("refund_no already exists")
+
+// CreateRefundRecord 锁住支付记录后检查所有退款之和不超过totalFen再创建，并发的部分退款不会超过订单金额
+// refund_no重复由唯一索引保证，返回ErrRefundNoConflict
+func CreateRefundRecord(r *RefundRecord, totalFen int64) error {
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		var rec PaymentRecord
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&rec, "id = ?", r.PaymentRecordID)
+		if !rec.Exists() {
+			return fmt.Errorf("not found payment record with id: %d", r.PaymentRecordID)
+		}
+		remain := totalFen - refundedFen(tx, r.PaymentRecordID)
+		if fen := YuanToFen(r.RefundMoney); fen > remain {
+			return fmt.Errorf("%w, refund_price: %d, refundable: %d", ErrRefundExceeded, fen, remain)
+		}
+		if err := tx.Create(r).Error; err != nil {
+			var e *mysql.MySQLError
+			if errors.As(err, &e) && e.Number == mysqlErrDuplicateEntry {
+				return fmt.Errorf("%w: %s", ErrRefundNoConflict, r.RefundNo)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func FindRefundRecordByRefundNo(refundNo string) (*RefundRecord, error) {
+	var r RefundRecord
+	conn.DB().First(&r, "refund_no = ?", refundNo)
+	if !r.Exists() {
+		return nil, errors.New("not found refund record, refund_no: " + refundNo)
+	}
+	return &r, nil
+}
+
+// FindProcessingRefundRecords accountType渠道的退款中、创建时间早于before并且到了next_sweep_at的记录
+func FindProcessingRefundRecords(accountType string, before, now time.Time, limit int) []RefundRecord {
+	var rs []RefundRecord
+	conn.DB().Where("status = ? AND created_at < ? AND (next_sweep_at IS NULL OR next_sweep_at <= ?) AND payment_account_id IN (?)",
+		REFUND_STATUS_PROCESSING, before, now,
+		conn.DB().Model(&PaymentAccount{}).Select("id").Where("account_type = ?", accountType)).
+		Order("id").Limit(limit).Find(&rs)
+	return rs
+}
+
+// DelaySweep 查询失败或者仍在处理的退款按PaymentSweepRetryWait推迟下次查询，不会占住每一轮的批次
+func (r *RefundRecord) DelaySweep(now time.Time) error {
+	attempts, next, err := delaySweep(&RefundRecord{}, r.ID, r.SweepAttempts, now)
+	if err != nil {
+		return err
+	}
+	r.SweepAttempts, r.NextSweepAt = attempts, &next
+	return nil
+}
+
+// RefundedFen 已退款或正在退款中的金额总和，单位为分
+func RefundedFen(paymentRecordID int64) int64 {
+	return refundedFen(conn.DB(), paymentRecordID)
+}
+
+func refundedFen(db *gorm.DB, paymentRecordID int64) int64 {
+	var rs []RefundRecord
+	db.Where("payment_record_id = ? AND status IN ?", paymentRecordID,
+		[]string{REFUND_STATUS_PROCESSING, REFUND_STATUS_SUCCESS}).Find(&rs)
+
+	var total int64
+	for _, r := range rs {
+		total += YuanToFen(r.RefundMoney)
+	}
+	return total
+}
+
+// SyncRefundStatus 根据所有退款记录重新计算支付记录的退款状态
+func (r *PaymentRecord) SyncRefundStatus(source string) error {
+	var rs []RefundRecord
+	conn.DB().Where("payment_record_id = ?", r.ID).Find(&rs)
+
+	var processing int
+	var refunded int64
+	for _, v := range rs {
+		switch v.Status {
+		case REFUND_STATUS_PROCESSING:
+			processing++
+		case REFUND_STATUS_SUCCESS:
+			refunded += YuanToFen(v.RefundMoney)
+		}
+	}
+
+	to := PAYMENT_STATUS_SUCCESS
+	switch {
+	case processing > 0:
+		to = PAYMENT_STATUS_REFUNDING
+	case refunded >= r.TotalFen():
+		to = PAYMENT_STATUS_REFUNDED
+	case refunded > 0:
+		to = PAYMENT_STATUS_PARTIALLY_REFUNDED
+	}
+	return r.TransitTo(to, source, fmt.Sprintf("refunded: %d, processing: %d", refunded, processing), nil)
+}
+
+func (r *RefundRecord) IsFinished() bool {
+	return r.Status == REFUND_STATUS_SUCCESS || r.Status == REFUND_STATUS_CLOSED
+}
+
+// UpdateRefundResult 用第三方返回的退款状态更新记录，状态统一转为小写
+// 只在记录的状态仍然是r.Status时更新，通知和补偿任务同时确认时只有一个生效；
+// 状态有变化时才保存通知ds(同一个事务)和记录退款的指标并返回true，记录已经被修改时重新加载r
+func (r *RefundRecord) UpdateRefundResult(refundID, status, rsp string, ds ...*WebhookDelivery) (bool, error) {
+	from := r.Status
+	to := strings.ToLower(status)
+	payNo := r.RefundPayNo
+	if len(refundID) > 0 {
+		payNo = refundID
+	}
+	var changed bool
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&RefundRecord{}).Where("id = ? AND status = ?", r.ID, from).Updates(map[string]interface{}{
+			"status":          to,
+			"refund_pay_no":   payNo,
+			"refund_response": rsp,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		changed = res.RowsAffected > 0 && from != to
+		if !changed {
+			return nil
+		}
+		return createWebhookDeliveries(tx, ds)
+	})
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		var cur RefundRecord
+		conn.DB().First(&cur, "id = ?", r.ID)
+		if cur.Exists() {
+			*r = cur
+		}
+		return false, nil
+	}
+	r.Status, r.RefundPayNo, r.RefundResponse = to, payNo, rsp
+	if to == REFUND_STATUS_SUCCESS {
+		recordOrderEvent(r.PaymentAccountID, r.StoreID, ORDER_EVENT_REFUNDED, YuanToFen(r.RefundMoney))
+	}
+	return true, nil
+}
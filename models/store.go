@@ -1,14 +1,34 @@
 package models
 
-import "go-gin-payment/conn"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"go-gin-payment/conn"
+
+	"gorm.io/gorm"
+)
 
 type Store struct {
 	BaseModel
 	Name               string `json:"name"`
-	WechatPaymentMerID string `gorm:"column:wechat_payment_mer_id" json:"wechat_payment_mer_id"`
+	WechatPaymentMerID string `gorm:"column:wechat_payment_mer_id" json:"wechat_payment_mer_id"` // 微信服务商模式的子商户号(sub_mchid)
 	UUID               string `gorm:"column:uuid" json:"uuid"`
 }
 
+// StorePaymentAccount 店铺可以使用的支付账号，每个渠道可以绑定多个，其中一个为默认账号
+//
+// 店铺绑定了某个渠道的账号后，下单时只能使用绑定的账号，没有绑定时不限制(兼容之前的数据)
+type StorePaymentAccount struct {
+	BaseModel
+	StoreID          int64  `gorm:"column:store_id;uniqueIndex:idx_store_payment_account" json:"store_id"`
+	PaymentAccountID int64  `gorm:"column:payment_account_id;uniqueIndex:idx_store_payment_account" json:"payment_account_id"`
+	AccountType      string `gorm:"column:account_type" json:"account_type"`
+	IsDefault        bool   `gorm:"column:is_default" json:"is_default"`
+}
+
 func IsStoreExists(uuid string) bool {
 	var s Store
 	conn.DB().First(&s, "uuid = ?", uuid)
@@ -23,3 +43,172 @@ func FindStoreWithOnlyMerID(id interface{}) (*Store, bool) {
 	}
 	return nil, false
 }
+
+func FindStore(id interface{}) (*Store, error) {
+	var s Store
+	conn.DB().First(&s, "id = ?", id)
+	if !s.Exists() {
+		return nil, fmt.Errorf("not found store with id: %v", id)
+	}
+	return &s, nil
+}
+
+func FindStores() []Store {
+	var ss []Store
+	conn.DB().Order("id").Find(&ss)
+	return ss
+}
+
+// FindWechatSubMerchantStore 微信服务商账号下单、查询、关单和退款都需要店铺的子商户号
+func FindWechatSubMerchantStore(storeID interface{}, pa *PaymentAccount) (*Store, error) {
+	store, ok := FindStoreWithOnlyMerID(storeID)
+	if !ok {
+		return nil, fmt.Errorf("not found store with id: %v, wechat service provider payment account %d requires a store", storeID, pa.ID)
+	}
+	if len(store.WechatPaymentMerID) == 0 {
+		return nil, fmt.Errorf("store %d has no wechat_payment_mer_id, required by wechat service provider payment account %d", store.ID, pa.ID)
+	}
+	return store, nil
+}
+
+func CreateStore(s *Store) error {
+	if len(s.Name) == 0 {
+		return errors.New("store name is required")
+	}
+	s.ID = 0
+	if len(s.UUID) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		s.UUID = hex.EncodeToString(b)
+	} else if IsStoreExists(s.UUID) {
+		return fmt.Errorf("store uuid already exists: %s", s.UUID)
+	}
+	return conn.DB().Create(s).Error
+}
+
+// Update 绑定了微信服务商账号的店铺不能清空子商户号
+func (s *Store) Update() error {
+	if len(s.Name) == 0 {
+		return errors.New("store name is required")
+	}
+	if len(s.WechatPaymentMerID) == 0 {
+		var n int64
+		conn.DB().Model(&StorePaymentAccount{}).
+			Joins("JOIN payment_accounts ON payment_accounts.id = store_payment_accounts.payment_account_id").
+			Where("store_payment_accounts.store_id = ? AND payment_accounts.account_type = ? AND payment_accounts.app_id <> ''",
+				s.ID, ACCOUNT_TYPE_WECHAT).
+			Count(&n)
+		if n > 0 {
+			return fmt.Errorf("store %d is bound to wechat service provider payment accounts, wechat_payment_mer_id is required", s.ID)
+		}
+	}
+	return conn.DB().Save(s).Error
+}
+
+// DeleteStore 已经有支付记录的店铺不能删除，同时删除绑定的支付账号
+func DeleteStore(s *Store) error {
+	var n int64
+	conn.DB().Model(&PaymentRecord{}).Where("store_id = ?", s.ID).Count(&n)
+	if n > 0 {
+		return fmt.Errorf("store has %d payment records, can not delete", n)
+	}
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("store_id = ?", s.ID).Delete(&StorePaymentAccount{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Store{}, s.ID).Error
+	})
+}
+
+func FindStorePaymentAccounts(storeID int64) []StorePaymentAccount {
+	var spas []StorePaymentAccount
+	conn.DB().Where("store_id = ?", storeID).Order("account_type, id").Find(&spas)
+	return spas
+}
+
+// BindStorePaymentAccount 绑定支付账号，已经绑定时只修改是否默认。
+// 设置为默认时取消同一渠道其他账号的默认，渠道的第一个账号自动成为默认
+func BindStorePaymentAccount(s *Store, pa *PaymentAccount, isDefault bool) (*StorePaymentAccount, error) {
+	if pa.IsWechatServiceProviderAccount() && len(s.WechatPaymentMerID) == 0 {
+		return nil, fmt.Errorf("store %d has no wechat_payment_mer_id, can not bind wechat service provider payment account %d", s.ID, pa.ID)
+	}
+	var spa StorePaymentAccount
+	err := conn.DB().Transaction(func(tx *gorm.DB) error {
+		var n int64
+		tx.Model(&StorePaymentAccount{}).
+			Where("store_id = ? AND account_type = ? AND payment_account_id <> ?", s.ID, pa.AccountType, pa.ID).
+			Count(&n)
+		if n == 0 {
+			isDefault = true
+		}
+		if isDefault {
+			err := tx.Model(&StorePaymentAccount{}).
+				Where("store_id = ? AND account_type = ?", s.ID, pa.AccountType).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		tx.Where("store_id = ? AND payment_account_id = ?", s.ID, pa.ID).First(&spa)
+		spa.StoreID = s.ID
+		spa.PaymentAccountID = pa.ID
+		spa.AccountType = pa.AccountType
+		spa.IsDefault = isDefault
+		return tx.Save(&spa).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &spa, nil
+}
+
+// UnbindStorePaymentAccount 解绑默认账号后，同一渠道最早绑定的账号成为默认
+func UnbindStorePaymentAccount(storeID, paymentAccountID int64) error {
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		var spa StorePaymentAccount
+		tx.Where("store_id = ? AND payment_account_id = ?", storeID, paymentAccountID).First(&spa)
+		if !spa.Exists() {
+			return fmt.Errorf("payment account %d is not bound to store %d", paymentAccountID, storeID)
+		}
+		if err := tx.Delete(&spa).Error; err != nil {
+			return err
+		}
+		if !spa.IsDefault {
+			return nil
+		}
+		var next StorePaymentAccount
+		tx.Where("store_id = ? AND account_type = ?", storeID, spa.AccountType).Order("id").First(&next)
+		if !next.Exists() {
+			return nil
+		}
+		return tx.Model(&next).Update("is_default", true).Error
+	})
+}
+
+// FindDefaultStorePaymentAccountID 店铺在该渠道的默认支付账号，下单时没有传payment_account_id时使用
+func FindDefaultStorePaymentAccountID(storeID int64, accountType string) (int64, error) {
+	var spa StorePaymentAccount
+	conn.DB().Where("store_id = ? AND account_type = ? AND is_default = ?", storeID, accountType, true).First(&spa)
+	if !spa.Exists() {
+		return 0, fmt.Errorf("store %d has no default %s payment account", storeID, accountType)
+	}
+	return spa.PaymentAccountID, nil
+}
+
+// CheckStorePaymentAccount 店铺在pa的渠道绑定了账号时，pa必须是其中之一
+func CheckStorePaymentAccount(storeID int64, pa *PaymentAccount) error {
+	var spas []StorePaymentAccount
+	conn.DB().Where("store_id = ? AND account_type = ?", storeID, pa.AccountType).Find(&spas)
+	if len(spas) == 0 {
+		return nil
+	}
+	for _, spa := range spas {
+		if spa.PaymentAccountID == pa.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("payment account %d is not bound to store %d", pa.ID, storeID)
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go-gin-payment/conn"
+
+	"gorm.io/gorm"
+)
+
+// 通知的状态，超过最大重试次数后为dead，不再自动重试
+// dead的通知手动重新发送后改为redelivered，之后由新的通知(redelivery_of)负责发送
+const (
+	WEBHOOK_STATUS_PENDING     = "pending"
+	WEBHOOK_STATUS_SUCCESS     = "success"
+	WEBHOOK_STATUS_DEAD        = "dead"
+	WEBHOOK_STATUS_REDELIVERED = "redelivered"
+)
+
+// 通知的目标，web为我们自己的web端，addi为下单时传入的addi_notify_url
+// url为手动重新发送到指定的地址
+const (
+	WEBHOOK_TARGET_WEB  = "web"
+	WEBHOOK_TARGET_ADDI = "addi"
+	WEBHOOK_TARGET_URL  = "url"
+)
+
+const (
+	WebhookMaxAttempts    = 20
+	webhookFirstRetryWait = 15 * time.Second
+	webhookMaxRetryWait   = time.Hour
+)
+
+// WebhookDelivery 需要发送的通知，先保存再由worker发送，失败后按指数退避重试
+type WebhookDelivery struct {
+	BaseModel
+	TransNo       string     `gorm:"column:trans_no;index;size:64" json:"trans_no"`
+	EventID       string     `gorm:"column:event_id;index;size:40" json:"event_id"` // 重试时不变，接收方用于去重
+	Event         string     `gorm:"column:event" json:"event"`
+	Target        string     `gorm:"column:target" json:"target"`
+	URL           string     `gorm:"column:url" json:"url"`
+	Payload       string     `gorm:"column:payload;type:text" json:"payload"`
+	Status        string     `gorm:"column:status;index:idx_webhook_status_next,priority:1;size:16" json:"status"`
+	Attempts      int        `gorm:"column:attempts" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"column:next_attempt_at;index:idx_webhook_status_next,priority:2" json:"next_attempt_at"`
+	LastError     string     `gorm:"column:last_error;type:text" json:"last_error"`
+	DeliveredAt   *time.Time `gorm:"column:delivered_at" json:"delivered_at"`
+	RedeliveryOf  int64      `gorm:"column:redelivery_of" json:"redelivery_of,omitempty"` // 手动重新发送时原通知的ID
+}
+
+// WebhookAttempt 每次发送的结果
+type WebhookAttempt struct {
+	BaseModel
+	DeliveryID   int64  `gorm:"column:delivery_id;index" json:"delivery_id"`
+	StatusCode   int    `gorm:"column:status_code" json:"status_code"`
+	ResponseBody string `gorm:"column:response_body;type:text" json:"response_body"`
+	LatencyMs    int64  `gorm:"column:latency_ms" json:"latency_ms"`
+	Error        string `gorm:"column:error;type:text" json:"error"`
+	Success      bool   `gorm:"column:success" json:"success"`
+}
+
+// WebhookRetryWait 第n次失败后等待的时间，15s开始翻倍，最多1小时，20次大约覆盖12个小时
+func WebhookRetryWait(attempts int) time.Duration {
+	wait := webhookFirstRetryWait
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= webhookMaxRetryWait {
+			return webhookMaxRetryWait
+		}
+	}
+	return wait
+}
+
+// NewWebhookEventID 同一个通知发送给多个target时使用相同的event_id
+func NewWebhookEventID() string {
+	return "evt_" + randomHex(16)
+}
+
+func CreateWebhookDelivery(d *WebhookDelivery) error {
+	return createWebhookDeliveries(conn.DB(), []*WebhookDelivery{d})
+}
+
+// createWebhookDeliveries 在tx中保存通知，和状态的修改在同一个事务中，避免状态改了但是通知没有保存
+func createWebhookDeliveries(tx *gorm.DB, ds []*WebhookDelivery) error {
+	now := time.Now()
+	for _, d := range ds {
+		d.Status = WEBHOOK_STATUS_PENDING
+		if len(d.EventID) == 0 {
+			d.EventID = NewWebhookEventID()
+		}
+		if d.NextAttemptAt.IsZero() {
+			d.NextAttemptAt = now
+		}
+		if err := tx.Create(d).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func FindWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	conn.DB().First(&d, "id = ?", id)
+	if !d.Exists() {
+		return nil, fmt.Errorf("not found webhook delivery, id: %d", id)
+	}
+	return &d, nil
+}
+
+// FindDueWebhookDeliveries 到了发送时间的通知，包括重启前没有发送完的
+func FindDueWebhookDeliveries(now time.Time, limit int) []WebhookDelivery {
+	var ds []WebhookDelivery
+	conn.DB().Where("status = ? AND next_attempt_at <= ?", WEBHOOK_STATUS_PENDING, now).
+		Order("next_attempt_at").Limit(limit).Find(&ds)
+	return ds
+}
+
+// CountPendingWebhookDeliveries 还没有发送成功并且会继续重试的通知数量
+func CountPendingWebhookDeliveries() (int64, error) {
+	var n int64
+	err := conn.DB().Model(&WebhookDelivery{}).Where("status = ?", WEBHOOK_STATUS_PENDING).Count(&n).Error
+	return n, err
+}
+
+func FindWebhookDeliveriesByTransNo(transNo string) []WebhookDelivery {
+	var ds []WebhookDelivery
+	conn.DB().Where("trans_no = ?", transNo).Order("id").Find(&ds)
+	return ds
+}
+
+// FindWebhookDeliveryByEventTarget 同一个通知发送给其他target的记录
+func FindWebhookDeliveryByEventTarget(eventID, target string) (*WebhookDelivery, bool) {
+	var d WebhookDelivery
+	conn.DB().Where("event_id = ? AND target = ?", eventID, target).Order("id").First(&d)
+	return &d, d.Exists()
+}
+
+// RedeliverWebhookDelivery 保存重新发送的通知nd，d为dead时同时改为redelivered，批量重新发送时不会再选中
+func RedeliverWebhookDelivery(d, nd *WebhookDelivery) error {
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := createWebhookDeliveries(tx, []*WebhookDelivery{nd}); err != nil {
+			return err
+		}
+		if d.Status != WEBHOOK_STATUS_DEAD {
+			return nil
+		}
+		err := tx.Model(&WebhookDelivery{}).Where("id = ? AND status = ?", d.ID, WEBHOOK_STATUS_DEAD).
+			Update("status", WEBHOOK_STATUS_REDELIVERED).Error
+		if err == nil {
+			d.Status = WEBHOOK_STATUS_REDELIVERED
+		}
+		return err
+	})
+}
+
+// FindDeadWebhookDeliveries 创建时间在[from, to)之间并且已经放弃重试的通知，afterID用于分页，返回id > afterID的
+func FindDeadWebhookDeliveries(from, to time.Time, afterID int64, limit int) []WebhookDelivery {
+	var ds []WebhookDelivery
+	conn.DB().Where("status = ? AND created_at >= ? AND created_at < ? AND id > ?", WEBHOOK_STATUS_DEAD, from, to, afterID).
+		Order("id").Limit(limit).Find(&ds)
+	return ds
+}
+
+func FindWebhookAttempts(deliveryID int64) []WebhookAttempt {
+	var as []WebhookAttempt
+	conn.DB().Where("delivery_id = ?", deliveryID).Order("id").Find(&as)
+	return as
+}
+
+// Claim 把下次发送时间推迟lease，返回false表示已经被其他worker(或其他实例)领取
+// 发送过程中进程退出的，lease过后会被重新发送
+func (d *WebhookDelivery) Claim(lease time.Duration) bool {
+	next := time.Now().Add(lease)
+	res := conn.DB().Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", d.ID, WEBHOOK_STATUS_PENDING, d.NextAttemptAt).
+		Update("next_attempt_at", next)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false
+	}
+	d.NextAttemptAt = next
+	return true
+}
+
+// RecordAttempt 保存发送结果，失败时安排下次重试，超过最大次数后改为dead
+func (d *WebhookDelivery) RecordAttempt(a *WebhookAttempt) error {
+	a.DeliveryID = d.ID
+	d.Attempts++
+	updates := map[string]interface{}{"attempts": d.Attempts}
+	now := time.Now()
+	switch {
+	case a.Success:
+		d.Status = WEBHOOK_STATUS_SUCCESS
+		d.DeliveredAt = &now
+		d.LastError = ""
+		updates["delivered_at"] = d.DeliveredAt
+	case d.Attempts >= WebhookMaxAttempts:
+		d.Status = WEBHOOK_STATUS_DEAD
+		d.LastError = a.Error
+	default:
+		d.NextAttemptAt = now.Add(WebhookRetryWait(d.Attempts))
+		d.LastError = a.Error
+		updates["next_attempt_at"] = d.NextAttemptAt
+	}
+	updates["status"] = d.Status
+	updates["last_error"] = d.LastError
+
+	return conn.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(a).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates).Error
+	})
+}
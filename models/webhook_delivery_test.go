@@ -0,0 +1,64 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/ext/envelope"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookRetryWait(t *testing.T) {
+	assert.Equal(t, 15*time.Second, WebhookRetryWait(1))
+	assert.Equal(t, 30*time.Second, WebhookRetryWait(2))
+	assert.Equal(t, 32*time.Minute, WebhookRetryWait(8))
+	assert.Equal(t, time.Hour, WebhookRetryWait(9))
+	assert.Equal(t, time.Hour, WebhookRetryWait(WebhookMaxAttempts))
+
+	var total time.Duration
+	for i := 1; i < WebhookMaxAttempts; i++ {
+		total += WebhookRetryWait(i)
+	}
+	assert.True(t, total > 10*time.Hour)
+}
+
+func TestMatchURLPrefix(t *testing.T) {
+	assert.True(t, matchURLPrefix("https://xx.com/notify", "https://xx.com"))
+	assert.True(t, matchURLPrefix("https://xx.com", "https://xx.com"))
+	assert.True(t, matchURLPrefix("https://xx.com/notify/1", "https://xx.com/notify/"))
+	assert.True(t, matchURLPrefix("https://xx.com?a=1", "https://xx.com"))
+
+	assert.False(t, matchURLPrefix("https://xx.com.evil.com/notify", "https://xx.com"))
+	assert.False(t, matchURLPrefix("https://xx.com/notify2", "https://xx.com/notify"))
+	assert.False(t, matchURLPrefix("https://xx.com", ""))
+}
+
+func TestWebhookTargetSecrets(t *testing.T) {
+	defer func(k []byte) { config.PaymentMasterKey = k }(config.PaymentMasterKey)
+	key, err := envelope.GenerateDataKey()
+	assert.Nil(t, err)
+	config.PaymentMasterKey = key
+
+	wt := WebhookTarget{URLPrefix: "https://xx.com/notify/", Secret: GenWebhookSecret()}
+	c, err := wt.encrypted()
+	assert.Nil(t, err)
+	assert.True(t, envelope.IsEncrypted(c.Secret))
+	assert.Empty(t, c.PreviousSecret)
+
+	d := *c
+	assert.Nil(t, d.decryptSecrets())
+	assert.Equal(t, wt.Secret, d.Secret)
+
+	// 轮换的overlap内旧secret也签名
+	now := time.Now()
+	expireAt := now.Add(time.Hour)
+	wt.PreviousSecret, wt.PreviousSecretExpiresAt = "whsec_old", &expireAt
+	assert.Equal(t, []string{wt.Secret, "whsec_old"}, wt.SigningSecrets(now))
+	assert.Equal(t, []string{wt.Secret}, wt.SigningSecrets(now.Add(2*time.Hour)))
+
+	config.PaymentMasterKey = nil
+	_, err = wt.encrypted()
+	assert.Equal(t, ErrNoMasterKey, err)
+}
@@ -0,0 +1,264 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-gin-payment/config"
+	"go-gin-payment/conn"
+	"go-gin-payment/ext/envelope"
+
+	"gorm.io/gorm"
+)
+
+// WebhookTarget 第三方通知地址(addi_notify_url)的签名secret，按url前缀匹配
+// 没有匹配的地址发送时不签名
+//
+// secret和支付账号的私钥一样使用信封加密保存(见payment_account_secret.go)，AfterFind中解密。
+// 轮换后旧secret在overlap内继续签名，请求中会有两个v1
+type WebhookTarget struct {
+	BaseModel
+	Name                    string     `gorm:"column:name" json:"name"`
+	URLPrefix               string     `gorm:"column:url_prefix;uniqueIndex;size:255" json:"url_prefix"` // 比如https://xx.com/notify/
+	Secret                  string     `gorm:"column:secret" json:"-"`
+	PreviousSecret          string     `gorm:"column:previous_secret" json:"-"`
+	PreviousSecretExpiresAt *time.Time `gorm:"column:previous_secret_expires_at" json:"previous_secret_expires_at"`
+	EncryptedDataKey        string     `gorm:"column:encrypted_data_key;type:text" json:"-"` // 为空表示没有加密
+	Enabled                 bool       `gorm:"column:enabled" json:"enabled"`
+}
+
+// webhookTargetSecretFields 需要加密的字段，name为加密时使用的aad
+var webhookTargetSecretFields = []struct {
+	name string
+	get  func(t *WebhookTarget) *string
+}{
+	{"webhook_secret", func(t *WebhookTarget) *string { return &t.Secret }},
+	{"webhook_previous_secret", func(t *WebhookTarget) *string { return &t.PreviousSecret }},
+}
+
+func GenWebhookSecret() string {
+	return "whsec_" + randomHex(24)
+}
+
+func (t *WebhookTarget) AfterFind(tx *gorm.DB) error {
+	return t.decryptSecrets()
+}
+
+func (t *WebhookTarget) decryptSecrets() error {
+	if len(t.EncryptedDataKey) == 0 {
+		return nil
+	}
+	if len(config.PaymentMasterKey) == 0 {
+		return ErrNoMasterKey
+	}
+	dek, err := envelope.UnwrapKey(config.PaymentMasterKey, t.EncryptedDataKey)
+	if err != nil {
+		return fmt.Errorf("unwrap webhook target data key error, id: %d, err: %w", t.ID, err)
+	}
+	for _, f := range webhookTargetSecretFields {
+		v := f.get(t)
+		if *v, err = envelope.Decrypt(dek, *v, f.name); err != nil {
+			return fmt.Errorf("decrypt webhook target %s error, id: %d, err: %w", f.name, t.ID, err)
+		}
+	}
+	return nil
+}
+
+// SigningSecrets 发送时使用的secret，轮换的overlap内包括旧secret
+func (t *WebhookTarget) SigningSecrets(now time.Time) []string {
+	var ss []string
+	if len(t.Secret) > 0 {
+		ss = append(ss, t.Secret)
+	}
+	if len(t.PreviousSecret) > 0 && t.PreviousSecretExpiresAt != nil && now.Before(*t.PreviousSecretExpiresAt) {
+		ss = append(ss, t.PreviousSecret)
+	}
+	return ss
+}
+
+// encrypted 返回加密后的副本用于保存，已有数据密钥时继续使用
+func (t *WebhookTarget) encrypted() (*WebhookTarget, error) {
+	if len(config.PaymentMasterKey) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	var dek []byte
+	var err error
+	if len(t.EncryptedDataKey) > 0 {
+		dek, err = envelope.UnwrapKey(config.PaymentMasterKey, t.EncryptedDataKey)
+	} else {
+		dek, err = envelope.GenerateDataKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := *t
+	if c.EncryptedDataKey, err = envelope.WrapKey(config.PaymentMasterKey, dek); err != nil {
+		return nil, err
+	}
+	for _, f := range webhookTargetSecretFields {
+		v := f.get(&c)
+		if len(*v) == 0 {
+			continue
+		}
+		if *v, err = envelope.Encrypt(dek, *v, f.name); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// save 加密后保存，t中仍然是明文
+func (t *WebhookTarget) save() error {
+	c, err := t.encrypted()
+	if err != nil {
+		return err
+	}
+	if err := conn.DB().Save(c).Error; err != nil {
+		return err
+	}
+	t.ID = c.ID
+	t.CreatedAt = c.CreatedAt
+	t.UpdatedAt = c.UpdatedAt
+	t.EncryptedDataKey = c.EncryptedDataKey
+	return nil
+}
+
+func (t *WebhookTarget) check() error {
+	t.URLPrefix = strings.TrimSpace(t.URLPrefix)
+	if !strings.HasPrefix(t.URLPrefix, "http://") && !strings.HasPrefix(t.URLPrefix, "https://") {
+		return fmt.Errorf("invalid url_prefix: %s", t.URLPrefix)
+	}
+	return nil
+}
+
+// CreateWebhookTarget 生成secret后保存，返回的secret只在创建和轮换时出现
+func CreateWebhookTarget(t *WebhookTarget) (string, error) {
+	if err := t.check(); err != nil {
+		return "", err
+	}
+	t.ID = 0
+	t.EncryptedDataKey = ""
+	t.Secret = GenWebhookSecret()
+	t.PreviousSecret = ""
+	t.PreviousSecretExpiresAt = nil
+	if err := t.save(); err != nil {
+		return "", err
+	}
+	return t.Secret, nil
+}
+
+func (t *WebhookTarget) Update() error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.save()
+}
+
+// RotateWebhookTargetSecret 生成新secret，旧secret在overlap内继续签名，overlap为0时立即失效
+func RotateWebhookTargetSecret(t *WebhookTarget, overlap time.Duration, now time.Time) (string, error) {
+	t.PreviousSecret = ""
+	t.PreviousSecretExpiresAt = nil
+	if overlap > 0 {
+		expireAt := now.Add(overlap)
+		t.PreviousSecret = t.Secret
+		t.PreviousSecretExpiresAt = &expireAt
+	}
+	t.Secret = GenWebhookSecret()
+	if err := t.save(); err != nil {
+		return "", err
+	}
+	return t.Secret, nil
+}
+
+func FindWebhookTargets() []WebhookTarget {
+	var ts []WebhookTarget
+	conn.DB().Order("id").Find(&ts)
+	return ts
+}
+
+func FindWebhookTarget(id int64) (*WebhookTarget, error) {
+	var t WebhookTarget
+	if err := conn.DB().First(&t, "id = ?", id).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !t.Exists() {
+		return nil, fmt.Errorf("not found webhook target, id: %d", id)
+	}
+	return &t, nil
+}
+
+func DeleteWebhookTarget(id int64) error {
+	return conn.DB().Delete(&WebhookTarget{}, id).Error
+}
+
+// EncryptPlaintextWebhookTargets 加密之前手动插入的明文secret，没有设置主密钥时不处理
+func EncryptPlaintextWebhookTargets() (int, error) {
+	if len(config.PaymentMasterKey) == 0 {
+		return 0, nil
+	}
+	var ts []WebhookTarget
+	if err := conn.DB().Where("encrypted_data_key IS NULL OR encrypted_data_key = ''").Find(&ts).Error; err != nil {
+		return 0, err
+	}
+	for i := range ts {
+		if err := ts[i].save(); err != nil {
+			return i, err
+		}
+	}
+	return len(ts), nil
+}
+
+// randomHex 用于secret，需要使用crypto/rand
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ErrNoWebhookTarget url没有匹配的WebhookTarget
+var ErrNoWebhookTarget = errors.New("no webhook target matches the url")
+
+// FindWebhookTargetForURL 匹配前缀最长的target，没有匹配时返回ErrNoWebhookTarget
+// 查询或者解密secret失败时返回错误，调用方不能当作没有匹配
+func FindWebhookTargetForURL(u string) (*WebhookTarget, error) {
+	var ts []WebhookTarget
+	if err := conn.DB().Where("enabled = ?", true).Find(&ts).Error; err != nil {
+		return nil, err
+	}
+
+	var found *WebhookTarget
+	for i := range ts {
+		if !matchURLPrefix(u, ts[i].URLPrefix) {
+			continue
+		}
+		if found == nil || len(ts[i].URLPrefix) > len(found.URLPrefix) {
+			found = &ts[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoWebhookTarget, u)
+	}
+	return found, nil
+}
+
+// matchURLPrefix 前缀必须在路径的边界上，防止https://xx.com匹配到https://xx.com.evil.com
+func matchURLPrefix(u, prefix string) bool {
+	if len(prefix) == 0 || !strings.HasPrefix(u, prefix) {
+		return false
+	}
+	if len(u) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	switch u[len(prefix)] {
+	case '/', '?', '#':
+		return true
+	}
+	return false
+}